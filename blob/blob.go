@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package blob implements a content-addressable store for raw opk files.
+package blob
+
+import (
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Store keeps opk files on the filesystem, keyed by their hash. Identical content is only stored
+// once.
+type Store struct {
+	dir string
+}
+
+// New returns a store rooted at dir, creating the directory if needed.
+func New(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Path returns the location of the blob for hash.
+func (s *Store) Path(hash []byte) string {
+	return filepath.Join(s.dir, hex.EncodeToString(hash)+".opk")
+}
+
+// Has reports whether the blob for hash is stored.
+func (s *Store) Has(hash []byte) bool {
+	_, err := os.Stat(s.Path(hash))
+	return err == nil
+}
+
+// Put copies the file at src into the store under hash. If the blob already exists, it is left
+// untouched.
+func (s *Store) Put(hash []byte, src string) error {
+	if s.Has(hash) {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Write to a temporary file first so a partial copy is never visible under the final name.
+	tmp, err := ioutil.TempFile(s.dir, "tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path(hash))
+}
+
+// Open opens the blob for hash for reading.
+func (s *Store) Open(hash []byte) (*os.File, error) {
+	return os.Open(s.Path(hash))
+}
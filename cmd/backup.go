@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/avalonbits/opkcat/db"
+)
+
+// backup writes a backup of the catalog to the file named in args. A running service holds the
+// database, so with -server the backup is downloaded from its admin endpoint. Otherwise open is
+// called to read the database directly, which only works while no service is running.
+func backup(args []string, open func() (*db.Handle, error)) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	server := fs.String("server", "",
+		"URL of the running service to download the backup from, authenticated with the "+
+			"OPKCAT_ADMIN_TOKEN environment variable.")
+	fs.Parse(args)
+	file := fs.Arg(0)
+	if file == "" {
+		return fmt.Errorf("usage: backup [-server url] <file>")
+	}
+
+	if *server != "" {
+		return writeFile(file, func(w io.Writer) error {
+			return downloadBackup(*server, os.Getenv("OPKCAT_ADMIN_TOKEN"), w)
+		})
+	}
+	storage, err := open()
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	return writeFile(file, storage.Backup)
+}
+
+// downloadBackup writes the backup served by the admin endpoint of the service at server to w.
+func downloadBackup(server, token string, w io.Writer) error {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(server, "/")+"/admin/backup", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s %s", req.URL, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// writeFile calls write with a file written next to file, which replaces file once complete. An
+// interrupted backup doesn't replace a previous one.
+func writeFile(file string, write func(io.Writer) error) error {
+	tmp := file + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := write(out); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// restore loads the backup in file into the catalog and rebuilds the index.
+func restore(storage *db.Handle, file string) error {
+	if file == "" {
+		return fmt.Errorf("usage: restore <file>")
+	}
+
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return storage.Restore(in)
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/avalonbits/opkcat/db"
+	"github.com/avalonbits/opkcat/fetcher"
+)
+
+// inspectRecord is a record as printed by the inspect command, with binary data replaced by its
+// size so the output stays readable.
+type inspectRecord struct {
+	*db.Record
+	Hash        string         `json:"Hash"`
+	Entries     []inspectEntry `json:"Entries"`
+	Screenshots []int          `json:"Screenshots"`
+
+	// Warnings are the problems found in the desktop entries of local files.
+	Warnings []fetcher.Warning `json:"Warnings,omitempty"`
+}
+
+type inspectEntry struct {
+	*db.Entry
+
+	// Icon is the size of the icon, in bytes.
+	Icon int `json:"Icon"`
+}
+
+// inspect parses the opk at target, either a URL or a local file, and writes the resulting record
+// to w as JSON.
+func inspect(w io.Writer, fetchServ *fetcher.Service, target string) error {
+	if target == "" {
+		return fmt.Errorf("usage: inspect <url-or-file>")
+	}
+
+	var record *db.Record
+	var warnings []fetcher.Warning
+	var err error
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		record, err = fetchServ.FromOPKURL(target)
+	} else {
+		record, err = fetchServ.FromOPK(target)
+		if err == nil {
+			warnings, err = fetchServ.ValidateOPK(target)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	view := inspectRecord{
+		Record:   record,
+		Hash:     hex.EncodeToString(record.Hash),
+		Warnings: warnings,
+	}
+	for _, entry := range record.Entries {
+		view.Entries = append(view.Entries, inspectEntry{Entry: entry, Icon: len(entry.Icon)})
+	}
+	for _, shot := range record.Screenshots {
+		view.Screenshots = append(view.Screenshots, len(shot))
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&view)
+}
+
+// validate checks the desktop entries of the opk file at target against the freedesktop
+// specification and prints the problems found. It reports whether the opk is compliant.
+func validate(fetchServ *fetcher.Service, target string) (bool, error) {
+	if target == "" {
+		return false, fmt.Errorf("usage: validate <file>")
+	}
+	warnings, err := fetchServ.ValidateOPK(target)
+	if err != nil {
+		return false, err
+	}
+	for _, w := range warnings {
+		fmt.Println(w)
+	}
+	return len(warnings) == 0, nil
+}
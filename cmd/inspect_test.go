@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/avalonbits/opkcat/fetcher"
+)
+
+// writeZipOPK writes an opk packed as a zip archive holding files, keyed by their path, which
+// the fetcher extracts without unsquashfs. It returns its path and a function removing it.
+func writeZipOPK(t *testing.T, files map[string]string) (string, func()) {
+	t.Helper()
+	f, err := ioutil.TempFile("", "cmd-*.opk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		os.Remove(f.Name())
+		t.Fatal(err)
+	}
+	return f.Name(), func() { os.Remove(f.Name()) }
+}
+
+func TestInspect(t *testing.T) {
+	path, remove := writeZipOPK(t, map[string]string{
+		"default.gcw0.desktop": "[Desktop Entry]\nName=Doom\nComment=Rip and tear\nType=Application\n" +
+			"Exec=doom %f\nIcon=doom\nCategories=games;\nX-Unknown=1\n",
+		"doom.png": "\x89PNG\r\n\x1a\nicon",
+	})
+	defer remove()
+	tmpdir, err := ioutil.TempDir("", "cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	var out bytes.Buffer
+	if err := inspect(&out, fetcher.New(tmpdir, nil, nil, 1), path); err != nil {
+		t.Fatal(err)
+	}
+	var view struct {
+		Hash    string
+		Size    int64
+		Entries []struct {
+			Name        string
+			Description string
+			Exec        string
+			Categories  []string
+			Icon        int
+		}
+		Warnings []fetcher.Warning
+	}
+	if err := json.Unmarshal(out.Bytes(), &view); err != nil {
+		t.Fatalf("%v:\n%s", err, out.Bytes())
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256(data); view.Hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("got hash %q, want the hex sha256 of the opk", view.Hash)
+	}
+	if view.Size != int64(len(data)) {
+		t.Errorf("got size %d, want %d", view.Size, len(data))
+	}
+	if len(view.Entries) != 1 {
+		t.Fatalf("got %d entries, want 1:\n%s", len(view.Entries), out.Bytes())
+	}
+	entry := view.Entries[0]
+	if entry.Name != "Doom" || entry.Description != "Rip and tear" || entry.Exec != "doom %f" {
+		t.Errorf("got entry %+v, want the fields of the desktop entry", entry)
+	}
+	if len(entry.Categories) != 1 || entry.Categories[0] != "Game" {
+		t.Errorf("got categories %v, want the normalized [Game]", entry.Categories)
+	}
+	// Binary data is replaced by its size.
+	if entry.Icon != len("\x89PNG\r\n\x1a\nicon") {
+		t.Errorf("got icon %d, want its size", entry.Icon)
+	}
+	// Local files are also validated against the desktop entry spec.
+	if len(view.Warnings) == 0 || view.Warnings[0].Key != "Categories" {
+		t.Errorf("got warnings %+v, want the unregistered category reported", view.Warnings)
+	}
+}
@@ -19,11 +19,18 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/avalonbits/opkcat"
+	"github.com/avalonbits/opkcat/blob"
 	"github.com/avalonbits/opkcat/db"
 	"github.com/avalonbits/opkcat/fetcher"
 	"github.com/avalonbits/opkcat/web"
@@ -33,26 +40,194 @@ var (
 	dbDir = flag.String("db_dir", "",
 		"Location of the database. Should point to an existing directory.")
 	idxFile = flag.String("idx_file", "", "Location of the full-text index file.")
-	tmpDir  = flag.String("tmp_dir", "",
+	idxType = flag.String("idx_type", "",
+		"Index type used when creating the index, e.g. scorch or upside_down. Requires -idx_store.")
+	idxStore = flag.String("idx_store", "",
+		"Key/value store used when creating the index, e.g. scorch or boltdb. Requires -idx_type.")
+	recencyBoost = flag.Float64("recency_boost", 0,
+		"Rank search results by relevance boosted by how recently they changed, instead of by "+
+			"name. The value is the weight of recency; zero disables it.")
+	fetchHistory = flag.Int("fetch_history", 0,
+		"Number of fetch cycles kept in the audit history. Zero keeps the default.")
+	refuseDowngrades = flag.Bool("refuse_downgrades", false,
+		"Keep the record of a url when it starts serving an older version of an application.")
+	tmpDir = flag.String("tmp_dir", "",
 		"Location use for temporary data. If empty, will use the system default.")
+	blobDir = flag.String("blob_dir", "",
+		"Location used to archive the raw opk files. If empty, opk files are not archived.")
+	listenAddr         = flag.String("listen_addr", ":8080", "Address the web service listens on.")
+	searchCacheEntries = flag.Int("search_cache_entries", 0,
+		"Number of search responses cached in memory. Zero disables the cache.")
+	searchCacheBytes = flag.Int64("search_cache_bytes", 64<<20,
+		"Maximum total size of the cached search responses.")
+	tagRules = flag.String("tag_rules", "",
+		"JSON file with the rules used to derive record tags. If empty, uses the built-in rules.")
+	categoryMap = flag.String("category_map", "",
+		"JSON file mapping category aliases to canonical names. If empty, uses the built-in map.")
+	sidecar = flag.String("sidecar", "",
+		"JSON file mapping opk urls or file names to descriptions, tags and ratings merged into "+
+			"their records.")
+	sidecarPolicy = flag.String("sidecar_policy", "override",
+		"How -sidecar values are merged: override the values read from the opk, or supplement them.")
+	cooldownAfter = flag.Int("cooldown_after", 0,
+		"Consecutive failures after which a url is skipped for -cooldown_period. Zero disables it.")
+	cooldownPeriod = flag.Duration("cooldown_period", 24*time.Hour,
+		"How long a url is skipped after -cooldown_after consecutive failures.")
+	pruneAfter = flag.Int("prune_after", 0,
+		"Remove urls that failed for more than this many consecutive fetches. Zero disables it.")
+	pruneGone = flag.Bool("prune_gone", false,
+		"Remove urls as soon as they answer with 404 Not Found or 410 Gone.")
+	recordTTL = flag.Duration("record_ttl", 0,
+		"Remove urls that haven't been fetched successfully for longer than this, after each fetch "+
+			"and on reconcile. Zero disables it.")
+	appIDKey = flag.String("app_id_key", fetcher.DefaultAppIDKey,
+		"Desktop entry key holding the application identifier.")
+	authorKey = flag.String("author_key", fetcher.DefaultAuthorKey,
+		"Desktop entry key holding the application author.")
+	sourceRepo = flag.String("source_repo", "",
+		"Git repository holding the markdown source list. If empty, the source list is the first "+
+			"argument: a URL, or a markdown, .txt or .json file. Set OPKCAT_GIT_TOKEN to access private "+
+			"repositories.")
+	sourceRef  = flag.String("source_ref", "master", "Branch, tag or commit of -source_repo to use.")
+	sourcePath = flag.String("source_path", "Sources.md",
+		"Location of the markdown source list in -source_repo.")
+	sourceDepth = flag.Int("source_depth", 0,
+		"When the source list is a URL, how deep to follow links to other markdown documents.")
+	headCheck = flag.Bool("head_check", false,
+		"Send a HEAD request before downloading opks from servers without conditional request "+
+			"support, and skip the download when the size and date are unchanged.")
+	fetchWorkers = flag.Int("fetch_workers", 10, "Number of opks fetched concurrently.")
+	fetchBacklog = flag.Int("fetch_backlog", 0,
+		"Number of urls queued for the fetch workers. Zero makes it the same as -fetch_workers.")
+	addWorkers = flag.Int("add_workers", 1,
+		"Number of transactions writing the urls of the source list concurrently.")
+	reloadPrune = flag.Bool("reload_prune", false,
+		"When the source list is reloaded on SIGHUP, remove the urls no longer in it from the catalog.")
+	maxSourceBytes = flag.Int64("max_source_bytes", opkcat.MaxSourceBytes,
+		"Maximum size of a source list document.")
+	maxSourceLinks = flag.Int("max_source_links", opkcat.MaxSourceLinks,
+		"Maximum number of opk links in the source list, including linked documents.")
+	screenshotDir = flag.String("screenshot_dir", "",
+		"Directory inside the opk files holding screenshots. If empty, screenshots are not stored.")
+	maxScreenshots     = flag.Int("max_screenshots", 5, "Maximum number of screenshots stored per opk.")
+	maxScreenshotBytes = flag.Int64("max_screenshot_bytes", 4<<20,
+		"Maximum total size of the screenshots stored per opk.")
+	extractBudget = flag.Int64("extract_budget", 0,
+		"Maximum total size in bytes of the opks downloaded and extracted at once. Zero disables it.")
+	requestsPerMinute = flag.Int("requests_per_minute", 0,
+		"Maximum number of opk requests per minute across all hosts, evenly spaced. Zero disables it.")
+	hostConcurrency = flag.Int("host_concurrency", 0,
+		"Maximum number of downloads from a single host at once. Zero disables it.")
+	hostRequestsPerMinute = flag.Int("host_requests_per_minute", 0,
+		"Maximum number of opk requests per minute to a single host. Zero disables it.")
+	hostLimits = flag.String("host_limits", "",
+		"JSON file mapping hosts to their own concurrency and requests_per_minute, overriding "+
+			"-host_concurrency and -host_requests_per_minute.")
+	retries = flag.Int("retries", 3,
+		"Maximum number of requests per opk when a download fails with a 5xx, 429 or connection error.")
+	retryBaseDelay = flag.Duration("retry_base_delay", time.Second,
+		"Delay before retrying a failed download, doubling on every retry.")
+	retryMaxDelay = flag.Duration("retry_max_delay", 30*time.Second,
+		"Maximum delay between retries of a failed download.")
+	showProgress = flag.Bool("progress", false,
+		"Show the progress of each fetch cycle on stderr.")
+	startJitter = flag.Duration("start_jitter", 0,
+		"Maximum random delay of the first fetch, which also offsets the following ones.")
+	pngIcons = flag.Bool("png_icons", false,
+		"Convert the icons to PNG. SVG icons and icons that can't be decoded are kept as they are.")
+	emptyOPKs = flag.String("empty_opks", "skip",
+		"What to do with opks without desktop entries: skip them, or name them after the opk file.")
+	webhook = flag.String("webhook", "",
+		"URL receiving a JSON summary of each fetch cycle. Works with Slack and Discord webhooks.")
+	force = flag.Bool("force", false,
+		"Download every opk on the first fetch, even the unchanged ones. An interrupted forced fetch "+
+			"resumes where it stopped when started again with -force.")
+	etagCache = flag.Bool("etag_cache", false,
+		"Reuse content downloaded in the same fetch cycle for urls served with the same ETag.")
+	urlHeaders = flag.String("url_headers", "",
+		"JSON file mapping opk urls to the headers sent only with their requests.")
+	logFormat = flag.String("log_format", "text",
+		"Format of the fetcher logs: text, or json for one JSON object per event.")
+	logLevel = flag.String("log_level", "debug",
+		"Least severe text log messages written: debug, info, warn or error.")
+	fetchTimeout = flag.Duration("fetch_timeout", time.Minute,
+		"Maximum time an opk request may go without receiving data, while waiting for the "+
+			"response or during the download. Zero disables it.")
+	httpLog = flag.String("http_log", "",
+		"File where every opk request and response is logged, or - for stderr. Empty disables it.")
 )
 
 type Getter struct {
 	client *http.Client
 }
 
+// newClient returns the client used for opk requests. When timeout is positive, a request fails
+// once its connection goes that long without receiving data, whether it is waiting for the
+// response or in the middle of the body, so large opks that keep downloading are never cut off.
+func newClient(timeout time.Duration) *http.Client {
+	if timeout <= 0 {
+		return &http.Client{}
+	}
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &idleConn{Conn: conn, timeout: timeout}, nil
+	}
+	return &http.Client{Transport: transport}
+}
+
+// idleConn is a connection whose reads fail with a timeout once no data arrived for timeout.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
 func (g *Getter) GetIfModified(since time.Time, etag, url string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", url, nil)
+	return g.GetIfModifiedContext(context.Background(), since, etag, url, nil)
+}
+
+func (g *Getter) GetIfModifiedWithHeaders(since time.Time, etag, url string, headers map[string]string) (*http.Response, error) {
+	return g.GetIfModifiedContext(context.Background(), since, etag, url, headers)
+}
+
+func (g *Getter) Head(ctx context.Context, url string, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
 	if err != nil {
 		return nil, err
 	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	return g.client.Do(req)
+}
 
-	// We either send the if-none-match or the if-modified-since header, never both or etag matching
-	// won't work.
+func (g *Getter) GetIfModifiedContext(ctx context.Context, since time.Time, etag, url string, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	// Servers that honor If-None-Match ignore If-Modified-Since, so sending both is safe. The
+	// fetcher leaves out the etag for servers that don't honor it.
 	if etag != "" {
 		req.Header["If-None-Match"] = []string{etag}
-	} else if !since.IsZero() {
-		req.Header["If-Modified-Since"] = []string{since.Format("Mon, 2 Jan 2006 15:04:05 MST")}
+	}
+	if !since.IsZero() {
+		req.Header["If-Modified-Since"] = []string{since.UTC().Format(http.TimeFormat)}
 	}
 
 	return g.client.Do(req)
@@ -60,21 +235,364 @@ func (g *Getter) GetIfModified(since time.Time, etag, url string) (*http.Respons
 
 func main() {
 	flag.Parse()
+	opkcat.MaxSourceBytes = *maxSourceBytes
+	opkcat.MaxSourceLinks = *maxSourceLinks
+
+	var fetchOpts []fetcher.Option
+	var webOpts []web.Option
+	if *blobDir != "" {
+		blobs, err := blob.New(*blobDir)
+		if err != nil {
+			panic(err)
+		}
+		fetchOpts = append(fetchOpts, fetcher.WithBlobStore(blobs))
+		webOpts = append(webOpts, web.WithBlobStore(blobs))
+	}
+	if *tagRules != "" {
+		rules, err := fetcher.LoadTagRules(*tagRules)
+		if err != nil {
+			panic(err)
+		}
+		fetchOpts = append(fetchOpts, fetcher.WithTagRules(rules))
+	}
+	if *categoryMap != "" {
+		categories, err := fetcher.LoadCategoryMap(*categoryMap)
+		if err != nil {
+			panic(err)
+		}
+		fetchOpts = append(fetchOpts, fetcher.WithCategoryMap(categories))
+	}
+	if *sidecar != "" {
+		enrichments, err := fetcher.LoadSidecar(*sidecar)
+		if err != nil {
+			panic(err)
+		}
+		policy := fetcher.SidecarOverride
+		switch *sidecarPolicy {
+		case "override":
+		case "supplement":
+			policy = fetcher.SidecarSupplement
+		default:
+			panic("invalid -sidecar_policy: " + *sidecarPolicy)
+		}
+		fetchOpts = append(fetchOpts, fetcher.WithSidecar(enrichments, policy))
+	}
+
+	fetchOpts = append(fetchOpts, fetcher.WithAppIDKey(*appIDKey), fetcher.WithAuthorKey(*authorKey))
+	if *screenshotDir != "" {
+		fetchOpts = append(fetchOpts,
+			fetcher.WithScreenshots(*screenshotDir, *maxScreenshots, *maxScreenshotBytes))
+	}
+	if *extractBudget > 0 {
+		fetchOpts = append(fetchOpts, fetcher.WithExtractBudget(*extractBudget))
+	}
+	if *headCheck {
+		fetchOpts = append(fetchOpts, fetcher.WithHeadCheck())
+	}
+	if *fetchBacklog > 0 {
+		fetchOpts = append(fetchOpts, fetcher.WithBacklog(*fetchBacklog))
+	}
+	if *requestsPerMinute > 0 {
+		fetchOpts = append(fetchOpts, fetcher.WithRateLimit(*requestsPerMinute))
+	}
+	if *hostConcurrency > 0 || *hostRequestsPerMinute > 0 || *hostLimits != "" {
+		var overrides map[string]fetcher.HostLimit
+		if *hostLimits != "" {
+			var err error
+			if overrides, err = fetcher.LoadHostLimits(*hostLimits); err != nil {
+				panic(err)
+			}
+		}
+		def := fetcher.HostLimit{Concurrency: *hostConcurrency, RequestsPerMinute: *hostRequestsPerMinute}
+		fetchOpts = append(fetchOpts, fetcher.WithHostLimits(def, overrides))
+	}
+	if *retries > 1 {
+		fetchOpts = append(fetchOpts, fetcher.WithRetry(fetcher.RetryPolicy{
+			MaxAttempts: *retries,
+			BaseDelay:   *retryBaseDelay,
+			MaxDelay:    *retryMaxDelay,
+		}))
+	}
+	if *showProgress {
+		fetchOpts = append(fetchOpts, fetcher.WithProgress(func(done, total int, url string) {
+			fmt.Fprintf(os.Stderr, "Fetched %d of %d urls (%d%%)\n", done, total, 100*done/total)
+		}))
+	}
+	if *startJitter > 0 {
+		fetchOpts = append(fetchOpts, fetcher.WithStartJitter(*startJitter))
+	}
+	if *pngIcons {
+		fetchOpts = append(fetchOpts, fetcher.WithPNGIcons())
+	}
+	if *webhook != "" {
+		fetchOpts = append(fetchOpts, fetcher.WithWebhook(*webhook))
+	}
+	if *force {
+		fetchOpts = append(fetchOpts, fetcher.WithForceFetch())
+	}
+	if *etagCache {
+		fetchOpts = append(fetchOpts, fetcher.WithEtagCache())
+	}
+	switch *emptyOPKs {
+	case "skip":
+	case "name":
+		fetchOpts = append(fetchOpts, fetcher.WithEmptyOPKPolicy(fetcher.NameEmptyOPKs))
+	default:
+		panic("invalid -empty_opks: " + *emptyOPKs)
+	}
+	level, err := opkcat.ParseLevel(*logLevel)
+	if err != nil {
+		panic(err)
+	}
+	logger := opkcat.StdLogger(level)
+	fetchOpts = append(fetchOpts, fetcher.WithLogger(logger))
+	webOpts = append(webOpts, web.WithLogger(logger))
+	switch *logFormat {
+	case "text":
+	case "json":
+		fetchOpts = append(fetchOpts, fetcher.WithJSONLog(os.Stderr))
+	default:
+		panic("invalid -log_format: " + *logFormat)
+	}
+	if *cooldownAfter > 0 {
+		fetchOpts = append(fetchOpts, fetcher.WithCooldown(*cooldownAfter, *cooldownPeriod))
+	}
+	if *pruneAfter > 0 {
+		fetchOpts = append(fetchOpts, fetcher.WithPruneAfter(*pruneAfter))
+	}
+	if *pruneGone {
+		fetchOpts = append(fetchOpts, fetcher.WithPruneGone())
+	}
+	if *recordTTL > 0 {
+		fetchOpts = append(fetchOpts, fetcher.WithRecordTTL(*recordTTL))
+	}
+
+	var getter fetcher.ModifiedGetter = &Getter{client: newClient(*fetchTimeout)}
+	if *httpLog == "-" {
+		getter = fetcher.NewLoggingGetter(getter, os.Stderr)
+	} else if *httpLog != "" {
+		logFile, err := os.OpenFile(*httpLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			panic(err)
+		}
+		defer logFile.Close()
+		getter = fetcher.NewLoggingGetter(getter, logFile)
+	}
+
+	if *searchCacheEntries > 0 {
+		webOpts = append(webOpts, web.WithSearchCache(*searchCacheEntries, *searchCacheBytes))
+	}
+	if token := os.Getenv("OPKCAT_ADMIN_TOKEN"); token != "" {
+		webOpts = append(webOpts, web.WithAdminToken(token))
+	}
 
-	storage, err := db.Prod(*dbDir, *idxFile)
+	// Inspecting or validating an opk doesn't need the database.
+	if flag.Arg(0) == "inspect" {
+		if err := inspect(os.Stdout, fetcher.New(*tmpDir, nil, getter, 1, fetchOpts...), flag.Arg(1)); err != nil {
+			panic(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "validate" {
+		ok, err := validate(fetcher.New(*tmpDir, nil, getter, 1, fetchOpts...), flag.Arg(1))
+		if err != nil {
+			panic(err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	var dbOpts []db.Option
+	if *idxType != "" || *idxStore != "" {
+		dbOpts = append(dbOpts, db.WithIndexType(*idxType, *idxStore))
+	}
+	// Searching only reads the catalog, but the database can't be opened while a service holds
+	// it. A running service is searched through its API with -server instead.
+	if flag.Arg(0) == "search" {
+		err := search(flag.Args()[1:], func() (*db.Handle, error) {
+			return db.Prod(*dbDir, *idxFile, append(dbOpts, db.WithReadOnly())...)
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	// A backup only reads the database, and a running service is backed up through its own handle.
+	if flag.Arg(0) == "backup" {
+		err := backup(flag.Args()[1:], func() (*db.Handle, error) {
+			return db.Prod(*dbDir, *idxFile, append(dbOpts, db.WithReadOnly())...)
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	storage, err := db.Prod(*dbDir, *idxFile, dbOpts...)
 	if err != nil {
 		panic(err)
 	}
 	defer storage.Close()
+	storage.SetRecencyBoost(*recencyBoost)
+	storage.SetRefuseDowngrades(*refuseDowngrades)
+	storage.SetFetchHistory(*fetchHistory)
+	storage.SetWriteWorkers(*addWorkers)
+	storage.SetLogger(logger)
+
+	if flag.Arg(0) == "reconcile" {
+		added, removed, err := storage.ReconcileIndex()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Indexed %d missing records, removed %d orphaned documents.\n", added, removed)
+		if *recordTTL > 0 {
+			expired, err := storage.ExpireFailing(*recordTTL)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Printf("Removed %d urls failing for longer than %v.\n", len(expired), *recordTTL)
+		}
+		return
+	}
+	if flag.Arg(0) == "reindex" {
+		if err := storage.Reindex(); err != nil {
+			panic(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "restore" {
+		if err := restore(storage, flag.Arg(1)); err != nil {
+			panic(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "verify" {
+		problems, err := storage.Verify()
+		if err != nil {
+			panic(err)
+		}
+		for _, p := range problems {
+			fmt.Printf("%s: %s\n", p.URL, p.Problem)
+		}
+		fmt.Printf("Found %d inconsistent urls.\n", len(problems))
 
-	fetchServ := fetcher.New(*tmpDir, storage, &Getter{client: &http.Client{}}, 10)
-	for _, source := range opkcat.SourceList(flag.Args()[0]) {
-		fetchServ.Add(source)
+		var bad []string
+		if *blobDir != "" {
+			if bad, err = storage.VerifyBlobs(*blobDir); err != nil {
+				panic(err)
+			}
+			for _, hash := range bad {
+				fmt.Println(hash)
+			}
+			fmt.Printf("Found %d corrupted opks.\n", len(bad))
+		}
+		if len(problems) > 0 || len(bad) > 0 {
+			exit(storage, 1)
+		}
+		return
 	}
-	webServ := web.New(storage)
 
+	fetchServ := fetcher.New(*tmpDir, storage, getter, *fetchWorkers, fetchOpts...)
+	if flag.Arg(0) == "mirrors" {
+		statuses, err := fetchServ.CheckMirrors(context.Background())
+		if err != nil {
+			panic(err)
+		}
+		down := 0
+		for _, st := range statuses {
+			if st.Reachable {
+				fmt.Printf("ok   %d %s\n", st.Status, st.URL)
+			} else {
+				down++
+				fmt.Printf("down %d %s: %s\n", st.Status, st.URL, st.Err)
+			}
+		}
+		fmt.Printf("%d of %d urls are down.\n", down, len(statuses))
+		if down > 0 {
+			exit(storage, 1)
+		}
+		return
+	}
+	if flag.Arg(0) == "serve" {
+		// Serving the catalog as it is, without fetching.
+		fs := flag.NewFlagSet("serve", flag.ExitOnError)
+		addr := fs.String("addr", *listenAddr, "Address the web service listens on.")
+		fs.Parse(flag.Args()[1:])
+		webServ := web.New(*addr, storage, webOpts...)
+		sManager := opkcat.NewServiceManager([]opkcat.StartStopper{webServ})
+		sManager.SetLogger(logger)
+		if err := sManager.Run(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(storage, 1)
+		}
+		return
+	}
+
+	// The fetch subcommand runs a single fetch cycle, with the source list as its argument.
+	// Without a subcommand, the source list is the first argument and the fetcher runs on its
+	// interval alongside the web server.
+	src := flag.Arg(0)
+	fetchOnce := src == "fetch"
+	forceOnce, prune := *force, false
+	if fetchOnce {
+		fs := flag.NewFlagSet("fetch", flag.ExitOnError)
+		fs.BoolVar(&forceOnce, "force", *force,
+			"Download every opk, even the unchanged ones. An interrupted forced fetch resumes "+
+				"where it stopped when run again with -force.")
+		fs.BoolVar(&prune, "prune", false,
+			"Remove the urls missing from the source list, with their records, before fetching.")
+		fs.Parse(flag.Args()[1:])
+		src = fs.Arg(0)
+	}
+	sources, err := loadSources(src, logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to read the source list:", err)
+		exit(storage, 1)
+	}
+	if err := addSources(storage, sourceName(src), sources, prune, logger); err != nil {
+		panic(err)
+	}
+	if fetchOnce {
+		ctx, cancel := context.WithCancel(context.Background())
+		sigC := make(chan os.Signal, 1)
+		signal.Notify(sigC, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sigC
+			cancel()
+		}()
+		fetch := fetchServ.Fetch
+		if forceOnce {
+			fetch = fetchServ.ForceFetch
+		}
+		err := fetch(ctx)
+		cancel()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(storage, 1)
+		}
+		return
+	}
+
+	webServ := web.New(*listenAddr, storage, webOpts...)
 	sManager := opkcat.NewServiceManager([]opkcat.StartStopper{fetchServ, webServ})
+	sManager.SetLogger(logger)
+	// The source list is read again on SIGHUP. A fetch in progress keeps going with the urls it
+	// already read.
+	sManager.SetReload(func() error {
+		return reloadSources(storage, src, logger)
+	})
 	if err := sManager.Run(); err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		exit(storage, 1)
 	}
 }
+
+// exit closes storage and exits with code. os.Exit skips the deferred calls, so the database would
+// not be closed otherwise.
+func exit(storage *db.Handle, code int) {
+	storage.Close()
+	os.Exit(code)
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetterIdleTimeout(t *testing.T) {
+	stall := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/headers":
+			<-stall
+		case "/body":
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			<-stall
+		case "/slow":
+			// Slower overall than the timeout, but never idle for that long.
+			for i := 0; i < 6; i++ {
+				w.Write([]byte("chunk"))
+				w.(http.Flusher).Flush()
+				time.Sleep(40 * time.Millisecond)
+			}
+		}
+	}))
+	defer srv.Close()
+	// The stalled handlers must return before the server can close.
+	defer close(stall)
+
+	g := &Getter{client: newClient(100 * time.Millisecond)}
+	get := func(path string) error {
+		resp, err := g.GetIfModifiedContext(context.Background(), time.Time{}, "", srv.URL+path, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = ioutil.ReadAll(resp.Body)
+		return err
+	}
+
+	for _, path := range []string{"/headers", "/body"} {
+		err := get(path)
+		var nerr net.Error
+		if !errors.As(err, &nerr) || !nerr.Timeout() {
+			t.Errorf("%s: got error %v, want a timeout", path, err)
+		}
+	}
+	if err := get("/slow"); err != nil {
+		t.Errorf("/slow: %v", err)
+	}
+}
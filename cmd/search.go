@@ -0,0 +1,137 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/avalonbits/opkcat/db"
+)
+
+// searchResult is a record as printed by the search command.
+type searchResult struct {
+	Hash       string   `json:"Hash"`
+	URL        string   `json:"URL"`
+	Name       string   `json:"Name"`
+	Categories []string `json:"Categories"`
+}
+
+// search queries the catalog with the terms in args and prints the matching records, as a table or
+// with -json as a JSON array. A running service holds the database, so with -server the query is
+// sent to its search API. Otherwise open is called to read the database directly, which only
+// works while no service is running.
+func search(args []string, open func() (*db.Handle, error)) error {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the results as a JSON array.")
+	order := fs.String("sort", "", "Order of the results: name, newest or oldest. Defaults to name.")
+	server := fs.String("server", "", "URL of the running service to send the query to.")
+	fs.Parse(args)
+
+	qry := strings.Join(fs.Args(), " ")
+	if qry == "" {
+		return fmt.Errorf("usage: search [-json] [-sort order] [-server url] <query>")
+	}
+	var records []*db.Record
+	var err error
+	if *server != "" {
+		records, err = searchServer(*server, qry, *order)
+	} else {
+		records, err = searchLocal(open, qry, *order)
+	}
+	if err != nil {
+		return err
+	}
+
+	results := make([]searchResult, 0, len(records))
+	for _, record := range records {
+		result := searchResult{Hash: hex.EncodeToString(record.Hash), URL: record.URL}
+		if entry := record.Primary(); entry != nil {
+			result.Name = entry.Name
+			result.Categories = entry.Categories
+		}
+		results = append(results, result)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+	return printResults(os.Stdout, results)
+}
+
+// searchLocal runs qry on the database returned by open.
+func searchLocal(open func() (*db.Handle, error), qry, order string) ([]*db.Record, error) {
+	storage, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer storage.Close()
+
+	var opts []db.QueryOption
+	if order != "" {
+		opts = append(opts, db.SortBy(order))
+	}
+	records, _, err := storage.Query(qry, opts...)
+	return records, err
+}
+
+// searchServer sends qry to the search API of the service at server.
+func searchServer(server, qry, order string) ([]*db.Record, error) {
+	params := url.Values{"q": {qry}}
+	if order != "" {
+		params.Set("sort", order)
+	}
+	resp, err := http.Get(strings.TrimSuffix(server, "/") + "/api/search?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var found struct {
+		Records []*db.Record `json:"records"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&found); err != nil {
+		return nil, err
+	}
+	return found.Records, nil
+}
+
+func printResults(w io.Writer, results []searchResult) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tCATEGORIES\tURL")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Name, strings.Join(r.Categories, ","), r.URL)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/avalonbits/opkcat/db"
+	"github.com/avalonbits/opkcat/web"
+)
+
+// newStorage returns a database with an index in a temporary directory, holding a record for each
+// of names, and a function closing and removing it.
+func newStorage(t *testing.T, names ...string) (*db.Handle, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := db.Prod(filepath.Join(dir, "db"), filepath.Join(dir, "index"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		opkurl := "http://example.com/" + strings.ToLower(name) + ".opk"
+		sum := sha256.Sum256([]byte(opkurl))
+		err := storage.UpdateRecord(&db.Record{
+			URL:     opkurl,
+			Hash:    sum[:],
+			Date:    time.Now().UTC(),
+			Entries: []*db.Entry{{Name: name, Type: "Application", Categories: []string{"games"}}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return storage, func() {
+		storage.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSearchServer(t *testing.T) {
+	storage, closeStorage := newStorage(t, "Tetris", "Pacman")
+	defer closeStorage()
+	srv := httptest.NewServer(web.New("", storage).Handler())
+	defer srv.Close()
+
+	records, err := searchServer(srv.URL, "tetris", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Primary().Name != "Tetris" {
+		t.Fatalf("got %v, want the Tetris record", records)
+	}
+	if records[0].URL != "http://example.com/tetris.opk" {
+		t.Errorf("got url %s, want http://example.com/tetris.opk", records[0].URL)
+	}
+
+	if _, err := searchServer(srv.URL, "tetris", "sideways"); err == nil {
+		t.Error("got no error for an invalid sort order")
+	}
+}
+
+func TestPrintResults(t *testing.T) {
+	var out bytes.Buffer
+	err := printResults(&out, []searchResult{
+		{Name: "Tetris", Categories: []string{"games", "puzzle"}, URL: "http://example.com/tetris.opk"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want a header and a result:\n%s", len(lines), out.String())
+	}
+	if fields := strings.Fields(lines[1]); len(fields) != 3 || fields[1] != "games,puzzle" {
+		t.Errorf("got result line %q", lines[1])
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/avalonbits/opkcat"
+	"github.com/avalonbits/opkcat/db"
+)
+
+// loadSources reads the configured source list, logging the linked documents it fails to read to
+// logger.
+func loadSources(src string, logger opkcat.Logger) ([]opkcat.SourceEntry, error) {
+	if *sourceRepo != "" {
+		var gitOpts []opkcat.GitOption
+		if token := os.Getenv("OPKCAT_GIT_TOKEN"); token != "" {
+			gitOpts = append(gitOpts, opkcat.WithGitToken(token))
+		}
+		return opkcat.SourceListFromGit(
+			context.Background(), *sourceRepo, *sourceRef, *sourcePath, gitOpts...)
+	}
+
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		return opkcat.SourceListFromURL(context.Background(), &http.Client{}, src, *sourceDepth, logger)
+	}
+	return opkcat.SourceListFrom(src)
+}
+
+// sourceName identifies the source list read by loadSources, so the urls in the catalog can be
+// attributed to it.
+func sourceName(src string) string {
+	if *sourceRepo != "" {
+		return *sourceRepo + "#" + *sourcePath
+	}
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		return src
+	}
+	if abs, err := filepath.Abs(src); err == nil {
+		return abs
+	}
+	return src
+}
+
+// reloadSources reads the source list src again and reconciles the catalog with it, pruning the
+// urls no longer listed if -reload_prune is set.
+func reloadSources(storage *db.Handle, src string, logger opkcat.Logger) error {
+	sources, err := loadSources(src, logger)
+	if err != nil {
+		return err
+	}
+	return addSources(storage, sourceName(src), sources, *reloadPrune, logger)
+}
+
+// addSources reconciles the catalog with sources, read from the source list named source: their
+// urls are added with their titles and headers, and the urls no longer listed are marked as
+// missing. With prune, the missing urls are removed from the catalog. Changes are logged to logger.
+func addSources(storage *db.Handle, source string, sources []opkcat.SourceEntry, prune bool, logger opkcat.Logger) error {
+	added, missing, err := storage.ReconcileSource(source, opkcat.SourceURLs(sources))
+	if err != nil {
+		return err
+	}
+	if len(added) > 0 || len(missing) > 0 {
+		logger.Info(fmt.Sprintf("Added %d urls from %s, %d are no longer listed.", len(added), source, len(missing)))
+	}
+	for _, src := range sources {
+		if err := storage.SetSourceTitle(src.URL, src.Title); err != nil {
+			return err
+		}
+	}
+	if *urlHeaders != "" {
+		headers, err := opkcat.LoadURLHeaders(*urlHeaders)
+		if err != nil {
+			return err
+		}
+		// Every source is set so headers removed from the file are removed from the url.
+		for _, src := range sources {
+			if err := storage.SetURLHeaders(src.URL, headers[src.URL]); err != nil {
+				return err
+			}
+		}
+	}
+	if !prune {
+		return nil
+	}
+
+	for _, u := range missing {
+		if err := storage.PruneURL(u); err != nil {
+			return err
+		}
+		logger.Info("Removed", u+", which is no longer in the source list.")
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/avalonbits/opkcat"
+)
+
+func TestReloadSources(t *testing.T) {
+	storage, cleanup := newStorage(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "sources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "Sources.md")
+	writeList := func(names ...string) {
+		var md strings.Builder
+		md.WriteString("# Games\n\n")
+		for _, name := range names {
+			md.WriteString("- [" + name + "](http://example.com/" + name + ".opk)\n")
+		}
+		if err := ioutil.WriteFile(src, []byte(md.String()), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	known := func() []string {
+		urls, err := storage.KnownURLs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var known []string
+		for _, u := range urls {
+			known = append(known, strings.TrimSuffix(strings.TrimPrefix(u.URL, "http://example.com/"), ".opk"))
+		}
+		sort.Strings(known)
+		return known
+	}
+	defer func(prune bool) { *reloadPrune = prune }(*reloadPrune)
+
+	writeList("doom", "quake")
+	if err := reloadSources(storage, src, opkcat.StdLogger(opkcat.LevelWarn)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := known(), []string{"doom", "quake"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got urls %v, want %v", got, want)
+	}
+
+	// The edited list adds its new urls, and keeps the ones it lost unless pruning.
+	writeList("doom", "heretic")
+	if err := reloadSources(storage, src, opkcat.StdLogger(opkcat.LevelWarn)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := known(), []string{"doom", "heretic", "quake"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got urls %v after the reload, want %v", got, want)
+	}
+	*reloadPrune = true
+	if err := reloadSources(storage, src, opkcat.StdLogger(opkcat.LevelWarn)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := known(), []string{"doom", "heretic"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got urls %v after the pruning reload, want %v", got, want)
+	}
+}
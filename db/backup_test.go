@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package db
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	src, closeSrc := newHandle(t)
+	defer closeSrc()
+	rec := testRecord("http://example.com/game.opk", "Backed Up Game")
+	if err := src.UpdateRecord(rec); err != nil {
+		t.Fatal(err)
+	}
+	var backup bytes.Buffer
+	if err := src.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, closeDst := newHandle(t)
+	defer closeDst()
+	if err := dst.Restore(bytes.NewReader(backup.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dst.GetRecord(rec.Hash); err != nil {
+		t.Errorf("restored record: %v", err)
+	}
+	// The index was rebuilt from the restored records.
+	records, _, err := dst.Query("backed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(records); len(got) != 1 || got[0] != "Backed Up Game" {
+		t.Errorf("got %v searching the restored catalog, want the restored record", got)
+	}
+	known, err := dst.KnownURLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(known) != 1 || known[0].URL != rec.URL {
+		t.Errorf("got known urls %v, want %s", known, rec.URL)
+	}
+}
+
+func TestRestoreWithoutIndexLocation(t *testing.T) {
+	src, closeSrc := newHandle(t)
+	defer closeSrc()
+	rec := testRecord("http://example.com/game.opk", "Game")
+	if err := src.UpdateRecord(rec); err != nil {
+		t.Fatal(err)
+	}
+	var backup bytes.Buffer
+	if err := src.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+
+	// Like test handles, the index has no location to be rebuilt in. Test handles themselves
+	// can't be used, as in-memory badger databases lose the values they load.
+	dst, closeDst := newHandle(t)
+	defer closeDst()
+	dst.idxLocation = ""
+	if err := dst.Restore(&backup); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dst.GetRecord(rec.Hash); err != nil {
+		t.Errorf("restored record: %v", err)
+	}
+	records, _, err := dst.Query("game")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Errorf("got %d records searching the restored catalog, want 1", len(records))
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/avalonbits/opkcat/blob"
+)
+
+func TestVerifyBlobs(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blobs, err := blob.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every record is hashed from its content, and only the first two are archived.
+	var records []*Record
+	for _, name := range []string{"Doom", "Quake", "Heretic"} {
+		content := []byte("opk of " + name)
+		rec := testRecord("http://example.com/"+name+".opk", name)
+		sum := sha256.Sum256(content)
+		rec.Hash = sum[:]
+		if err := h.UpdateRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+		if len(records) > 2 {
+			continue
+		}
+		src := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(src, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := blobs.Put(rec.Hash, src); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bad, err := h.VerifyBlobs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bad) != 0 {
+		t.Errorf("got corrupted blobs %v, want none", bad)
+	}
+
+	// Flip a bit of the second blob.
+	path := blobs.Path(records[1].Hash)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] ^= 1
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	bad, err = h.VerifyBlobs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{hex.EncodeToString(records[1].Hash)}; !reflect.DeepEqual(bad, want) {
+		t.Errorf("got corrupted blobs %v, want %v", bad, want)
+	}
+}
@@ -21,19 +21,81 @@ package db
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/avalonbits/opkcat"
+	"github.com/avalonbits/opkcat/blob"
 	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/custom"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/analysis/token/lowercase"
+	"github.com/blevesearch/bleve/analysis/tokenizer/single"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/query"
 	"github.com/dgraph-io/badger/v2"
 )
 
+// Key prefixes for the entries that are not records.
+const (
+	urlPrefix        = "_url:"
+	errPrefix        = "_err:"
+	metaPrefix       = "_meta:"
+	quarantinePrefix = "_quarantine:"
+	refetchPrefix    = "_refetch:"
+	fetchLogPrefix   = "_fetchlog:"
+)
+
+var lastFetchKey = []byte(metaPrefix + "lastfetch")
+
+// ErrNotFound is returned when a record doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// DefaultQueryLimit is the maximum number of records returned by Query unless changed with
+// SetQueryLimit.
+const DefaultQueryLimit = 100
+
 // Handle is a database handle. It can be used to read and write data concurrently.
 type Handle struct {
-	db    *badger.DB
-	index bleve.Index
+	// badRecords counts the query hits skipped because their record could not be decoded. It is
+	// the first field to keep it 64-bit aligned for atomic access.
+	badRecords int64
+	// version changes every time the records or the index change. It follows the clock, so it is
+	// not repeated after a restart.
+	version int64
+
+	db           *badger.DB
+	index        bleve.Index
+	queryLimit   int
+	recencyBoost float64
+	fetchHistory int
+	writeWorkers int
+
+	// refuseDowngrades keeps the record of a url when it starts serving an older version.
+	refuseDowngrades bool
+
+	logger opkcat.Logger
+
+	// idxLocation and idxOpts are where and how the index was opened, to rebuild it. Test
+	// handles have no index location.
+	idxLocation string
+	idxOpts     options
 }
 
 // Record is the record that can be stored in the database.
@@ -42,53 +104,454 @@ type Record struct {
 	Hash    []byte
 	Date    time.Time
 	Etag    string
+	Size    int64
 	Entries []*Entry
+	Tags    []string
+
+	// URLs are all the urls serving the content, URL among them. Records stored before mirrors
+	// were tracked leave it empty, so it should be read with Mirrors.
+	URLs []string
+
+	// PrimaryEntry is the index in Entries of the entry representing the opk.
+	PrimaryEntry int
+
+	// LastModified is the Last-Modified date sent by the server, and Conditional the conditional
+	// request mechanism it was observed to honor.
+	LastModified time.Time
+	Conditional  string
+
+	// ContentLength is the Content-Length of the response the opk was downloaded from. It differs
+	// from Size when the server encoded the opk, and is -1 when the server didn't send it.
+	ContentLength int64
+
+	// InstalledSize is the uncompressed size of the files in the opk.
+	InstalledSize int64
+
+	// SourceTitle is the text of the source list link to the url.
+	SourceTitle string
+
+	// DowngradedFrom is the newer version the url served before this record, if it served an
+	// older version of an entry.
+	DowngradedFrom string
+
+	// Screenshots are the images bundled with the opk, if any.
+	Screenshots [][]byte
+
+	// Curated fields. They are set by curators rather than read from the opk, and are carried
+	// forward when the url is fetched again.
+	Rating    string
+	Languages []string
+
+	// Deprecated records stay in the catalog, but curators advise against them. SupersededBy is
+	// the hash or url of the record replacing it, if any. Unlike the other curated fields, they
+	// are only carried forward while the url serves the same content.
+	Deprecated   bool
+	SupersededBy string
+}
+
+// Mirrors returns the urls serving the content of the record.
+func (rec *Record) Mirrors() []string {
+	if len(rec.URLs) == 0 {
+		return []string{rec.URL}
+	}
+	return rec.URLs
+}
+
+// addMirror returns mirrors with opkurl, unless it is already there.
+func addMirror(mirrors []string, opkurl string) []string {
+	for _, u := range mirrors {
+		if u == opkurl {
+			return mirrors
+		}
+	}
+	return append(mirrors, opkurl)
+}
+
+// dropMirror removes opkurl from the urls of rec, stored at hash, when other urls still serve its
+// content. A record fetched from opkurl moves to the first of them. It returns rec if it changed,
+// to be indexed again once the transaction is committed.
+func dropMirror(opkurl string, rec *Record, hash []byte, txn *badger.Txn) (*Record, error) {
+	mirrors := make([]string, 0, len(rec.URLs))
+	for _, u := range rec.URLs {
+		if u != opkurl {
+			mirrors = append(mirrors, u)
+		}
+	}
+	if len(mirrors) == len(rec.URLs) || len(mirrors) == 0 {
+		return nil, nil
+	}
+	rec.URLs = mirrors
+	if rec.URL == opkurl {
+		rec.URL = mirrors[0]
+	}
+	return rec, setGob(txn, hash, rec)
+}
+
+// Primary returns the entry representing the opk, or nil if it has no entries.
+func (rec *Record) Primary() *Entry {
+	if len(rec.Entries) == 0 {
+		return nil
+	}
+	if rec.PrimaryEntry < 0 || rec.PrimaryEntry >= len(rec.Entries) {
+		return rec.Entries[0]
+	}
+	return rec.Entries[rec.PrimaryEntry]
+}
+
+// carryForward copies the curated fields of prev that rec doesn't set. The deprecation only holds
+// for the content it was set on, so it is carried forward only when prev has the same content: a
+// new release from the same url starts out not deprecated.
+func (rec *Record) carryForward(prev *Record) {
+	if rec.Rating == "" {
+		rec.Rating = prev.Rating
+	}
+	if rec.Languages == nil {
+		rec.Languages = prev.Languages
+	}
+	if !bytes.Equal(rec.Hash, prev.Hash) {
+		return
+	}
+	if !rec.Deprecated {
+		rec.Deprecated = prev.Deprecated
+	}
+	if rec.SupersededBy == "" {
+		rec.SupersededBy = prev.SupersededBy
+	}
 }
 
 type Entry struct {
 	Name        string
 	Description string
 	Type        string
+	Exec        string
 	Categories  []string
 	Icon        []byte
+	Platform    string
+
+	// IconFormat is the image format of Icon: png, jpeg, gif, bmp or svg. Records fetched before
+	// it was added have png icons and no IconFormat.
+	IconFormat string
+
+	// AppID is a stable application identifier that is kept across versions and mirrors.
+	AppID  string
+	Author string
+
+	// NeedsDownload is set when the application downloads additional assets when it runs.
+	NeedsDownload bool
+
+	// Version is the version of the application, if the desktop entry has one.
+	Version string
+
+	// LocalizedNames and LocalizedDescriptions are the translations of Name and Description,
+	// keyed by language code, like fr or pt_BR.
+	LocalizedNames        map[string]string
+	LocalizedDescriptions map[string]string
+
+	// Actions are the additional ways to start the application defined by the desktop entry.
+	Actions []*Action
+}
+
+// Action is a desktop action, like starting a game in a different mode.
+type Action struct {
+	ID   string
+	Name string
+	Exec string
 }
 
+// Conditional request mechanisms a server honors. When it isn't known yet, every validator
+// available is sent.
+const (
+	ConditionalUnknown  = ""
+	ConditionalETag     = "etag"
+	ConditionalModified = "modified"
+)
+
 type URLFreshness struct {
 	URL        string
 	LastUpdate time.Time
 	Etag       string
+	Headers    map[string]string
+	Title      string
+
+	// LastModified is the Last-Modified date the server sent with the content, and Conditional
+	// the conditional request mechanism it honors.
+	LastModified time.Time
+	Conditional  string
+
+	// Size is the size of the content last fetched from the url, and ContentLength the length of
+	// the response it was read from.
+	Size          int64
+	ContentLength int64
+
+	// QuarantineEtag is the etag of the content that failed extraction, if the url is in
+	// quarantine.
+	QuarantineEtag string
+
+	// Source names the source list the url was read from, and MissingSince is when the url was
+	// first found missing from it. Urls missing from their source are candidates for pruning.
+	Source       string
+	MissingSince time.Time
 }
 
-// Prod returns a production version of the database in location.
-func Prod(dbLocation, idxLocation string) (*Handle, error) {
-	db, err := badger.Open(badger.DefaultOptions(dbLocation))
-	if err != nil {
+type options struct {
+	indexType string
+	kvStore   string
+	kvConfig  map[string]interface{}
+	readOnly  bool
+}
+
+// Option configures how Prod opens the database.
+type Option func(*options)
+
+// WithIndexType makes new indexes use the bleve index type and key/value store, e.g. "scorch" for
+// both, or "upside_down" and "boltdb". Existing indexes keep the configuration they were created
+// with.
+func WithIndexType(indexType, kvStore string) Option {
+	return func(o *options) {
+		o.indexType = indexType
+		o.kvStore = kvStore
+	}
+}
+
+// WithKVConfig passes config to the key/value store of new indexes.
+func WithKVConfig(config map[string]interface{}) Option {
+	return func(o *options) {
+		o.kvConfig = config
+	}
+}
+
+// WithReadOnly opens the database and index without writing to them, so they can't be
+// modified. The index must already exist.
+func WithReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
+// Prod returns a production version of the database in location. Without options, new indexes use
+// the bleve defaults.
+func Prod(dbLocation, idxLocation string, opts ...Option) (*Handle, error) {
+	if err := validateLocations(dbLocation, idxLocation); err != nil {
 		return nil, err
 	}
-	index, err := bleve.Open(idxLocation)
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	db, err := badger.Open(badger.DefaultOptions(dbLocation).WithReadOnly(o.readOnly))
 	if err != nil {
+		return nil, err
+	}
+	var index bleve.Index
+	var stale bool
+	if o.readOnly {
+		index, err = bleve.OpenUsing(idxLocation, map[string]interface{}{"read_only": true})
+	} else {
+		index, err = bleve.Open(idxLocation)
+	}
+	if err != nil && o.readOnly {
+		db.Close()
+		return nil, err
+	} else if err != nil {
 		// Path might not exist. Let's try creating it.
-		if index, err = bleve.New(idxLocation, bleve.NewIndexMapping()); err != nil {
+		if index, err = newIndex(idxLocation, &o); err != nil {
 			db.Close()
 			return nil, err
 		}
+	} else if version, err := indexMappingVersion(index); err != nil {
+		index.Close()
+		db.Close()
+		return nil, err
+	} else if version < mappingVersion {
+		stale = true
 	}
 
-	return &Handle{
-		db:    db,
-		index: index,
-	}, nil
+	h := &Handle{
+		db:           db,
+		index:        index,
+		queryLimit:   DefaultQueryLimit,
+		fetchHistory: DefaultFetchHistory,
+		version:      time.Now().UnixNano(),
+		idxLocation:  idxLocation,
+		idxOpts:      o,
+		logger:       opkcat.StdLogger(opkcat.LevelDebug),
+	}
+	if stale {
+		// The records are all in the database, so the index can be rebuilt from scratch.
+		h.logger.Warn(fmt.Sprintf("The index in %s was built with an older mapping. Run the reindex "+
+			"subcommand to rebuild it with the current one.", idxLocation))
+	}
+	return h, nil
+}
+
+// validateLocations checks that the database and index locations can be used together. Both
+// create their own directory, so only the parent has to exist.
+func validateLocations(dbLocation, idxLocation string) error {
+	if dbLocation == "" {
+		return fmt.Errorf("empty database location")
+	}
+	if idxLocation == "" {
+		return fmt.Errorf("empty index location")
+	}
+
+	dbAbs, err := filepath.Abs(dbLocation)
+	if err != nil {
+		return err
+	}
+	idxAbs, err := filepath.Abs(idxLocation)
+	if err != nil {
+		return err
+	}
+
+	if dbAbs == idxAbs {
+		return fmt.Errorf("database and index can't share the same location %q", dbAbs)
+	}
+	sep := string(filepath.Separator)
+	if strings.HasPrefix(idxAbs, dbAbs+sep) || strings.HasPrefix(dbAbs, idxAbs+sep) {
+		return fmt.Errorf("database location %q and index location %q can't be nested", dbAbs, idxAbs)
+	}
+
+	for _, loc := range []struct{ name, path string }{{"database", dbAbs}, {"index", idxAbs}} {
+		parent := filepath.Dir(loc.path)
+		info, err := os.Stat(parent)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("%s location %q: directory %q does not exist", loc.name, loc.path, parent)
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s location %q: %q is not a directory", loc.name, loc.path, parent)
+		}
+	}
+	return nil
+}
+
+func newIndex(idxLocation string, o *options) (bleve.Index, error) {
+	var index bleve.Index
+	var err error
+	switch {
+	case o.indexType == "" && o.kvStore == "" && o.kvConfig == nil:
+		index, err = bleve.New(idxLocation, indexMapping())
+	case o.indexType == "" || o.kvStore == "":
+		return nil, fmt.Errorf("index type and key/value store must be set together")
+	default:
+		index, err = bleve.NewUsing(idxLocation, indexMapping(), o.indexType, o.kvStore, o.kvConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := index.SetInternal(mappingVersionKey, []byte(strconv.Itoa(mappingVersion))); err != nil {
+		index.Close()
+		return nil, err
+	}
+	return index, nil
+}
+
+// mappingVersion is the version of indexMapping, stored in new indexes. It changes whenever the
+// mapping does, so indexes built with an older mapping can be told apart.
+const mappingVersion = 3
+
+// mappingVersionKey is the internal index key holding the mapping version. Indexes built before
+// it was introduced don't have it, which is version 1.
+var mappingVersionKey = []byte("opkcat:mapping_version")
+
+// lowercaseKeyword is the analyzer of values matched whole, but regardless of case.
+const lowercaseKeyword = "lowercase_keyword"
+
+// indexMapping returns the mapping used for new indexes. Only the fields mapped here are indexed:
+// the others, like icons and screenshots, which would be indexed as lists of numbers, and the
+// fetch bookkeeping, are left out of the index.
+func indexMapping() mapping.IndexMapping {
+	m := bleve.NewIndexMapping()
+	err := m.AddCustomAnalyzer(lowercaseKeyword, map[string]interface{}{
+		"type":          custom.Name,
+		"tokenizer":     single.Name,
+		"token_filters": []string{lowercase.Name},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	keywordField := bleve.NewTextFieldMapping()
+	keywordField.Analyzer = keyword.Name
+
+	categoryField := bleve.NewTextFieldMapping()
+	categoryField.Analyzer = lowercaseKeyword
+
+	// Authors are searchable as text, but also kept whole for exact matches and facets.
+	authorKeyword := bleve.NewTextFieldMapping()
+	authorKeyword.Analyzer = keyword.Name
+	authorKeyword.Name = "AuthorKeyword"
+	authorKeyword.IncludeInAll = false
+
+	disabled := bleve.NewDocumentDisabledMapping()
+
+	// Translations are keyed by language, so every language found is indexed.
+	localized := bleve.NewDocumentMapping()
+
+	entries := bleve.NewDocumentStaticMapping()
+	entries.AddFieldMappingsAt("Name", bleve.NewTextFieldMapping())
+	entries.AddFieldMappingsAt("Description", bleve.NewTextFieldMapping())
+	entries.AddSubDocumentMapping("LocalizedNames", localized)
+	entries.AddSubDocumentMapping("LocalizedDescriptions", localized)
+	entries.AddFieldMappingsAt("Categories", categoryField)
+	entries.AddFieldMappingsAt("AppID", keywordField)
+	entries.AddFieldMappingsAt("Author", bleve.NewTextFieldMapping(), authorKeyword)
+	entries.AddFieldMappingsAt("NeedsDownload", bleve.NewBooleanFieldMapping())
+	// Versions are kept whole, so searching for 1.2 doesn't match 1.2.1.
+	entries.AddFieldMappingsAt("Version", keywordField)
+	entries.AddSubDocumentMapping("Icon", disabled)
+
+	m.DefaultMapping.Dynamic = false
+	m.DefaultMapping.AddSubDocumentMapping("Entries", entries)
+	m.DefaultMapping.AddFieldMappingsAt("URL", bleve.NewTextFieldMapping())
+	m.DefaultMapping.AddFieldMappingsAt("SourceTitle", bleve.NewTextFieldMapping())
+	m.DefaultMapping.AddFieldMappingsAt("Tags", bleve.NewTextFieldMapping())
+	m.DefaultMapping.AddFieldMappingsAt("Rating", bleve.NewTextFieldMapping())
+	m.DefaultMapping.AddFieldMappingsAt("Languages", bleve.NewTextFieldMapping())
+	// Every record has a size, so a range on it matches them all. See allRecords.
+	m.DefaultMapping.AddFieldMappingsAt("Size", bleve.NewNumericFieldMapping())
+	m.DefaultMapping.AddFieldMappingsAt("Date", bleve.NewDateTimeFieldMapping())
+	m.DefaultMapping.AddFieldMappingsAt("Deprecated", bleve.NewBooleanFieldMapping())
+	m.DefaultMapping.AddSubDocumentMapping("Hash", disabled)
+	m.DefaultMapping.AddSubDocumentMapping("Screenshots", disabled)
+	return m
+}
+
+// indexMappingVersion returns the version of the mapping index was built with.
+func indexMappingVersion(index bleve.Index) (int, error) {
+	v, err := index.GetInternal(mappingVersionKey)
+	if err != nil {
+		return 0, err
+	}
+	if v == nil {
+		return 1, nil
+	}
+	return strconv.Atoi(string(v))
 }
 
-// Test returns a test (in-memory) version of the database.
+// Test returns a test (in-memory) version of the database. Its index is in memory too, so it has no
+// location to be rebuilt in.
 func Test() (*Handle, error) {
 	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
 	if err != nil {
 		return nil, err
 	}
+	index, err := bleve.NewMemOnly(indexMapping())
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	return &Handle{
-		db: db,
+		db:           db,
+		index:        index,
+		queryLimit:   DefaultQueryLimit,
+		fetchHistory: DefaultFetchHistory,
+		version:      time.Now().UnixNano(),
+		logger:       opkcat.StdLogger(opkcat.LevelDebug),
 	}, nil
 }
 
@@ -102,229 +565,2216 @@ func (h *Handle) Close() error {
 	return nil
 }
 
+// Sync flushes the writes buffered by the database to disk, so they survive a crash. Writes are
+// not synced as they happen because that makes every update wait on the disk; instead callers
+// choose how much they can afford to lose by how often they call Sync. Index updates are
+// persisted as each batch is applied, except for scorch indexes, which persist them in the
+// background.
+func (h *Handle) Sync() error {
+	return h.db.Sync()
+}
+
 func (h *Handle) IndexURL(opkurl string) error {
+	return h.db.Update(func(txn *badger.Txn) error {
+		return h.indexURL(opkurl, txn)
+	})
+}
+
+func (h *Handle) indexURL(opkurl string, txn *badger.Txn) error {
+	fresh, err := h.lastUpdated(opkurl, txn)
+	if err != nil {
+		return err
+	}
+
+	// If we have already indexed the url, we are done.
+	if fresh != nil {
+		return nil
+	}
+
+	var fBuf bytes.Buffer
+	fEnc := gob.NewEncoder(&fBuf)
+	if err := fEnc.Encode(&freshness{Date: time.Time{}, Etag: ""}); err != nil {
+		return err
+	}
+	return txn.Set(urlKey(opkurl), fBuf.Bytes())
+}
+
+// SetURLHeaders sets the headers sent only with the requests for opkurl, replacing the previous
+// ones. Nil headers remove them. It returns ErrNotFound if opkurl is not known.
+func (h *Handle) SetURLHeaders(opkurl string, headers map[string]string) error {
 	return h.db.Update(func(txn *badger.Txn) error {
 		fresh, err := h.lastUpdated(opkurl, txn)
 		if err != nil {
 			return err
 		}
-
-		// If we have already indexed the url, we are done.
-		if fresh != nil {
+		if fresh == nil {
+			return ErrNotFound
+		}
+		if reflect.DeepEqual(fresh.Headers, headers) || len(fresh.Headers)+len(headers) == 0 {
 			return nil
 		}
+		fresh.Headers = headers
+		return setGob(txn, urlKey(opkurl), fresh)
+	})
+}
 
-		var fBuf bytes.Buffer
-		fEnc := gob.NewEncoder(&fBuf)
-		if err := fEnc.Encode(&freshness{Date: time.Time{}, Etag: ""}); err != nil {
+// SetConditional records the conditional request mechanism the server of opkurl was observed to
+// honor. It returns ErrNotFound if opkurl is not known.
+func (h *Handle) SetConditional(opkurl, conditional string) error {
+	return h.db.Update(func(txn *badger.Txn) error {
+		fresh, err := h.lastUpdated(opkurl, txn)
+		if err != nil {
 			return err
 		}
-		return txn.Set([]byte("_url:"+url.PathEscape(opkurl)), fBuf.Bytes())
+		if fresh == nil {
+			return ErrNotFound
+		}
+		if fresh.Conditional == conditional {
+			return nil
+		}
+		fresh.Conditional = conditional
+		return setGob(txn, urlKey(opkurl), fresh)
 	})
 }
 
-type freshness struct {
-	Date time.Time
-	Etag string
-}
-
-func (h *Handle) Query(qry string) ([]*Record, error) {
-	if qry == "" {
-		return nil, fmt.Errorf("empty query string")
+// ReconcileSource brings the urls read from the source list named source in line with opkurls.
+// Unknown urls are added, and every listed url is attributed to source. The urls of source that are
+// no longer listed are marked as missing and returned, so the caller can decide whether to prune
+// them; a url listed again is no longer missing. Urls added before sources were tracked are taken
+// as coming from source. The urls are written in batches, concurrently as set by SetWriteWorkers,
+// and both returned lists are sorted.
+func (h *Handle) ReconcileSource(source string, opkurls []string) (added, missing []string, err error) {
+	listed := make(map[string]bool, len(opkurls))
+	unique := make([]string, 0, len(opkurls))
+	for _, opkurl := range opkurls {
+		if !listed[opkurl] {
+			listed[opkurl] = true
+			unique = append(unique, opkurl)
+		}
 	}
-	query := bleve.NewMatchQuery(qry)
-	search := bleve.NewSearchRequestOptions(query, 100, 0, false)
-	search.SortBy([]string{"Entries.Name"})
-	results, err := h.index.Search(search)
+	var mu sync.Mutex
+	err = h.updateFreshness(unique, func(opkurl string, fresh *freshness) *freshness {
+		if fresh == nil {
+			mu.Lock()
+			added = append(added, opkurl)
+			mu.Unlock()
+			return &freshness{Source: source}
+		}
+		if fresh.Source == source && fresh.MissingSince.IsZero() {
+			return nil
+		}
+		fresh.Source = source
+		fresh.MissingSince = time.Time{}
+		return fresh
+	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	recIds := make([][]byte, len(results.Hits))
-	for i, hit := range results.Hits {
-		recIds[i] = []byte(hit.ID)
+	known, err := h.KnownURLs()
+	if err != nil {
+		return nil, nil, err
 	}
-
-	records := make([]*Record, 0, len(results.Hits))
-	err = h.db.View(func(txn *badger.Txn) error {
-		for _, id := range recIds {
-			item, err := txn.Get(id)
-			if err != nil {
-				if err == badger.ErrKeyNotFound {
-					fmt.Printf("Did not find record for key %x. Should not happen.\n", id)
-					continue
-				}
-				return err
-			}
-			err = item.Value(func(data []byte) error {
-				record := &Record{}
-				buf := bytes.NewBuffer(data)
-				dec := gob.NewDecoder(buf)
-				if err := dec.Decode(record); err != nil {
-					fmt.Println("ERROR DECODING")
-					return err
-				}
-				records = append(records, record)
-				return nil
-			})
-			if err != nil {
-				return err
-			}
+	var absent []string
+	for _, u := range known {
+		if !listed[u.URL] && (u.Source == source || u.Source == "") {
+			absent = append(absent, u.URL)
 		}
-		return nil
+	}
+	now := time.Now().UTC()
+	err = h.updateFreshness(absent, func(opkurl string, fresh *freshness) *freshness {
+		// The url may have been removed since it was listed.
+		if fresh == nil {
+			return nil
+		}
+		mu.Lock()
+		missing = append(missing, opkurl)
+		mu.Unlock()
+		if !fresh.MissingSince.IsZero() {
+			return nil
+		}
+		fresh.Source = source
+		fresh.MissingSince = now
+		return fresh
 	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return records, err
+	// The batches finish in any order.
+	sort.Strings(added)
+	sort.Strings(missing)
+	return added, missing, nil
 }
 
-func (h *Handle) KnownURLs() ([]*URLFreshness, error) {
-	var urls []*URLFreshness
-	err := h.db.View(func(txn *badger.Txn) error {
-		prefix := []byte("_url:")
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
+// updateFreshness calls fn with the freshness of each of opkurls, nil if the url is not known, and
+// stores the freshness fn returns unless it is nil. The urls are updated in batches of
+// deleteBatchSize per transaction, written by up to writeWorkers goroutines, so fn must be safe
+// for concurrent use. Opkurls must not repeat, or the transactions would conflict. Every failed
+// batch is reported.
+func (h *Handle) updateFreshness(opkurls []string, fn func(string, *freshness) *freshness) error {
+	batches := make(chan []string)
+	go func() {
+		defer close(batches)
+		for start := 0; start < len(opkurls); start += deleteBatchSize {
+			end := start + deleteBatchSize
+			if end > len(opkurls) {
+				end = len(opkurls)
+			}
+			batches <- opkurls[start:end]
+		}
+	}()
 
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			item := it.Item()
-			key := bytes.TrimPrefix(item.Key(), prefix)
-			opkurl, err := url.PathUnescape(string(key))
+	workers := h.writeWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []string
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				if err := h.updateBatch(batch, fn); err != nil {
+					mu.Lock()
+					errs = append(errs, err.Error())
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d batches failed: %s", len(errs), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// updateBatch is updateFreshness for a single transaction.
+func (h *Handle) updateBatch(opkurls []string, fn func(string, *freshness) *freshness) error {
+	return h.db.Update(func(txn *badger.Txn) error {
+		for _, opkurl := range opkurls {
+			fresh, err := h.lastUpdated(opkurl, txn)
 			if err != nil {
 				return err
 			}
-			err = item.Value(func(data []byte) error {
-				fresh := &freshness{}
-				buf := bytes.NewBuffer(data)
-				dec := gob.NewDecoder(buf)
-				if err := dec.Decode(fresh); err != nil {
-					return err
-				}
-				urls = append(urls, &URLFreshness{
-					URL:        opkurl,
-					LastUpdate: fresh.Date,
-					Etag:       fresh.Etag,
-				})
-				return nil
-			})
-			if err != nil {
-				return nil
+			if fresh = fn(opkurl, fresh); fresh == nil {
+				continue
+			}
+			if err := setGob(txn, urlKey(opkurl), fresh); err != nil {
+				return err
 			}
 		}
 		return nil
 	})
-
-	if err != nil {
-		return nil, err
-	}
-	return urls, nil
 }
 
-func (h *Handle) LastUpdated(opkurl string) (time.Time, string, error) {
-	if len(opkurl) == 0 {
-		return time.Time{}, "", fmt.Errorf("empty url")
+// SetWriteWorkers changes the number of transactions ReconcileSource writes concurrently. Values
+// not greater than zero write them one at a time. It should be called before the handle is shared
+// between goroutines.
+func (h *Handle) SetWriteWorkers(workers int) {
+	if workers <= 0 {
+		workers = 1
 	}
+	h.writeWorkers = workers
+}
 
-	var fresh *freshness
-	err := h.db.View(func(txn *badger.Txn) error {
+// SetSourceTitle sets the text of the source list link to opkurl. The record fetched from opkurl,
+// if any, is updated right away. It returns ErrNotFound if opkurl is not known.
+func (h *Handle) SetSourceTitle(opkurl, title string) error {
+	var updated *Record
+	err := h.db.Update(func(txn *badger.Txn) error {
+		fresh, err := h.lastUpdated(opkurl, txn)
+		if err != nil {
+			return err
+		}
+		if fresh == nil {
+			return ErrNotFound
+		}
+		if fresh.Title == title {
+			return nil
+		}
+		fresh.Title = title
+		if err := setGob(txn, urlKey(opkurl), fresh); err != nil {
+			return err
+		}
+
+		if len(fresh.Hash) == 0 {
+			return nil
+		}
+		rec := &Record{}
+		if err := getGob(txn, fresh.Hash, rec); err != nil {
+			if err == badger.ErrKeyNotFound {
+				return nil
+			}
+			return err
+		}
+		// The same content may have been fetched from another url since.
+		if rec.URL != opkurl {
+			return nil
+		}
+		rec.SourceTitle = title
+		updated = rec
+		return setGob(txn, fresh.Hash, rec)
+	})
+	if err != nil || updated == nil {
+		return err
+	}
+	return h.indexRecords([]*Record{updated})
+}
+
+type freshness struct {
+	Date time.Time
+	Etag string
+	Hash []byte
+
+	// LastModified, Conditional, Size and ContentLength are the URLFreshness fields of the same
+	// name.
+	LastModified  time.Time
+	Conditional   string
+	Size          int64
+	ContentLength int64
+
+	// Headers are sent only with the requests for this url.
+	Headers map[string]string
+
+	// Title is the text of the source list link to the url.
+	Title string
+
+	// Source and MissingSince are the URLFreshness fields of the same name.
+	Source       string
+	MissingSince time.Time
+}
+
+// isMetaKey reports whether key belongs to an entry that is not a record.
+func isMetaKey(key []byte) bool {
+	for _, prefix := range []string{urlPrefix, errPrefix, metaPrefix, quarantinePrefix, refetchPrefix, fetchLogPrefix} {
+		if bytes.HasPrefix(key, []byte(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+func urlKey(opkurl string) []byte {
+	return []byte(urlPrefix + url.PathEscape(opkurl))
+}
+
+func errKey(opkurl string) []byte {
+	return []byte(errPrefix + url.PathEscape(opkurl))
+}
+
+func quarantineKey(opkurl string) []byte {
+	return []byte(quarantinePrefix + url.PathEscape(opkurl))
+}
+
+func refetchKey(opkurl string) []byte {
+	return []byte(refetchPrefix + url.PathEscape(opkurl))
+}
+
+// getGob decodes the value stored at key into v.
+func getGob(txn *badger.Txn, key []byte, v interface{}) error {
+	item, err := txn.Get(key)
+	if err != nil {
+		return err
+	}
+	return item.Value(func(data []byte) error {
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+	})
+}
+
+// setGob stores the gob encoding of v at key.
+func setGob(txn *badger.Txn, key []byte, v interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	return txn.Set(key, buf.Bytes())
+}
+
+// failure tracks the consecutive fetch failures of a url.
+type failure struct {
+	Err   string
+	Date  time.Time
+	Count int
+
+	// Since is the date of the first of the consecutive failures.
+	Since time.Time
+}
+
+// RecordFailure registers a failed fetch of opkurl. It returns the number of consecutive failures,
+// including this one.
+func (h *Handle) RecordFailure(opkurl string, ferr error) (int, error) {
+	count := 0
+	err := h.db.Update(func(txn *badger.Txn) error {
+		key := errKey(opkurl)
+		fail := &failure{}
+		if err := getGob(txn, key, fail); err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		fail.Err = ferr.Error()
+		fail.Date = time.Now().UTC()
+		fail.Count++
+		if fail.Since.IsZero() {
+			fail.Since = fail.Date
+		}
+		count = fail.Count
+		return setGob(txn, key, fail)
+	})
+	return count, err
+}
+
+// ClearFailure resets the consecutive failure count of opkurl after a successful fetch. It also
+// releases opkurl from quarantine, since its content was fetched successfully.
+func (h *Handle) ClearFailure(opkurl string) error {
+	return h.db.Update(func(txn *badger.Txn) error {
+		// Most urls never fail, so avoid the write when there is nothing to clear.
+		for _, key := range [][]byte{errKey(opkurl), quarantineKey(opkurl)} {
+			if _, err := txn.Get(key); err != nil {
+				if err == badger.ErrKeyNotFound {
+					continue
+				}
+				return err
+			}
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// QuarantinedURL is a url whose content couldn't be extracted. It is not downloaded again while
+// it is served with the same Etag.
+type QuarantinedURL struct {
+	URL  string    `json:"url"`
+	Etag string    `json:"etag"`
+	Err  string    `json:"error"`
+	Date time.Time `json:"date"`
+}
+
+// Quarantine puts opkurl in quarantine while it is served with etag, after its content failed
+// with qerr.
+func (h *Handle) Quarantine(opkurl, etag string, qerr error) error {
+	if etag == "" {
+		return fmt.Errorf("%s: can't quarantine without an etag", opkurl)
+	}
+	return h.db.Update(func(txn *badger.Txn) error {
+		return setGob(txn, quarantineKey(opkurl), &QuarantinedURL{
+			URL:  opkurl,
+			Etag: etag,
+			Err:  qerr.Error(),
+			Date: time.Now().UTC(),
+		})
+	})
+}
+
+// QuarantinedURLs returns the urls in quarantine, in url order.
+func (h *Handle) QuarantinedURLs() ([]*QuarantinedURL, error) {
+	var urls []*QuarantinedURL
+	err := h.db.View(func(txn *badger.Txn) error {
+		prefix := []byte(quarantinePrefix)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			q := &QuarantinedURL{}
+			err := it.Item().Value(func(data []byte) error {
+				return gob.NewDecoder(bytes.NewReader(data)).Decode(q)
+			})
+			if err != nil {
+				return err
+			}
+			urls = append(urls, q)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+// URLError is the failure tracking of a url whose last fetch failed.
+type URLError struct {
+	URL  string    `json:"url"`
+	Err  string    `json:"error"`
+	Date time.Time `json:"date"`
+
+	// Count is the number of consecutive failures, the first of which happened at Since.
+	Count int       `json:"count"`
+	Since time.Time `json:"since"`
+}
+
+// FailingURLs returns the urls whose last fetch failed, the ones with the most consecutive failures
+// first.
+func (h *Handle) FailingURLs() ([]*URLError, error) {
+	var urls []*URLError
+	err := h.db.View(func(txn *badger.Txn) error {
+		prefix := []byte(errPrefix)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			fail := &failure{}
+			err := it.Item().Value(func(data []byte) error {
+				return gob.NewDecoder(bytes.NewReader(data)).Decode(fail)
+			})
+			if err != nil {
+				return err
+			}
+			opkurl, err := url.PathUnescape(string(bytes.TrimPrefix(it.Item().Key(), prefix)))
+			if err != nil {
+				return err
+			}
+			urls = append(urls, &URLError{
+				URL:   opkurl,
+				Err:   fail.Err,
+				Date:  fail.Date,
+				Count: fail.Count,
+				Since: fail.Since,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(urls, func(i, j int) bool {
+		return urls[i].Count > urls[j].Count
+	})
+	return urls, nil
+}
+
+// ExpireFailing removes from the catalog, as PruneURL does, the urls that have been failing for
+// longer than ttl, meaning they weren't fetched successfully since. It returns the removed urls.
+func (h *Handle) ExpireFailing(ttl time.Duration) ([]string, error) {
+	cutoff := time.Now().UTC().Add(-ttl)
+	var expired []string
+	err := h.db.View(func(txn *badger.Txn) error {
+		prefix := []byte(errPrefix)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			fail := &failure{}
+			err := it.Item().Value(func(data []byte) error {
+				return gob.NewDecoder(bytes.NewReader(data)).Decode(fail)
+			})
+			if err != nil {
+				return err
+			}
+			// Failures recorded before Since was tracked start counting at their next failure.
+			if fail.Since.IsZero() || fail.Since.After(cutoff) {
+				continue
+			}
+			opkurl, err := url.PathUnescape(string(bytes.TrimPrefix(it.Item().Key(), prefix)))
+			if err != nil {
+				return err
+			}
+			expired = append(expired, opkurl)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, opkurl := range expired {
+		if err := h.PruneURL(opkurl); err != nil {
+			return expired[:i], err
+		}
+	}
+	return expired, nil
+}
+
+// MarkRefetched records that opkurls were processed by the forced re-fetch in progress, so an
+// interrupted run can resume without processing them again.
+func (h *Handle) MarkRefetched(opkurls []string) error {
+	for start := 0; start < len(opkurls); start += deleteBatchSize {
+		end := start + deleteBatchSize
+		if end > len(opkurls) {
+			end = len(opkurls)
+		}
+		err := h.db.Update(func(txn *badger.Txn) error {
+			for _, opkurl := range opkurls[start:end] {
+				if err := txn.Set(refetchKey(opkurl), nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RefetchedURLs returns the urls already processed by the forced re-fetch in progress.
+func (h *Handle) RefetchedURLs() (map[string]bool, error) {
+	keys, err := h.keysWithPrefix(refetchPrefix)
+	if err != nil {
+		return nil, err
+	}
+	urls := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		opkurl, err := url.PathUnescape(string(bytes.TrimPrefix(key, []byte(refetchPrefix))))
+		if err != nil {
+			return nil, err
+		}
+		urls[opkurl] = true
+	}
+	return urls, nil
+}
+
+// ClearRefetch forgets the progress of the forced re-fetch, once it completed.
+func (h *Handle) ClearRefetch() error {
+	keys, err := h.keysWithPrefix(refetchPrefix)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(keys); start += deleteBatchSize {
+		end := start + deleteBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		err := h.db.Update(func(txn *badger.Txn) error {
+			for _, key := range keys[start:end] {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keysWithPrefix returns the keys starting with prefix.
+func (h *Handle) keysWithPrefix(prefix string) ([][]byte, error) {
+	var keys [][]byte
+	err := h.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// PruneURL removes opkurl from the catalog: its freshness, its failure tracking and the record
+// fetched from it. Records written before freshness tracked their hash are left in place.
+func (h *Handle) PruneURL(opkurl string) error {
+	var hash []byte
+	var kept *Record
+	err := h.db.Update(func(txn *badger.Txn) error {
+		var err error
+		hash, kept, err = h.pruneURL(opkurl, txn)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if kept != nil {
+		return h.indexRecords([]*Record{kept})
+	}
+	if hash != nil {
+		return h.unindex(hash)
+	}
+	return nil
+}
+
+// pruneURL deletes everything stored for opkurl, returning the hash of the deleted record, if any.
+// The caller must remove the hash from the index once the transaction is committed. A record still
+// served by mirrors is kept without opkurl instead, and returned to be indexed again.
+func (h *Handle) pruneURL(opkurl string, txn *badger.Txn) ([]byte, *Record, error) {
+	var hash []byte
+	var kept *Record
+	fresh, err := h.lastUpdated(opkurl, txn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fresh != nil && len(fresh.Hash) > 0 {
+		rec := &Record{}
+		err := getGob(txn, fresh.Hash, rec)
+		if err != nil && err != badger.ErrKeyNotFound {
+			return nil, nil, err
+		}
+		if err == nil {
+			if kept, err = dropMirror(opkurl, rec, fresh.Hash, txn); err != nil {
+				return nil, nil, err
+			}
+		}
+		// The same content may have been fetched from another url since.
+		if err == nil && kept == nil && rec.URL == opkurl {
+			if err := txn.Delete(fresh.Hash); err != nil {
+				return nil, nil, err
+			}
+			hash = fresh.Hash
+		}
+	}
+	if err := deleteURLKeys(opkurl, txn); err != nil {
+		return nil, nil, err
+	}
+	return hash, kept, nil
+}
+
+// deleteURLKeys deletes the freshness, failure tracking, quarantine and re-fetch progress of
+// opkurl.
+func deleteURLKeys(opkurl string, txn *badger.Txn) error {
+	for _, key := range [][]byte{urlKey(opkurl), errKey(opkurl), quarantineKey(opkurl), refetchKey(opkurl)} {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteURL removes opkurl from the urls fetched, along with its failure tracking. Unlike
+// PruneURL, the record fetched from it is kept. It returns ErrNotFound if opkurl is not known.
+func (h *Handle) DeleteURL(opkurl string) error {
+	return h.db.Update(func(txn *badger.Txn) error {
+		fresh, err := h.lastUpdated(opkurl, txn)
+		if err != nil {
+			return err
+		}
+		if fresh == nil {
+			return ErrNotFound
+		}
+		return deleteURLKeys(opkurl, txn)
+	})
+}
+
+// DeleteRecord removes the record with hash from the database and the index. The urls serving it
+// that still point to it are fetched again in full on the next cycle. It returns
+// ErrNotFound if there is no record with hash.
+func (h *Handle) DeleteRecord(hash []byte) error {
+	err := h.db.Update(func(txn *badger.Txn) error {
+		// A meta key is not a record, whatever the caller passed as a hash.
+		if ok, err := h.recordExists(hash, txn); err != nil {
+			return err
+		} else if !ok {
+			return ErrNotFound
+		}
+		rec := &Record{}
+		if err := getGob(txn, hash, rec); err != nil {
+			return err
+		}
+		if err := txn.Delete(hash); err != nil {
+			return err
+		}
+
+		for _, opkurl := range rec.Mirrors() {
+			fresh, err := h.lastUpdated(opkurl, txn)
+			if err != nil {
+				return err
+			}
+			if fresh == nil || !bytes.Equal(fresh.Hash, hash) {
+				continue
+			}
+			fresh.Date = time.Time{}
+			fresh.Etag = ""
+			fresh.Hash = nil
+			fresh.LastModified = time.Time{}
+			fresh.Size = 0
+			fresh.ContentLength = 0
+			if err := setGob(txn, urlKey(opkurl), fresh); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The record is only removed from the index once it is gone from the database. If that fails,
+	// searches skip the missing record until ReconcileIndex removes it.
+	return h.unindex(hash)
+}
+
+// deleteBatchSize is the number of urls deleted per transaction by DeleteByURLPrefix, also used to
+// batch the re-fetch progress.
+const deleteBatchSize = 500
+
+// DeleteByURLPrefix removes every url starting with prefix from the catalog, as PruneURL does. It
+// is meant for retiring a whole mirror and returns the number of urls removed.
+func (h *Handle) DeleteByURLPrefix(prefix string) (int, error) {
+	if prefix == "" {
+		return 0, fmt.Errorf("empty url prefix")
+	}
+
+	// Escaping works character by character, so the escaped prefix is a key prefix as well.
+	var urls []string
+	err := h.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		seek := urlKey(prefix)
+		for it.Seek(seek); it.ValidForPrefix(seek); it.Next() {
+			opkurl, err := url.PathUnescape(string(bytes.TrimPrefix(it.Item().Key(), []byte(urlPrefix))))
+			if err != nil {
+				return err
+			}
+			if strings.HasPrefix(opkurl, prefix) {
+				urls = append(urls, opkurl)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for start := 0; start < len(urls); start += deleteBatchSize {
+		end := start + deleteBatchSize
+		if end > len(urls) {
+			end = len(urls)
+		}
+
+		var hashes [][]byte
+		var kept []*Record
+		err := h.db.Update(func(txn *badger.Txn) error {
+			hashes = hashes[:0]
+			kept = kept[:0]
+			for _, opkurl := range urls[start:end] {
+				hash, rec, err := h.pruneURL(opkurl, txn)
+				if err != nil {
+					return err
+				}
+				if hash != nil {
+					hashes = append(hashes, hash)
+				}
+				if rec != nil {
+					kept = append(kept, rec)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return count, err
+		}
+		count += end - start
+
+		if err := h.indexRecords(kept); err != nil {
+			return count, err
+		}
+
+		for _, hash := range hashes {
+			if err := h.unindex(hash); err != nil {
+				return count, err
+			}
+		}
+	}
+	return count, nil
+}
+
+// SetQueryLimit changes the maximum number of records returned by Query. It should be called
+// before the handle is shared between goroutines.
+func (h *Handle) SetQueryLimit(limit int) {
+	if limit <= 0 {
+		limit = DefaultQueryLimit
+	}
+	h.queryLimit = limit
+}
+
+// recencySteps are the ages under which a record gets a share of the recency boost. A record gets
+// the share of every step it is younger than, so newer records score higher.
+var recencySteps = []struct {
+	age   time.Duration
+	share float64
+}{
+	{30 * 24 * time.Hour, 1},
+	{180 * 24 * time.Hour, 0.5},
+	{365 * 24 * time.Hour, 0.25},
+}
+
+// SetRecencyBoost makes Query rank records by relevance combined with how recently their content
+// changed, instead of by name. Weight is how much recency counts compared to the text relevance;
+// zero disables the boost. It should be called before the handle is shared between goroutines.
+func (h *Handle) SetRecencyBoost(weight float64) {
+	if weight < 0 {
+		weight = 0
+	}
+	h.recencyBoost = weight
+}
+
+// recencyQueries returns the queries scoring the recency of records at now.
+func (h *Handle) recencyQueries(now time.Time) []query.Query {
+	var queries []query.Query
+	for _, step := range recencySteps {
+		recent := bleve.NewDateRangeQuery(now.Add(-step.age), time.Time{})
+		recent.SetField("Date")
+		recent.SetBoost(h.recencyBoost * step.share)
+		queries = append(queries, recent)
+	}
+	return queries
+}
+
+// QueryOption narrows down the records returned by a query.
+type QueryOption func(*queryOptions)
+
+type queryOptions struct {
+	phrase               bool
+	excludeNeedsDownload bool
+	excludeDeprecated    bool
+	since                time.Time
+	sort                 string
+}
+
+// MatchPhrase makes the query match only records with the query terms next to each other and in
+// order, instead of records with any of the terms.
+func MatchPhrase() QueryOption {
+	return func(o *queryOptions) {
+		o.phrase = true
+	}
+}
+
+// ExcludeNeedsDownload leaves out the records with an entry that downloads additional assets when
+// it runs.
+func ExcludeNeedsDownload() QueryOption {
+	return func(o *queryOptions) {
+		o.excludeNeedsDownload = true
+	}
+}
+
+// ExcludeDeprecated leaves out the records curators marked as deprecated.
+func ExcludeDeprecated() QueryOption {
+	return func(o *queryOptions) {
+		o.excludeDeprecated = true
+	}
+}
+
+// ChangedSince keeps only the records fetched at or after t, which is when their content last
+// changed.
+func ChangedSince(t time.Time) QueryOption {
+	return func(o *queryOptions) {
+		o.since = t
+	}
+}
+
+// Orders of the query results.
+const (
+	SortName   = "name"
+	SortNewest = "newest"
+	SortOldest = "oldest"
+)
+
+// SortBy orders the results by order: SortName, or SortNewest and SortOldest for the date the
+// records were fetched, with ties broken by name. Without it, the results are sorted by name, or
+// by relevance when there is a recency boost.
+func SortBy(order string) QueryOption {
+	return func(o *queryOptions) {
+		o.sort = order
+	}
+}
+
+// textQuery returns the query for the text qry, restricted by opts. An empty qry matches every
+// record.
+func (h *Handle) textQuery(qry string, opts []QueryOption) query.Query {
+	o := queryOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var match query.Query
+	switch {
+	case qry == "":
+		match = allRecords()
+	case o.phrase:
+		match = bleve.NewMatchPhraseQuery(qry)
+	default:
+		match = bleve.NewMatchQuery(qry)
+	}
+	must := []query.Query{match}
+	if !o.since.IsZero() {
+		since := bleve.NewDateRangeQuery(o.since, time.Time{})
+		since.SetField("Date")
+		must = append(must, since)
+	}
+
+	var mustNot []query.Query
+	if o.excludeNeedsDownload {
+		needsDownload := bleve.NewBoolFieldQuery(true)
+		needsDownload.SetField("Entries.NeedsDownload")
+		mustNot = append(mustNot, needsDownload)
+	}
+	if o.excludeDeprecated {
+		deprecated := bleve.NewBoolFieldQuery(true)
+		deprecated.SetField("Deprecated")
+		mustNot = append(mustNot, deprecated)
+	}
+	var should []query.Query
+	if h.recencyBoost > 0 {
+		should = h.recencyQueries(time.Now())
+	}
+	if len(must) == 1 && len(mustNot) == 0 && len(should) == 0 {
+		return match
+	}
+	filter := bleve.NewBooleanQuery()
+	filter.AddMust(must...)
+	if len(should) > 0 {
+		filter.AddShould(should...)
+	}
+	if len(mustNot) > 0 {
+		filter.AddMustNot(mustNot...)
+	}
+	return filter
+}
+
+// Query returns the records matching qry, capped at the handle query limit. It also returns the
+// total number of matches, which will be larger than the number of records when the cap is hit.
+func (h *Handle) Query(qry string, opts ...QueryOption) ([]*Record, int, error) {
+	return h.QueryPaged(qry, h.queryLimit, 0, opts...)
+}
+
+// QueryPaged is like Query, but returns up to size records starting at the match from, so callers
+// can page through all the matches. size is capped at the handle query limit.
+func (h *Handle) QueryPaged(qry string, size, from int, opts ...QueryOption) ([]*Record, int, error) {
+	search, err := h.searchRequest(qry, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	if size > 0 && size < h.queryLimit {
+		search.Size = size
+	}
+	if from > 0 {
+		search.From = from
+	}
+
+	records := make([]*Record, 0, search.Size)
+	total, err := h.searchFunc(search, func(record *Record) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return records, total, nil
+}
+
+// QueryFunc is like Query, but calls fn with each record as soon as it is decoded instead of
+// collecting them. If fn returns an error, the query stops and returns that error.
+func (h *Handle) QueryFunc(qry string, fn func(*Record) error, opts ...QueryOption) (int, error) {
+	search, err := h.searchRequest(qry, opts)
+	if err != nil {
+		return 0, err
+	}
+	return h.searchFunc(search, fn)
+}
+
+// ExplainedHit is a search result with the explanation of its score.
+type ExplainedHit struct {
+	Hash        string              `json:"hash"`
+	URL         string              `json:"url,omitempty"`
+	Name        string              `json:"name,omitempty"`
+	Score       float64             `json:"score"`
+	Explanation *search.Explanation `json:"explanation"`
+}
+
+// Explain runs the same search as QueryFunc, but returns how the score of each hit was computed
+// instead of the records. Explaining scores is expensive, so this is only meant for tuning the
+// search.
+func (h *Handle) Explain(qry string, opts ...QueryOption) ([]*ExplainedHit, error) {
+	req, err := h.searchRequest(qry, opts)
+	if err != nil {
+		return nil, err
+	}
+	req.Explain = true
+	results, err := h.index.Search(req)
+	if err != nil {
+		return nil, err
+	}
+
+	hits := make([]*ExplainedHit, 0, len(results.Hits))
+	byHash := make(map[string]*ExplainedHit, len(results.Hits))
+	for _, hit := range results.Hits {
+		eh := &ExplainedHit{
+			Hash:        hex.EncodeToString([]byte(hit.ID)),
+			Score:       hit.Score,
+			Explanation: hit.Expl,
+		}
+		hits = append(hits, eh)
+		byHash[hit.ID] = eh
+	}
+	_, err = h.searchFunc(req, func(record *Record) error {
+		if eh, ok := byHash[string(record.Hash)]; ok {
+			eh.URL = record.URL
+			if entry := record.Primary(); entry != nil {
+				eh.Name = entry.Name
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hits, nil
+}
+
+// searchRequest returns the search for the text qry restricted by opts, as run by QueryFunc. qry
+// can only be empty when a filter like ChangedSince restricts the records.
+func (h *Handle) searchRequest(qry string, opts []QueryOption) (*bleve.SearchRequest, error) {
+	o := queryOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if qry == "" && o.since.IsZero() {
+		return nil, fmt.Errorf("empty query string")
+	}
+	search := bleve.NewSearchRequestOptions(h.textQuery(qry, opts), h.queryLimit, 0, false)
+	switch o.sort {
+	case "":
+		if h.recencyBoost > 0 {
+			search.SortBy([]string{"-_score", "Entries.Name"})
+		} else {
+			search.SortBy([]string{"Entries.Name"})
+		}
+	case SortName:
+		search.SortBy([]string{"Entries.Name"})
+	case SortNewest:
+		search.SortBy([]string{"-Date", "Entries.Name"})
+	case SortOldest:
+		search.SortBy([]string{"Date", "Entries.Name"})
+	default:
+		return nil, fmt.Errorf("unknown sort order %q", o.sort)
+	}
+	return search, nil
+}
+
+// QueryByAuthor returns the records with an entry by author, which must match exactly. Like
+// Query, it also returns the total number of matches.
+func (h *Handle) QueryByAuthor(author string) ([]*Record, int, error) {
+	if author == "" {
+		return nil, 0, fmt.Errorf("empty author")
+	}
+	query := bleve.NewTermQuery(author)
+	query.SetField("Entries.AuthorKeyword")
+	search := bleve.NewSearchRequestOptions(query, h.queryLimit, 0, false)
+	search.SortBy([]string{"Entries.Name"})
+
+	records := make([]*Record, 0, h.queryLimit)
+	total, err := h.searchFunc(search, func(record *Record) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return records, total, nil
+}
+
+// FacetCount is the number of records having a term.
+type FacetCount struct {
+	Term  string `json:"term"`
+	Count int    `json:"count"`
+}
+
+// allRecords returns a query matching every indexed record. Match all queries can't be used: the
+// upside_down index only iterates the document ids below 0xff, so they miss the records whose hash
+// starts with it. Every record has a size, so a range over all the sizes matches them all.
+func allRecords() query.Query {
+	min := -math.MaxFloat64
+	all := bleve.NewNumericRangeQuery(&min, nil)
+	all.SetField("Size")
+	return all
+}
+
+// Authors returns the limit authors with the most records, in decreasing order.
+func (h *Handle) Authors(limit int) ([]FacetCount, error) {
+	search := bleve.NewSearchRequestOptions(allRecords(), 0, 0, false)
+	search.AddFacet("authors", bleve.NewFacetRequest("Entries.AuthorKeyword", limit))
+	results, err := h.index.Search(search)
+	if err != nil {
+		return nil, err
+	}
+
+	facet, ok := results.Facets["authors"]
+	if !ok {
+		return nil, nil
+	}
+	authors := make([]FacetCount, 0, len(facet.Terms))
+	for _, term := range facet.Terms {
+		authors = append(authors, FacetCount{Term: term.Term, Count: term.Count})
+	}
+	return authors, nil
+}
+
+// BadRecords returns how many query hits were skipped since the handle was opened because their
+// record could not be decoded.
+func (h *Handle) BadRecords() int64 {
+	return atomic.LoadInt64(&h.badRecords)
+}
+
+// RecordsByAppID returns the records with an entry for appID, which usually are the same
+// application fetched from different mirrors or in different versions.
+func (h *Handle) RecordsByAppID(appID string) ([]*Record, error) {
+	if appID == "" {
+		return nil, fmt.Errorf("empty app id")
+	}
+	query := bleve.NewTermQuery(appID)
+	query.SetField("Entries.AppID")
+	search := bleve.NewSearchRequestOptions(query, h.queryLimit, 0, false)
+	search.SortBy([]string{"-Date"})
+
+	var records []*Record
+	_, err := h.searchFunc(search, func(record *Record) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// GetRecord returns the record with hash. It returns ErrNotFound if there is none, including for
+// the keys of the other data in the database, which hash may come from users.
+func (h *Handle) GetRecord(hash []byte) (*Record, error) {
+	if isMetaKey(hash) {
+		return nil, ErrNotFound
+	}
+	rec := &Record{}
+	err := h.db.View(func(txn *badger.Txn) error {
+		return getGob(txn, hash, rec)
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Related returns up to limit records sharing the most categories, tags and authors with the
+// record with hash, which is left out. Records sharing more come first.
+func (h *Handle) Related(hash []byte, limit int) ([]*Record, error) {
+	rec, err := h.GetRecord(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	terms := relatedTerms(rec)
+	var should []query.Query
+	for c := range terms.categories {
+		q := bleve.NewMatchQuery(c)
+		q.SetField("Entries.Categories")
+		should = append(should, q)
+	}
+	for t := range terms.tags {
+		q := bleve.NewMatchQuery(t)
+		q.SetField("Tags")
+		should = append(should, q)
+	}
+	for a := range terms.authors {
+		q := bleve.NewTermQuery(a)
+		q.SetField("Entries.AuthorKeyword")
+		should = append(should, q)
+	}
+	if len(should) == 0 || limit <= 0 {
+		return nil, nil
+	}
+
+	related := bleve.NewBooleanQuery()
+	related.AddShould(should...)
+	related.SetMinShould(1)
+
+	// The index finds the candidates, which are then ranked by their exact overlap. The record
+	// itself is one of them, and is left out here: like match all queries, doc id queries miss the
+	// hashes starting with 0xff.
+	size := h.queryLimit
+	if limit > size {
+		size = limit
+	}
+	var records []*Record
+	var overlaps []int
+	_, err = h.searchFunc(bleve.NewSearchRequestOptions(related, size+1, 0, false), func(record *Record) error {
+		if bytes.Equal(record.Hash, hash) {
+			return nil
+		}
+		records = append(records, record)
+		overlaps = append(overlaps, terms.overlap(relatedTerms(record)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Stable(byOverlap{records, overlaps})
+	if len(records) > limit {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+// recordTerms are the categories, tags and authors of a record, as compared by Related.
+type recordTerms struct {
+	categories, tags, authors map[string]bool
+}
+
+func relatedTerms(rec *Record) recordTerms {
+	terms := recordTerms{map[string]bool{}, map[string]bool{}, map[string]bool{}}
+	for _, entry := range rec.Entries {
+		for _, c := range entry.Categories {
+			terms.categories[c] = true
+		}
+		if entry.Author != "" {
+			terms.authors[entry.Author] = true
+		}
+	}
+	for _, t := range rec.Tags {
+		terms.tags[t] = true
+	}
+	return terms
+}
+
+// overlap returns the number of terms shared by t and other.
+func (t recordTerms) overlap(other recordTerms) int {
+	return shared(t.categories, other.categories) + shared(t.tags, other.tags) +
+		shared(t.authors, other.authors)
+}
+
+// shared returns the number of terms in both a and b.
+func shared(a, b map[string]bool) int {
+	n := 0
+	for term := range a {
+		if b[term] {
+			n++
+		}
+	}
+	return n
+}
+
+// byOverlap sorts records by decreasing overlap.
+type byOverlap struct {
+	records  []*Record
+	overlaps []int
+}
+
+func (b byOverlap) Len() int           { return len(b.records) }
+func (b byOverlap) Less(i, j int) bool { return b.overlaps[i] > b.overlaps[j] }
+func (b byOverlap) Swap(i, j int) {
+	b.records[i], b.records[j] = b.records[j], b.records[i]
+	b.overlaps[i], b.overlaps[j] = b.overlaps[j], b.overlaps[i]
+}
+
+// searchFunc runs search and calls fn with each record found, returning the total number of hits.
+func (h *Handle) searchFunc(search *bleve.SearchRequest, fn func(*Record) error) (int, error) {
+	results, err := h.index.Search(search)
+	if err != nil {
+		return 0, err
+	}
+
+	recIds := make([][]byte, len(results.Hits))
+	for i, hit := range results.Hits {
+		recIds[i] = []byte(hit.ID)
+	}
+
+	err = h.db.View(func(txn *badger.Txn) error {
+		for _, id := range recIds {
+			item, err := txn.Get(id)
+			if err != nil {
+				if err == badger.ErrKeyNotFound {
+					// The record was deleted but not unindexed. It is skipped until
+					// ReconcileIndex removes it.
+					continue
+				}
+				return err
+			}
+			record := &Record{}
+			var decodeErr error
+			err = item.Value(func(data []byte) error {
+				buf := bytes.NewBuffer(data)
+				dec := gob.NewDecoder(buf)
+				decodeErr = dec.Decode(record)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			// A corrupt record shouldn't break every search that hits it.
+			if decodeErr != nil {
+				h.logger.Warn(fmt.Sprintf("Skipping record %x: %v", id, decodeErr))
+				atomic.AddInt64(&h.badRecords, 1)
+				continue
+			}
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(results.Total), nil
+}
+
+func (h *Handle) KnownURLs() ([]*URLFreshness, error) {
+	var urls []*URLFreshness
+	err := h.db.View(func(txn *badger.Txn) error {
+		prefix := []byte(urlPrefix)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			key := bytes.TrimPrefix(item.Key(), prefix)
+			opkurl, err := url.PathUnescape(string(key))
+			if err != nil {
+				return err
+			}
+			err = item.Value(func(data []byte) error {
+				fresh := &freshness{}
+				buf := bytes.NewBuffer(data)
+				dec := gob.NewDecoder(buf)
+				if err := dec.Decode(fresh); err != nil {
+					return err
+				}
+				urls = append(urls, &URLFreshness{
+					URL:           opkurl,
+					LastUpdate:    fresh.Date,
+					Etag:          fresh.Etag,
+					Headers:       fresh.Headers,
+					Title:         fresh.Title,
+					LastModified:  fresh.LastModified,
+					Conditional:   fresh.Conditional,
+					Size:          fresh.Size,
+					ContentLength: fresh.ContentLength,
+					Source:        fresh.Source,
+					MissingSince:  fresh.MissingSince,
+				})
+				return nil
+			})
+			if err != nil {
+				return nil
+			}
+
+			q := &QuarantinedURL{}
+			if err := getGob(txn, quarantineKey(opkurl), q); err == nil {
+				urls[len(urls)-1].QuarantineEtag = q.Etag
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+func (h *Handle) LastUpdated(opkurl string) (time.Time, string, error) {
+	if len(opkurl) == 0 {
+		return time.Time{}, "", fmt.Errorf("empty url")
+	}
+
+	var fresh *freshness
+	err := h.db.View(func(txn *badger.Txn) error {
 		var err error
 		fresh, err = h.lastUpdated(opkurl, txn)
 		return err
 	})
 	if err != nil {
-		return time.Time{}, "", err
+		return time.Time{}, "", err
+	}
+	if fresh == nil {
+		return time.Time{}, "", nil
+	}
+	return fresh.Date, fresh.Etag, nil
+}
+
+func (h *Handle) lastUpdated(opkurl string, txn *badger.Txn) (*freshness, error) {
+	key := urlKey(opkurl)
+	item, err := txn.Get(key)
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	fresh := &freshness{}
+	err = item.Value(func(data []byte) error {
+		buf := bytes.NewBuffer(data)
+		dec := gob.NewDecoder(buf)
+		return dec.Decode(fresh)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return fresh, nil
+}
+
+// SetRefuseDowngrades sets whether a url serving an older version of an entry than before keeps
+// its previous record. Either way the downgrade is logged and, when the record is replaced,
+// recorded in its DowngradedFrom field. It should be called before the handle is shared between
+// goroutines.
+func (h *Handle) SetRefuseDowngrades(refuse bool) {
+	h.refuseDowngrades = refuse
+}
+
+// SetLogger makes the handle write its messages to logger instead of the standard logger. It
+// should be called before the handle is shared between goroutines.
+func (h *Handle) SetLogger(logger opkcat.Logger) {
+	h.logger = logger
+}
+
+// PutRecord will insert a record into the database.
+// If the record already exist, it will be updated.
+func (h *Handle) UpdateRecord(rec *Record) error {
+	if len(rec.Hash) == 0 {
+		return fmt.Errorf("no valid hash for the record")
+	}
+
+	// We assume that if the hash exists then the record is valid.
+	stored := false
+	var moved []*Record
+	err := h.db.Update(func(txn *badger.Txn) error {
+		var err error
+		stored, moved, err = h.updateRecord(rec, txn)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if stored {
+		moved = append(moved, rec)
+	}
+	return h.indexRecords(moved)
+}
+
+func (h *Handle) MultiUpdateRecord(records []*Record) (int, error) {
+	// The records are indexed in the order they are written, so a record changed twice is
+	// indexed as it was last written.
+	var stored, written []*Record
+	err := h.db.Update(func(txn *badger.Txn) error {
+		for _, rec := range records {
+			if len(rec.Hash) == 0 {
+				return fmt.Errorf("No valid hash for %s", rec.URL)
+			}
+
+			ok, recMoved, err := h.updateRecord(rec, txn)
+			if err != nil {
+				return err
+			}
+			written = append(written, recMoved...)
+			if ok {
+				stored = append(stored, rec)
+				written = append(written, rec)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Nothing was committed.
+		return 0, err
+	}
+	return len(stored), h.indexRecords(written)
+}
+
+// indexRecords indexes records in a single batch. It must only be called after the records are
+// committed, otherwise a failed transaction would leave documents for records that don't exist.
+func (h *Handle) indexRecords(records []*Record) error {
+	defer h.changed()
+	batch := h.index.NewBatch()
+	for _, rec := range records {
+		if err := batch.Index(string(rec.Hash), rec); err != nil {
+			return err
+		}
+	}
+	return h.index.Batch(batch)
+}
+
+// unindex removes the record with hash from the index, once it is gone from the database.
+func (h *Handle) unindex(hash []byte) error {
+	defer h.changed()
+	return h.index.Delete(string(hash))
+}
+
+// Version returns a stamp that changes every time the records or the index change, so results
+// read from the catalog can be cached for as long as it stays the same.
+func (h *Handle) Version() int64 {
+	return atomic.LoadInt64(&h.version)
+}
+
+// changed moves the version forward. It must be called after a change is committed, so a version
+// read before the change is never paired with results read before it.
+func (h *Handle) changed() {
+	for {
+		prev := atomic.LoadInt64(&h.version)
+		next := time.Now().UnixNano()
+		if next <= prev {
+			next = prev + 1
+		}
+		if atomic.CompareAndSwapInt64(&h.version, prev, next) {
+			return
+		}
+	}
+}
+
+// reconcilePageSize is the number of index documents read per search by ReconcileIndex.
+const reconcilePageSize = 1000
+
+// ReconcileIndex makes the index match the records in the database, indexing the records missing
+// from it and deleting the documents without a record. Unlike rebuilding the index, it only
+// touches the differences, so it is cheap to run when only a few documents drifted.
+func (h *Handle) ReconcileIndex() (added, removed int, err error) {
+	indexed, err := h.indexedIDs()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var missing []*Record
+	err = h.ForEachRecord(func(record *Record) error {
+		id := string(record.Hash)
+		if indexed[id] {
+			delete(indexed, id)
+		} else {
+			missing = append(missing, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
 	}
-	if fresh == nil {
-		return time.Time{}, "", nil
+
+	// What is left in indexed has no record.
+	batch := h.index.NewBatch()
+	for id := range indexed {
+		batch.Delete(id)
 	}
-	return fresh.Date, fresh.Etag, nil
+	for _, record := range missing {
+		if err := batch.Index(string(record.Hash), record); err != nil {
+			return 0, 0, err
+		}
+	}
+	err = h.index.Batch(batch)
+	h.changed()
+	if err != nil {
+		return 0, 0, err
+	}
+	return len(missing), len(indexed), nil
 }
 
-func (h *Handle) lastUpdated(opkurl string, txn *badger.Txn) (*freshness, error) {
-	key := []byte("_url:" + url.PathEscape(opkurl))
-	item, err := txn.Get(key)
+// reindexBatchSize is the number of records Reindex indexes per batch.
+const reindexBatchSize = 500
+
+// Reindex rebuilds the index from the records in the database, with the current mapping. The new
+// index is built next to the current one, which is only replaced once the new one is complete. It
+// must not be called while the handle is shared between goroutines.
+func (h *Handle) Reindex() error {
+	if h.idxLocation == "" {
+		return fmt.Errorf("the index has no location to rebuild it in")
+	}
+
+	tmpLocation := h.idxLocation + ".reindex"
+	// A previous reindex may have been interrupted.
+	if err := os.RemoveAll(tmpLocation); err != nil {
+		return err
+	}
+	index, err := newIndex(tmpLocation, &h.idxOpts)
 	if err != nil {
-		if err == badger.ErrKeyNotFound {
-			return nil, nil
-		}
-		return nil, err
+		return err
 	}
-	fresh := &freshness{}
-	err = item.Value(func(data []byte) error {
-		buf := bytes.NewBuffer(data)
-		dec := gob.NewDecoder(buf)
-		return dec.Decode(fresh)
+
+	count := 0
+	batch := index.NewBatch()
+	err = h.ForEachRecord(func(record *Record) error {
+		if err := batch.Index(string(record.Hash), record); err != nil {
+			return err
+		}
+		count++
+		if batch.Size() < reindexBatchSize {
+			return nil
+		}
+		if err := index.Batch(batch); err != nil {
+			return err
+		}
+		batch.Reset()
+		return nil
 	})
+	if err == nil {
+		err = index.Batch(batch)
+	}
+	if cerr := index.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.RemoveAll(tmpLocation)
+		return err
+	}
+
+	// Swap the indexes, putting the old one back if the new one can't be opened.
+	oldLocation := h.idxLocation + ".old"
+	if err := os.RemoveAll(oldLocation); err != nil {
+		return err
+	}
+	if err := h.index.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(h.idxLocation, oldLocation); err != nil {
+		return h.reopenIndex(err)
+	}
+	if err := os.Rename(tmpLocation, h.idxLocation); err != nil {
+		os.Rename(oldLocation, h.idxLocation)
+		return h.reopenIndex(err)
+	}
+	if h.index, err = bleve.Open(h.idxLocation); err != nil {
+		os.RemoveAll(h.idxLocation)
+		os.Rename(oldLocation, h.idxLocation)
+		return h.reopenIndex(err)
+	}
+	h.changed()
+	h.logger.Info(fmt.Sprintf("Reindexed %d records.", count))
+	return os.RemoveAll(oldLocation)
+}
+
+// restorePendingWrites is the number of writes Restore keeps in flight.
+const restorePendingWrites = 256
+
+// Backup writes every entry of the database to w, in the badger backup format. It can run while
+// the database is in use, but only the process holding the database can call it, so the backup of
+// a running service is taken through the service itself. The index is not included, as Restore
+// rebuilds it.
+func (h *Handle) Backup(w io.Writer) error {
+	_, err := h.db.Backup(w, 0)
+	return err
+}
 
+// Restore loads the backup in r, written by Backup, into the database and rebuilds the index from
+// the result. Entries missing from the backup are kept, so it is meant for an empty database. An
+// index without a location to be rebuilt in is reconciled with the restored records instead.
+func (h *Handle) Restore(r io.Reader) error {
+	err := h.db.Load(r, restorePendingWrites)
+	h.changed()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return fresh, nil
+	if h.idxLocation == "" {
+		_, _, err := h.ReconcileIndex()
+		return err
+	}
+	return h.Reindex()
 }
 
-// PutRecord will insert a record into the database.
-// If the record already exist, it will be updated.
-func (h *Handle) UpdateRecord(rec *Record) error {
-	if len(rec.Hash) == 0 {
-		return fmt.Errorf("no valid hash for the record")
+// reopenIndex opens the index again after a failed Reindex closed it, and returns the error that
+// made it fail.
+func (h *Handle) reopenIndex(reindexErr error) error {
+	index, err := bleve.Open(h.idxLocation)
+	if err != nil {
+		return fmt.Errorf("%v; reopening the index: %v", reindexErr, err)
 	}
+	h.index = index
+	return reindexErr
+}
 
-	// We assume that if the hash exists then the record is valid.
-	return h.db.Update(func(txn *badger.Txn) error {
-		return h.updateRecord(rec, txn)
+// indexedIDs returns the ids of all the documents in the index.
+func (h *Handle) indexedIDs() (map[string]bool, error) {
+	ids := map[string]bool{}
+	for from := 0; ; from += reconcilePageSize {
+		search := bleve.NewSearchRequestOptions(allRecords(), reconcilePageSize, from, false)
+		search.SortBy([]string{"_id"})
+		results, err := h.index.Search(search)
+		if err != nil {
+			return nil, err
+		}
+		for _, hit := range results.Hits {
+			ids[hit.ID] = true
+		}
+		if len(results.Hits) < reconcilePageSize {
+			return ids, nil
+		}
+	}
+}
+
+// VerifyBlobs hashes the archived opk of every record in the blob store at blobDir and returns
+// the hex encoded hashes of the records whose opk no longer matches its hash. Records without an
+// archived opk are skipped.
+func (h *Handle) VerifyBlobs(blobDir string) (bad []string, err error) {
+	blobs, err := blob.New(blobDir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = h.ForEachRecord(func(record *Record) error {
+		f, err := blobs.Open(record.Hash)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		hash := sha256.New()
+		if _, err := io.Copy(hash, f); err != nil {
+			return err
+		}
+		if !bytes.Equal(hash.Sum(nil), record.Hash) {
+			bad = append(bad, hex.EncodeToString(record.Hash))
+		}
+		return nil
 	})
+	return bad, err
 }
 
-func (h *Handle) MultiUpdateRecord(records []*Record) (int, error) {
-	count := 0
-	err := h.db.Update(func(txn *badger.Txn) error {
-		for _, rec := range records {
-			if len(rec.Hash) == 0 {
-				return fmt.Errorf("No valid hash for %s", rec.URL)
+// Inconsistency is a disagreement between the freshness of a url and the record it points to,
+// reported by Verify.
+type Inconsistency struct {
+	URL     string `json:"url"`
+	Hash    string `json:"hash,omitempty"`
+	Problem string `json:"problem"`
+}
+
+// Verify cross-checks the freshness of every url with the record it points to and returns the
+// inconsistencies found: url keys that don't survive an escaping round-trip, freshness pointing to
+// a missing record, and records whose url doesn't point back to them. A record shared by several
+// urls serving the same content only has to agree with one of them.
+func (h *Handle) Verify() ([]*Inconsistency, error) {
+	var problems []*Inconsistency
+	err := h.db.View(func(txn *badger.Txn) error {
+		hashes := map[string][]byte{}
+		prefix := []byte(urlPrefix)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			key := string(bytes.TrimPrefix(item.Key(), prefix))
+			opkurl, err := url.PathUnescape(key)
+			if err != nil {
+				problems = append(problems, &Inconsistency{URL: key, Problem: "url key can't be unescaped"})
+				continue
+			}
+			if url.PathEscape(opkurl) != key {
+				problems = append(problems, &Inconsistency{
+					URL:     opkurl,
+					Problem: fmt.Sprintf("url key %q doesn't match the escaped url", key),
+				})
+			}
+
+			fresh := &freshness{}
+			err = item.Value(func(data []byte) error {
+				return gob.NewDecoder(bytes.NewReader(data)).Decode(fresh)
+			})
+			if err != nil {
+				return err
+			}
+			// Freshness written before it tracked hashes doesn't point to any record.
+			if len(fresh.Hash) > 0 {
+				hashes[opkurl] = fresh.Hash
 			}
+		}
 
-			if err := h.updateRecord(rec, txn); err != nil {
+		for opkurl, hash := range hashes {
+			rec := &Record{}
+			err := getGob(txn, hash, rec)
+			if err == badger.ErrKeyNotFound {
+				problems = append(problems, &Inconsistency{
+					URL:     opkurl,
+					Hash:    hex.EncodeToString(hash),
+					Problem: "record is missing",
+				})
+				continue
+			}
+			if err != nil {
 				return err
 			}
-			count++
+			if rec.URL != opkurl && !bytes.Equal(hashes[rec.URL], hash) {
+				problems = append(problems, &Inconsistency{
+					URL:     opkurl,
+					Hash:    hex.EncodeToString(hash),
+					Problem: fmt.Sprintf("record url %q doesn't point back to the record", rec.URL),
+				})
+			}
 		}
 		return nil
 	})
-	return count, err
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].URL < problems[j].URL })
+	return problems, nil
+}
+
+// IndexStats returns the internals of the full-text index: the number of documents, the number
+// of distinct terms of each field and the stats bleve keeps about the index, under "bleve".
+func (h *Handle) IndexStats() (map[string]interface{}, error) {
+	docs, err := h.index.DocCount()
+	if err != nil {
+		return nil, err
+	}
+	fields, err := h.index.Fields()
+	if err != nil {
+		return nil, err
+	}
+	terms := make(map[string]int, len(fields))
+	for _, field := range fields {
+		n, err := h.fieldTerms(field)
+		if err != nil {
+			return nil, err
+		}
+		terms[field] = n
+	}
+	return map[string]interface{}{
+		"doc_count":   docs,
+		"field_count": len(fields),
+		"field_terms": terms,
+		"bleve":       h.index.StatsMap(),
+	}, nil
+}
+
+// fieldTerms returns the number of distinct terms indexed for field.
+func (h *Handle) fieldTerms(field string) (int, error) {
+	dict, err := h.index.FieldDict(field)
+	if err != nil {
+		return 0, err
+	}
+	defer dict.Close()
+
+	n := 0
+	for {
+		entry, err := dict.Next()
+		if err != nil {
+			return 0, err
+		}
+		if entry == nil {
+			return n, nil
+		}
+		n++
+	}
 }
 
-func (h *Handle) updateRecord(rec *Record, txn *badger.Txn) error {
+// updateRecord stores rec and the freshness of its url. It reports whether rec was stored, which
+// it isn't when it downgrades the url and downgrades are refused. It also returns the record of the
+// previous content of the url when it changed to drop the url from its mirrors, which must be
+// indexed again once the transaction is committed.
+func (h *Handle) updateRecord(rec *Record, txn *badger.Txn) (bool, []*Record, error) {
+	fresh, err := h.lastUpdated(rec.URL, txn)
+	if err != nil {
+		return false, nil, err
+	}
+
+	// Compare the versions with the content previously fetched from the url. Records may come
+	// with DowngradedFrom already set, e.g. when imported, but it only holds for that comparison.
+	rec.DowngradedFrom = ""
+	var old *Record
+	var from string
+	if fresh != nil && len(fresh.Hash) > 0 && !bytes.Equal(fresh.Hash, rec.Hash) {
+		old = &Record{}
+		err := getGob(txn, fresh.Hash, old)
+		if err == nil {
+			from = h.downgradedFrom(rec, old)
+			rec.DowngradedFrom = from
+		} else if err == badger.ErrKeyNotFound {
+			old = nil
+		} else {
+			return false, nil, err
+		}
+	}
+	if from != "" {
+		h.logger.Warn(rec.URL+": downgrade from version", from)
+		if h.refuseDowngrades {
+			// Keep the record, but remember the etag so the content isn't downloaded again.
+			fresh.Date = rec.Date
+			fresh.Etag = rec.Etag
+			fresh.LastModified = rec.LastModified
+			fresh.Conditional = rec.Conditional
+			fresh.Size = rec.Size
+			fresh.ContentLength = rec.ContentLength
+			return false, nil, setGob(txn, urlKey(rec.URL), fresh)
+		}
+	}
+
+	// The previous content of the url stays with its other mirrors, if it has any.
+	var moved []*Record
+	if old != nil {
+		mirrored, err := dropMirror(rec.URL, old, fresh.Hash, txn)
+		if err != nil {
+			return false, nil, err
+		}
+		if mirrored != nil {
+			moved = append(moved, mirrored)
+		}
+	}
+
+	// Keep the curated fields of the record being replaced, which is either the same content or
+	// the previous content fetched from the same url. The same content may be served by mirrors,
+	// which the record keeps along with the mirrors it comes with, e.g. when imported.
+	mirrors := addMirror(append([]string(nil), rec.Mirrors()...), rec.URL)
+	prev := &Record{}
+	err = getGob(txn, rec.Hash, prev)
+	if err == nil {
+		rec.URLs = prev.Mirrors()
+	} else {
+		rec.URLs = nil
+		if err == badger.ErrKeyNotFound && fresh != nil && len(fresh.Hash) > 0 {
+			err = getGob(txn, fresh.Hash, prev)
+		}
+	}
+	for _, u := range mirrors {
+		rec.URLs = addMirror(rec.URLs, u)
+	}
+	if err == nil {
+		rec.carryForward(prev)
+	} else if err != badger.ErrKeyNotFound {
+		return false, nil, err
+	}
+
 	var eBuf bytes.Buffer
 	enc := gob.NewEncoder(&eBuf)
 	if err := enc.Encode(rec); err != nil {
-		return err
+		return false, nil, err
 	}
 	if err := txn.Set(rec.Hash, eBuf.Bytes()); err != nil {
-		return err
+		return false, nil, err
 	}
 
+	updated := &freshness{
+		Date:          rec.Date,
+		Etag:          rec.Etag,
+		Hash:          rec.Hash,
+		LastModified:  rec.LastModified,
+		Conditional:   rec.Conditional,
+		Size:          rec.Size,
+		ContentLength: rec.ContentLength,
+	}
+	if fresh != nil {
+		updated.Headers = fresh.Headers
+		updated.Title = fresh.Title
+		updated.Source = fresh.Source
+		updated.MissingSince = fresh.MissingSince
+	}
 	var fBuf bytes.Buffer
 	fEnc := gob.NewEncoder(&fBuf)
-	if err := fEnc.Encode(&freshness{Date: rec.Date, Etag: rec.Etag}); err != nil {
-		return err
+	if err := fEnc.Encode(updated); err != nil {
+		return false, nil, err
 	}
-	if err := txn.Set([]byte("_url:"+url.PathEscape(rec.URL)), fBuf.Bytes()); err != nil {
-		return err
+	return true, moved, txn.Set(urlKey(rec.URL), fBuf.Bytes())
+}
+
+// recordExists reports whether there is a record stored exactly at hash. A key that only starts
+// with hash, like a longer hash or a url key, doesn't count.
+func (h *Handle) recordExists(hash []byte, txn *badger.Txn) (bool, error) {
+	if len(hash) == 0 || isMetaKey(hash) {
+		return false, nil
+	}
+	// Record exists if key exists, no need to read the value.
+	_, err := txn.Get(hash)
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ForEachRecord calls fn with every record in the database. If fn returns an error, the iteration
+// stops and returns that error.
+func (h *Handle) ForEachRecord(fn func(*Record) error) error {
+	return h.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if isMetaKey(item.Key()) {
+				continue
+			}
+			record := &Record{}
+			err := item.Value(func(data []byte) error {
+				return gob.NewDecoder(bytes.NewReader(data)).Decode(record)
+			})
+			if err != nil {
+				return err
+			}
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DuplicateNames returns the records sharing an entry name with other records, grouped by name.
+// Names are compared ignoring case and surrounding spaces, and each group is keyed by the name as
+// it appears in its first record. Only names shared by more than one record are returned.
+func (h *Handle) DuplicateNames() (map[string][]*Record, error) {
+	names := map[string]string{}
+	groups := map[string][]*Record{}
+	err := h.ForEachRecord(func(record *Record) error {
+		seen := map[string]bool{}
+		for _, entry := range record.Entries {
+			key := strings.ToLower(strings.TrimSpace(entry.Name))
+			if key == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			if _, ok := names[key]; !ok {
+				names[key] = entry.Name
+			}
+			groups[key] = append(groups[key], record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dups := map[string][]*Record{}
+	for key, records := range groups {
+		if len(records) > 1 {
+			dups[names[key]] = records
+		}
 	}
+	return dups, nil
+}
 
-	// Now index the record.
-	return h.index.Index(string(rec.Hash), rec)
+// SizeBucket counts the records with a size up to MaxSize bytes. A zero MaxSize means no limit.
+type SizeBucket struct {
+	MaxSize int64 `json:"max_size"`
+	Count   int   `json:"count"`
 }
 
-func (h *Handle) recordExists(hash []byte, txn *badger.Txn) bool {
-	// Record exists if key exists, no need to read the value.
-	opts := badger.DefaultIteratorOptions
-	opts.PrefetchValues = false
+// CatalogStats is an overview of the records in the catalog.
+type CatalogStats struct {
+	Packages    int            `json:"packages"`
+	TotalSize   int64          `json:"total_size"`
+	UnknownSize int            `json:"unknown_size"`
+	SizeBuckets []SizeBucket   `json:"size_buckets"`
+	Categories  map[string]int `json:"categories"`
+	Platforms   map[string]int `json:"platforms"`
+}
+
+// sizeBucketLimits are the upper limits of the size buckets in CatalogStats.
+var sizeBucketLimits = []int64{1 << 20, 10 << 20, 50 << 20, 100 << 20, 500 << 20, 0}
+
+// Stats computes the catalog stats in a single pass over the records. Categories and platforms are
+// counted once per record, even when several of its entries share them.
+func (h *Handle) Stats() (CatalogStats, error) {
+	stats := CatalogStats{
+		SizeBuckets: make([]SizeBucket, len(sizeBucketLimits)),
+		Categories:  map[string]int{},
+		Platforms:   map[string]int{},
+	}
+	for i, limit := range sizeBucketLimits {
+		stats.SizeBuckets[i].MaxSize = limit
+	}
+
+	err := h.ForEachRecord(func(record *Record) error {
+		stats.Packages++
+		stats.TotalSize += record.Size
+
+		// Records fetched before sizes were tracked don't fit any bucket.
+		if record.Size == 0 {
+			stats.UnknownSize++
+		} else {
+			for i := range stats.SizeBuckets {
+				bucket := &stats.SizeBuckets[i]
+				if bucket.MaxSize == 0 || record.Size <= bucket.MaxSize {
+					bucket.Count++
+					break
+				}
+			}
+		}
+
+		categories := map[string]bool{}
+		platforms := map[string]bool{}
+		for _, entry := range record.Entries {
+			for _, c := range entry.Categories {
+				categories[c] = true
+			}
+			if entry.Platform != "" {
+				platforms[entry.Platform] = true
+			}
+		}
+		for c := range categories {
+			stats.Categories[c]++
+		}
+		for p := range platforms {
+			stats.Platforms[p]++
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// SetLastFetchTime records when the fetcher last wrote to the catalog.
+func (h *Handle) SetLastFetchTime(t time.Time) error {
+	return h.db.Update(func(txn *badger.Txn) error {
+		return setGob(txn, lastFetchKey, t)
+	})
+}
+
+// LastFetchTime returns when the fetcher last wrote to the catalog. It returns the zero time if
+// it never did.
+func (h *Handle) LastFetchTime() (time.Time, error) {
+	var t time.Time
+	err := h.db.View(func(txn *badger.Txn) error {
+		if err := getGob(txn, lastFetchKey, &t); err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		return nil
+	})
+	return t, err
+}
+
+// SetRating sets the curated content rating and languages of the record with hash.
+func (h *Handle) SetRating(hash []byte, rating string, languages []string) error {
+	return h.curate(hash, func(rec *Record) {
+		rec.Rating = rating
+		rec.Languages = languages
+	})
+}
 
-	itr := txn.NewIterator(opts)
-	defer itr.Close()
+// SetDeprecated marks the record with hash as deprecated or not. SupersededBy is the hash or url
+// of the record replacing it, and is cleared when the record is no longer deprecated.
+func (h *Handle) SetDeprecated(hash []byte, deprecated bool, supersededBy string) error {
+	if !deprecated {
+		supersededBy = ""
+	}
+	return h.curate(hash, func(rec *Record) {
+		rec.Deprecated = deprecated
+		rec.SupersededBy = supersededBy
+	})
+}
 
-	// Go straight to our expected key.
-	itr.Seek(hash)
-	return itr.ValidForPrefix(hash)
+// curate applies fn to the record with hash, then stores and re-indexes it.
+func (h *Handle) curate(hash []byte, fn func(*Record)) error {
+	rec := &Record{}
+	err := h.db.Update(func(txn *badger.Txn) error {
+		if ok, err := h.recordExists(hash, txn); err != nil {
+			return err
+		} else if !ok {
+			return ErrNotFound
+		}
+		if err := getGob(txn, hash, rec); err != nil {
+			return err
+		}
+		fn(rec)
+		return setGob(txn, hash, rec)
+	})
+	if err != nil {
+		return err
+	}
+	return h.indexRecords([]*Record{rec})
 }
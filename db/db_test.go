@@ -0,0 +1,73 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package db
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newHandle returns a database with an index in a temporary directory, and a function closing
+// and removing it.
+func newHandle(t testing.TB, opts ...Option) (*Handle, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := Prod(filepath.Join(dir, "db"), filepath.Join(dir, "index"), opts...)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return h, func() {
+		h.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// testRecord returns a record of an opk named name served at opkurl. The hash depends on both, so
+// records of different names or urls don't share it.
+func testRecord(opkurl, name string) *Record {
+	sum := sha256.Sum256([]byte(opkurl + "\x00" + name))
+	return &Record{
+		URL:  opkurl,
+		Hash: sum[:],
+		Date: time.Now().UTC(),
+		Size: 1024,
+		Entries: []*Entry{{
+			Name:       name,
+			Type:       "Application",
+			Categories: []string{"games"},
+		}},
+	}
+}
+
+// names returns the names of the primary entries of records.
+func names(records []*Record) []string {
+	var names []string
+	for _, rec := range records {
+		names = append(names, rec.Primary().Name)
+	}
+	return names
+}
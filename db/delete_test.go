@@ -0,0 +1,177 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package db
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// knownURLs returns the sorted urls known to h.
+func knownURLs(t *testing.T, h *Handle) []string {
+	t.Helper()
+	known, err := h.KnownURLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var urls []string
+	for _, u := range known {
+		urls = append(urls, u.URL)
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+func TestDeleteByURLPrefix(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+
+	records := []*Record{
+		testRecord("http://mirror1.example.com/doom.opk", "Doom"),
+		testRecord("http://mirror1.example.com/games/quake.opk", "Quake"),
+		testRecord("http://mirror1.example.com.evil/heretic.opk", "Heretic"),
+		testRecord("http://mirror2.example.com/hexen.opk", "Hexen"),
+	}
+	for _, rec := range records {
+		if err := h.IndexURL(rec.URL); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.UpdateRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := h.DeleteByURLPrefix("http://mirror1.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("got %d urls removed, want 2", removed)
+	}
+	want := []string{"http://mirror1.example.com.evil/heretic.opk", "http://mirror2.example.com/hexen.opk"}
+	if got := knownURLs(t, h); !reflect.DeepEqual(got, want) {
+		t.Errorf("got urls %v, want %v", got, want)
+	}
+	// The records are gone from the database and the index.
+	for _, rec := range records[:2] {
+		if _, err := h.GetRecord(rec.Hash); err != ErrNotFound {
+			t.Errorf("%s: got error %v, want ErrNotFound", rec.URL, err)
+		}
+	}
+	found, _, err := h.Query("doom quake heretic hexen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(found); !reflect.DeepEqual(got, []string{"Heretic", "Hexen"}) {
+		t.Errorf("got records %v, want [Heretic Hexen]", got)
+	}
+}
+
+func TestDeleteByURLPrefixKeepsMirrored(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+
+	// The same content served by both hosts.
+	doom := testRecord("http://mirror1.example.com/doom.opk", "Doom")
+	mirrored := *doom
+	mirrored.URL = "http://mirror2.example.com/doom.opk"
+	for _, rec := range []*Record{doom, &mirrored} {
+		if err := h.IndexURL(rec.URL); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := h.MultiUpdateRecord([]*Record{rec}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec, err := h.GetRecord(doom.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Mirrors()) != 2 {
+		t.Fatalf("got mirrors %v, want both urls", rec.Mirrors())
+	}
+
+	if _, err := h.DeleteByURLPrefix("http://mirror1.example.com/"); err != nil {
+		t.Fatal(err)
+	}
+	rec, err = h.GetRecord(doom.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{mirrored.URL}; !reflect.DeepEqual(rec.Mirrors(), want) {
+		t.Errorf("got mirrors %v, want %v", rec.Mirrors(), want)
+	}
+}
+
+func TestExpireFailing(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+
+	abandoned := testRecord("http://example.com/abandoned.opk", "Abandoned")
+	flaky := testRecord("http://example.com/flaky.opk", "Flaky")
+	legacy := testRecord("http://example.com/legacy.opk", "Legacy")
+	healthy := testRecord("http://example.com/healthy.opk", "Healthy")
+	healthy.Date = time.Now().UTC().AddDate(0, -1, 0)
+	for _, rec := range []*Record{abandoned, flaky, legacy, healthy} {
+		if err := h.UpdateRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now().UTC()
+	err := h.db.Update(func(txn *badger.Txn) error {
+		// Failing for ten days, last checked an hour ago.
+		fail := &failure{Err: "404", Date: now.Add(-time.Hour), Count: 10, Since: now.AddDate(0, 0, -10)}
+		if err := setGob(txn, errKey(abandoned.URL), fail); err != nil {
+			return err
+		}
+		// Failures recorded before Since was tracked.
+		return setGob(txn, errKey(legacy.URL), &failure{Err: "404", Date: now.AddDate(0, 0, -10), Count: 10})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.RecordFailure(flaky.URL, errors.New("timeout")); err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := h.ExpireFailing(7 * 24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{abandoned.URL}; !reflect.DeepEqual(expired, want) {
+		t.Errorf("got expired urls %v, want %v", expired, want)
+	}
+	if want := []string{flaky.URL, healthy.URL, legacy.URL}; !reflect.DeepEqual(knownURLs(t, h), want) {
+		t.Errorf("got urls %v, want %v", knownURLs(t, h), want)
+	}
+	if _, err := h.GetRecord(abandoned.Hash); err != ErrNotFound {
+		t.Errorf("got error %v for the expired record, want ErrNotFound", err)
+	}
+	for _, rec := range []*Record{flaky, legacy, healthy} {
+		if _, err := h.GetRecord(rec.Hash); err != nil {
+			t.Errorf("%s: %v", rec.URL, err)
+		}
+	}
+}
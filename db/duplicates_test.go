@@ -0,0 +1,53 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package db
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestDuplicateNames(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+	first := testRecord("http://example.com/doom.opk", "Doom")
+	second := testRecord("http://other.example.com/prboom.opk", "Doom")
+	quake := testRecord("http://example.com/quake.opk", "Quake")
+	for _, rec := range []*Record{first, second, quake} {
+		if err := h.UpdateRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dups, err := h.DuplicateNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dups) != 1 {
+		t.Fatalf("got %d groups, want only the Doom one", len(dups))
+	}
+	var urls []string
+	for _, rec := range dups["Doom"] {
+		urls = append(urls, rec.URL)
+	}
+	sort.Strings(urls)
+	if len(urls) != 2 || urls[0] != first.URL || urls[1] != second.URL {
+		t.Errorf("got Doom records %v, want both urls", urls)
+	}
+}
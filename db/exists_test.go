@@ -0,0 +1,91 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package db
+
+import (
+	"testing"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+func TestRecordExists(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+
+	doom := testRecord("http://example.com/doom.opk", "Doom")
+	if err := h.UpdateRecord(doom); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  []byte
+		want bool
+	}{
+		{"stored hash", doom.Hash, true},
+		{"prefix of the stored hash", doom.Hash[:16], false},
+		{"stored hash as a prefix", append(append([]byte{}, doom.Hash...), 0x00), false},
+		{"prefix of a url key", urlKey(doom.URL)[:len(urlPrefix)+4], false},
+		{"url key", urlKey(doom.URL), false},
+		{"empty hash", nil, false},
+	}
+	err := h.db.View(func(txn *badger.Txn) error {
+		for _, test := range tests {
+			got, err := h.recordExists(test.key, txn)
+			if err != nil {
+				return err
+			}
+			if got != test.want {
+				t.Errorf("%s: got %t, want %t", test.name, got, test.want)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Curating by a prefix of a stored hash doesn't touch the stored record.
+	if err := h.SetRating(doom.Hash[:16], "PEGI 18", nil); err != ErrNotFound {
+		t.Errorf("got error %v curating a prefix of a hash, want ErrNotFound", err)
+	}
+}
+
+func TestUpdateRecordPrefixHash(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+
+	// A new record whose hash is a prefix of a stored one is still stored.
+	doom := testRecord("http://example.com/doom.opk", "Doom")
+	if err := h.UpdateRecord(doom); err != nil {
+		t.Fatal(err)
+	}
+	short := testRecord("http://example.com/short.opk", "Short")
+	short.Hash = append([]byte{}, doom.Hash[:16]...)
+	if _, err := h.MultiUpdateRecord([]*Record{short}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := h.GetRecord(short.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Primary().Name != "Short" {
+		t.Errorf("got record %q for the prefix hash, want Short", got.Primary().Name)
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gobMagic starts every ExportGob stream.
+const gobMagic = "opkcat-gob-1\n"
+
+// maxGobFrame is the largest record ImportGob accepts, so a corrupted length can't make it
+// allocate an absurd amount of memory.
+const maxGobFrame = 256 << 20
+
+// importBatchSize is the number of records stored per transaction by ImportGob.
+const importBatchSize = 100
+
+// ExportGob writes every record to w as gob, for ImportGob on another instance. Each record is a
+// frame prefixed by its length, and the stream ends with an empty frame, so a truncated stream is
+// detected instead of being imported partially without notice.
+func (h *Handle) ExportGob(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(gobMagic); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	var size [4]byte
+	err := h.ForEachRecord(func(record *Record) error {
+		// Every frame has its own encoder, so frames decode independently.
+		buf.Reset()
+		if err := gob.NewEncoder(&buf).Encode(record); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(size[:], uint32(buf.Len()))
+		if _, err := bw.Write(size[:]); err != nil {
+			return err
+		}
+		_, err := bw.Write(buf.Bytes())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	binary.BigEndian.PutUint32(size[:], 0)
+	if _, err := bw.Write(size[:]); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ImportGob stores and indexes the records written by ExportGob to r, as if they were fetched. It
+// returns io.ErrUnexpectedEOF if the stream ends before the final frame. Records are stored in
+// batches, and the batches stored before an error are kept.
+func (h *Handle) ImportGob(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(gobMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != gobMagic {
+		return fmt.Errorf("not an opkcat gob export")
+	}
+
+	var batch []*Record
+	flush := func() error {
+		_, err := h.MultiUpdateRecord(batch)
+		batch = batch[:0]
+		return err
+	}
+
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(br, size[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n == 0 {
+			return flush()
+		}
+		if n > maxGobFrame {
+			return fmt.Errorf("record frame of %d bytes is larger than the maximum of %d", n, maxGobFrame)
+		}
+
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(br, frame); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		record := &Record{}
+		if err := gob.NewDecoder(bytes.NewReader(frame)).Decode(record); err != nil {
+			return err
+		}
+
+		batch = append(batch, record)
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// csvHeader are the columns written by ExportCSV.
+var csvHeader = []string{"url", "hash", "name", "description", "categories", "size", "date", "version"}
+
+// ExportCSV writes records to w as CSV, for review in a spreadsheet. Each entry is a row, and
+// binary data like icons is left out. Categories are separated by semicolons.
+func (h *Handle) ExportCSV(w io.Writer, records []*Record) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, record := range records {
+		for _, entry := range record.Entries {
+			err := cw.Write([]string{
+				record.URL,
+				hex.EncodeToString(record.Hash),
+				entry.Name,
+				entry.Description,
+				strings.Join(entry.Categories, ";"),
+				strconv.FormatInt(record.Size, 10),
+				record.Date.UTC().Format(time.RFC3339),
+				entry.Version,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
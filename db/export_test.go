@@ -0,0 +1,199 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package db
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+func TestExportGob(t *testing.T) {
+	src, closeSrc := newHandle(t)
+	defer closeSrc()
+	var records []*Record
+	for i := 0; i < importBatchSize+2; i++ {
+		rec := testRecord(fmt.Sprintf("http://example.com/%d.opk", i), fmt.Sprintf("Game %d", i))
+		// Icons are binary data of any byte.
+		rec.Entries[0].Icon = []byte{0x89, 'P', 'N', 'G', 0, 0xff, byte(i)}
+		rec.Entries[0].IconFormat = "png"
+		records = append(records, rec)
+	}
+	if _, err := src.MultiUpdateRecord(records); err != nil {
+		t.Fatal(err)
+	}
+	var export bytes.Buffer
+	if err := src.ExportGob(&export); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, closeDst := newHandle(t)
+	defer closeDst()
+	if err := dst.ImportGob(bytes.NewReader(export.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		want, err := src.GetRecord(rec.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := dst.GetRecord(rec.Hash)
+		if err != nil {
+			t.Fatalf("imported %s: %v", rec.URL, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got imported record %+v, want %+v", got, want)
+		}
+		if !bytes.Equal(got.Entries[0].Icon, rec.Entries[0].Icon) {
+			t.Errorf("got icon %x for %s, want %x", got.Entries[0].Icon, rec.URL, rec.Entries[0].Icon)
+		}
+	}
+	// The imported records are indexed and their urls known.
+	if _, total, err := dst.Query("game"); err != nil || total != len(records) {
+		t.Errorf("got %d hits and error %v searching the import, want %d", total, err, len(records))
+	}
+	if known, err := dst.KnownURLs(); err != nil || len(known) != len(records) {
+		t.Errorf("got %d known urls and error %v, want %d", len(known), err, len(records))
+	}
+}
+
+func TestImportGobDowngrade(t *testing.T) {
+	src, closeSrc := newHandle(t)
+	defer closeSrc()
+	const opkurl, mirror = "http://example.com/doom.opk", "http://mirror.example.com/doom.opk"
+	older := versionRecord(opkurl, "1.0")
+	older.DowngradedFrom = "2.0"
+	older.URLs = []string{mirror, opkurl}
+	if err := src.db.Update(func(txn *badger.Txn) error {
+		return setGob(txn, older.Hash, older)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var export bytes.Buffer
+	if err := src.ExportGob(&export); err != nil {
+		t.Fatal(err)
+	}
+
+	// Whether the url is new or holds an older version, the import is no downgrade.
+	for _, prev := range []*Record{nil, versionRecord(opkurl, "0.5")} {
+		dst, closeDst := newHandle(t)
+		defer closeDst()
+		dst.SetRefuseDowngrades(true)
+		if prev != nil {
+			if err := dst.UpdateRecord(prev); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := dst.ImportGob(bytes.NewReader(export.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(storedHash(t, dst, opkurl), older.Hash) {
+			t.Errorf("got the import refused over %v, want it stored", prev)
+		}
+		got, err := dst.GetRecord(older.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.DowngradedFrom != "" {
+			t.Errorf("got the import downgraded from %q, want no downgrade", got.DowngradedFrom)
+		}
+		if want := []string{mirror, opkurl}; !reflect.DeepEqual(got.URLs, want) {
+			t.Errorf("got mirrors %v, want %v", got.URLs, want)
+		}
+	}
+}
+
+func TestImportGobTruncated(t *testing.T) {
+	src, closeSrc := newHandle(t)
+	defer closeSrc()
+	if err := src.UpdateRecord(testRecord("http://example.com/game.opk", "Game")); err != nil {
+		t.Fatal(err)
+	}
+	var export bytes.Buffer
+	if err := src.ExportGob(&export); err != nil {
+		t.Fatal(err)
+	}
+	data := export.Bytes()
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		// Without the final empty frame.
+		{"end", data[:len(data)-4]},
+		{"record", data[:len(data)-10]},
+		{"length", data[:len(gobMagic)+2]},
+	}
+	for _, test := range tests {
+		dst, closeDst := newHandle(t)
+		err := dst.ImportGob(bytes.NewReader(test.data))
+		closeDst()
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("truncated %s: got error %v, want %v", test.name, err, io.ErrUnexpectedEOF)
+		}
+	}
+
+	dst, closeDst := newHandle(t)
+	defer closeDst()
+	if err := dst.ImportGob(bytes.NewReader(data[1:])); err == nil {
+		t.Error("got no error importing a stream without the header")
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+
+	doom := testRecord("http://example.com/doom.opk", "Doom")
+	doom.Date = time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	doom.Size = 2048
+	doom.Entries[0].Description = `The "classic", with a comma`
+	doom.Entries[0].Categories = []string{"Game", "Shooter"}
+	doom.Entries[0].Version = "1.10"
+	doom.Entries[0].Icon = []byte("\x89PNG")
+	doom.Entries = append(doom.Entries, &Entry{Name: "Doom Setup", Description: "Two\nlines"})
+
+	var out bytes.Buffer
+	if err := h.ExportCSV(&out, []*Record{doom}); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(bytes.NewReader(out.Bytes())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := hex.EncodeToString(doom.Hash)
+	want := [][]string{
+		{"url", "hash", "name", "description", "categories", "size", "date", "version"},
+		{doom.URL, hash, "Doom", `The "classic", with a comma`, "Game;Shooter", "2048", "2020-06-01T12:00:00Z", "1.10"},
+		{doom.URL, hash, "Doom Setup", "Two\nlines", "", "2048", "2020-06-01T12:00:00Z", ""},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("got rows %q, want %q", rows, want)
+	}
+	if bytes.Contains(out.Bytes(), []byte("PNG")) {
+		t.Error("got the icon in the export")
+	}
+}
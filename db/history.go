@@ -0,0 +1,129 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// DefaultFetchHistory is the number of fetch cycles kept by AddFetchStats unless changed with
+// SetFetchHistory.
+const DefaultFetchHistory = 100
+
+// FetchStats describes a fetch cycle, for the audit history.
+type FetchStats struct {
+	Start       time.Time `json:"start"`
+	Duration    float64   `json:"duration_seconds"`
+	URLs        int       `json:"urls"`
+	Updated     int       `json:"updated"`
+	UpToDate    int       `json:"up_to_date"`
+	Failed      int       `json:"failed"`
+	Quarantined int       `json:"quarantined"`
+	Skipped     int       `json:"skipped"`
+
+	// NewURLs are the urls fetched for the first time, and PrunedURLs the urls removed for
+	// failing too long.
+	NewURLs    []string `json:"new_urls,omitempty"`
+	PrunedURLs []string `json:"pruned_urls,omitempty"`
+
+	// Error is the error that ended the cycle, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// fetchLogKey returns the history key of a cycle started at start. Keys sort by start time.
+func fetchLogKey(start time.Time) []byte {
+	key := make([]byte, len(fetchLogPrefix)+8)
+	copy(key, fetchLogPrefix)
+	binary.BigEndian.PutUint64(key[len(fetchLogPrefix):], uint64(start.UnixNano()))
+	return key
+}
+
+// SetFetchHistory changes the number of fetch cycles kept by AddFetchStats. Values not greater
+// than zero restore DefaultFetchHistory.
+func (h *Handle) SetFetchHistory(cycles int) {
+	if cycles <= 0 {
+		cycles = DefaultFetchHistory
+	}
+	h.fetchHistory = cycles
+}
+
+// AddFetchStats adds stats to the fetch history, dropping the oldest cycles beyond the size of the
+// history.
+func (h *Handle) AddFetchStats(stats *FetchStats) error {
+	return h.db.Update(func(txn *badger.Txn) error {
+		if err := setGob(txn, fetchLogKey(stats.Start), stats); err != nil {
+			return err
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		// Reverse iteration starts at the largest key with the prefix.
+		prefix := []byte(fetchLogPrefix)
+		kept := 0
+		var drop [][]byte
+		for it.Seek(append(prefix, 0xff)); it.ValidForPrefix(prefix); it.Next() {
+			kept++
+			if kept > h.fetchHistory {
+				drop = append(drop, it.Item().KeyCopy(nil))
+			}
+		}
+		for _, key := range drop {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// FetchHistory returns up to limit fetch cycles, most recent first.
+func (h *Handle) FetchHistory(limit int) ([]*FetchStats, error) {
+	var history []*FetchStats
+	err := h.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := []byte(fetchLogPrefix)
+		for it.Seek(append(prefix, 0xff)); it.ValidForPrefix(prefix) && len(history) < limit; it.Next() {
+			stats := &FetchStats{}
+			err := it.Item().Value(func(data []byte) error {
+				return gob.NewDecoder(bytes.NewReader(data)).Decode(stats)
+			})
+			if err != nil {
+				return err
+			}
+			history = append(history, stats)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFetchHistory(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+	h.SetFetchHistory(3)
+
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		stats := &FetchStats{Start: start.Add(time.Duration(i) * time.Hour), URLs: i, NewURLs: []string{"http://example.com/doom.opk"}}
+		if err := h.AddFetchStats(stats); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		limit int
+		want  []int
+	}{
+		// Only the last 3 cycles are kept, most recent first.
+		{10, []int{4, 3, 2}},
+		{2, []int{4, 3}},
+		{0, nil},
+	}
+	for _, test := range tests {
+		history, err := h.FetchHistory(test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		for _, stats := range history {
+			got = append(got, stats.URLs)
+			if want := start.Add(time.Duration(stats.URLs) * time.Hour); !stats.Start.Equal(want) || len(stats.NewURLs) != 1 {
+				t.Errorf("got stats %+v, want the cycle started at %v", stats, want)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("limit %d: got cycles %v, want %v", test.limit, got, test.want)
+		}
+	}
+
+	// The history isn't taken for records.
+	if err := h.ForEachRecord(func(rec *Record) error {
+		t.Errorf("got record %+v from the history", rec)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
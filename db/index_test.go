@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIndexType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbLocation, idxLocation := filepath.Join(dir, "db"), filepath.Join(dir, "index")
+
+	// Unsafe batches are persisted in the background, so they could be lost by closing the index
+	// right after the updates.
+	h, err := Prod(dbLocation, idxLocation,
+		WithIndexType("scorch", "scorch"), WithKVConfig(map[string]interface{}{"unsafe_batch": false}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Doom", "Quake"} {
+		if err := h.UpdateRecord(testRecord("http://example.com/"+name+".opk", name)); err != nil {
+			h.Close()
+			t.Fatal(err)
+		}
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The index keeps its type when opened again without options.
+	h, err = Prod(dbLocation, idxLocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	records, _, err := h.Query("quake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(records); !reflect.DeepEqual(got, []string{"Quake"}) {
+		t.Errorf("got records %v, want [Quake]", got)
+	}
+}
+
+func TestIndexTypeWithoutStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h, err := Prod(filepath.Join(dir, "db"), filepath.Join(dir, "index"), WithIndexType("scorch", ""))
+	if err == nil {
+		h.Close()
+		t.Fatal("got no error for an index type without a key/value store")
+	}
+}
+
+func TestIndexMapping(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+	rec := testRecord("http://example.com/doom.opk", "Doom")
+	rec.Etag = "etagvalue"
+	rec.Entries[0].Exec = "doomexec"
+	rec.Entries[0].Icon = []byte{0x89, 'P', 'N', 'G'}
+	rec.Entries[0].LocalizedNames = map[string]string{"pt_BR": "Condenação"}
+	if err := h.UpdateRecord(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fields without a mapping aren't searchable.
+	for _, qry := range []string{"etagvalue", "doomexec"} {
+		if _, total, err := h.Query(qry); err != nil || total != 0 {
+			t.Errorf("got %d hits and error %v searching %s, want none", total, err, qry)
+		}
+	}
+	for _, qry := range []string{"doom", "condenação"} {
+		if _, total, err := h.Query(qry); err != nil || total != 1 {
+			t.Errorf("got %d hits and error %v searching %s, want 1", total, err, qry)
+		}
+	}
+
+	fields, err := h.index.Fields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexed := map[string]bool{}
+	for _, field := range fields {
+		indexed[field] = true
+	}
+	for _, field := range []string{"Etag", "Hash", "Entries.Exec", "Entries.Icon", "Screenshots", "LastModified"} {
+		if indexed[field] {
+			t.Errorf("got field %s indexed, want it left out", field)
+		}
+	}
+	for _, field := range []string{"Entries.Name", "Entries.LocalizedNames.pt_BR", "Size", "Date"} {
+		if !indexed[field] {
+			t.Errorf("got field %s left out of the index, want it indexed", field)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProdInvalidLocations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, db, idx string
+	}{
+		{"empty database location", "", filepath.Join(dir, "index")},
+		{"empty index location", filepath.Join(dir, "db"), ""},
+		{"same location", filepath.Join(dir, "data"), filepath.Join(dir, "data")},
+		{"index in the database", filepath.Join(dir, "db"), filepath.Join(dir, "db", "index")},
+		{"database in the index", filepath.Join(dir, "index", "db"), filepath.Join(dir, "index")},
+		{"missing database parent", filepath.Join(dir, "missing", "db"), filepath.Join(dir, "index")},
+		{"missing index parent", filepath.Join(dir, "db"), filepath.Join(dir, "missing", "index")},
+		{"database parent is a file", filepath.Join(file, "db"), filepath.Join(dir, "index")},
+		{"index parent is a file", filepath.Join(dir, "db"), filepath.Join(file, "index")},
+	}
+	for _, test := range tests {
+		h, err := Prod(test.db, test.idx)
+		if err == nil {
+			h.Close()
+			t.Errorf("%s: got no error", test.name)
+		}
+	}
+	// Nothing was created by the failed attempts.
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d entries in %s, want only the file", len(entries), dir)
+	}
+}
+
+func TestProdSeparateLocations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, sub := range []string{"data", "search"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h, err := Prod(filepath.Join(dir, "data", "db"), filepath.Join(dir, "search", "index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.UpdateRecord(testRecord("http://example.com/doom.opk", "Doom")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "search", "index")); err != nil {
+		t.Errorf("the index was not created in its location: %v", err)
+	}
+}
+
+func TestInMemoryQueries(t *testing.T) {
+	h, err := Test()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.UpdateRecord(testRecord("http://example.com/doom.opk", "Doom")); err != nil {
+		t.Fatal(err)
+	}
+	records, _, err := h.Query("doom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(records); !reflect.DeepEqual(got, []string{"Doom"}) {
+		t.Errorf("got records %v, want [Doom]", got)
+	}
+}
@@ -0,0 +1,363 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package db
+
+import (
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+func TestQueryLimit(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+	h.SetQueryLimit(3)
+
+	for i := 0; i < 5; i++ {
+		rec := testRecord(fmt.Sprintf("http://example.com/doom%d.opk", i), fmt.Sprintf("Doom %d", i))
+		if err := h.UpdateRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, total, err := h.Query("doom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Errorf("got %d records, want the limit of 3", len(records))
+	}
+	if total != 5 {
+		t.Errorf("got a total of %d, want all 5 matches", total)
+	}
+
+	// The matches past the limit are reached by paging.
+	records, total, err = h.QueryPaged("doom", 3, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || total != 5 {
+		t.Errorf("got %d records of %d from the second page, want 2 of 5", len(records), total)
+	}
+}
+
+func TestRecordsByAppID(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+
+	now := time.Now().UTC()
+	old := testRecord("http://mirror1.example.com/doom.opk", "Doom")
+	old.Date = now.Add(-time.Hour)
+	recent := testRecord("http://mirror2.example.com/doom.opk", "Doom")
+	recent.Date = now
+	other := testRecord("http://example.com/quake.opk", "Quake")
+	old.Entries[0].AppID = "com.example.Doom"
+	recent.Entries[0].AppID = "com.example.Doom"
+	other.Entries[0].AppID = "com.example.Quake"
+	for _, rec := range []*Record{old, recent, other} {
+		if err := h.UpdateRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := h.RecordsByAppID("com.example.Doom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var urls []string
+	for _, rec := range records {
+		urls = append(urls, rec.URL)
+	}
+	// The newest version comes first.
+	if want := []string{recent.URL, old.URL}; !reflect.DeepEqual(urls, want) {
+		t.Errorf("got records %v, want %v", urls, want)
+	}
+}
+
+func TestQuerySkipsCorruptRecords(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+
+	doom := testRecord("http://example.com/doom.opk", "Doom")
+	doom2 := testRecord("http://example.com/doom2.opk", "Doom II")
+	for _, rec := range []*Record{doom, doom2} {
+		if err := h.UpdateRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := h.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(doom.Hash, []byte("not a gob"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, _, err := h.Query("doom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(records); !reflect.DeepEqual(got, []string{"Doom II"}) {
+		t.Errorf("got records %v, want only the one that decodes", got)
+	}
+	if got := h.BadRecords(); got != 1 {
+		t.Errorf("got %d bad records, want 1", got)
+	}
+}
+
+func TestQueryByAuthor(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+
+	authors := map[string]string{"Doom": "John Carmack", "Quake": "John Carmack", "Heretic": "Raven Software"}
+	for name, author := range authors {
+		rec := testRecord("http://example.com/"+name+".opk", name)
+		rec.Entries[0].Author = author
+		// Hashes starting with 0xff are missed by match all queries.
+		rec.Hash[0] = 0xff
+		if err := h.UpdateRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, total, err := h.QueryByAuthor("John Carmack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(records); total != 2 || !reflect.DeepEqual(got, []string{"Doom", "Quake"}) {
+		t.Errorf("got records %v of %d, want [Doom Quake]", got, total)
+	}
+	// Only whole names match exactly, but the author is searchable as text.
+	if records, _, err = h.QueryByAuthor("Carmack"); err != nil || len(records) != 0 {
+		t.Errorf("got records %v and error %v for part of the name, want none", names(records), err)
+	}
+	if records, _, err = h.Query("raven"); err != nil || !reflect.DeepEqual(names(records), []string{"Heretic"}) {
+		t.Errorf("got records %v and error %v searching the author, want [Heretic]", names(records), err)
+	}
+
+	counts, err := h.Authors(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FacetCount{{Term: "John Carmack", Count: 2}, {Term: "Raven Software", Count: 1}}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("got authors %v, want %v", counts, want)
+	}
+}
+
+func TestQueryExcludeNeedsDownload(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+
+	offline := testRecord("http://example.com/doom.opk", "Doom")
+	online := testRecord("http://example.com/doom-shareware.opk", "Doom Shareware")
+	online.Entries[0].NeedsDownload = true
+	for _, rec := range []*Record{offline, online} {
+		if err := h.UpdateRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, total, err := h.Query("doom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 {
+		t.Errorf("got %d hits without the filter, want 2", total)
+	}
+	records, total, err = h.Query("doom", ExcludeNeedsDownload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(records); total != 1 || !reflect.DeepEqual(got, []string{"Doom"}) {
+		t.Errorf("got records %v of %d, want only [Doom]", got, total)
+	}
+	if got, err := h.GetRecord(online.Hash); err != nil || !got.Entries[0].NeedsDownload {
+		t.Errorf("got NeedsDownload unset and error %v for the stored record", err)
+	}
+}
+
+func TestQueryMatchPhrase(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+
+	for _, name := range []string{"Super Mario War", "Mario Kart Super Circuit"} {
+		if err := h.UpdateRecord(testRecord("http://example.com/"+name+".opk", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, _, err := h.Query("super mario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Errorf("got records %v, want both records with the words", names(records))
+	}
+	records, _, err = h.Query("super mario", MatchPhrase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(records); !reflect.DeepEqual(got, []string{"Super Mario War"}) {
+		t.Errorf("got records %v for the phrase, want only [Super Mario War]", got)
+	}
+}
+
+func TestQueryRecencyBoost(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+
+	// Both records match the query equally, and the older one sorts first by name.
+	old := testRecord("http://example.com/alpha-doom.opk", "Alpha Doom")
+	old.Date = time.Now().UTC().AddDate(-2, 0, 0)
+	recent := testRecord("http://example.com/zeta-doom.opk", "Zeta Doom")
+	recent.Date = time.Now().UTC().AddDate(0, 0, -1)
+	for _, rec := range []*Record{old, recent} {
+		if err := h.UpdateRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, _, err := h.Query("doom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(records), []string{"Alpha Doom", "Zeta Doom"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got records %v without the boost, want %v", got, want)
+	}
+	h.SetRecencyBoost(1)
+	records, total, err := h.Query("doom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(records), []string{"Zeta Doom", "Alpha Doom"}; total != 2 || !reflect.DeepEqual(got, want) {
+		t.Errorf("got records %v of %d with the boost, want %v", got, total, want)
+	}
+}
+
+func TestQueryChangedSince(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+
+	now := time.Now().UTC()
+	var records []*Record
+	for i, name := range []string{"Old Doom", "Old Quake", "New Doom", "New Quake"} {
+		rec := testRecord("http://example.com/"+name+".opk", name)
+		if i < 2 {
+			rec.Date = now.AddDate(0, 0, -7)
+		}
+		records = append(records, rec)
+	}
+	// Hashes starting with 0xff are matched too.
+	records[3].Hash[0] = 0xff
+	if _, err := h.MultiUpdateRecord(records); err != nil {
+		t.Fatal(err)
+	}
+
+	since := ChangedSince(now.AddDate(0, 0, -1))
+	tests := []struct {
+		qry  string
+		want []string
+	}{
+		{"", []string{"New Doom", "New Quake"}},
+		{"doom", []string{"New Doom"}},
+	}
+	for _, test := range tests {
+		records, total, err := h.Query(test.qry, since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := names(records); total != len(test.want) || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got records %v of %d, want %v", test.qry, got, total, test.want)
+		}
+	}
+}
+
+func TestRelated(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+
+	record := func(name string, categories, tags []string, author string) *Record {
+		rec := testRecord("http://example.com/"+name+".opk", name)
+		rec.Entries[0].Categories = categories
+		rec.Entries[0].Author = author
+		rec.Tags = tags
+		if err := h.UpdateRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+	doom := record("Doom", []string{"Game", "Shooter"}, []string{"fps", "retro"}, "id Software")
+	record("Tetris", []string{"Game"}, nil, "")
+	record("Heretic", []string{"Game", "Shooter"}, []string{"fps"}, "Raven")
+	record("Quake", []string{"Game", "Shooter"}, []string{"fps"}, "id Software")
+	record("Editor", []string{"Development"}, []string{"tools"}, "")
+
+	tests := []struct {
+		limit int
+		want  []string
+	}{
+		{10, []string{"Quake", "Heretic", "Tetris"}},
+		{2, []string{"Quake", "Heretic"}},
+		{0, nil},
+	}
+	for _, test := range tests {
+		records, err := h.Related(doom.Hash, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := names(records); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("limit %d: got related records %v, want %v", test.limit, got, test.want)
+		}
+	}
+
+	if _, err := h.Related(make([]byte, 32), 10); err != ErrNotFound {
+		t.Errorf("got error %v for an unknown record, want ErrNotFound", err)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+
+	doom := testRecord("http://example.com/doom.opk", "Doom")
+	for _, rec := range []*Record{doom, testRecord("http://example.com/quake.opk", "Quake")} {
+		if err := h.UpdateRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hits, err := h.Explain("doom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 {
+		t.Fatalf("got %d hits, want 1", len(hits))
+	}
+	hit := hits[0]
+	if hit.Hash != hex.EncodeToString(doom.Hash) || hit.URL != doom.URL || hit.Name != "Doom" {
+		t.Errorf("got hit %+v, want the doom record", hit)
+	}
+	if hit.Explanation == nil || hit.Explanation.Value != hit.Score || hit.Explanation.Message == "" || len(hit.Explanation.Children) == 0 {
+		t.Errorf("got explanation %+v for score %v, want how the score was computed", hit.Explanation, hit.Score)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// listURLs returns n distinct opk urls.
+func listURLs(n int) []string {
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("https://example.com/opks/%05d.opk", i)
+	}
+	return urls
+}
+
+func TestReconcileSourceConcurrent(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+	h.SetWriteWorkers(4)
+
+	// More than one batch per worker, with every url listed twice.
+	urls := listURLs(5 * deleteBatchSize)
+	added, missing, err := h.ReconcileSource("list", append(urls, urls...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(added, urls) || len(missing) != 0 {
+		t.Fatalf("got %d added, %d missing, want %d added", len(added), len(missing), len(urls))
+	}
+
+	// Adding again is a no-op, and urls no longer listed are reported missing.
+	added, missing, err = h.ReconcileSource("list", urls[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 0 || !reflect.DeepEqual(missing, urls[:1]) {
+		t.Fatalf("got added %v, missing %v, want none added and %v missing", added, missing, urls[:1])
+	}
+	known, err := h.KnownURLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(known) != len(urls) {
+		t.Fatalf("got %d known urls, want %d", len(known), len(urls))
+	}
+}
+
+// benchmarkURLs is the size of the source list added by the benchmarks.
+const benchmarkURLs = 10000
+
+// BenchmarkAddSerial adds the source list one transaction per url, as it was added at startup
+// before ReconcileSource.
+func TestReconcileIndex(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+
+	// Hashes starting with 0xff are missed by match all queries.
+	var records []*Record
+	for _, name := range []string{"Doom", "Quake", "Heretic"} {
+		rec := testRecord("http://example.com/"+name+".opk", name)
+		rec.Hash[0] = 0xff
+		if err := h.UpdateRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+
+	// The index drifts both ways: a record loses its document and a document loses its record.
+	if err := h.index.Delete(string(records[0].Hash)); err != nil {
+		t.Fatal(err)
+	}
+	orphan := testRecord("http://example.com/hexen.opk", "Hexen")
+	orphan.Hash[0] = 0xff
+	if err := h.index.Index(string(orphan.Hash), orphan); err != nil {
+		t.Fatal(err)
+	}
+
+	added, removed, err := h.ReconcileIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 1 || removed != 1 {
+		t.Errorf("got %d added and %d removed documents, want 1 and 1", added, removed)
+	}
+	got, _, err := h.Query("doom hexen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names(got), []string{"Doom"}) {
+		t.Errorf("got records %v after reconciling, want [Doom]", names(got))
+	}
+	indexed, err := h.indexedIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		if !indexed[string(rec.Hash)] {
+			t.Errorf("%s: got no document after reconciling", rec.URL)
+		}
+	}
+	if len(indexed) != len(records) {
+		t.Errorf("got %d documents, want %d", len(indexed), len(records))
+	}
+
+	// Once reconciled, there is nothing left to fix.
+	if added, removed, err = h.ReconcileIndex(); err != nil || added != 0 || removed != 0 {
+		t.Errorf("got %d added, %d removed and error %v reconciling again, want nothing", added, removed, err)
+	}
+}
+
+func BenchmarkAddSerial(b *testing.B) {
+	urls := listURLs(benchmarkURLs)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		h, cleanup := newHandle(b)
+		b.StartTimer()
+		for _, u := range urls {
+			if err := h.IndexURL(u); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+		cleanup()
+	}
+}
+
+func BenchmarkAddBatched(b *testing.B) {
+	benchmarkReconcile(b, 1)
+}
+
+func BenchmarkAddConcurrent(b *testing.B) {
+	benchmarkReconcile(b, 4)
+}
+
+func benchmarkReconcile(b *testing.B, workers int) {
+	urls := listURLs(benchmarkURLs)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		h, cleanup := newHandle(b)
+		h.SetWriteWorkers(workers)
+		b.StartTimer()
+		if _, _, err := h.ReconcileSource("list", urls); err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		cleanup()
+	}
+}
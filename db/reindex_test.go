@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+)
+
+func TestReindex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbLocation, idxLocation := filepath.Join(dir, "db"), filepath.Join(dir, "index")
+
+	h, err := Prod(dbLocation, idxLocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Doom", "Quake"} {
+		if err := h.UpdateRecord(testRecord("http://example.com/"+name+".opk", name)); err != nil {
+			h.Close()
+			t.Fatal(err)
+		}
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The index is dropped, and replaced by an empty one, or by one built with the default mapping
+	// before the mapping was versioned.
+	replacements := map[string]func() error{
+		"dropped": func() error { return nil },
+		"stale": func() error {
+			index, err := bleve.New(idxLocation, bleve.NewIndexMapping())
+			if err != nil {
+				return err
+			}
+			return index.Close()
+		},
+	}
+	for name, replace := range replacements {
+		if err := os.RemoveAll(idxLocation); err != nil {
+			t.Fatal(err)
+		}
+		if err := replace(); err != nil {
+			t.Fatal(err)
+		}
+		h, err := Prod(dbLocation, idxLocation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, total, err := h.Query("doom"); err != nil || total != 0 {
+			h.Close()
+			t.Fatalf("%s: got %d hits and error %v before reindexing, want none", name, total, err)
+		}
+
+		if err := h.Reindex(); err != nil {
+			h.Close()
+			t.Fatal(err)
+		}
+		records, _, err := h.Query("doom quake")
+		if err != nil {
+			h.Close()
+			t.Fatal(err)
+		}
+		if got := names(records); !reflect.DeepEqual(got, []string{"Doom", "Quake"}) {
+			t.Errorf("%s: got records %v after reindexing, want [Doom Quake]", name, got)
+		}
+		if version, err := indexMappingVersion(h.index); err != nil || version != mappingVersion {
+			t.Errorf("%s: got mapping version %d and error %v, want %d", name, version, err, mappingVersion)
+		}
+		if err := h.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the reindexed index is left.
+	for _, suffix := range []string{".reindex", ".old"} {
+		if _, err := os.Stat(idxLocation + suffix); !os.IsNotExist(err) {
+			t.Errorf("got %s%s left behind, want it removed", idxLocation, suffix)
+		}
+	}
+}
+
+func TestReindexInMemory(t *testing.T) {
+	h, err := Test()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Reindex(); err == nil {
+		t.Error("got no error reindexing an index without a location")
+	}
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+
+	sizes := []int64{0, 512 << 10, 1 << 20, 5 << 20, 80 << 20, 2 << 30}
+	for i, size := range sizes {
+		rec := testRecord(fmt.Sprintf("http://example.com/%d.opk", i), fmt.Sprintf("App %d", i))
+		rec.Size = size
+		rec.Entries[0].Platform = "gcw0"
+		if i == 0 {
+			// Categories shared by several entries count once.
+			rec.Entries = append(rec.Entries, &Entry{Name: "Editor", Categories: []string{"games", "Development"}})
+		}
+		if err := h.UpdateRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := h.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Packages != len(sizes) || stats.UnknownSize != 1 {
+		t.Errorf("got %d packages, %d of unknown size, want %d and 1", stats.Packages, stats.UnknownSize, len(sizes))
+	}
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	if stats.TotalSize != total {
+		t.Errorf("got a total size of %d, want %d", stats.TotalSize, total)
+	}
+	var counts []int
+	for _, bucket := range stats.SizeBuckets {
+		counts = append(counts, bucket.Count)
+	}
+	// Up to 1MiB, 10MiB, 50MiB, 100MiB, 500MiB, and larger.
+	if want := []int{2, 1, 0, 1, 0, 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("got bucket counts %v, want %v", counts, want)
+	}
+	if want := map[string]int{"games": 6, "Development": 1}; !reflect.DeepEqual(stats.Categories, want) {
+		t.Errorf("got categories %v, want %v", stats.Categories, want)
+	}
+	if want := map[string]int{"gcw0": 6}; !reflect.DeepEqual(stats.Platforms, want) {
+		t.Errorf("got platforms %v, want %v", stats.Platforms, want)
+	}
+}
+
+func TestIndexStats(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+
+	var records []*Record
+	for i := 0; i < 3; i++ {
+		rec := testRecord(fmt.Sprintf("http://example.com/%d.opk", i), fmt.Sprintf("App %d", i))
+		if err := h.UpdateRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	if err := h.DeleteRecord(records[0].Hash); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := 0
+	if err := h.ForEachRecord(func(*Record) error { stored++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := h.IndexStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docs := stats["doc_count"]; docs != uint64(stored) || stored != 2 {
+		t.Errorf("got %v documents for %d stored records, want 2 of both", docs, stored)
+	}
+	terms, ok := stats["field_terms"].(map[string]int)
+	if !ok || terms["Entries.Name"] == 0 {
+		t.Errorf("got field terms %v, want the terms of the entry names", stats["field_terms"])
+	}
+	if fields, ok := stats["field_count"].(int); !ok || fields != len(terms) {
+		t.Errorf("got a field count of %v, want %d", stats["field_count"], len(terms))
+	}
+	if _, ok := stats["bleve"]; !ok {
+		t.Error("got no bleve stats")
+	}
+}
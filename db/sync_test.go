@@ -0,0 +1,72 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncSurvivesReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbDir, idxDir := filepath.Join(dir, "db"), filepath.Join(dir, "index")
+
+	h, err := Prod(dbDir, idxDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := testRecord("http://example.com/doom.opk", "Doom")
+	if err := h.UpdateRecord(rec); err != nil {
+		h.Close()
+		t.Fatal(err)
+	}
+	if err := h.Sync(); err != nil {
+		h.Close()
+		t.Fatal(err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err = Prod(dbDir, idxDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	got, err := h.GetRecord(rec.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.URL != rec.URL || got.Primary().Name != "Doom" {
+		t.Errorf("got record %s named %q, want the synced one", got.URL, got.Primary().Name)
+	}
+	records, _, err := h.Query("doom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Errorf("got %d hits after re-opening, want 1", len(records))
+	}
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package db
+
+import "testing"
+
+func TestMultiUpdateRecordFailure(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+
+	// The record without a hash fails the transaction after the first record was written to it,
+	// so nothing is committed.
+	doom := testRecord("http://example.com/doom.opk", "Doom")
+	broken := testRecord("http://example.com/broken.opk", "Broken")
+	broken.Hash = nil
+	if _, err := h.MultiUpdateRecord([]*Record{doom, broken}); err == nil {
+		t.Fatal("got no error for a record without a hash")
+	}
+
+	if _, err := h.GetRecord(doom.Hash); err != ErrNotFound {
+		t.Errorf("got error %v for the record of the failed transaction, want ErrNotFound", err)
+	}
+	count, err := h.index.DocCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("got %d documents in the index, want none", count)
+	}
+	records, total, err := h.Query("doom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 0 || len(records) != 0 {
+		t.Errorf("got %d hits for the record of the failed transaction, want none", total)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+func TestVerify(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+
+	doom := testRecord("http://example.com/doom.opk", "Doom")
+	quake := testRecord("http://example.com/quake.opk", "Quake")
+	for _, rec := range []*Record{doom, quake} {
+		if err := h.UpdateRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	problems, err := h.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("got problems %v in a consistent database, want none", problems)
+	}
+
+	missing := sha256.Sum256([]byte("missing"))
+	err = h.db.Update(func(txn *badger.Txn) error {
+		// A mirror serving the same content as doom agrees with it.
+		if err := setGob(txn, urlKey("http://mirror.example.com/doom.opk"), &freshness{Date: time.Now(), Hash: doom.Hash}); err != nil {
+			return err
+		}
+		// The quake record now claims another url, which points elsewhere.
+		quake.URL = "http://example.com/quake2.opk"
+		if err := setGob(txn, quake.Hash, quake); err != nil {
+			return err
+		}
+		if err := setGob(txn, urlKey("http://example.com/missing.opk"), &freshness{Hash: missing[:]}); err != nil {
+			return err
+		}
+		// Keys written without escaping the url.
+		if err := setGob(txn, []byte(urlPrefix+"http://example.com/doom 2.opk"), &freshness{Hash: doom.Hash}); err != nil {
+			return err
+		}
+		return setGob(txn, []byte(urlPrefix+"http:%zz"), &freshness{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err = h.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range problems {
+		got = append(got, fmt.Sprintf("%s %s: %s", p.URL, p.Hash, p.Problem))
+	}
+	want := []string{
+		"http:%zz : url key can't be unescaped",
+		`http://example.com/doom 2.opk : url key "http://example.com/doom 2.opk" doesn't match the escaped url`,
+		"http://example.com/missing.opk " + hex.EncodeToString(missing[:]) + ": record is missing",
+		"http://example.com/quake.opk " + hex.EncodeToString(quake.Hash) + `: record url "http://example.com/quake2.opk" doesn't point back to the record`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got problems\n%s\nwant\n%s", got, want)
+	}
+}
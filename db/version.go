@@ -0,0 +1,132 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// compareVersions compares the versions a and b, returning -1, 0 or 1 when a is older, the same
+// or newer than b. Versions are split into numeric and text parts, like "1.10.2-rc1", and parts
+// are compared in order, numerically when both are numbers. Versions that don't start with a
+// number can't be compared that way, so they are compared as strings and ok is false.
+func compareVersions(a, b string) (cmp int, ok bool) {
+	pa, oka := versionParts(a)
+	pb, okb := versionParts(b)
+	if !oka || !okb {
+		return strings.Compare(a, b), false
+	}
+
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		if c := comparePart(pa[i], pb[i]); c != 0 {
+			return c, true
+		}
+	}
+	// The longer version is newer, unless it continues with a pre-release tag: 1.0 > 1.0-rc1.
+	switch {
+	case len(pa) < len(pb):
+		return -comparePart(pb[len(pa)], ""), true
+	case len(pa) > len(pb):
+		return comparePart(pa[len(pb)], ""), true
+	}
+	return 0, true
+}
+
+// versionParts splits version into runs of digits and runs of letters, dropping separators and a
+// leading "v". It reports whether the version starts with a number.
+func versionParts(version string) ([]string, bool) {
+	version = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(version)), "v")
+	var parts []string
+	start := -1
+	digits := false
+	for i, r := range version {
+		isDigit := unicode.IsDigit(r)
+		isPart := isDigit || unicode.IsLetter(r)
+		if start >= 0 && (!isPart || isDigit != digits) {
+			parts = append(parts, version[start:i])
+			start = -1
+		}
+		if isPart && start < 0 {
+			start = i
+			digits = isDigit
+		}
+	}
+	if start >= 0 {
+		parts = append(parts, version[start:])
+	}
+	return parts, len(parts) > 0 && unicode.IsDigit(rune(parts[0][0]))
+}
+
+// comparePart compares version parts, numerically if both are numbers.
+func comparePart(a, b string) int {
+	na, erra := strconv.ParseUint(a, 10, 64)
+	nb, errb := strconv.ParseUint(b, 10, 64)
+	switch {
+	case erra == nil && errb == nil:
+		if na < nb {
+			return -1
+		} else if na > nb {
+			return 1
+		}
+		return 0
+	case erra == nil:
+		// A number is a newer release than a pre-release tag, like 1.0.1 > 1.0.rc1.
+		return 1
+	case errb == nil:
+		return -1
+	case a == "":
+		// Nothing is a newer release than a pre-release tag.
+		return 1
+	case b == "":
+		return -1
+	}
+	return strings.Compare(a, b)
+}
+
+// downgradedFrom returns the version of prev that rec downgrades, or an empty string. Entries are
+// matched by AppID, or by name when they have none.
+func (h *Handle) downgradedFrom(rec, prev *Record) string {
+	key := func(entry *Entry) string {
+		if entry.AppID != "" {
+			return "id:" + entry.AppID
+		}
+		return "name:" + entry.Name
+	}
+	old := map[string]string{}
+	for _, entry := range prev.Entries {
+		old[key(entry)] = entry.Version
+	}
+	for _, entry := range rec.Entries {
+		prevVersion := old[key(entry)]
+		if entry.Version == "" || prevVersion == "" {
+			continue
+		}
+		cmp, ok := compareVersions(entry.Version, prevVersion)
+		if !ok {
+			h.logger.Warn(fmt.Sprintf("%s: versions %q and %q compared as strings", rec.URL, entry.Version, prevVersion))
+		}
+		if cmp < 0 {
+			return prevVersion
+		}
+	}
+	return ""
+}
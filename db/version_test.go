@@ -0,0 +1,160 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		cmp  int
+		ok   bool
+	}{
+		{"1.0", "1.0", 0, true},
+		{"v1.0", "1.0", 0, true},
+		{"1.10", "1.9", 1, true},
+		{"1.9", "1.10", -1, true},
+		{"1.0.1", "1.0", 1, true},
+		{"1.0", "1.0-rc1", 1, true},
+		{"1.0-rc1", "1.0-rc2", -1, true},
+		{"1.0.1", "1.0.rc1", 1, true},
+		{"2020-12-01", "2020-11-30", 1, true},
+		{"beta", "alpha", 1, false},
+		{"alpha", "1.0", 1, false},
+	}
+	for _, test := range tests {
+		cmp, ok := compareVersions(test.a, test.b)
+		if cmp != test.cmp || ok != test.ok {
+			t.Errorf("compareVersions(%q, %q): got %d, %t, want %d, %t", test.a, test.b, cmp, ok, test.cmp, test.ok)
+		}
+	}
+}
+
+// versionRecord returns a record of version of Doom served at opkurl.
+func versionRecord(opkurl, version string) *Record {
+	rec := testRecord(opkurl, "Doom")
+	sum := sha256.Sum256([]byte(opkurl + "\x00" + version))
+	rec.Hash = sum[:]
+	rec.Etag = version
+	rec.Entries[0].Version = version
+	return rec
+}
+
+// storedHash returns the hash of the record stored for opkurl.
+func storedHash(t *testing.T, h *Handle, opkurl string) []byte {
+	t.Helper()
+	var hash []byte
+	err := h.db.View(func(txn *badger.Txn) error {
+		fresh, err := h.lastUpdated(opkurl, txn)
+		if fresh != nil {
+			hash = fresh.Hash
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestDowngrade(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+
+	const opkurl = "http://example.com/doom.opk"
+	for _, version := range []string{"1.2", "1.10"} {
+		rec := versionRecord(opkurl, version)
+		if err := h.UpdateRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.DowngradedFrom != "" {
+			t.Errorf("got version %s flagged as a downgrade from %s", version, rec.DowngradedFrom)
+		}
+	}
+
+	older := versionRecord(opkurl, "1.9")
+	if err := h.UpdateRecord(older); err != nil {
+		t.Fatal(err)
+	}
+	if older.DowngradedFrom != "1.10" {
+		t.Errorf("got downgraded from %q, want 1.10", older.DowngradedFrom)
+	}
+	stored, err := h.GetRecord(older.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.DowngradedFrom != "1.10" {
+		t.Errorf("got stored record downgraded from %q, want 1.10", stored.DowngradedFrom)
+	}
+	if !bytes.Equal(storedHash(t, h, opkurl), older.Hash) {
+		t.Error("got the downgrade not stored for the url")
+	}
+}
+
+func TestRefuseDowngrades(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+	h.SetRefuseDowngrades(true)
+
+	const opkurl = "http://example.com/doom.opk"
+	newer := versionRecord(opkurl, "2.0")
+	if err := h.UpdateRecord(newer); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.UpdateRecord(versionRecord(opkurl, "1.0")); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(storedHash(t, h, opkurl), newer.Hash) {
+		t.Error("got the downgrade stored for the url, want the newer record kept")
+	}
+	// The etag of the refused content is remembered so it isn't downloaded again.
+	if _, etag, err := h.LastUpdated(opkurl); err != nil || etag != "1.0" {
+		t.Errorf("got etag %q and error %v, want the etag of the refused content", etag, err)
+	}
+	if records, _, err := h.Query("doom"); err != nil || len(records) != 1 || records[0].Primary().Version != "2.0" {
+		t.Errorf("got records %v and error %v searching, want version 2.0", records, err)
+	}
+}
+
+func TestRefuseDowngradesPreset(t *testing.T) {
+	h, cleanup := newHandle(t)
+	defer cleanup()
+	h.SetRefuseDowngrades(true)
+
+	// Only the comparison with the previous content of the url refuses a record, not a
+	// DowngradedFrom set by the caller, whether the url is new or not.
+	const opkurl = "http://example.com/doom.opk"
+	for _, version := range []string{"1.0", "2.0"} {
+		rec := versionRecord(opkurl, version)
+		rec.DowngradedFrom = "3.0"
+		if err := h.UpdateRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(storedHash(t, h, opkurl), rec.Hash) {
+			t.Errorf("got version %s refused, want it stored", version)
+		}
+	}
+}
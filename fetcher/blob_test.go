@@ -0,0 +1,63 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/avalonbits/opkcat/blob"
+	"github.com/avalonbits/opkcat/fetcher"
+	"github.com/avalonbits/opkcat/fetcher/fetchertest"
+)
+
+func TestBlobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := blob.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opk := fakeOPK("Archived")
+	getter := fetchertest.NewFakeGetter()
+	getter.Set("http://example.com/archived.opk", &fetchertest.Response{Body: opk})
+	s, cleanup := newService(t, nil, getter, fetcher.WithBlobStore(store))
+	defer cleanup()
+
+	record, err := s.FromOPKURL("http://example.com/archived.opk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !store.Has(record.Hash) {
+		t.Fatalf("the opk was not archived under its hash %x", record.Hash)
+	}
+	archived, err := ioutil.ReadFile(store.Path(record.Hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(archived, opk) {
+		t.Errorf("got archived bytes %q, want the opk %q", archived, opk)
+	}
+}
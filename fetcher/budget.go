@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher
+
+import (
+	"context"
+	"sync"
+)
+
+// byteBudget limits the total size of the opks being downloaded and extracted at once, so a few
+// large opks can't exhaust the disk or memory of the server while small ones still go through.
+// A nil budget doesn't limit anything.
+type byteBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+
+	// freed is closed and replaced every time bytes are released, waking up the waiting acquires.
+	freed chan struct{}
+}
+
+func newByteBudget(limit int64) *byteBudget {
+	return &byteBudget{limit: limit, freed: make(chan struct{})}
+}
+
+// acquire waits until size bytes of the budget are free and takes them, returning the amount to
+// release. Sizes larger than the whole budget take all of it, so they proceed once nothing else is
+// running. Waiting requests don't hold back smaller ones that still fit in the budget. It fails
+// if ctx is done first.
+func (b *byteBudget) acquire(ctx context.Context, size int64) (int64, error) {
+	if b == nil || size <= 0 {
+		return 0, nil
+	}
+	if size > b.limit {
+		size = b.limit
+	}
+
+	for {
+		b.mu.Lock()
+		if b.used+size <= b.limit {
+			b.used += size
+			b.mu.Unlock()
+			return size, nil
+		}
+		freed := b.freed
+		b.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// grow replaces the taken bytes of a download that turned out to need size bytes, returning the
+// new amount to release. The taken bytes are released first, so two downloads growing at once
+// can't wait for each other. On error, nothing is held.
+func (b *byteBudget) grow(ctx context.Context, taken, size int64) (int64, error) {
+	if b == nil || size <= taken || taken >= b.limit {
+		return taken, nil
+	}
+	b.release(taken)
+	return b.acquire(ctx, size)
+}
+
+// release frees size bytes taken by acquire.
+func (b *byteBudget) release(size int64) {
+	if b == nil || size == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= size
+	close(b.freed)
+	b.freed = make(chan struct{})
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBudgetSmallNotBlockedByLarge(t *testing.T) {
+	b := newByteBudget(100)
+	ctx := context.Background()
+
+	large, err := b.acquire(ctx, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second large opk has to wait for the first one.
+	waiting := make(chan int64)
+	go func() {
+		taken, err := b.acquire(ctx, 80)
+		if err != nil {
+			t.Error(err)
+		}
+		waiting <- taken
+	}()
+
+	// Small ones still fit next to the first large one.
+	for i := 0; i < 5; i++ {
+		small, err := b.acquire(ctx, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.release(small)
+	}
+
+	select {
+	case <-waiting:
+		t.Fatal("large opk did not wait for the budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.release(large)
+	select {
+	case taken := <-waiting:
+		b.release(taken)
+	case <-time.After(time.Second):
+		t.Fatal("large opk still waiting after the budget was released")
+	}
+}
+
+func TestBudgetAcquireCancelled(t *testing.T) {
+	b := newByteBudget(100)
+	taken, err := b.acquire(context.Background(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taken != 100 {
+		t.Errorf("got %d bytes for an opk larger than the budget, want 100", taken)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := b.acquire(ctx, 10); err != context.DeadlineExceeded {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if b.used != 100 {
+		t.Errorf("a cancelled acquire left %d bytes used, want 100", b.used)
+	}
+}
+
+func TestBudgetGrow(t *testing.T) {
+	b := newByteBudget(100)
+	ctx := context.Background()
+
+	first, _ := b.acquire(ctx, 30)
+	second, _ := b.acquire(ctx, 30)
+
+	// Both grow at once: neither keeps its bytes while waiting for the other.
+	done := make(chan int64, 2)
+	for _, taken := range []int64{first, second} {
+		go func(taken int64) {
+			grown, err := b.grow(ctx, taken, 60)
+			if err != nil {
+				t.Error(err)
+			}
+			done <- grown
+			time.Sleep(10 * time.Millisecond)
+			b.release(grown)
+		}(taken)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case grown := <-done:
+			if grown != 60 {
+				t.Errorf("grew to %d bytes, want 60", grown)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("growing downloads are waiting for each other")
+		}
+	}
+}
+
+func TestNilBudget(t *testing.T) {
+	var b *byteBudget
+	taken, err := b.acquire(context.Background(), 1<<40)
+	if err != nil || taken != 0 {
+		t.Errorf("nil budget took %d bytes with error %v", taken, err)
+	}
+	b.release(taken)
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/avalonbits/opkcat/fetcher"
+	"github.com/avalonbits/opkcat/fetcher/fetchertest"
+)
+
+func TestCancelledFetchKeepsGathered(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	const (
+		fast = "http://example.com/fast.opk"
+		slow = "http://example.com/slow.opk"
+	)
+	getter := newStallingGetter(slow)
+	getter.Set(fast, &fetchertest.Response{Body: fakeOPK("Fast"), Etag: `"fast"`})
+
+	// The fetch is cancelled, as on SIGTERM, once the fast url is done and the slow one is being
+	// downloaded.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	progress := func(done, total int, url string) {
+		if url == fast {
+			<-getter.stalled
+			cancel()
+		}
+	}
+	s, cleanup := newService(t, storage, getter, fetcher.WithProgress(progress))
+	defer cleanup()
+	addURLs(t, s, fast, slow)
+
+	if err := s.Fetch(ctx); err != context.Canceled {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	records := storedRecords(t, storage)
+	if records[fast] == nil {
+		t.Error("the record gathered before the cancellation was not stored")
+	}
+	if records[slow] != nil {
+		t.Error("got a record for the url whose download was cancelled")
+	}
+	// The cancelled url is not counted as failing.
+	failing, err := storage.FailingURLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failing) != 0 {
+		t.Errorf("got failing urls %v, want none", failing)
+	}
+}
+
+func TestResumeForceFetch(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	const slow = "http://example.com/slow.opk"
+	// Opks without desktop entries are skipped, but processed all the same.
+	fast := []string{"http://example.com/doom.opk", "http://example.com/quake.opk", "http://example.com/empty.opk"}
+	stalling := newStallingGetter(slow)
+	getter := fetchertest.NewFakeGetter()
+	for _, g := range []*fetchertest.FakeGetter{stalling.FakeGetter, getter} {
+		g.Set(fast[0], &fetchertest.Response{Body: fakeOPK("Doom"), Etag: `"doom"`})
+		g.Set(fast[1], &fetchertest.Response{Body: fakeOPK("Quake"), Etag: `"quake"`})
+		g.Set(fast[2], &fetchertest.Response{Body: fakeImage(map[string]string{"README": "empty"}), Etag: `"empty"`})
+	}
+	getter.Set(slow, &fetchertest.Response{Body: fakeOPK("Slow"), Etag: `"slow"`})
+
+	// The forced fetch is interrupted once the fast urls are done and the slow one is being
+	// downloaded.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	progress := func(done, total int, url string) {
+		if done == len(fast) {
+			<-stalling.stalled
+			cancel()
+		}
+	}
+	s, cleanup := newService(t, storage, stalling, fetcher.WithProgress(progress))
+	defer cleanup()
+	addURLs(t, s, append(fast, slow)...)
+	if err := s.ForceFetch(ctx); err != context.Canceled {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	done, err := storage.RefetchedURLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != len(fast) || !done[fast[0]] || !done[fast[1]] || !done[fast[2]] {
+		t.Errorf("got processed urls %v, want %v", done, fast)
+	}
+
+	// The next forced fetch only does the slow url, and clears the progress once done.
+	s, cleanup = newService(t, storage, getter)
+	defer cleanup()
+	if err := s.ForceFetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range fast {
+		if got := len(getter.RequestsFor(url)); got != 0 {
+			t.Errorf("got %d requests for %s processed before the interruption, want none", got, url)
+		}
+	}
+	if got := len(getter.RequestsFor(slow)); got != 1 {
+		t.Errorf("got %d requests for %s, want 1", got, slow)
+	}
+	if records := storedRecords(t, storage); len(records) != 3 {
+		t.Errorf("got %d records, want 3", len(records))
+	}
+	if done, err := storage.RefetchedURLs(); err != nil || len(done) != 0 {
+		t.Errorf("got processed urls %v and error %v after completing, want none", done, err)
+	}
+
+	// So the following forced fetch starts over.
+	if err := s.ForceFetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for url, want := range map[string]int{fast[0]: 1, fast[1]: 1, fast[2]: 1, slow: 2} {
+		if got := len(getter.RequestsFor(url)); got != want {
+			t.Errorf("got %d requests for %s, want %d", got, url, want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// CategoryMap maps lower-cased category aliases to their canonical name.
+type CategoryMap map[string]string
+
+// defaultCategoryMap is used when no category map is configured.
+var defaultCategoryMap = CategoryMap{
+	"game":         "Game",
+	"games":        "Game",
+	"emulator":     "Emulator",
+	"emulators":    "Emulator",
+	"emulation":    "Emulator",
+	"application":  "Application",
+	"applications": "Application",
+	"apps":         "Application",
+	"utility":      "Utility",
+	"utilities":    "Utility",
+	"setting":      "Settings",
+	"settings":     "Settings",
+	"multimedia":   "AudioVideo",
+	"audiovideo":   "AudioVideo",
+	"audio":        "Audio",
+	"music":        "Audio",
+	"video":        "Video",
+	"graphics":     "Graphics",
+	"network":      "Network",
+	"development":  "Development",
+	"education":    "Education",
+	"office":       "Office",
+	"system":       "System",
+}
+
+// LoadCategoryMap reads a JSON object mapping aliases to canonical categories from path. Alias
+// keys are case insensitive.
+func LoadCategoryMap(path string) (CategoryMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var raw map[string]string
+	if err := json.NewDecoder(f).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	m := make(CategoryMap, len(raw))
+	for alias, canonical := range raw {
+		m[strings.ToLower(strings.TrimSpace(alias))] = strings.TrimSpace(canonical)
+	}
+	return m, nil
+}
+
+// Normalize canonicalizes categories, dropping empty and repeated values. Unknown categories are
+// kept as-is, only trimmed.
+func (m CategoryMap) Normalize(categories []string) []string {
+	seen := make(map[string]bool, len(categories))
+	normalized := make([]string, 0, len(categories))
+	for _, c := range categories {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if canonical, ok := m[strings.ToLower(c)]; ok {
+			c = canonical
+		}
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		normalized = append(normalized, c)
+	}
+	return normalized
+}
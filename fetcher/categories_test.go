@@ -0,0 +1,55 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeCategories(t *testing.T) {
+	got := defaultCategoryMap.Normalize([]string{"game", "Games", " Game ", "", "Puzzle"})
+	if want := []string{"Game", "Puzzle"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got categories %v, want %v", got, want)
+	}
+}
+
+func TestLoadCategoryMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "categories")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "categories.json")
+	if err := ioutil.WriteFile(path, []byte(`{" Emu ": "Emulator", "PORT": "Game"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := LoadCategoryMap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := m.Normalize([]string{"emu", "Port", "Emulator"})
+	if want := []string{"Emulator", "Game"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got categories %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/avalonbits/opkcat/fetcher"
+	"github.com/avalonbits/opkcat/fetcher/fetchertest"
+)
+
+func TestCooldown(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	const (
+		broken = "http://example.com/broken.opk"
+		period = 500 * time.Millisecond
+	)
+	getter := fetchertest.NewFakeGetter()
+	getter.Set(broken, &fetchertest.Response{Status: http.StatusInternalServerError})
+	s, cleanup := newService(t, storage, getter, fetcher.WithCooldown(2, period))
+	defer cleanup()
+	addURLs(t, s, broken)
+
+	fetch := func(want int) {
+		t.Helper()
+		if err := s.Fetch(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(getter.RequestsFor(broken)); got != want {
+			t.Errorf("got %d requests, want %d", got, want)
+		}
+	}
+	// The url is fetched until it fails twice, then skipped for the period.
+	fetch(1)
+	fetch(2)
+	start := time.Now()
+	fetch(2)
+
+	// Once the period has passed since the last failure, the url is fetched again.
+	time.Sleep(period - time.Since(start))
+	fetch(3)
+	// Failing again starts another cooldown, since the failures are still consecutive.
+	fetch(3)
+
+	// Forced fetches don't skip it.
+	if err := s.ForceFetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(getter.RequestsFor(broken)); got != 4 {
+		t.Errorf("got %d requests after a forced fetch, want 4", got)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/avalonbits/opkcat/fetcher"
+	"github.com/avalonbits/opkcat/fetcher/fetchertest"
+)
+
+// emptyOPK is an opk without desktop entries for the gcw0 or any other platform.
+var emptyOPK = fakeImage(map[string]string{
+	"super_mario.gcw0.png": "icon",
+	"README":               "no entries",
+})
+
+func TestEmptyOPKSkipped(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	const opkurl = "http://example.com/super_mario.opk"
+	getter := fetchertest.NewFakeGetter()
+	getter.Set(opkurl, &fetchertest.Response{Body: emptyOPK, Etag: `"v1"`})
+	var log bytes.Buffer
+	s, cleanup := newService(t, storage, getter, fetcher.WithJSONLog(&log))
+	defer cleanup()
+	addURLs(t, s, opkurl)
+
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if records := storedRecords(t, storage); len(records) != 0 {
+		t.Errorf("got %d records, want the opk without entries skipped", len(records))
+	}
+	if !strings.Contains(log.String(), "Skipped opk without desktop entries") {
+		t.Errorf("got log %s, want a warning about the skipped opk", log.String())
+	}
+	// It isn't failing, but it is quarantined until its content changes.
+	if failing, err := storage.FailingURLs(); err != nil || len(failing) != 0 {
+		t.Errorf("got failing urls %v and error %v, want none", failing, err)
+	}
+	quarantined, err := storage.QuarantinedURLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantined) != 1 || quarantined[0].Etag != `"v1"` {
+		t.Errorf("got quarantined urls %+v, want %s with its etag", quarantined, opkurl)
+	}
+}
+
+func TestEmptyOPKNamed(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	const opkurl = "http://example.com/super_mario.opk"
+	getter := fetchertest.NewFakeGetter()
+	getter.Set(opkurl, &fetchertest.Response{Body: emptyOPK})
+	s, cleanup := newService(t, storage, getter, fetcher.WithEmptyOPKPolicy(fetcher.NameEmptyOPKs))
+	defer cleanup()
+	addURLs(t, s, opkurl)
+
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	record := storedRecords(t, storage)[opkurl]
+	if record == nil {
+		t.Fatal("got no record for the opk without entries")
+	}
+	if len(record.Entries) != 1 || record.Entries[0].Name != "Super Mario" || record.Entries[0].Type != "Application" {
+		t.Errorf("got entries %+v, want a single application named after the file", record.Entries)
+	}
+	records, _, err := storage.Query("mario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Errorf("got %d records searching the derived name, want 1", len(records))
+	}
+}
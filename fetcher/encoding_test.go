@@ -0,0 +1,149 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/avalonbits/opkcat/fetcher"
+	"github.com/avalonbits/opkcat/fetcher/fetchertest"
+)
+
+// encode returns data compressed by the writer returned by newWriter.
+func encode(t *testing.T, data []byte, newWriter func(io.Writer) io.WriteCloser) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := newWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestEncodedOPK(t *testing.T) {
+	opk := fakeOPK("Encoded")
+	sum := sha256.Sum256(opk)
+
+	tests := []struct {
+		encoding  string
+		newWriter func(io.Writer) io.WriteCloser
+	}{
+		{"gzip", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+		{"x-gzip", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+		{"deflate", func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }},
+		{"deflate", func(w io.Writer) io.WriteCloser {
+			// Raw deflate, as sent by servers ignoring the zlib wrapping.
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		}},
+	}
+	for _, test := range tests {
+		body := encode(t, opk, test.newWriter)
+		getter := fetchertest.NewFakeGetter()
+		getter.Set("http://example.com/encoded.opk", &fetchertest.Response{
+			Header: http.Header{"Content-Encoding": []string{test.encoding}},
+			Body:   body,
+		})
+		s, cleanup := newService(t, nil, getter)
+		record, err := s.FromOPKURL("http://example.com/encoded.opk")
+		cleanup()
+		if err != nil {
+			t.Errorf("%s: %v", test.encoding, err)
+			continue
+		}
+
+		// The opk is hashed and extracted as the file itself.
+		if !bytes.Equal(record.Hash, sum[:]) {
+			t.Errorf("%s: got hash %x, want the hash of the decoded opk %x", test.encoding, record.Hash, sum)
+		}
+		if record.Size != int64(len(opk)) {
+			t.Errorf("%s: got size %d, want %d", test.encoding, record.Size, len(opk))
+		}
+		if record.ContentLength != int64(len(body)) {
+			t.Errorf("%s: got content length %d, want the encoded length %d", test.encoding, record.ContentLength, len(body))
+		}
+		if len(record.Entries) != 1 || record.Entries[0].Name != "Encoded" {
+			t.Errorf("%s: got entries %v, want the entry of the opk", test.encoding, record.Entries)
+		}
+	}
+}
+
+func TestUnsupportedEncoding(t *testing.T) {
+	getter := fetchertest.NewFakeGetter()
+	getter.Set("http://example.com/brotli.opk", &fetchertest.Response{
+		Header: http.Header{"Content-Encoding": []string{"br"}},
+		Body:   fakeOPK("Brotli"),
+	})
+	s, cleanup := newService(t, nil, getter)
+	defer cleanup()
+	if _, err := s.FromOPKURL("http://example.com/brotli.opk"); err == nil {
+		t.Error("got no error for an unsupported content encoding")
+	}
+}
+
+func TestHeadCheckEncodedOPK(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	const opkurl = "http://example.com/encoded.opk"
+	body := encode(t, fakeOPK("Encoded"), func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })
+	getter := fetchertest.NewFakeGetter()
+	getter.Set(opkurl, &fetchertest.Response{
+		Header:       http.Header{"Content-Encoding": []string{"gzip"}},
+		Body:         body,
+		LastModified: time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC),
+	})
+	s, cleanup := newService(t, storage, getter, fetcher.WithHeadCheck())
+	defer cleanup()
+	if err := s.Add(opkurl); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.Fetch(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The HEAD response has the length of the encoded opk, not its size, and it matches the
+	// download, so the second fetch doesn't send a GET.
+	if got := len(getter.RequestsFor(opkurl)); got != 1 {
+		t.Errorf("got %d downloads, want 1", got)
+	}
+	heads := 0
+	for _, req := range getter.Requests() {
+		if req.Method == http.MethodHead {
+			heads++
+		}
+	}
+	if heads != 1 {
+		t.Errorf("got %d HEAD requests, want 1", heads)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/avalonbits/opkcat/db"
+	"github.com/avalonbits/opkcat/fetcher"
+	"github.com/avalonbits/opkcat/fetcher/fetchertest"
+)
+
+func TestEntryExec(t *testing.T) {
+	path, remove := writeOPK(t, fakeImage(map[string]string{
+		"gambatte.gcw0.desktop": "[Desktop Entry]\nName=Gambatte\nType=Application\nExec=gambatte_sdl -f %f\n",
+	}))
+	defer remove()
+	s, cleanup := newService(t, nil, nil)
+	defer cleanup()
+
+	record, err := s.FromOPK(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record.Entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(record.Entries))
+	}
+	if got, want := record.Entries[0].Exec, "gambatte_sdl -f %f"; got != want {
+		t.Errorf("got Exec %q, want %q", got, want)
+	}
+}
+
+func TestEntryAuthor(t *testing.T) {
+	tests := []struct {
+		key  string
+		opts []fetcher.Option
+	}{
+		{fetcher.DefaultAuthorKey, nil},
+		{"X-Maintainer", []fetcher.Option{fetcher.WithAuthorKey("X-Maintainer")}},
+	}
+	for _, test := range tests {
+		path, remove := writeOPK(t, fakeImage(map[string]string{
+			"default.gcw0.desktop": desktopEntry("Doom", test.key+"= John Carmack \n"),
+		}))
+		s, cleanup := newService(t, nil, nil, test.opts...)
+		record, err := s.FromOPK(path)
+		cleanup()
+		remove()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := record.Entries[0].Author; got != "John Carmack" {
+			t.Errorf("%s: got author %q, want %q", test.key, got, "John Carmack")
+		}
+	}
+}
+
+func TestEntryNeedsDownload(t *testing.T) {
+	tests := []struct {
+		extra string
+		want  bool
+	}{
+		{"X-OD-NeedsDownload=true\n", true},
+		{"X-OD-NeedsDownload=false\n", false},
+		{"X-OD-NeedsDownload=sometimes\n", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		path, remove := writeOPK(t, fakeImage(map[string]string{
+			"default.gcw0.desktop": desktopEntry("Doom", test.extra),
+		}))
+		s, cleanup := newService(t, nil, nil)
+		record, err := s.FromOPK(path)
+		cleanup()
+		remove()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := record.Entries[0].NeedsDownload; got != test.want {
+			t.Errorf("%q: got NeedsDownload %t, want %t", test.extra, got, test.want)
+		}
+	}
+}
+
+func TestSourceTitle(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	const opkurl = "http://example.com/smw.opk"
+	getter := fetchertest.NewFakeGetter()
+	getter.Set(opkurl, &fetchertest.Response{Body: fakeOPK("smw")})
+	s, cleanup := newService(t, storage, getter)
+	defer cleanup()
+	addURLs(t, s, opkurl)
+	if err := storage.SetSourceTitle(opkurl, "Super Mario War"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	record := storedRecords(t, storage)[opkurl]
+	if record == nil || record.SourceTitle != "Super Mario War" {
+		t.Fatalf("got record %+v, want the source title of the url", record)
+	}
+
+	// A new title is set on the stored record right away.
+	if err := storage.SetSourceTitle(opkurl, "Super Mario War 1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedRecords(t, storage)[opkurl].SourceTitle; got != "Super Mario War 1.0" {
+		t.Errorf("got source title %q, want the new one", got)
+	}
+}
+
+func TestEntryOrder(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	// The files are listed in another order than the entries are sorted in.
+	files := map[string]string{
+		"a.gcw0.desktop": desktopEntry("Zeta Editor", ""),
+		"b.gcw0.desktop": "[Desktop Entry]\nName=Super Mario\nType=Application\nExec=smario\n",
+		"c.gcw0.desktop": desktopEntry("Super Mario", ""),
+		"d.gcw0.desktop": "[Desktop Entry]\nName=Alpha Manual\nType=Link\nURL=manual.html\n",
+	}
+	tests := []struct {
+		url     string
+		primary int
+	}{
+		// The entry named after the opk file.
+		{"http://example.com/super_mario.opk", 1},
+		// Or whose executable is.
+		{"http://example.com/smario.opk", 2},
+		// Else the first application.
+		{"http://example.com/pack.opk", 1},
+	}
+	getter := fetchertest.NewFakeGetter()
+	s, cleanup := newService(t, storage, getter)
+	defer cleanup()
+	for _, test := range tests {
+		// A readme keeps the content of the urls apart.
+		files["README"] = test.url
+		getter.Set(test.url, &fetchertest.Response{Body: fakeImage(files)})
+		addURLs(t, s, test.url)
+	}
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	records := storedRecords(t, storage)
+	for _, test := range tests {
+		record := records[test.url]
+		if record == nil {
+			t.Fatalf("got no record for %s", test.url)
+		}
+		var got []string
+		for _, entry := range record.Entries {
+			got = append(got, entry.Name+"/"+entry.Exec)
+		}
+		want := []string{"Alpha Manual/", "Super Mario/Super Mario", "Super Mario/smario", "Zeta Editor/Zeta Editor"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got entries %v, want %v", test.url, got, want)
+		}
+		if record.PrimaryEntry != test.primary {
+			t.Errorf("%s: got primary entry %d, want %d", test.url, record.PrimaryEntry, test.primary)
+		}
+	}
+}
+
+func TestEntryLocalized(t *testing.T) {
+	path, remove := writeOPK(t, fakeImage(map[string]string{
+		"default.gcw0.desktop": desktopEntry("Doom", "Comment=Hell on Mars\n"+
+			"Name[pt_BR]=Doom: Inferno\nComment[pt_BR]= Inferno em Marte \n"+
+			"Name[de]=\nName[]=Nameless\n"),
+	}))
+	defer remove()
+	s, cleanup := newService(t, nil, nil)
+	defer cleanup()
+
+	record, err := s.FromOPK(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := record.Entries[0]
+	if want := map[string]string{"pt_BR": "Doom: Inferno"}; !reflect.DeepEqual(entry.LocalizedNames, want) {
+		t.Errorf("got localized names %v, want %v", entry.LocalizedNames, want)
+	}
+	if want := map[string]string{"pt_BR": "Inferno em Marte"}; !reflect.DeepEqual(entry.LocalizedDescriptions, want) {
+		t.Errorf("got localized descriptions %v, want %v", entry.LocalizedDescriptions, want)
+	}
+	if entry.Name != "Doom" || entry.Description != "Hell on Mars" {
+		t.Errorf("got name %q and description %q, want the untranslated ones", entry.Name, entry.Description)
+	}
+}
+
+func TestEntryActions(t *testing.T) {
+	const sections = "\n[Desktop Action nightmare]\nName=Nightmare!\nExec=doom -skill 5\n" +
+		"\n[Desktop Action editor]\nName=Map Editor\nExec=doom-editor\n"
+	nightmare := &db.Action{ID: "nightmare", Name: "Nightmare!", Exec: "doom -skill 5"}
+	editor := &db.Action{ID: "editor", Name: "Map Editor", Exec: "doom-editor"}
+	tests := []struct {
+		extra string
+		want  []*db.Action
+	}{
+		// Listed actions follow the order of the Actions key, and those without a section are
+		// left out.
+		{"Actions=editor;missing;nightmare;\n" + sections, []*db.Action{editor, nightmare}},
+		{"Actions=nightmare\n" + sections, []*db.Action{nightmare}},
+		{sections, []*db.Action{nightmare, editor}},
+		{"", nil},
+	}
+	for _, test := range tests {
+		path, remove := writeOPK(t, fakeImage(map[string]string{
+			"default.gcw0.desktop": desktopEntry("Doom", test.extra),
+		}))
+		s, cleanup := newService(t, nil, nil)
+		record, err := s.FromOPK(path)
+		cleanup()
+		remove()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := record.Entries[0].Actions; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got actions %s, want %s", test.extra, actionIDs(got), actionIDs(test.want))
+		}
+	}
+}
+
+// actionIDs returns the ids of actions.
+func actionIDs(actions []*db.Action) []string {
+	var ids []string
+	for _, action := range actions {
+		ids = append(ids, action.ID)
+	}
+	return ids
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/avalonbits/opkcat/fetcher"
+	"github.com/avalonbits/opkcat/fetcher/fetchertest"
+)
+
+// downloadCounter is a FakeGetter counting the response bodies read, by url.
+type downloadCounter struct {
+	*fetchertest.FakeGetter
+	mu        sync.Mutex
+	downloads map[string]int
+}
+
+func (g *downloadCounter) GetIfModifiedContext(ctx context.Context, since time.Time, etag, url string, headers map[string]string) (*http.Response, error) {
+	resp, err := g.GetIfModifiedWithHeaders(since, etag, url, headers)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, count: func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.downloads[url]++
+	}}
+	return resp, nil
+}
+
+// countingBody calls count on its first read.
+type countingBody struct {
+	io.ReadCloser
+	once  sync.Once
+	count func()
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	b.once.Do(b.count)
+	return b.ReadCloser.Read(p)
+}
+
+func TestEtagCache(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	const (
+		origin = "http://example.com/doom.opk"
+		mirror = "http://mirror.example.com/doom.opk"
+	)
+	getter := &downloadCounter{FakeGetter: fetchertest.NewFakeGetter(), downloads: map[string]int{}}
+	opk := fakeOPK("Doom")
+	getter.Set(origin, &fetchertest.Response{Body: opk, Etag: `"doom"`})
+	getter.Set(mirror, &fetchertest.Response{Body: opk, Etag: `"doom"`})
+
+	// A single worker fetches the urls one after the other, so the second finds the first cached.
+	tmpdir, err := ioutil.TempDir("", "fetcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	s := fetcher.New(tmpdir, storage, getter, 1, fetcher.WithLogger(discardLogger{}), fetcher.WithEtagCache())
+	fetcher.SetUnsquashfs(s, fakeUnsquashfs)
+	addURLs(t, s, origin, mirror)
+
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if downloads := getter.downloads[origin] + getter.downloads[mirror]; downloads != 1 {
+		t.Errorf("got %d downloads of the shared content, want 1", downloads)
+	}
+
+	// Both urls are associated with the single record of the content.
+	records := storedRecords(t, storage)
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	for _, record := range records {
+		urls := record.Mirrors()
+		sort.Strings(urls)
+		if len(urls) != 2 || urls[0] != origin || urls[1] != mirror {
+			t.Errorf("got urls %v for the record, want both urls", urls)
+		}
+	}
+	known := knownURLs(t, storage)
+	if !known[origin] || !known[mirror] {
+		t.Errorf("got known urls %v, want both urls", known)
+	}
+}
+
+func TestEtagCacheIgnoresWeakEtags(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	const (
+		origin = "http://example.com/doom.opk"
+		mirror = "http://mirror.example.com/doom.opk"
+	)
+	getter := &downloadCounter{FakeGetter: fetchertest.NewFakeGetter(), downloads: map[string]int{}}
+	getter.Set(origin, &fetchertest.Response{Body: fakeOPK("Doom"), Etag: `W/"doom"`})
+	getter.Set(mirror, &fetchertest.Response{Body: fakeOPK("Doom"), Etag: `W/"doom"`})
+
+	s, cleanup := newService(t, storage, getter, fetcher.WithEtagCache())
+	defer cleanup()
+	addURLs(t, s, origin, mirror)
+
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if getter.downloads[origin] != 1 || getter.downloads[mirror] != 1 {
+		t.Errorf("got downloads %v, want each url downloaded for weak etags", getter.downloads)
+	}
+}
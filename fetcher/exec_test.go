@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// hangingUnsquashfs is an unsquashfs that writes its pid to the pid file next to it and hangs.
+const hangingUnsquashfs = `#!/bin/sh
+echo $$ > "$(dirname "$0")/pid"
+exec sleep 60
+`
+
+func TestRunUnsquashfsCancelled(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell to run the fake unsquashfs")
+	}
+	dir, err := ioutil.TempDir("", "fetcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "unsquashfs"), []byte(hangingUnsquashfs), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	defer os.Setenv("PATH", path)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- runUnsquashfs(ctx, filepath.Join(dir, "out"), filepath.Join(dir, "game.opk"))
+	}()
+
+	// Cancel once the subprocess is running.
+	pidFile := filepath.Join(dir, "pid")
+	var pid int
+	for deadline := time.Now().Add(5 * time.Second); pid == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the fake unsquashfs didn't start")
+		}
+		data, err := ioutil.ReadFile(pidFile)
+		if err == nil {
+			pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+		}
+	}
+	cancel()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("got no error from the cancelled extraction")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the extraction didn't return after the cancellation")
+	}
+	// The process was killed and reaped, so it no longer exists.
+	if err := syscall.Kill(pid, 0); err != syscall.ESRCH {
+		t.Errorf("got error %v signaling the unsquashfs process, want it gone", err)
+	}
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher
+
+import (
+	"context"
+	"time"
+
+	"github.com/avalonbits/opkcat/db"
+)
+
+// SetUnsquashfs replaces the unsquashfs command of s, so tests can extract fake images.
+func SetUnsquashfs(s *Service, unsquashfs func(ctx context.Context, dst, file string) error) {
+	s.unsquashfs = unsquashfs
+}
+
+// SharedRecordFromURL downloads and parses the opk at opkurl as the fetch workers do, sharing the
+// download with the concurrent calls for the same url.
+func SharedRecordFromURL(s *Service, opkurl string) (*db.Record, error) {
+	return s.sharedRecordFromURL(context.Background(), &db.URLFreshness{URL: opkurl}, nil)
+}
+
+// RecordFromURL downloads and parses the opk at opkurl with ctx, as a fetch worker does.
+func RecordFromURL(ctx context.Context, s *Service, opkurl string) (*db.Record, error) {
+	return s.recordFromURL(ctx, &db.URLFreshness{URL: opkurl}, nil)
+}
+
+// SetJitter replaces the random delay of s, so tests control when the first fetch starts.
+func SetJitter(s *Service, jitter func(max time.Duration) time.Duration) {
+	s.jitter = jitter
+}
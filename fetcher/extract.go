@@ -0,0 +1,231 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package fetcher
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// format is a container format opks are extracted from.
+type format struct {
+	name string
+
+	// match reports whether a file starting with header is in the format.
+	match func(header []byte) bool
+
+	// extract extracts the contents of file into the directory dst, which doesn't exist yet.
+	// depth is the number of containers file was already extracted from.
+	extract func(ctx context.Context, s *Service, dst, file string, depth int) error
+}
+
+// formats are the registered formats, in detection order.
+var formats []*format
+
+// registerFormat adds f to the formats extractFormat detects.
+func registerFormat(f *format) {
+	formats = append(formats, f)
+}
+
+// errNotSquashFS is returned for opks in no known format, like the HTML error pages some mirrors
+// serve with a 200 status.
+var errNotSquashFS = errors.New("not a squashfs image")
+
+// squashfsFormat is the format of regular opks. The magic number is hsqs on little-endian images
+// and sqsh on big-endian ones.
+var squashfsFormat = &format{
+	name: "squashfs",
+	match: func(header []byte) bool {
+		return bytes.HasPrefix(header, []byte("hsqs")) || bytes.HasPrefix(header, []byte("sqsh"))
+	},
+	extract: func(ctx context.Context, s *Service, dst, file string, depth int) error {
+		return s.unsquashfs(ctx, dst, file)
+	},
+}
+
+func init() {
+	registerFormat(squashfsFormat)
+	registerFormat(&format{
+		name: "zip",
+		match: func(header []byte) bool {
+			return bytes.HasPrefix(header, []byte("PK\x03\x04"))
+		},
+		extract: extractZip,
+	})
+	registerFormat(&format{
+		name: "gzip",
+		match: func(header []byte) bool {
+			return bytes.HasPrefix(header, []byte{0x1f, 0x8b})
+		},
+		extract: extractGzip,
+	})
+}
+
+// formatHeaderSize is the number of bytes read from a file to detect its format.
+const formatHeaderSize = 512
+
+// maxContainerDepth is the maximum number of containers nested in an opk, like a gzipped zip.
+const maxContainerDepth = 2
+
+// maxExtractedBytes limits the size of the content decompressed from zip and gzip opks, so a
+// small malicious file can't fill the disk.
+const maxExtractedBytes = 1 << 30
+
+// detectFormat returns the format of file. Files in no registered format fail with
+// errNotSquashFS, without running unsquashfs on them.
+func detectFormat(file string) (*format, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, formatHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	header = header[:n]
+	for _, f := range formats {
+		if f.match(header) {
+			return f, nil
+		}
+	}
+	if len(header) > 16 {
+		header = header[:16]
+	}
+	return nil, fmt.Errorf("%w: file starts with %q", errNotSquashFS, header)
+}
+
+// extractFormat extracts file into dst with the handler of its format.
+func (s *Service) extractFormat(ctx context.Context, dst, file string, depth int) error {
+	if depth > maxContainerDepth {
+		return fmt.Errorf("more than %d nested containers", maxContainerDepth)
+	}
+	f, err := detectFormat(file)
+	if err != nil {
+		return err
+	}
+	return f.extract(ctx, s, dst, file, depth)
+}
+
+// extractZip extracts the zip archive in file into dst. Entries escaping dst are rejected.
+func extractZip(ctx context.Context, s *Service, dst, file string, depth int) error {
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var total int64
+	for _, zf := range r.File {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		name := filepath.Join(dst, filepath.FromSlash(zf.Name))
+		if name != dst && !strings.HasPrefix(name, dst+string(filepath.Separator)) {
+			return fmt.Errorf("zip entry %q is outside of the archive", zf.Name)
+		}
+		if zf.FileInfo().IsDir() {
+			if err := os.MkdirAll(name, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if !zf.Mode().IsRegular() {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+
+		n, err := extractZipFile(zf, name, maxExtractedBytes-total)
+		if err != nil {
+			return err
+		}
+		total += n
+	}
+	return os.MkdirAll(dst, 0755)
+}
+
+// extractZipFile writes the content of zf to name, failing if it is larger than limit.
+func extractZipFile(zf *zip.File, name string, limit int64) (int64, error) {
+	in, err := zf.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, io.LimitReader(in, limit+1))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return n, err
+	}
+	if n > limit {
+		return n, fmt.Errorf("zip content is larger than %d bytes", int64(maxExtractedBytes))
+	}
+	return n, nil
+}
+
+// extractGzip decompresses the gzip file in file and extracts the result with the handler of
+// its own format.
+func extractGzip(ctx context.Context, s *Service, dst, file string, depth int) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tmp, err := ioutil.TempFile(s.tmpdir, "Gopkcat-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, io.LimitReader(gz, maxExtractedBytes+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if n > maxExtractedBytes {
+		return fmt.Errorf("gzip content is larger than %d bytes", int64(maxExtractedBytes))
+	}
+	return s.extractFormat(ctx, dst, tmp.Name(), depth+1)
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/avalonbits/opkcat/fetcher"
+)
+
+func TestScreenshots(t *testing.T) {
+	path, remove := writeOPK(t, fakeImage(map[string]string{
+		"default.gcw0.desktop":  desktopEntry("Doom", ""),
+		"screenshots/2.png":     "second",
+		"screenshots/1.png":     "first",
+		"screenshots/notes.txt": "not an image",
+		"screenshots/3.jpg":     "too large for what is left of the budget",
+		"screenshots/4.gif":     "4th",
+		"screenshots/5.bmp":     "5th",
+		"title.png":             "outside the directory",
+	}))
+	defer remove()
+	s, cleanup := newService(t, nil, nil, fetcher.WithScreenshots("screenshots", 3, 20))
+	defer cleanup()
+
+	record, err := s.FromOPK(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Images are read in name order, skipping those over the size cap, up to the count cap.
+	var shots []string
+	for _, shot := range record.Screenshots {
+		shots = append(shots, string(shot))
+	}
+	if want := []string{"first", "second", "4th"}; !reflect.DeepEqual(shots, want) {
+		t.Errorf("got screenshots %q, want %q", shots, want)
+	}
+}
+
+func TestNoScreenshots(t *testing.T) {
+	path, remove := writeOPK(t, fakeOPK("Doom"))
+	defer remove()
+	s, cleanup := newService(t, nil, nil, fetcher.WithScreenshots("screenshots", 3, 1<<20))
+	defer cleanup()
+
+	record, err := s.FromOPK(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Screenshots != nil {
+		t.Errorf("got screenshots %q for an opk without them", record.Screenshots)
+	}
+}
+
+// gzipped returns data compressed with gzip.
+func gzipped(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		panic(err)
+	}
+	if err := zw.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFormatDispatch(t *testing.T) {
+	entry := map[string]string{"default.gcw0.desktop": desktopEntry("Doom", "")}
+	tests := []struct {
+		name       string
+		data       []byte
+		unsquashfs bool
+		err        string
+	}{
+		{"squashfs", fakeImage(entry), true, ""},
+		{"zip", zipImage(entry), false, ""},
+		{"gzipped squashfs", gzipped(fakeImage(entry)), true, ""},
+		{"gzipped zip", gzipped(zipImage(entry)), false, ""},
+		{"html", []byte("<html>Not found</html>"), false, "not a squashfs image"},
+		{"nested too deep", gzipped(gzipped(gzipped(zipImage(entry)))), false, "nested containers"},
+		{"zip slip", zipImage(map[string]string{"../default.gcw0.desktop": entry["default.gcw0.desktop"]}), false, "outside of the archive"},
+	}
+	for _, test := range tests {
+		path, remove := writeOPK(t, test.data)
+		s, cleanup := newService(t, nil, nil)
+		unsquashed := false
+		fetcher.SetUnsquashfs(s, func(ctx context.Context, dst, file string) error {
+			unsquashed = true
+			return fakeUnsquashfs(ctx, dst, file)
+		})
+		record, err := s.FromOPK(path)
+		cleanup()
+		remove()
+
+		if unsquashed != test.unsquashfs {
+			t.Errorf("%s: got unsquashfs run %t, want %t", test.name, unsquashed, test.unsquashfs)
+		}
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want one about %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if len(record.Entries) != 1 || record.Entries[0].Name != "Doom" {
+			t.Errorf("%s: got entries %+v, want Doom", test.name, record.Entries)
+		}
+	}
+}
@@ -22,21 +22,28 @@ package fetcher
 import (
 	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
+	"github.com/avalonbits/opkcat"
+	"github.com/avalonbits/opkcat/blob"
 	"github.com/avalonbits/opkcat/db"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 	"gopkg.in/ini.v1"
 )
 
@@ -44,25 +51,304 @@ type ModifiedGetter interface {
 	GetIfModified(since time.Time, etag, url string) (*http.Response, error)
 }
 
+// Default desktop entry keys for metadata that is not part of the freedesktop spec.
+const (
+	DefaultAppIDKey  = "X-OD-AppID"
+	DefaultAuthorKey = "X-OD-Author"
+)
+
 type Service struct {
 	tmpdir     string
 	storage    *db.Handle
 	getter     ModifiedGetter
 	maxFetches int
+	backlog    int
+	blobs      *blob.Store
+	tagRules   []*TagRule
+	categories CategoryMap
+	pruneAfter int
+	cooldown   cooldown
+	pruneGone  bool
+	recordTTL  time.Duration
+	etagCache  bool
+	headCheck  bool
+	webhook    string
+	pngIcons   bool
+	emptyOPKs  EmptyOPKPolicy
+	force      bool
+	budget     *byteBudget
+	limiter    *rateLimiter
+	retry      RetryPolicy
+	hosts      *hostLimiter
+	jsonLog    *jsonLog
+	logger     opkcat.Logger
+	progress   ProgressFunc
+	appIDKey   string
+	authorKey  string
+
+	// sidecar has the metadata merged into records, following sidecarPolicy.
+	sidecar       Sidecar
+	sidecarPolicy SidecarPolicy
+
+	screenshotDir      string
+	maxScreenshots     int
+	maxScreenshotBytes int64
+
+	// unsquashfs extracts the squashfs image in file into dst. It is a field so it can be stubbed.
+	unsquashfs func(ctx context.Context, dst, file string) error
+
+	// inflight makes concurrent fetches of the same url share a single download.
+	inflight singleflight.Group
+
+	// startJitter is the maximum delay of the first fetch. jitter returns a random delay up to
+	// its argument; it is a field so it can be stubbed.
+	startJitter time.Duration
+	jitter      func(max time.Duration) time.Duration
+
+	// ready is closed once Start runs, as Stop can only stop a running service.
+	ready    chan struct{}
+	quit     chan struct{}
+	interval time.Duration
+	ticker   *time.Ticker
+}
+
+// Option configures optional behavior of the Service.
+type Option func(*Service)
+
+// WithBlobStore makes the service archive every downloaded opk in store.
+func WithBlobStore(store *blob.Store) Option {
+	return func(s *Service) {
+		s.blobs = store
+	}
+}
+
+// WithAppIDKey changes the desktop entry key read into the entry AppID.
+func WithAppIDKey(key string) Option {
+	return func(s *Service) {
+		s.appIDKey = key
+	}
+}
+
+// WithAuthorKey changes the desktop entry key read into the entry Author.
+func WithAuthorKey(key string) Option {
+	return func(s *Service) {
+		s.authorKey = key
+	}
+}
+
+// WithCategoryMap replaces the default map used to normalize entry categories.
+func WithCategoryMap(categories CategoryMap) Option {
+	return func(s *Service) {
+		s.categories = categories
+	}
+}
+
+// EmptyOPKPolicy is how the service handles opks without desktop entries.
+type EmptyOPKPolicy int
+
+const (
+	// SkipEmptyOPKs doesn't store opks without desktop entries. They are put in quarantine, so
+	// they are only downloaded again when they change.
+	SkipEmptyOPKs EmptyOPKPolicy = iota
+
+	// NameEmptyOPKs stores opks without desktop entries with a single entry, named after the opk
+	// file.
+	NameEmptyOPKs
+)
+
+// WithEmptyOPKPolicy changes how the service handles opks without desktop entries. By default,
+// they are skipped.
+func WithEmptyOPKPolicy(policy EmptyOPKPolicy) Option {
+	return func(s *Service) {
+		s.emptyOPKs = policy
+	}
+}
+
+// WithExtractBudget limits the total size of the opks being downloaded and extracted at once to
+// maxBytes. A request takes the size its opk had on the last fetch before it is sent, and an opk
+// found to be larger once downloaded takes the rest before it is extracted. Small opks keep going
+// through while large ones wait for room, and an opk larger than the whole budget waits until it
+// can run alone.
+func WithExtractBudget(maxBytes int64) Option {
+	return func(s *Service) {
+		s.budget = newByteBudget(maxBytes)
+	}
+}
+
+// WithRateLimit limits the requests of all the workers together to perMinute, evenly spaced. It is
+// meant for fragile mirrors that can't take bursts of requests.
+func WithRateLimit(perMinute int) Option {
+	return func(s *Service) {
+		s.limiter = newRateLimiter(perMinute)
+	}
+}
+
+// WithBacklog sets how many urls are queued for the workers of a fetch cycle, independently of the
+// number of workers. A larger backlog keeps the workers busy while the urls are read, at the cost of
+// holding more of them in memory. It defaults to the number of workers.
+func WithBacklog(size int) Option {
+	return func(s *Service) {
+		s.backlog = size
+	}
+}
+
+// ProgressFunc is called as each url of a fetch cycle is done, with the number of urls done so
+// far out of total, and the url just done. Calls never overlap, and done increases by one on each
+// call.
+type ProgressFunc func(done, total int, url string)
+
+// WithProgress makes the service call fn as each url of a fetch cycle is done, to report how far
+// along the cycle is.
+func WithProgress(fn ProgressFunc) Option {
+	return func(s *Service) {
+		s.progress = fn
+	}
+}
+
+// progress reports the progress of a fetch cycle to a ProgressFunc. A nil progress reports
+// nothing.
+type progress struct {
+	mu    sync.Mutex
+	fn    ProgressFunc
+	done  int
+	total int
+}
+
+func (p *progress) setTotal(total int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total = total
+}
+
+// advance reports that opkurl is done.
+func (p *progress) advance(opkurl string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	p.fn(p.done, p.total, opkurl)
+}
+
+// WithStartJitter delays the first fetch by a random duration up to max, and the following fetch
+// cycles with it. This keeps instances started at the same time, like by cron, from all hitting
+// the mirrors at once.
+func WithStartJitter(max time.Duration) Option {
+	return func(s *Service) {
+		s.startJitter = max
+	}
+}
+
+// WithForceFetch makes the first fetch cycle a forced one, as ForceFetch does.
+func WithForceFetch() Option {
+	return func(s *Service) {
+		s.force = true
+	}
+}
+
+// WithPNGIcons makes the service convert the icons to PNG, so they can always be served as
+// image/png. SVG icons, and icons that can't be decoded, are stored as they are.
+func WithPNGIcons() Option {
+	return func(s *Service) {
+		s.pngIcons = true
+	}
+}
+
+// WithEtagCache makes the service remember, during each fetch cycle, the records downloaded with a
+// strong ETag. Another url served with the same ETag and size then reuses the record instead of
+// downloading the content again. This saves bandwidth on heavily mirrored catalogs, but trusts
+// that mirrors don't reuse ETags for different content.
+func WithEtagCache() Option {
+	return func(s *Service) {
+		s.etagCache = true
+	}
+}
+
+// WithPruneAfter makes the service remove urls from the catalog once they fail to fetch for more
+// than failures consecutive cycles. Pruning is disabled when failures is zero.
+func WithPruneAfter(failures int) Option {
+	return func(s *Service) {
+		s.pruneAfter = failures
+	}
+}
+
+// cooldown is how long a url failing repeatedly is left alone.
+type cooldown struct {
+	failures int
+	period   time.Duration
+}
+
+// WithCooldown skips the urls that failed at least failures consecutive times until period has
+// passed since their last failure, so chronically broken urls don't take a worker every cycle.
+// Forced fetches don't skip them.
+func WithCooldown(failures int, period time.Duration) Option {
+	return func(s *Service) {
+		s.cooldown = cooldown{failures: failures, period: period}
+	}
+}
+
+// WithPruneGone makes the service remove urls from the catalog as soon as they answer with 404 Not
+// Found or 410 Gone, instead of waiting for WithPruneAfter or WithRecordTTL.
+func WithPruneGone() Option {
+	return func(s *Service) {
+		s.pruneGone = true
+	}
+}
+
+// WithRecordTTL makes the service remove urls from the catalog, after each fetch cycle, once they
+// haven't been fetched successfully for longer than ttl. Unlike WithPruneAfter, it doesn't depend
+// on how often the cycles run.
+func WithRecordTTL(ttl time.Duration) Option {
+	return func(s *Service) {
+		s.recordTTL = ttl
+	}
+}
+
+// WithScreenshots makes the service store the images found in dir, relative to the root of the
+// opk, as record screenshots. At most maxCount images are stored, up to maxBytes in total.
+func WithScreenshots(dir string, maxCount int, maxBytes int64) Option {
+	return func(s *Service) {
+		s.screenshotDir = dir
+		s.maxScreenshots = maxCount
+		s.maxScreenshotBytes = maxBytes
+	}
+}
 
-	quit   chan struct{}
-	ticker *time.Ticker
+// WithTagRules replaces the default rules used to derive record tags.
+func WithTagRules(rules []*TagRule) Option {
+	return func(s *Service) {
+		s.tagRules = rules
+	}
 }
 
-func New(tmpdir string, storage *db.Handle, getter ModifiedGetter, maxFetches int) *Service {
-	return &Service{
+func New(tmpdir string, storage *db.Handle, getter ModifiedGetter, maxFetches int, opts ...Option) *Service {
+	s := &Service{
+		tmpdir:     tmpdir,
 		storage:    storage,
 		getter:     getter,
 		maxFetches: maxFetches,
+		tagRules:   defaultTagRules,
+		categories: defaultCategoryMap,
+		appIDKey:   DefaultAppIDKey,
+		authorKey:  DefaultAuthorKey,
+		logger:     opkcat.StdLogger(opkcat.LevelDebug),
+		unsquashfs: runUnsquashfs,
+
+		jitter: randomJitter,
 
-		quit:   make(chan struct{}),
-		ticker: time.NewTicker(12 * time.Hour),
+		ready:    make(chan struct{}),
+		quit:     make(chan struct{}),
+		interval: fetchInterval,
+		ticker:   time.NewTicker(fetchInterval),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 func (s *Service) Add(url string) error {
@@ -73,30 +359,66 @@ func (s *Service) done() {
 	s.quit <- struct{}{}
 }
 
+// fetchInterval is the time between fetch cycles.
+const fetchInterval = 12 * time.Hour
+
+// randomJitter returns a random duration in [0, max).
+func randomJitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.New(rand.NewSource(time.Now().UnixNano())).Int63n(int64(max)))
+}
+
+// Ready returns a channel closed once Start is running, so that Stop can stop it.
+func (s *Service) Ready() <-chan struct{} {
+	return s.ready
+}
+
 func (s *Service) Start() error {
 	defer s.done()
+	close(s.ready)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// We always run the fetcher on startup.
+	// We always run the fetcher on startup, after the start delay if there is one.
 	runFetch := make(chan bool, 1)
-	runFetch <- true
+	var startC <-chan time.Time
+	if delay := s.jitter(s.startJitter); delay > 0 {
+		s.logEvent(logEvent{Msg: fmt.Sprintf("Delaying the first fetch by %v", delay)})
+		start := time.NewTimer(delay)
+		defer start.Stop()
+		startC = start.C
+	} else {
+		runFetch <- true
+	}
 
 	var fetchMu sync.Mutex
+	force := s.force
 RUN:
 	for {
 		select {
 		case <-runFetch:
 			fetchMu.Lock()
+			fetch := s.Fetch
+			if force {
+				fetch = s.ForceFetch
+				force = false
+			}
 			go func() {
 				defer fetchMu.Unlock()
-				if err := s.Fetch(ctx); err != nil {
-					log.Println(err)
+				if err := fetch(ctx); err != nil {
+					s.logError("", err)
 				} else {
-					log.Println("Done fetching.")
+					s.logEvent(logEvent{Msg: "Done fetching."})
 				}
 			}()
+		case <-startC:
+			// Following cycles are offset by the same delay.
+			s.ticker.Stop()
+			s.ticker = time.NewTicker(s.interval)
+			runFetch <- true
 		case <-s.ticker.C:
 			runFetch <- true
 		case <-s.quit:
@@ -111,10 +433,10 @@ RUN:
 			for _ = range runFetch {
 			}
 
-			log.Println("Waiting for fetches to finish.")
+			s.logEvent(logEvent{Msg: "Waiting for fetches to finish."})
 			fetchMu.Lock()
 			fetchMu.Unlock()
-			log.Println("Done fetching.")
+			s.logEvent(logEvent{Msg: "Done fetching."})
 			break RUN
 		}
 	}
@@ -133,8 +455,40 @@ func (s *Service) Stop() error {
 
 // Fetch retrieves and stores metadata on each known opk.
 func (s *Service) Fetch(ctx context.Context) error {
+	return s.runFetch(ctx, false)
+}
+
+// ForceFetch is like Fetch, but downloads every opk even when it hasn't changed. The urls done
+// are remembered, so a run interrupted by the cancellation of ctx resumes where it stopped the next
+// time ForceFetch is called.
+func (s *Service) ForceFetch(ctx context.Context) error {
+	return s.runFetch(ctx, true)
+}
+
+func (s *Service) runFetch(ctx context.Context, force bool) error {
+	sum := &FetchSummary{Start: time.Now().UTC()}
+	err := s.fetch(ctx, sum, force)
+	sum.finish(err)
+	if herr := s.storage.AddFetchStats(sum.stats()); herr != nil {
+		s.logError("", herr)
+	}
+	if s.webhook != "" {
+		s.postSummary(sum)
+	}
+	return err
+}
+
+func (s *Service) fetch(ctx context.Context, sum *FetchSummary, force bool) error {
 	var group errgroup.Group
-	urlsCh := make(chan *db.URLFreshness, s.maxFetches)
+	var prog *progress
+	if s.progress != nil {
+		prog = &progress{fn: s.progress}
+	}
+	backlog := s.backlog
+	if backlog <= 0 {
+		backlog = s.maxFetches
+	}
+	urlsCh := make(chan *db.URLFreshness, backlog)
 
 	// To limit the amount of goroutines, we desing the fetcher in the following way:
 	// - 1 goroutine reads the known urls and send them over a channel.
@@ -145,6 +499,15 @@ func (s *Service) Fetch(ctx context.Context) error {
 		if err != nil {
 			return err
 		}
+		sum.URLs = len(urls)
+		if force {
+			if urls, err = s.pendingRefetch(urls); err != nil {
+				return err
+			}
+		} else if urls, err = s.skipCoolingDown(urls, sum); err != nil {
+			return err
+		}
+		prog.setTotal(len(urls))
 
 	URL_LOOP:
 		for _, opkurl := range urls {
@@ -159,27 +522,85 @@ func (s *Service) Fetch(ctx context.Context) error {
 	})
 
 	// - maxFetches goroutines read from the url channel and do the fethcing and record creating.
+	var cache *contentCache
+	if s.etagCache {
+		cache = &contentCache{records: map[string]*db.Record{}}
+	}
+
 	var mu sync.Mutex
 	records := []*db.Record{}
+	gathered := map[string]bool{}
+	var processed []string
 	for i := 0; i < s.maxFetches; i++ {
 		group.Go(func() error {
 			for opkurl := range urlsCh {
-				log.Println("Processing", opkurl.URL)
-				record, err := s.recordFromURL(opkurl)
-				if err != nil {
-					log.Println(err)
+				// On cancellation we stop fetching, but keep what was already gathered.
+				if ctx.Err() != nil {
 					continue
 				}
+				// Every url counts as done, whatever its outcome.
+				func() {
+					defer prog.advance(opkurl.URL)
+					s.logEvent(logEvent{Level: levelDebug, Msg: "Processing", URL: opkurl.URL})
+					fetchURL := opkurl
+					if force {
+						// Without freshness, nothing is up-to-date or quarantined.
+						unconditional := *opkurl
+						unconditional.LastUpdate = time.Time{}
+						unconditional.LastModified = time.Time{}
+						unconditional.Etag = ""
+						unconditional.QuarantineEtag = ""
+						fetchURL = &unconditional
+					}
+					record, err := s.sharedRecordFromURL(ctx, fetchURL, cache)
+					if err != nil && err != errQuarantined && ctx.Err() != nil {
+						// Work stopped by the cancellation is not the url's fault.
+						return
+					}
+					// Every other outcome is final, so a resumed forced fetch skips the url.
+					if force {
+						mu.Lock()
+						processed = append(processed, opkurl.URL)
+						mu.Unlock()
+					}
+					if err == errQuarantined {
+						s.logEvent(logEvent{Msg: "Quarantined", URL: opkurl.URL})
+						sum.inc(&sum.Quarantined)
+						return
+					}
+					if errors.Is(err, errNoEntries) {
+						s.logEvent(logEvent{Level: levelWarning, Msg: "Skipped opk without desktop entries", URL: opkurl.URL})
+						sum.inc(&sum.Skipped)
+						return
+					}
+					if err != nil {
+						s.logError(opkurl.URL, err)
+						sum.addError(opkurl.URL, err)
+						s.trackFailure(opkurl.URL, err, sum)
+						return
+					}
+					if err := s.storage.ClearFailure(opkurl.URL); err != nil {
+						s.logError(opkurl.URL, err)
+					}
 
-				if record == nil {
-					log.Println(opkurl, "is up-to-date.")
-					// The current record is up-to-date, we are done with the url.
-					continue
-				}
+					if record == nil {
+						s.logEvent(logEvent{Level: levelDebug, Msg: "Up-to-date", URL: opkurl.URL})
+						sum.inc(&sum.UpToDate)
+						// The current record is up-to-date, we are done with the url.
+						return
+					}
 
-				mu.Lock()
-				records = append(records, record)
-				mu.Unlock()
+					// Workers sharing a download get the same record, which we only want once.
+					mu.Lock()
+					if !gathered[record.URL] {
+						gathered[record.URL] = true
+						records = append(records, record)
+						if opkurl.LastUpdate.IsZero() && opkurl.Etag == "" {
+							sum.NewPackages = append(sum.NewPackages, record.URL)
+						}
+					}
+					mu.Unlock()
+				}()
 			}
 			return nil
 		})
@@ -190,25 +611,285 @@ func (s *Service) Fetch(ctx context.Context) error {
 		return err
 	}
 
-	log.Println("Will write", len(records), "records")
-	// - Once everyone is done, we write the records in a single batch.
-	_, err := s.storage.MultiUpdateRecord(records)
-	return err
+	// - Once everyone is done, we write the records in a single batch. This also happens when the
+	// fetch was cancelled, so a shutdown doesn't lose the records gathered so far.
+	if ctx.Err() != nil {
+		s.logEvent(logEvent{Msg: fmt.Sprintf("Fetch cancelled. Flushing %d records", len(records))})
+	} else {
+		s.logEvent(logEvent{Msg: fmt.Sprintf("Will write %d records", len(records))})
+	}
+	updated, err := s.storage.MultiUpdateRecord(records)
+	if err != nil {
+		return err
+	}
+	sum.Updated = updated
+	if s.recordTTL > 0 {
+		expired, err := s.storage.ExpireFailing(s.recordTTL)
+		for _, opkurl := range expired {
+			s.logEvent(logEvent{Msg: "Expired after failing for longer than " + s.recordTTL.String(), URL: opkurl})
+			sum.addPruned(opkurl)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if force {
+		if err := s.saveRefetch(ctx, processed); err != nil {
+			return err
+		}
+	}
+	if err := s.storage.SetLastFetchTime(time.Now().UTC()); err != nil {
+		return err
+	}
+	if err := s.storage.Sync(); err != nil {
+		return err
+	}
+	return ctx.Err()
 }
 
-func (s *Service) recordFromURL(opkurl *db.URLFreshness) (*db.Record, error) {
-	// We only retrieve tha opk if it is newer than the current version.
-	resp, err := s.getter.GetIfModified(opkurl.LastUpdate, opkurl.Etag, opkurl.URL)
+// pendingRefetch returns the urls not yet processed by the forced fetch in progress.
+func (s *Service) pendingRefetch(urls []*db.URLFreshness) ([]*db.URLFreshness, error) {
+	done, err := s.storage.RefetchedURLs()
+	if err != nil {
+		return nil, err
+	}
+	if len(done) == 0 {
+		return urls, nil
+	}
+
+	pending := urls[:0]
+	for _, opkurl := range urls {
+		if !done[opkurl.URL] {
+			pending = append(pending, opkurl)
+		}
+	}
+	s.logEvent(logEvent{Msg: fmt.Sprintf("Resuming forced fetch, skipping %d processed urls", len(urls)-len(pending))})
+	return pending, nil
+}
+
+// saveRefetch remembers the urls processed by a forced fetch, once their records are written. When
+// the forced fetch completed, there is nothing to resume and the progress is cleared instead.
+func (s *Service) saveRefetch(ctx context.Context, processed []string) error {
+	if ctx.Err() == nil {
+		return s.storage.ClearRefetch()
+	}
+	return s.storage.MarkRefetched(processed)
+}
+
+// skipCoolingDown returns urls without the ones in cooldown, counting them as skipped.
+func (s *Service) skipCoolingDown(urls []*db.URLFreshness, sum *FetchSummary) ([]*db.URLFreshness, error) {
+	if s.cooldown.failures <= 0 || s.cooldown.period <= 0 {
+		return urls, nil
+	}
+	failing, err := s.storage.FailingURLs()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	until := map[string]time.Time{}
+	for _, f := range failing {
+		if f.Count >= s.cooldown.failures && f.Date.Add(s.cooldown.period).After(now) {
+			until[f.URL] = f.Date.Add(s.cooldown.period)
+		}
+	}
+	if len(until) == 0 {
+		return urls, nil
+	}
+
+	kept := make([]*db.URLFreshness, 0, len(urls))
+	for _, opkurl := range urls {
+		if t, ok := until[opkurl.URL]; ok {
+			s.logEvent(logEvent{Level: levelDebug, Msg: fmt.Sprintf("Cooling down until %s", t.Format(time.RFC3339)), URL: opkurl.URL})
+			sum.inc(&sum.Skipped)
+			continue
+		}
+		kept = append(kept, opkurl)
+	}
+	return kept, nil
+}
+
+// trackFailure records a failed fetch of opkurl, pruning it if it has been failing for too long,
+// or if it is gone and the service prunes those right away. Pruned urls are added to sum.
+func (s *Service) trackFailure(opkurl string, ferr error, sum *FetchSummary) {
+	if s.pruneGone && isGone(ferr) {
+		if err := s.storage.PruneURL(opkurl); err != nil {
+			s.logError(opkurl, err)
+			return
+		}
+		s.logEvent(logEvent{Msg: "Pruned after the opk was removed", URL: opkurl, Err: ferr})
+		sum.addPruned(opkurl)
+		return
+	}
+
+	failures, err := s.storage.RecordFailure(opkurl, ferr)
+	if err != nil {
+		s.logError(opkurl, err)
+		return
+	}
+	if s.pruneAfter <= 0 || failures <= s.pruneAfter {
+		return
+	}
+
+	if err := s.storage.PruneURL(opkurl); err != nil {
+		s.logError(opkurl, err)
+		return
+	}
+	s.logEvent(logEvent{Msg: fmt.Sprintf("Pruned after %d consecutive failures", failures), URL: opkurl})
+	sum.addPruned(opkurl)
+}
+
+// sharedRecordFromURL calls recordFromURL, making concurrent calls for the same url share the
+// result of a single call.
+func (s *Service) sharedRecordFromURL(ctx context.Context, opkurl *db.URLFreshness, cache *contentCache) (*db.Record, error) {
+	v, err, _ := s.inflight.Do(opkurl.URL, func() (interface{}, error) {
+		return s.recordFromURL(ctx, opkurl, cache)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*db.Record), nil
+}
+
+// errQuarantined is returned for urls still serving content that failed extraction before.
+var errQuarantined = errors.New("quarantined")
+
+// errNoEntries is returned for opks without desktop entries, when they are skipped.
+var errNoEntries = errors.New("no desktop entries")
+
+// statusError is returned for urls answering with an unexpected HTTP status.
+type statusError struct {
+	Status int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("http fetch error: %v", e.Status)
+}
+
+// isGone reports whether err says the opk was removed from its url.
+func isGone(err error) bool {
+	var serr *statusError
+	return errors.As(err, &serr) && (serr.Status == http.StatusNotFound || serr.Status == http.StatusGone)
+}
+
+// contentCache holds the records downloaded during a fetch cycle, keyed by their validator.
+type contentCache struct {
+	mu      sync.Mutex
+	records map[string]*db.Record
+}
+
+// cacheKey returns the key for the response content, or an empty string if it can't be cached.
+// Weak ETags don't guarantee identical bytes, so they are not used. The Content-Length is that of
+// the encoded content, so the encoding is part of the key.
+func cacheKey(resp *http.Response, etag string) string {
+	if etag == "" || strings.HasPrefix(etag, "W/") || resp.ContentLength < 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s\x00%d\x00%s", etag, resp.ContentLength, resp.Header.Get("Content-Encoding"))
+}
+
+func (c *contentCache) get(key string) *db.Record {
+	if c == nil || key == "" {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.records[key]
+}
+
+func (c *contentCache) put(key string, record *db.Record) {
+	if c == nil || key == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.records[key] = record
+}
+
+// conditionalHeaders returns the If-Modified-Since date and If-None-Match etag of the request
+// for opkurl, leaving out the etag if its server doesn't honor it. We only retrieve the opk if it
+// is newer than the current version. For urls in quarantine, we only want the content if it isn't
+// the one that failed.
+func conditionalHeaders(opkurl *db.URLFreshness) (time.Time, string) {
+	since := opkurl.LastModified
+	if since.IsZero() {
+		since = opkurl.LastUpdate
+	}
+	if opkurl.QuarantineEtag != "" {
+		return since, opkurl.QuarantineEtag
+	}
+	if opkurl.Conditional == db.ConditionalModified {
+		return since, ""
+	}
+	return since, opkurl.Etag
+}
+
+// validators returns the Last-Modified date of resp, and the conditional request mechanism its
+// server is expected to honor: the etag if there is one, since servers prefer it.
+func validators(resp *http.Response) (time.Time, string) {
+	lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		lastModified = time.Time{}
+	}
+	switch {
+	case resp.Header.Get("Etag") != "":
+		return lastModified, db.ConditionalETag
+	case !lastModified.IsZero():
+		return lastModified, db.ConditionalModified
+	}
+	return lastModified, db.ConditionalUnknown
+}
+
+// recordFromURL fetches and parses the opk at opkurl. It returns nil if the opk didn't change. If
+// cache is not nil, content already downloaded in this cycle is not downloaded again. Cancelling
+// ctx stops the download or extraction in progress.
+func (s *Service) recordFromURL(ctx context.Context, opkurl *db.URLFreshness, cache *contentCache) (*db.Record, error) {
+	since, etag := conditionalHeaders(opkurl)
+
+	// Downloads from a host only count against its limit until the content is read.
+	releaseHost, err := s.hosts.acquire(ctx, opkurl.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseHost()
+	if s.unchangedByHead(ctx, opkurl) {
+		s.logEvent(logEvent{Level: levelDebug, Msg: "Unchanged according to a HEAD request", URL: opkurl.URL})
+		if opkurl.QuarantineEtag != "" {
+			return nil, errQuarantined
+		}
+		return nil, nil
+	}
+
+	// Waiting for the budget happens before the request, so no response is left open meanwhile.
+	taken, err := s.budget.acquire(ctx, opkurl.Size)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { s.budget.release(taken) }()
+
+	start := time.Now()
+	resp, err := s.getWithRetry(ctx, opkurl.URL, func() (*http.Response, error) {
+		return getWithHeaders(ctx, s.getter, since, etag, opkurl.URL, opkurl.Headers)
+	})
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	s.logEvent(logEvent{
+		Level:    levelDebug,
+		Msg:      "Fetched",
+		URL:      opkurl.URL,
+		Status:   resp.StatusCode,
+		Duration: time.Since(start),
+	})
 
 	if resp.StatusCode == http.StatusNotModified {
+		if opkurl.QuarantineEtag != "" {
+			return nil, errQuarantined
+		}
 		return nil, nil
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("http fetch error: %v", resp.StatusCode)
+		return nil, &statusError{Status: resp.StatusCode}
 	}
 
 	var readEtag string
@@ -217,17 +898,69 @@ func (s *Service) recordFromURL(opkurl *db.URLFreshness) (*db.Record, error) {
 	}
 
 	// As a last resort, we compare the etags here in case the server didn't respond with a 304.
-	if readEtag == opkurl.Etag {
+	if readEtag != "" && readEtag == opkurl.QuarantineEtag {
+		return nil, errQuarantined
+	}
+	lastModified, conditional := validators(resp)
+	if opkurl.Conditional == db.ConditionalModified && !lastModified.IsZero() {
+		// Sending an etag didn't work before, so it won't now.
+		conditional = db.ConditionalModified
+	}
+	if readEtag != "" && readEtag == opkurl.Etag {
+		// The server doesn't honor If-None-Match, so stop sending it if there is an alternative.
+		if !lastModified.IsZero() {
+			if err := s.storage.SetConditional(opkurl.URL, db.ConditionalModified); err != nil {
+				s.logError(opkurl.URL, err)
+			}
+		}
 		return nil, nil
 	}
 
-	tmpFile, err := ioutil.TempFile(s.tmpdir, "Fopkcat-*-"+url.PathEscape(opkurl.URL))
+	// The same content was already downloaded from another url, so only the url is new.
+	key := cacheKey(resp, readEtag)
+	if cached := cache.get(key); cached != nil {
+		s.logEvent(logEvent{Level: levelDebug, Msg: "Reusing content downloaded from " + cached.URL, URL: opkurl.URL})
+		mirror := *cached
+		mirror.URL = opkurl.URL
+		mirror.SourceTitle = opkurl.Title
+		mirror.Date = time.Now().UTC()
+		mirror.LastModified = lastModified
+		mirror.Conditional = conditional
+		return &mirror, nil
+	}
+
+	tmpFile, err := ioutil.TempFile(s.tmpdir, "Fopkcat-*-"+tmpName(opkurl.URL))
 	if err != nil {
 		return nil, err
 	}
 	defer os.Remove(tmpFile.Name())
 
-	if _, err := io.Copy(tmpFile, resp.Body); err != nil {
+	// Not every getter knows about ctx, so closing the body is what stops the download.
+	copied := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			resp.Body.Close()
+		case <-copied:
+		}
+	}()
+	body, err := decodedBody(resp)
+	var size int64
+	if err == nil {
+		size, err = io.Copy(tmpFile, body)
+		if cerr := body.Close(); err == nil {
+			err = cerr
+		}
+	}
+	close(copied)
+	releaseHost()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if taken, err = s.budget.grow(ctx, taken, size); err != nil {
 		return nil, err
 	}
 
@@ -235,12 +968,38 @@ func (s *Service) recordFromURL(opkurl *db.URLFreshness) (*db.Record, error) {
 		return nil, err
 	}
 
-	return s.fromOPK(tmpFile.Name(), readEtag, opkurl.URL)
+	record, err := s.fromOPK(ctx, tmpFile.Name(), readEtag, opkurl.URL)
+	if err != nil {
+		return nil, err
+	}
+	record.SourceTitle = opkurl.Title
+	record.LastModified = lastModified
+	record.Conditional = conditional
+	record.ContentLength = resp.ContentLength
+
+	// Archive the raw opk if we have a blob store.
+	if s.blobs != nil {
+		if err := s.blobs.Put(record.Hash, tmpFile.Name()); err != nil {
+			return nil, err
+		}
+	}
+	cache.put(key, record)
+	return record, nil
+}
+
+// FromOPK parses the opk file at path into a record, without storing it.
+func (s *Service) FromOPK(path string) (*db.Record, error) {
+	return s.fromOPK(context.Background(), path, "", path)
 }
 
-// FromOPK creates a record by parsing an opkfile. opkurl as added to the the URL field.
-func (s *Service) fromOPK(opkfile, etag, opkurl string) (*db.Record, error) {
-	hash, err := fileSHA256(opkfile)
+// FromOPKURL downloads and parses the opk at opkurl into a record, without storing it.
+func (s *Service) FromOPKURL(opkurl string) (*db.Record, error) {
+	return s.recordFromURL(context.Background(), &db.URLFreshness{URL: opkurl}, nil)
+}
+
+// fromOPK creates a record by parsing an opkfile. opkurl as added to the the URL field.
+func (s *Service) fromOPK(ctx context.Context, opkfile, etag, opkurl string) (*db.Record, error) {
+	hash, size, err := fileSHA256(opkfile)
 	if err != nil {
 		return nil, err
 	}
@@ -250,46 +1009,67 @@ func (s *Service) fromOPK(opkfile, etag, opkurl string) (*db.Record, error) {
 		URL:  opkurl,
 		Date: time.Now().UTC(),
 		Etag: etag,
+		Size: size,
 	}
 
-	if err := s.extractOPK(opkfile, record); err != nil {
+	if err := s.extractOPK(ctx, opkfile, record); err != nil {
+		// Content that can't be extracted won't extract next time either, unless it changes.
+		if etag != "" && s.storage != nil && ctx.Err() == nil && !isTransientUnsquashError(err) {
+			if qerr := s.storage.Quarantine(opkurl, etag, err); qerr != nil {
+				s.logError(opkurl, qerr)
+			}
+		}
 		return nil, err
 	}
+	s.enrich(record)
 	return record, nil
 }
 
-// fileSHA256 computes the SHA256 hash of a file.
-func fileSHA256(name string) ([]byte, error) {
+// fileSHA256 computes the SHA256 hash of a file. It also returns the file size.
+func fileSHA256(name string) ([]byte, int64, error) {
 	f, err := os.Open(name)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer f.Close()
 
 	to := sha256.New()
-	if _, err := io.Copy(to, f); err != nil {
-		return nil, err
+	size, err := io.Copy(to, f)
+	if err != nil {
+		return nil, 0, err
 	}
-	return to.Sum(nil), nil
+	return to.Sum(nil), size, nil
 }
 
 // extractOPK opens and pareses the contents of the opk file to create a valid
-func (s *Service) extractOPK(file string, record *db.Record) error {
-	dir, err := ioutil.TempDir(s.tmpdir, "Dopkcat-*")
-	if err != nil {
-		return err
+func (s *Service) extractOPK(ctx context.Context, file string, record *db.Record) error {
+	// Extract the opk file so we can read its contents. Under heavy concurrent I/O unsquashfs
+	// sometimes fails for reasons unrelated to the opk, so those failures are retried.
+	var dir, finalDir string
+	for attempt := 1; ; attempt++ {
+		var err error
+		dir, finalDir, err = s.extract(ctx, file, record.URL)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt >= unsquashAttempts || !isTransientUnsquashError(err) {
+			return err
+		}
+		s.logEvent(logEvent{Level: levelWarning, Msg: "Retrying unsquashfs", URL: record.URL, Err: err})
 	}
 	defer os.RemoveAll(dir)
 
-	// Unsquash the opk file so we can read its contents.
-	finalDir := filepath.Join(dir, url.PathEscape(record.URL))
-	cmd := exec.Command("unsquashfs", "-no-xattrs", "-d", finalDir, file)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("%s: %w", out, err)
+	installed, err := installedSize(finalDir)
+	if err != nil {
+		return err
 	}
+	record.InstalledSize = installed
 
 	// Read and parse the  desktop entries.
-	entries, err := filepath.Glob(filepath.Join(finalDir, "*.gcw0.desktop"))
+	entries, err := desktopEntries(finalDir)
 	if err != nil {
 		return err
 	}
@@ -304,19 +1084,244 @@ func (s *Service) extractOPK(file string, record *db.Record) error {
 		if err != nil {
 			return err
 		}
-		entry, err := parseDesktopEntry(content, finalDir)
+		parsed, err := s.parseDesktopEntry(content, finalDir)
+		if err != nil {
+			return err
+		}
+		parsed.Platform = desktopPlatform(entry)
+		record.Entries = append(record.Entries, parsed)
+	}
+	if len(record.Entries) == 0 {
+		if s.emptyOPKs == SkipEmptyOPKs {
+			return errNoEntries
+		}
+		record.Entries = []*db.Entry{{Name: nameFromURL(record.URL), Type: "Application"}}
+	}
+	sortEntries(record.Entries)
+	record.PrimaryEntry = primaryEntry(record.URL, record.Entries)
+	record.Tags = deriveTags(s.tagRules, record.Entries)
+
+	if s.screenshotDir != "" {
+		shots, err := s.readScreenshots(filepath.Join(finalDir, filepath.Clean("/"+s.screenshotDir)))
+		if err != nil {
+			return err
+		}
+		record.Screenshots = shots
+	}
+	return nil
+}
+
+// installedSize returns the total size of the regular files under dir. Summing the extracted files
+// doesn't depend on the output format of the installed unsquashfs version.
+func installedSize(dir string) (int64, error) {
+	var total int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		record.Entries = append(record.Entries, entry)
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// screenshotExts are the file extensions accepted as screenshots.
+var screenshotExts = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".bmp": true, ".gif": true}
+
+// readScreenshots reads the images in dir in name order, respecting the configured caps. Images
+// that would exceed the size cap are skipped. A missing dir is not an error.
+func (s *Service) readScreenshots(dir string) ([][]byte, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var shots [][]byte
+	var total int64
+	for _, file := range files {
+		if len(shots) >= s.maxScreenshots {
+			break
+		}
+		if !file.Mode().IsRegular() || !screenshotExts[strings.ToLower(filepath.Ext(file.Name()))] {
+			continue
+		}
+		if total+file.Size() > s.maxScreenshotBytes {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		total += int64(len(data))
+		shots = append(shots, data)
+	}
+	return shots, nil
+}
+
+// unsquashAttempts is the number of times extraction is tried on transient failures.
+const unsquashAttempts = 3
+
+// transientUnsquashErrors are unsquashfs messages for failures that may not happen again.
+var transientUnsquashErrors = []string{
+	"cannot create directory",
+	"Resource temporarily unavailable",
+	"Too many open files",
+	"Interrupted system call",
+}
+
+func isTransientUnsquashError(err error) bool {
+	for _, msg := range transientUnsquashErrors {
+		if strings.Contains(err.Error(), msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// extract extracts file, in any registered format, into a new temporary directory, returning the
+// directory to remove once done and the directory holding the opk contents.
+func (s *Service) extract(ctx context.Context, file, opkurl string) (string, string, error) {
+	dir, err := ioutil.TempDir(s.tmpdir, "Dopkcat-*")
+	if err != nil {
+		return "", "", err
+	}
+
+	finalDir := filepath.Join(dir, tmpName(opkurl))
+	if err := s.extractFormat(ctx, finalDir, file, 0); err != nil {
+		os.RemoveAll(dir)
+		return "", "", err
+	}
+	return dir, finalDir, nil
+}
+
+// maxTmpNameLen is the maximum length of the url part of temporary file names. It keeps names
+// well below the 255 byte limit of most filesystems.
+const maxTmpNameLen = 64
+
+// tmpName returns a file name for temporary data of opkurl. It keeps the end of the url, which
+// usually names the opk, and a hash of the whole url so different urls don't share a name.
+func tmpName(opkurl string) string {
+	name := url.PathEscape(path.Base(opkurl))
+	if len(name) > maxTmpNameLen {
+		name = name[len(name)-maxTmpNameLen:]
+	}
+	sum := sha256.Sum256([]byte(opkurl))
+	return fmt.Sprintf("%x-%s", sum[:6], name)
+}
+
+// runUnsquashfs extracts file into dst with unsquashfs, which is killed if ctx is cancelled.
+func runUnsquashfs(ctx context.Context, dst, file string) error {
+	cmd := exec.CommandContext(ctx, "unsquashfs", "-no-xattrs", "-d", dst, file)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w", out, err)
 	}
 	return nil
 }
 
+// nameFromURL derives an application name from the opk file name in opkurl, like "Super Mario"
+// from super_mario.opk.
+func nameFromURL(opkurl string) string {
+	if u, err := url.Parse(opkurl); err == nil {
+		opkurl = u.Path
+	}
+	name := strings.TrimSuffix(path.Base(opkurl), ".opk")
+	words := strings.FieldsFunc(name, func(r rune) bool {
+		return r == '_' || r == '-' || r == '.' || unicode.IsSpace(r)
+	})
+	return strings.Title(strings.Join(words, " "))
+}
+
+// sortEntries sorts entries by name, then platform, so their order doesn't depend on the order the
+// filesystem lists the desktop entry files in.
+func sortEntries(entries []*db.Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Platform != b.Platform {
+			return a.Platform < b.Platform
+		}
+		return a.Exec < b.Exec
+	})
+}
+
+// primaryEntry returns the index of the entry representing the opk at opkurl: the one whose name
+// or executable matches the opk file name, else the first application, else the first entry.
+func primaryEntry(opkurl string, entries []*db.Entry) int {
+	pkg := opkurl
+	if u, err := url.Parse(opkurl); err == nil {
+		pkg = u.Path
+	}
+	pkg = entryKey(strings.TrimSuffix(path.Base(pkg), ".opk"))
+	if pkg != "" {
+		for i, entry := range entries {
+			var exec string
+			if fields := strings.Fields(entry.Exec); len(fields) > 0 {
+				exec = strings.TrimSuffix(path.Base(fields[0]), path.Ext(fields[0]))
+			}
+			if entryKey(entry.Name) == pkg || entryKey(exec) == pkg {
+				return i
+			}
+		}
+	}
+	for i, entry := range entries {
+		if entry.Type == "Application" {
+			return i
+		}
+	}
+	return 0
+}
+
+// entryKey lowercases name and drops everything but letters and digits, so "Super Mario" matches
+// super_mario.opk.
+func entryKey(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+}
+
+// desktopEntryGlob matches the desktop entry files read from the opks, and
+// fallbackDesktopEntryGlob the generic ones read when there are none, as in packages ported from
+// other platforms.
+const (
+	desktopEntryGlob         = "*.gcw0.desktop"
+	fallbackDesktopEntryGlob = "*.desktop"
+)
+
+// desktopEntries returns the desktop entry files in dir.
+func desktopEntries(dir string) ([]string, error) {
+	entries, err := filepath.Glob(filepath.Join(dir, desktopEntryGlob))
+	if err != nil || len(entries) > 0 {
+		return entries, err
+	}
+	return filepath.Glob(filepath.Join(dir, fallbackDesktopEntryGlob))
+}
+
+// desktopPlatform returns the platform of a desktop entry file named <name>.<platform>.desktop.
+func desktopPlatform(file string) string {
+	name := strings.TrimSuffix(filepath.Base(file), ".desktop")
+	if ext := filepath.Ext(name); ext != "" {
+		return ext[1:]
+	}
+	return ""
+}
+
 // parseDesktopEntry parses the opk desktop entry file.
 // It uses the ini file format.
-func parseDesktopEntry(content []byte, dir string) (*db.Entry, error) {
-	cfg, err := ini.Load(content)
+func (s *Service) parseDesktopEntry(content []byte, dir string) (*db.Entry, error) {
+	// As in ValidateDesktopEntry, semicolons separate list values like Categories and Actions
+	// rather than start comments.
+	cfg, err := ini.LoadSources(ini.LoadOptions{IgnoreInlineComment: true}, content)
 	if err != nil {
 		return nil, err
 	}
@@ -327,23 +1332,111 @@ func parseDesktopEntry(content []byte, dir string) (*db.Entry, error) {
 		return nil, err
 	}
 
-	// Read the icon content. It is always a png file.
-	icon := sec.Key("Icon").String() + ".png"
-	fIcon, err := os.Open(filepath.Join(dir, icon))
+	// Read the icon content. Entries without an icon file are kept without an icon.
+	icon := sec.Key("Icon").String()
+	iconData, iconFile, err := readIcon(dir, icon)
 	if err != nil {
 		return nil, err
 	}
-	defer fIcon.Close()
-
-	iconData, err := ioutil.ReadAll(fIcon)
-	if err != nil {
-		return nil, err
+	if iconData == nil && icon != "" {
+		s.logEvent(logEvent{Level: levelWarning, Msg: "Missing icon " + icon})
+	}
+	if s.pngIcons && iconData != nil {
+		if converted, err := normalizeIcon(iconData); err != nil {
+			s.logEvent(logEvent{Level: levelDebug, Msg: "Keeping icon " + iconFile + " as is", Err: err})
+		} else {
+			iconData = converted
+		}
 	}
 	return &db.Entry{
-		Name:        sec.Key("Name").String(),
-		Type:        sec.Key("Type").String(),
-		Description: sec.Key("Comment").String(),
-		Categories:  strings.Split(sec.Key("Categories").String(), ";"),
-		Icon:        iconData,
+		Name:          sec.Key("Name").String(),
+		Type:          sec.Key("Type").String(),
+		Exec:          sec.Key("Exec").String(),
+		Description:   sec.Key("Comment").String(),
+		Categories:    s.categories.Normalize(strings.Split(sec.Key("Categories").String(), ";")),
+		Icon:          iconData,
+		IconFormat:    iconFormat(iconData, iconFile),
+		AppID:         strings.TrimSpace(sec.Key(s.appIDKey).String()),
+		Author:        strings.TrimSpace(sec.Key(s.authorKey).String()),
+		NeedsDownload: boolKey(sec, needsDownloadKey),
+		Version:       strings.TrimSpace(sec.Key(versionKey).String()),
+
+		LocalizedNames:        localizedKey(sec, "Name"),
+		LocalizedDescriptions: localizedKey(sec, "Comment"),
+		Actions:               desktopActions(cfg, sec),
 	}, nil
 }
+
+// localizedKey returns the translations of key in sec, keyed by the language code between the
+// brackets of Key[lang]. It returns nil if there are none.
+func localizedKey(sec *ini.Section, key string) map[string]string {
+	var values map[string]string
+	for _, k := range sec.Keys() {
+		name := k.Name()
+		if !strings.HasPrefix(name, key+"[") || !strings.HasSuffix(name, "]") {
+			continue
+		}
+		lang := name[len(key)+1 : len(name)-1]
+		value := strings.TrimSpace(k.String())
+		if lang == "" || value == "" {
+			continue
+		}
+		if values == nil {
+			values = map[string]string{}
+		}
+		values[lang] = value
+	}
+	return values
+}
+
+// desktopActionPrefix starts the name of the sections defining desktop actions.
+const desktopActionPrefix = "Desktop Action "
+
+// desktopActions returns the actions defined in cfg, in the order of the Actions key of the
+// desktop entry section sec. Actions without a section of their own are left out, and so are
+// sections not listed in Actions, unless there is no Actions key.
+func desktopActions(cfg *ini.File, sec *ini.Section) []*db.Action {
+	var ids []string
+	if sec.HasKey("Actions") {
+		for _, id := range strings.Split(sec.Key("Actions").String(), ";") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	} else {
+		for _, name := range cfg.SectionStrings() {
+			if strings.HasPrefix(name, desktopActionPrefix) {
+				ids = append(ids, strings.TrimPrefix(name, desktopActionPrefix))
+			}
+		}
+	}
+
+	var actions []*db.Action
+	for _, id := range ids {
+		asec, err := cfg.GetSection(desktopActionPrefix + id)
+		if err != nil {
+			continue
+		}
+		actions = append(actions, &db.Action{
+			ID:   id,
+			Name: asec.Key("Name").String(),
+			Exec: asec.Key("Exec").String(),
+		})
+	}
+	return actions
+}
+
+// versionKey is the desktop entry key holding the application version. The standard Version key
+// is not used as a fallback: it holds the version of the desktop entry spec the file follows, so
+// most entries would claim to be 1.0.
+const versionKey = "X-OD-Version"
+
+// needsDownloadKey is the desktop entry key set by applications that download additional assets
+// when they run.
+const needsDownloadKey = "X-OD-NeedsDownload"
+
+// boolKey returns the boolean value of key in sec. Missing or unparseable values are false.
+func boolKey(sec *ini.Section, key string) bool {
+	value, err := sec.Key(key).Bool()
+	return err == nil && value
+}
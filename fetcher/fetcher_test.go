@@ -0,0 +1,229 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/avalonbits/opkcat/db"
+	"github.com/avalonbits/opkcat/fetcher"
+	"github.com/avalonbits/opkcat/fetcher/fetchertest"
+)
+
+// squashfsMagic starts the fake squashfs images built by fakeOPK.
+const squashfsMagic = "hsqs"
+
+// fakeOPK returns a fake squashfs image of an opk with a single desktop entry named name.
+// Services built by newService extract it without unsquashfs.
+func fakeOPK(name string) []byte {
+	return fakeImage(map[string]string{
+		"default.gcw0.desktop": desktopEntry(name, ""),
+	})
+}
+
+// desktopEntry returns a desktop entry for an application named name, with the extra lines.
+func desktopEntry(name, extra string) string {
+	return fmt.Sprintf("[Desktop Entry]\nName=%s\nType=Application\nExec=%s\n%s", name, name, extra)
+}
+
+// fakeImage returns a fake squashfs image holding files, keyed by their path.
+func fakeImage(files map[string]string) []byte {
+	data, err := json.Marshal(files)
+	if err != nil {
+		panic(err)
+	}
+	return append([]byte(squashfsMagic), data...)
+}
+
+// zipImage returns an opk packed as a zip archive holding files, keyed by their path. The fetcher
+// extracts it itself, without unsquashfs.
+func zipImage(files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			panic(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			panic(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// fakeUnsquashfs extracts the images built by fakeImage.
+func fakeUnsquashfs(ctx context.Context, dst, file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(data, []byte(squashfsMagic)) {
+		return fmt.Errorf("%s is not a fake squashfs image", file)
+	}
+	var files map[string]string
+	if err := json.Unmarshal(bytes.TrimPrefix(data, []byte(squashfsMagic)), &files); err != nil {
+		return err
+	}
+	for path, content := range files {
+		path = filepath.Join(dst, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeOPK writes the image data to a temporary file, returning its path and a function removing
+// it.
+func writeOPK(t *testing.T, data []byte) (string, func()) {
+	t.Helper()
+	f, err := ioutil.TempFile("", "fetcher-*.opk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		t.Fatal(err)
+	}
+	return f.Name(), func() { os.Remove(f.Name()) }
+}
+
+// newService returns a service fetching with getter into storage, which may be nil, and a
+// function removing its temporary directory.
+func newService(t *testing.T, storage *db.Handle, getter fetcher.ModifiedGetter, opts ...fetcher.Option) (*fetcher.Service, func()) {
+	t.Helper()
+	tmpdir, err := ioutil.TempDir("", "fetcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]fetcher.Option{fetcher.WithLogger(discardLogger{})}, opts...)
+	s := fetcher.New(tmpdir, storage, getter, 2, opts...)
+	fetcher.SetUnsquashfs(s, fakeUnsquashfs)
+	return s, func() { os.RemoveAll(tmpdir) }
+}
+
+// discardLogger drops every message, keeping the test output readable.
+type discardLogger struct{}
+
+func (discardLogger) Debug(v ...interface{}) {}
+func (discardLogger) Info(v ...interface{})  {}
+func (discardLogger) Warn(v ...interface{})  {}
+func (discardLogger) Error(v ...interface{}) {}
+
+// newStorage returns a database with an index in a temporary directory, and a function closing
+// and removing it.
+func newStorage(t *testing.T) (*db.Handle, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "fetcher-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := db.Prod(filepath.Join(dir, "db"), filepath.Join(dir, "index"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return storage, func() {
+		storage.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// storedRecords returns the records in storage by url.
+func storedRecords(t *testing.T, storage *db.Handle) map[string]*db.Record {
+	t.Helper()
+	records := map[string]*db.Record{}
+	err := storage.ForEachRecord(func(record *db.Record) error {
+		records[record.URL] = record
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// addURLs adds opkurls to the urls fetched by s.
+func addURLs(t *testing.T, s *fetcher.Service, opkurls ...string) {
+	t.Helper()
+	for _, opkurl := range opkurls {
+		if err := s.Add(opkurl); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// stallingGetter is a FakeGetter whose requests for the stalled url only return when their
+// context is done. The stalled channel is closed once such a request is sent.
+type stallingGetter struct {
+	*fetchertest.FakeGetter
+	url     string
+	stalled chan struct{}
+	once    sync.Once
+}
+
+func newStallingGetter(url string) *stallingGetter {
+	return &stallingGetter{
+		FakeGetter: fetchertest.NewFakeGetter(),
+		url:        url,
+		stalled:    make(chan struct{}),
+	}
+}
+
+func (g *stallingGetter) GetIfModifiedContext(ctx context.Context, since time.Time, etag, url string, headers map[string]string) (*http.Response, error) {
+	if url != g.url {
+		return g.GetIfModifiedWithHeaders(since, etag, url, headers)
+	}
+	g.once.Do(func() { close(g.stalled) })
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// knownURLs returns the urls fetched from storage.
+func knownURLs(t *testing.T, storage *db.Handle) map[string]bool {
+	t.Helper()
+	urls, err := storage.KnownURLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	known := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		known[u.URL] = true
+	}
+	return known
+}
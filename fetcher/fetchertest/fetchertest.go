@@ -0,0 +1,188 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package fetchertest provides utilities for testing code that uses the fetcher.
+package fetchertest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/avalonbits/opkcat/fetcher"
+)
+
+// Response is a canned response served by FakeGetter.
+type Response struct {
+	// Status defaults to 200 OK.
+	Status int
+	Header http.Header
+	Body   []byte
+
+	// Etag and LastModified are the validators of the content. They are sent as headers and
+	// matched against the conditional requests.
+	Etag         string
+	LastModified time.Time
+}
+
+// Request is a request received by FakeGetter.
+type Request struct {
+	// Method is GET or HEAD.
+	Method  string
+	URL     string
+	Since   time.Time
+	Etag    string
+	Headers map[string]string
+}
+
+// FakeGetter is an in-memory fetcher.HeaderGetter and fetcher.HeadGetter serving canned responses
+// by url. It records the requests it receives and answers conditional requests matching the
+// content validators with 304 Not Modified. Urls without a response get a 404. It is safe for
+// concurrent use.
+type FakeGetter struct {
+	mu        sync.Mutex
+	responses map[string]*Response
+	queued    map[string][]*Response
+	requests  []Request
+}
+
+var (
+	_ fetcher.HeaderGetter = (*FakeGetter)(nil)
+	_ fetcher.HeadGetter   = (*FakeGetter)(nil)
+)
+
+// NewFakeGetter returns a FakeGetter without responses.
+func NewFakeGetter() *FakeGetter {
+	return &FakeGetter{
+		responses: map[string]*Response{},
+		queued:    map[string][]*Response{},
+	}
+}
+
+// Set makes g serve resp for url, replacing the previous response.
+func (g *FakeGetter) Set(url string, resp *Response) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.responses[url] = resp
+}
+
+// Queue makes g serve resps for url once each, in order, before the response set with Set. Every
+// request for url, GET or HEAD, takes the next one, so tests can script failures followed by a
+// success.
+func (g *FakeGetter) Queue(url string, resps ...*Response) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.queued[url] = append(g.queued[url], resps...)
+}
+
+// Requests returns the requests received so far, in order.
+func (g *FakeGetter) Requests() []Request {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]Request(nil), g.requests...)
+}
+
+// RequestsFor returns the GET requests received so far for url, in order.
+func (g *FakeGetter) RequestsFor(url string) []Request {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var reqs []Request
+	for _, req := range g.requests {
+		if req.URL == url && req.Method == http.MethodGet {
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs
+}
+
+func (g *FakeGetter) GetIfModified(since time.Time, etag, url string) (*http.Response, error) {
+	return g.GetIfModifiedWithHeaders(since, etag, url, nil)
+}
+
+// Head answers with the headers and Content-Length of the response for url, without its body.
+func (g *FakeGetter) Head(ctx context.Context, url string, headers map[string]string) (*http.Response, error) {
+	resp, err := g.get(http.MethodHead, time.Time{}, "", url, headers)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(nil))
+	return resp, nil
+}
+
+func (g *FakeGetter) GetIfModifiedWithHeaders(since time.Time, etag, url string, headers map[string]string) (*http.Response, error) {
+	return g.get(http.MethodGet, since, etag, url, headers)
+}
+
+func (g *FakeGetter) get(method string, since time.Time, etag, url string, headers map[string]string) (*http.Response, error) {
+	g.mu.Lock()
+	g.requests = append(g.requests, Request{Method: method, URL: url, Since: since, Etag: etag, Headers: headers})
+	canned := g.responses[url]
+	if queued := g.queued[url]; len(queued) > 0 {
+		canned, g.queued[url] = queued[0], queued[1:]
+	}
+	g.mu.Unlock()
+
+	if canned == nil {
+		return response(http.StatusNotFound, http.Header{}, nil), nil
+	}
+
+	header := http.Header{}
+	for key, values := range canned.Header {
+		header[key] = append([]string(nil), values...)
+	}
+	if canned.Etag != "" {
+		header.Set("Etag", canned.Etag)
+	}
+	if !canned.LastModified.IsZero() {
+		header.Set("Last-Modified", canned.LastModified.UTC().Format(http.TimeFormat))
+	}
+
+	// As with real servers, the etag takes precedence over the modification date.
+	notModified := false
+	if etag != "" {
+		notModified = etag == canned.Etag
+	} else if !since.IsZero() && !canned.LastModified.IsZero() {
+		notModified = !canned.LastModified.Truncate(time.Second).After(since)
+	}
+	if notModified {
+		return response(http.StatusNotModified, header, nil), nil
+	}
+
+	status := canned.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return response(status, header, canned.Body), nil
+}
+
+func response(status int, header http.Header, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetchertest
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFakeGetterConditional(t *testing.T) {
+	modified := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	g := NewFakeGetter()
+	g.Set("http://example.com/doom.opk", &Response{Body: []byte("doom"), Etag: `"v2"`, LastModified: modified})
+	g.Set("http://example.com/quake.opk", &Response{Body: []byte("quake"), LastModified: modified})
+
+	tests := []struct {
+		name   string
+		url    string
+		since  time.Time
+		etag   string
+		status int
+	}{
+		{"unconditional", "http://example.com/doom.opk", time.Time{}, "", http.StatusOK},
+		{"matching etag", "http://example.com/doom.opk", time.Time{}, `"v2"`, http.StatusNotModified},
+		{"stale etag", "http://example.com/doom.opk", time.Time{}, `"v1"`, http.StatusOK},
+		{"etag takes precedence over the date", "http://example.com/doom.opk", modified, `"v1"`, http.StatusOK},
+		{"not modified since", "http://example.com/quake.opk", modified.Add(500 * time.Millisecond), "", http.StatusNotModified},
+		{"modified since", "http://example.com/quake.opk", modified.Add(-time.Second), "", http.StatusOK},
+		{"unknown url", "http://example.com/missing.opk", time.Time{}, "", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		resp, err := g.GetIfModified(test.since, test.etag, test.url)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, resp.StatusCode, test.status)
+		}
+		if test.status != http.StatusOK && len(body) != 0 {
+			t.Errorf("%s: got body %q with status %d", test.name, body, resp.StatusCode)
+		}
+	}
+}
+
+func TestFakeGetterResponse(t *testing.T) {
+	modified := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	g := NewFakeGetter()
+	g.Set("http://example.com/doom.opk", &Response{
+		Header:       http.Header{"Content-Type": []string{"application/octet-stream"}},
+		Body:         []byte("doom"),
+		Etag:         `"v2"`,
+		LastModified: modified,
+	})
+
+	resp, err := g.GetIfModified(time.Time{}, "", "http://example.com/doom.opk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "doom" || resp.ContentLength != 4 {
+		t.Errorf("got body %q of length %d, want doom", body, resp.ContentLength)
+	}
+	if got := resp.Header.Get("Etag"); got != `"v2"` {
+		t.Errorf("got Etag %q, want %q", got, `"v2"`)
+	}
+	if got := resp.Header.Get("Last-Modified"); got != modified.Format(http.TimeFormat) {
+		t.Errorf("got Last-Modified %q, want %q", got, modified.Format(http.TimeFormat))
+	}
+	if got := resp.Header.Get("Content-Type"); got != "application/octet-stream" {
+		t.Errorf("got Content-Type %q, want the canned header", got)
+	}
+}
+
+func TestFakeGetterRequests(t *testing.T) {
+	g := NewFakeGetter()
+	g.Set("http://example.com/doom.opk", &Response{Body: []byte("doom"), Etag: `"v2"`})
+	since := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	headers := map[string]string{"Authorization": "Bearer token"}
+
+	calls := []func() (*http.Response, error){
+		func() (*http.Response, error) {
+			return g.Head(context.Background(), "http://example.com/doom.opk", nil)
+		},
+		func() (*http.Response, error) {
+			return g.GetIfModifiedWithHeaders(since, `"v1"`, "http://example.com/doom.opk", headers)
+		},
+		func() (*http.Response, error) {
+			return g.GetIfModified(time.Time{}, "", "http://example.com/quake.opk")
+		},
+	}
+	for _, call := range calls {
+		resp, err := call()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if reqs := g.Requests(); len(reqs) != 3 || reqs[0].Method != http.MethodHead {
+		t.Fatalf("got requests %+v, want the HEAD request first of 3", reqs)
+	}
+	// Only GET requests are returned by url.
+	reqs := g.RequestsFor("http://example.com/doom.opk")
+	if len(reqs) != 1 {
+		t.Fatalf("got %d GET requests for doom.opk, want 1", len(reqs))
+	}
+	req := reqs[0]
+	if req.Method != http.MethodGet || !req.Since.Equal(since) || req.Etag != `"v1"` || req.Headers["Authorization"] != "Bearer token" {
+		t.Errorf("got request %+v, want the conditional GET with its headers", req)
+	}
+}
+
+func TestFakeGetterQueue(t *testing.T) {
+	g := NewFakeGetter()
+	g.Set("http://example.com/doom.opk", &Response{Body: []byte("doom")})
+	g.Queue("http://example.com/doom.opk",
+		&Response{Status: http.StatusServiceUnavailable},
+		&Response{Status: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"1"}}},
+	)
+
+	var statuses []int
+	for i := 0; i < 4; i++ {
+		resp, err := g.GetIfModified(time.Time{}, "", "http://example.com/doom.opk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+		if resp.StatusCode == http.StatusTooManyRequests && resp.Header.Get("Retry-After") != "1" {
+			t.Errorf("got Retry-After %q, want the queued header", resp.Header.Get("Retry-After"))
+		}
+	}
+	want := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK, http.StatusOK}
+	if !reflect.DeepEqual(statuses, want) {
+		t.Errorf("got statuses %v, want %v", statuses, want)
+	}
+}
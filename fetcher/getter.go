@@ -0,0 +1,166 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type loggingGetter struct {
+	inner ModifiedGetter
+
+	mu   sync.Mutex
+	sink io.Writer
+}
+
+// NewLoggingGetter returns a ModifiedGetter that calls inner and writes a summary of each request
+// and its response headers to sink. It is meant for diagnosing misbehaving mirrors.
+func NewLoggingGetter(inner ModifiedGetter, sink io.Writer) ModifiedGetter {
+	return &loggingGetter{
+		inner: inner,
+		sink:  sink,
+	}
+}
+
+// HeaderGetter is a ModifiedGetter that can also send extra headers with a request.
+type HeaderGetter interface {
+	ModifiedGetter
+	GetIfModifiedWithHeaders(since time.Time, etag, url string, headers map[string]string) (*http.Response, error)
+}
+
+// ContextGetter is a HeaderGetter whose requests stop when their context is done.
+type ContextGetter interface {
+	HeaderGetter
+	GetIfModifiedContext(ctx context.Context, since time.Time, etag, url string, headers map[string]string) (*http.Response, error)
+}
+
+// getWithHeaders calls getter, sending headers with the request. It fails if there are headers
+// that getter can't send, so a request never goes out without the credentials it needs. ctx only
+// stops the request if getter is a ContextGetter.
+func getWithHeaders(ctx context.Context, getter ModifiedGetter, since time.Time, etag, url string, headers map[string]string) (*http.Response, error) {
+	if cg, ok := getter.(ContextGetter); ok {
+		return cg.GetIfModifiedContext(ctx, since, etag, url, headers)
+	}
+	if len(headers) == 0 {
+		return getter.GetIfModified(since, etag, url)
+	}
+	hg, ok := getter.(HeaderGetter)
+	if !ok {
+		return nil, fmt.Errorf("%s: getter can't send the url headers", url)
+	}
+	return hg.GetIfModifiedWithHeaders(since, etag, url, headers)
+}
+
+func (g *loggingGetter) GetIfModified(since time.Time, etag, url string) (*http.Response, error) {
+	return g.GetIfModifiedContext(context.Background(), since, etag, url, nil)
+}
+
+func (g *loggingGetter) GetIfModifiedWithHeaders(since time.Time, etag, url string, headers map[string]string) (*http.Response, error) {
+	return g.GetIfModifiedContext(context.Background(), since, etag, url, headers)
+}
+
+func (g *loggingGetter) GetIfModifiedContext(ctx context.Context, since time.Time, etag, url string, headers map[string]string) (*http.Response, error) {
+	start := time.Now()
+	resp, err := getWithHeaders(ctx, g.inner, since, etag, url, headers)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s GET %s since=%q etag=%q\n",
+		start.UTC().Format(time.RFC3339), url, formatSince(since), etag)
+	if err != nil {
+		fmt.Fprintf(&buf, "  error after %v: %v\n", time.Since(start), err)
+	} else {
+		if resp.Request != nil {
+			writeHeaders(&buf, "  > ", resp.Request.Header)
+		}
+		fmt.Fprintf(&buf, "  < %s after %v\n", resp.Status, time.Since(start))
+		writeHeaders(&buf, "  < ", resp.Header)
+	}
+
+	// Write each exchange at once so concurrent fetches don't interleave.
+	g.mu.Lock()
+	g.sink.Write(buf.Bytes())
+	g.mu.Unlock()
+
+	return resp, err
+}
+
+func (g *loggingGetter) Head(ctx context.Context, url string, headers map[string]string) (*http.Response, error) {
+	hg, ok := g.inner.(HeadGetter)
+	if !ok {
+		return nil, errNoHead
+	}
+	start := time.Now()
+	resp, err := hg.Head(ctx, url, headers)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s HEAD %s\n", start.UTC().Format(time.RFC3339), url)
+	if err != nil {
+		fmt.Fprintf(&buf, "  error after %v: %v\n", time.Since(start), err)
+	} else {
+		if resp.Request != nil {
+			writeHeaders(&buf, "  > ", resp.Request.Header)
+		}
+		fmt.Fprintf(&buf, "  < %s after %v\n", resp.Status, time.Since(start))
+		writeHeaders(&buf, "  < ", resp.Header)
+	}
+
+	g.mu.Lock()
+	g.sink.Write(buf.Bytes())
+	g.mu.Unlock()
+
+	return resp, err
+}
+
+func formatSince(since time.Time) string {
+	if since.IsZero() {
+		return ""
+	}
+	return since.UTC().Format(http.TimeFormat)
+}
+
+// secretHeaders are the headers whose values are not logged.
+var secretHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+}
+
+// writeHeaders writes header to w in key order, one per line.
+func writeHeaders(w io.Writer, prefix string, header http.Header) {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range header[key] {
+			if secretHeaders[key] {
+				value = "<redacted>"
+			}
+			fmt.Fprintf(w, "%s%s: %s\n", prefix, key, value)
+		}
+	}
+}
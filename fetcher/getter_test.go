@@ -0,0 +1,131 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/avalonbits/opkcat/fetcher"
+	"github.com/avalonbits/opkcat/fetcher/fetchertest"
+)
+
+func TestLoggingGetter(t *testing.T) {
+	inner := fetchertest.NewFakeGetter()
+	inner.Set("http://example.com/doom.opk", &fetchertest.Response{Body: fakeOPK("Doom"), Etag: `"v2"`})
+	var sink bytes.Buffer
+	getter := fetcher.NewLoggingGetter(inner, &sink)
+
+	since := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	resp, err := getter.GetIfModified(since, `"v1"`, "http://example.com/doom.opk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	got := sink.String()
+	for _, want := range []string{
+		`GET http://example.com/doom.opk since="Fri, 01 May 2020 12:00:00 GMT" etag="\"v1\""`,
+		"  < 200 OK after ",
+		`  < Etag: "v2"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("the log doesn't contain %q:\n%s", want, got)
+		}
+	}
+}
+
+// requestGetter answers every request with an empty 200 response to a request with header.
+type requestGetter http.Header
+
+func (g requestGetter) GetIfModified(since time.Time, etag, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = http.Header(g)
+	return &http.Response{Status: "200 OK", StatusCode: http.StatusOK, Header: http.Header{}, Request: req}, nil
+}
+
+func TestLoggingGetterRedacts(t *testing.T) {
+	var sink bytes.Buffer
+	getter := fetcher.NewLoggingGetter(requestGetter{
+		"Authorization": {"Bearer secret"},
+		"User-Agent":    {"opkcat"},
+	}, &sink)
+	if _, err := getter.GetIfModified(time.Time{}, "", "http://example.com/doom.opk"); err != nil {
+		t.Fatal(err)
+	}
+
+	got := sink.String()
+	if strings.Contains(got, "secret") {
+		t.Errorf("the log contains the credentials:\n%s", got)
+	}
+	for _, want := range []string{"  > Authorization: <redacted>", "  > User-Agent: opkcat"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("the log doesn't contain %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestURLHeaders(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	const (
+		private = "http://private.example.com/doom.opk"
+		public  = "http://example.com/quake.opk"
+	)
+	getter := fetchertest.NewFakeGetter()
+	getter.Set(private, &fetchertest.Response{Body: fakeOPK("Doom"), Etag: `"doom"`})
+	getter.Set(public, &fetchertest.Response{Body: fakeOPK("Quake"), Etag: `"quake"`})
+	s, cleanup := newService(t, storage, getter)
+	defer cleanup()
+	addURLs(t, s, private, public)
+	token := map[string]string{"Authorization": "Bearer mirror-token"}
+	if err := storage.SetURLHeaders(private, token); err != nil {
+		t.Fatal(err)
+	}
+
+	// The headers are kept once the url is fetched, so they are sent on every fetch.
+	for i := 0; i < 2; i++ {
+		if err := s.ForceFetch(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	requests := getter.RequestsFor(private)
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests for %s, want 2", len(requests), private)
+	}
+	for _, req := range requests {
+		if !reflect.DeepEqual(req.Headers, token) {
+			t.Errorf("got headers %v for %s, want %v", req.Headers, private, token)
+		}
+	}
+	for _, req := range getter.RequestsFor(public) {
+		if len(req.Headers) != 0 {
+			t.Errorf("got headers %v for %s, want none", req.Headers, public)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/avalonbits/opkcat/db"
+)
+
+// HeadGetter is a ModifiedGetter that can also send HEAD requests.
+type HeadGetter interface {
+	ModifiedGetter
+	Head(ctx context.Context, url string, headers map[string]string) (*http.Response, error)
+}
+
+// errNoHead is returned by getters wrapping one that can't send HEAD requests.
+var errNoHead = errors.New("getter can't send HEAD requests")
+
+// WithHeadCheck makes the service send a HEAD request before downloading an opk whose server
+// doesn't honor conditional requests. When the Content-Length and Last-Modified of the response
+// match the content already fetched, the download is skipped. It requires a HeadGetter, and is
+// opt-in because servers don't all answer HEAD requests as they answer GET ones.
+func WithHeadCheck() Option {
+	return func(s *Service) {
+		s.headCheck = true
+	}
+}
+
+// unchangedByHead reports whether a HEAD request shows that the content of opkurl didn't change.
+// Urls whose Content-Length and Last-Modified date aren't known yet, and servers honoring
+// If-None-Match, are not checked. The Content-Length is compared with that of the last download
+// rather than with the size of the opk, which differs when the server encodes it. Failed checks are
+// logged and reported as changes, so the content is downloaded.
+func (s *Service) unchangedByHead(ctx context.Context, opkurl *db.URLFreshness) bool {
+	if !s.headCheck || opkurl.ContentLength <= 0 || opkurl.LastModified.IsZero() || opkurl.Conditional == db.ConditionalETag {
+		return false
+	}
+	hg, ok := s.getter.(HeadGetter)
+	if !ok {
+		return false
+	}
+	if err := s.waitRequest(ctx, opkurl.URL); err != nil {
+		return false
+	}
+
+	resp, err := hg.Head(ctx, opkurl.URL, opkurl.Headers)
+	if err != nil {
+		s.logEvent(logEvent{Level: levelWarning, Msg: "HEAD request failed", URL: opkurl.URL, Err: err})
+		return false
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+	lastModified, _ := validators(resp)
+	return resp.ContentLength == opkurl.ContentLength && lastModified.Equal(opkurl.LastModified)
+}
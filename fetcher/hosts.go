@@ -0,0 +1,156 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package fetcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// HostLimit limits the requests sent to a single host. Zero values don't limit anything.
+type HostLimit struct {
+	// Concurrency is the maximum number of downloads from the host at once.
+	Concurrency int `json:"concurrency"`
+
+	// RequestsPerMinute is the maximum request rate to the host, evenly spaced.
+	RequestsPerMinute int `json:"requests_per_minute"`
+}
+
+// LoadHostLimits reads a JSON object mapping hosts to their HostLimit from path. Hosts are case
+// insensitive and may include a port.
+func LoadHostLimits(path string) (map[string]HostLimit, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var raw map[string]HostLimit
+	if err := json.NewDecoder(f).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	limits := make(map[string]HostLimit, len(raw))
+	for host, limit := range raw {
+		limits[strings.ToLower(strings.TrimSpace(host))] = limit
+	}
+	return limits, nil
+}
+
+// WithHostLimits limits the requests to every host to def, except for the hosts in overrides,
+// which have their own limits. Hosts are limited independently of each other, and on top of
+// WithRateLimit.
+func WithHostLimits(def HostLimit, overrides map[string]HostLimit) Option {
+	return func(s *Service) {
+		s.hosts = &hostLimiter{def: def, overrides: overrides, hosts: map[string]*hostState{}}
+	}
+}
+
+// hostLimiter applies the HostLimit of each host. A nil limiter doesn't limit anything.
+type hostLimiter struct {
+	def       HostLimit
+	overrides map[string]HostLimit
+
+	mu    sync.Mutex
+	hosts map[string]*hostState
+}
+
+type hostState struct {
+	slots chan struct{}
+	rate  *rateLimiter
+}
+
+// state returns the state of host, creating it on first use.
+func (l *hostLimiter) state(host string) *hostState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if st, ok := l.hosts[host]; ok {
+		return st
+	}
+
+	limit, ok := l.overrides[host]
+	if !ok {
+		limit = l.def
+	}
+	st := &hostState{}
+	if limit.Concurrency > 0 {
+		st.slots = make(chan struct{}, limit.Concurrency)
+	}
+	if limit.RequestsPerMinute > 0 {
+		st.rate = newRateLimiter(limit.RequestsPerMinute)
+	}
+	l.hosts[host] = st
+	return st
+}
+
+// hostState returns the state of the host of opkurl, or nil if hosts aren't limited.
+func (l *hostLimiter) hostState(opkurl string) (*hostState, error) {
+	if l == nil {
+		return nil, nil
+	}
+	u, err := url.Parse(opkurl)
+	if err != nil {
+		return nil, err
+	}
+	return l.state(strings.ToLower(u.Host)), nil
+}
+
+// acquire waits for a download slot on the host of opkurl. The returned function releases the
+// slot; it can be called more than once. It returns the error of ctx if it is cancelled first.
+// Every request sent while holding the slot still waits for the rate of the host, with wait.
+func (l *hostLimiter) acquire(ctx context.Context, opkurl string) (func(), error) {
+	st, err := l.hostState(opkurl)
+	if err != nil {
+		return nil, err
+	}
+	if st == nil || st.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case st.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-st.slots })
+	}, nil
+}
+
+// wait blocks until a request to the host of opkurl is allowed by its rate, or returns the error
+// of ctx if it is cancelled first.
+func (l *hostLimiter) wait(ctx context.Context, opkurl string) error {
+	st, err := l.hostState(opkurl)
+	if err != nil || st == nil {
+		return err
+	}
+	return st.rate.wait(ctx)
+}
+
+// waitRequest blocks until a request to opkurl is allowed by both the rate of the service and that
+// of its host. Every request sent for a url waits, including HEAD requests and retries.
+func (s *Service) waitRequest(ctx context.Context, opkurl string) error {
+	if err := s.limiter.wait(ctx); err != nil {
+		return err
+	}
+	return s.hosts.wait(ctx, opkurl)
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/avalonbits/opkcat/fetcher"
+	"github.com/avalonbits/opkcat/fetcher/fetchertest"
+)
+
+// concurrencyGetter is a FakeGetter holding every request for a while, to track the most
+// requests in flight to each host and to all of them.
+type concurrencyGetter struct {
+	*fetchertest.FakeGetter
+	mu               sync.Mutex
+	inFlight, most   map[string]int
+	total, mostTotal int
+}
+
+func (g *concurrencyGetter) GetIfModifiedContext(ctx context.Context, since time.Time, etag, opkurl string, headers map[string]string) (*http.Response, error) {
+	u, err := url.Parse(opkurl)
+	if err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	g.inFlight[u.Host]++
+	g.total++
+	if g.inFlight[u.Host] > g.most[u.Host] {
+		g.most[u.Host] = g.inFlight[u.Host]
+	}
+	if g.total > g.mostTotal {
+		g.mostTotal = g.total
+	}
+	g.mu.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+
+	g.mu.Lock()
+	g.inFlight[u.Host]--
+	g.total--
+	g.mu.Unlock()
+	return g.GetIfModifiedWithHeaders(since, etag, opkurl, headers)
+}
+
+func TestHostLimits(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	const (
+		cdn     = "cdn.example.com"
+		fragile = "fragile.example.com"
+	)
+	getter := &concurrencyGetter{
+		FakeGetter: fetchertest.NewFakeGetter(),
+		inFlight:   map[string]int{},
+		most:       map[string]int{},
+	}
+	tmpdir, err := ioutil.TempDir("", "fetcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	// Enough workers for both hosts to fill their limits at once.
+	s := fetcher.New(tmpdir, storage, getter, 8, fetcher.WithLogger(discardLogger{}),
+		fetcher.WithHostLimits(fetcher.HostLimit{Concurrency: 1}, map[string]fetcher.HostLimit{cdn: {Concurrency: 3}}))
+	fetcher.SetUnsquashfs(s, fakeUnsquashfs)
+	for i := 0; i < 6; i++ {
+		for _, host := range []string{cdn, fragile} {
+			opkurl := fmt.Sprintf("http://%s/app%d.opk", host, i)
+			getter.Set(opkurl, &fetchertest.Response{Body: fakeOPK(opkurl)})
+			addURLs(t, s, opkurl)
+		}
+	}
+
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{cdn: 3, fragile: 1}; !reflect.DeepEqual(getter.most, want) {
+		t.Errorf("got at most %v requests at once, want %v", getter.most, want)
+	}
+	// The fragile host doesn't take the slots of the cdn.
+	if getter.mostTotal != 4 {
+		t.Errorf("got at most %d requests at once to both hosts, want 4", getter.mostTotal)
+	}
+	if records := storedRecords(t, storage); len(records) != 12 {
+		t.Errorf("got %d records, want 12", len(records))
+	}
+}
+
+// flakyGetter is a FakeGetter failing the first GET request for every url with a 503, and
+// recording when every request, GET or HEAD, is sent.
+type flakyGetter struct {
+	*fetchertest.FakeGetter
+	mu    sync.Mutex
+	gets  map[string]int
+	times []time.Time
+}
+
+func (g *flakyGetter) GetIfModifiedContext(ctx context.Context, since time.Time, etag, opkurl string, headers map[string]string) (*http.Response, error) {
+	g.mu.Lock()
+	g.times = append(g.times, time.Now())
+	g.gets[opkurl]++
+	first := g.gets[opkurl] == 1
+	g.mu.Unlock()
+	if first {
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}
+	return g.GetIfModifiedWithHeaders(since, etag, opkurl, headers)
+}
+
+func (g *flakyGetter) Head(ctx context.Context, opkurl string, headers map[string]string) (*http.Response, error) {
+	g.mu.Lock()
+	g.times = append(g.times, time.Now())
+	g.mu.Unlock()
+	return g.FakeGetter.Head(ctx, opkurl, headers)
+}
+
+func TestHostRateRetries(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	const (
+		fragile   = "fragile.example.com"
+		perMinute = 600
+		interval  = time.Minute / perMinute
+	)
+	getter := &flakyGetter{FakeGetter: fetchertest.NewFakeGetter(), gets: map[string]int{}}
+	s, cleanup := newService(t, storage, getter,
+		fetcher.WithHostLimits(fetcher.HostLimit{}, map[string]fetcher.HostLimit{fragile: {RequestsPerMinute: perMinute}}),
+		fetcher.WithRetry(fetcher.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}),
+		fetcher.WithHeadCheck())
+	defer cleanup()
+	for _, name := range []string{"a", "b"} {
+		opkurl := fmt.Sprintf("http://%s/%s.opk", fragile, name)
+		getter.Set(opkurl, &fetchertest.Response{Body: fakeOPK(name), LastModified: time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)})
+		addURLs(t, s, opkurl)
+	}
+
+	// The first fetch retries both urls, and the second only checks them with HEAD requests.
+	for i := 0; i < 2; i++ {
+		if err := s.Fetch(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(getter.times) != 6 {
+		t.Fatalf("got %d requests, want 4 GET and 2 HEAD requests", len(getter.times))
+	}
+	sort.Slice(getter.times, func(i, j int) bool { return getter.times[i].Before(getter.times[j]) })
+	for i := 1; i < len(getter.times); i++ {
+		if gap := getter.times[i].Sub(getter.times[i-1]); gap < interval-interval/10 {
+			t.Errorf("got request %d %v after the previous one, want at least %v", i, gap, interval)
+		}
+	}
+}
+
+func TestLoadHostLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts.json")
+	content := `{" CDN.example.com ": {"concurrency": 8}, "fragile.example.com:8080": {"requests_per_minute": 30}}`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	limits, err := fetcher.LoadHostLimits(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]fetcher.HostLimit{
+		"cdn.example.com":          {Concurrency: 8},
+		"fragile.example.com:8080": {RequestsPerMinute: 30},
+	}
+	if !reflect.DeepEqual(limits, want) {
+		t.Errorf("got limits %v, want %v", limits, want)
+	}
+}
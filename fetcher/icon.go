@@ -0,0 +1,265 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"  // Decodes gif icons.
+	_ "image/jpeg" // Decodes jpeg icons.
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// iconExtensions are the extensions tried, in order, when the Icon key of a desktop entry doesn't
+// name a file.
+var iconExtensions = []string{".png", ".jpg", ".bmp"}
+
+// maxIconSize is the largest icon read, so a bogus desktop entry can't have a huge file stored with
+// every entry.
+const maxIconSize = 1 << 20
+
+// readIcon returns the content of the icon named icon in dir, and the file it was read from. icon
+// is tried as is first, then with each of the iconExtensions. A missing icon is not an error: its
+// content is nil.
+//
+// icon comes from an untrusted desktop entry, so only regular files inside dir, reached without
+// following symlinks, are read. Anything else is treated as a missing icon.
+func readIcon(dir, icon string) ([]byte, string, error) {
+	if icon == "" {
+		return nil, "", nil
+	}
+	names := []string{icon}
+	for _, ext := range iconExtensions {
+		names = append(names, icon+ext)
+	}
+	for _, name := range names {
+		path := filepath.Clean(filepath.Join(dir, name))
+		if !strings.HasPrefix(path, filepath.Clean(dir)+string(filepath.Separator)) {
+			return nil, "", nil
+		}
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		// Directories, symlinks and oversized files named like the icon are as good as a missing file.
+		if !info.Mode().IsRegular() || info.Size() > maxIconSize {
+			continue
+		}
+		if viaSymlink, err := hasSymlinkedDir(dir, path); err != nil || viaSymlink {
+			return nil, "", err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, "", err
+		}
+		return data, name, nil
+	}
+	return nil, "", nil
+}
+
+// hasSymlinkedDir reports whether any directory between dir and path, which must be inside dir,
+// is a symlink.
+func hasSymlinkedDir(dir, path string) (bool, error) {
+	dir = filepath.Clean(dir)
+	for parent := filepath.Dir(path); parent != dir; parent = filepath.Dir(parent) {
+		info, err := os.Lstat(parent)
+		if err != nil {
+			return false, err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// iconFormat returns the image format of icon, read from file. The content decides the format;
+// the extension of file is only used when the content isn't recognized.
+func iconFormat(icon []byte, file string) string {
+	switch {
+	case len(icon) == 0:
+		return ""
+	case isSVG(icon):
+		return "svg"
+	case bytes.HasPrefix(icon, []byte("BM")):
+		return "bmp"
+	}
+	if _, format, err := image.DecodeConfig(bytes.NewReader(icon)); err == nil {
+		return format
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".jpg", ".jpeg":
+		return "jpeg"
+	case ".bmp":
+		return "bmp"
+	case ".gif":
+		return "gif"
+	case ".svg":
+		return "svg"
+	}
+	return "png"
+}
+
+// normalizeIcon returns icon encoded as PNG, so icons can always be served as image/png. PNG and
+// SVG icons are returned as they are, since SVG can't be rasterized without extra dependencies.
+func normalizeIcon(icon []byte) ([]byte, error) {
+	if len(icon) == 0 || isSVG(icon) {
+		return icon, nil
+	}
+
+	var img image.Image
+	var err error
+	if bytes.HasPrefix(icon, []byte("BM")) {
+		img, err = decodeBMP(icon)
+	} else {
+		var format string
+		img, format, err = image.Decode(bytes.NewReader(icon))
+		if err == nil && format == "png" {
+			return icon, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// isSVG reports whether icon looks like an SVG document.
+func isSVG(icon []byte) bool {
+	head := bytes.TrimSpace(icon)
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	return bytes.HasPrefix(head, []byte("<svg")) ||
+		(bytes.HasPrefix(head, []byte("<?xml")) && bytes.Contains(head, []byte("<svg")))
+}
+
+// maxBMPPixels is the largest BMP decoded, to keep a bogus header from allocating huge images.
+const maxBMPPixels = 4096 * 4096
+
+var errUnsupportedBMP = errors.New("unsupported bmp")
+
+// bmpInfoHeader is the BITMAPINFOHEADER. Later header versions start with the same fields.
+type bmpInfoHeader struct {
+	Size        uint32
+	Width       int32
+	Height      int32
+	Planes      uint16
+	BitCount    uint16
+	Compression uint32
+	ImageSize   uint32
+	XPerMeter   int32
+	YPerMeter   int32
+	ColorsUsed  uint32
+	Important   uint32
+}
+
+// decodeBMP decodes the uncompressed 8, 24 and 32 bits per pixel BMP images, which are the ones
+// found in opks. The standard library doesn't decode BMP.
+func decodeBMP(data []byte) (image.Image, error) {
+	const fileHeaderSize = 14
+	if len(data) < fileHeaderSize+40 {
+		return nil, errUnsupportedBMP
+	}
+	offset := binary.LittleEndian.Uint32(data[10:14])
+
+	var hdr bmpInfoHeader
+	if err := binary.Read(bytes.NewReader(data[fileHeaderSize:]), binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if hdr.Size < 40 || hdr.Compression != 0 || hdr.Width <= 0 || hdr.Height == 0 {
+		return nil, errUnsupportedBMP
+	}
+	width, height := int(hdr.Width), int(hdr.Height)
+	topDown := height < 0
+	if topDown {
+		height = -height
+	}
+	if width*height > maxBMPPixels {
+		return nil, fmt.Errorf("bmp too large: %dx%d", width, height)
+	}
+
+	var palette []color.RGBA
+	switch hdr.BitCount {
+	case 8:
+		colors := int(hdr.ColorsUsed)
+		if colors == 0 || colors > 256 {
+			colors = 256
+		}
+		start := fileHeaderSize + int(hdr.Size)
+		if start+4*colors > len(data) {
+			return nil, errUnsupportedBMP
+		}
+		palette = make([]color.RGBA, colors)
+		for i := range palette {
+			p := data[start+4*i:]
+			palette[i] = color.RGBA{R: p[2], G: p[1], B: p[0], A: 0xff}
+		}
+	case 24, 32:
+	default:
+		return nil, errUnsupportedBMP
+	}
+
+	// Rows are padded to 4 bytes and stored bottom-up unless the height is negative.
+	bytesPerPixel := int(hdr.BitCount) / 8
+	stride := (width*bytesPerPixel + 3) &^ 3
+	if int(offset)+stride*height > len(data) {
+		return nil, errUnsupportedBMP
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		row := data[int(offset)+y*stride:]
+		dy := height - 1 - y
+		if topDown {
+			dy = y
+		}
+		for x := 0; x < width; x++ {
+			var c color.RGBA
+			if palette != nil {
+				idx := int(row[x])
+				if idx >= len(palette) {
+					return nil, errUnsupportedBMP
+				}
+				c = palette[idx]
+			} else {
+				p := row[x*bytesPerPixel:]
+				c = color.RGBA{R: p[2], G: p[1], B: p[0], A: 0xff}
+			}
+			img.SetRGBA(x, dy, c)
+		}
+	}
+	return img, nil
+}
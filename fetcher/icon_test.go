@@ -0,0 +1,184 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/avalonbits/opkcat/fetcher"
+)
+
+// bmp24 returns an uncompressed 24 bits per pixel BMP image of the pixels, given top row first.
+func bmp24(pixels [][]color.RGBA) []byte {
+	height, width := len(pixels), len(pixels[0])
+	stride := (width*3 + 3) &^ 3
+	var buf bytes.Buffer
+	buf.WriteString("BM")
+	binary.Write(&buf, binary.LittleEndian, []uint32{uint32(54 + stride*height), 0, 54})
+	binary.Write(&buf, binary.LittleEndian, []int32{40, int32(width), int32(height)})
+	binary.Write(&buf, binary.LittleEndian, []uint16{1, 24})
+	binary.Write(&buf, binary.LittleEndian, []uint32{0, uint32(stride * height), 0, 0, 0, 0})
+	// Rows are stored bottom-up.
+	for y := height - 1; y >= 0; y-- {
+		row := make([]byte, stride)
+		for x, c := range pixels[y] {
+			row[3*x], row[3*x+1], row[3*x+2] = c.B, c.G, c.R
+		}
+		buf.Write(row)
+	}
+	return buf.Bytes()
+}
+
+// iconEntry returns the icon of the opk holding icon, and its format, as extracted by a service
+// with opts.
+func iconEntry(t *testing.T, icon []byte, opts ...fetcher.Option) (data []byte, format string) {
+	t.Helper()
+	path, remove := writeOPK(t, zipImage(map[string]string{
+		"default.gcw0.desktop": desktopEntry("Doom", "Icon=doom\n"),
+		"doom.bmp":             string(icon),
+	}))
+	defer remove()
+	s, cleanup := newService(t, nil, nil, opts...)
+	defer cleanup()
+
+	record, err := s.FromOPK(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record.Entries[0].Icon, record.Entries[0].IconFormat
+}
+
+func TestPNGIcons(t *testing.T) {
+	red := color.RGBA{R: 0xff, A: 0xff}
+	green := color.RGBA{G: 0xff, A: 0xff}
+	blue := color.RGBA{B: 0xff, A: 0xff}
+	white := color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	pixels := [][]color.RGBA{{red, green, blue}, {white, blue, red}}
+	bmp := bmp24(pixels)
+
+	data, format := iconEntry(t, bmp, fetcher.WithPNGIcons())
+	if format != "png" {
+		t.Errorf("got icon format %q, want png", format)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("got an invalid PNG icon: %v", err)
+	}
+	if got := img.Bounds(); got != image.Rect(0, 0, 3, 2) {
+		t.Fatalf("got icon bounds %v, want 3x2", got)
+	}
+	for y, row := range pixels {
+		for x, want := range row {
+			if got := color.RGBAModel.Convert(img.At(x, y)); got != want {
+				t.Errorf("pixel (%d, %d): got %v, want %v", x, y, got, want)
+			}
+		}
+	}
+
+	// Without the option, the icon is kept as is.
+	if data, format := iconEntry(t, bmp); !bytes.Equal(data, bmp) || format != "bmp" {
+		t.Errorf("got %s icon of %d bytes without the option, want the bmp", format, len(data))
+	}
+}
+
+func TestPNGIconsUndecodable(t *testing.T) {
+	// Icons that can't be decoded are kept as they are.
+	bogus := append([]byte("BM"), bytes.Repeat([]byte{0xff}, 100)...)
+	if data, format := iconEntry(t, bogus, fetcher.WithPNGIcons()); !bytes.Equal(data, bogus) || format != "bmp" {
+		t.Errorf("got %s icon of %d bytes, want the undecodable bmp kept", format, len(data))
+	}
+}
+
+// secretFile writes a file outside of any opk, returning its path and a function removing it.
+func secretFile(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "environ")
+	if err := ioutil.WriteFile(path, []byte("OPKCAT_ADMIN_TOKEN=secret"), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestIconOutsideOPK(t *testing.T) {
+	secret, removeSecret := secretFile(t)
+	defer removeSecret()
+	icon := strings.Repeat("../", 32) + strings.TrimPrefix(filepath.ToSlash(secret), "/")
+
+	path, remove := writeOPK(t, zipImage(map[string]string{
+		"default.gcw0.desktop": desktopEntry("Doom", "Icon="+icon+"\n"),
+	}))
+	defer remove()
+	s, cleanup := newService(t, nil, nil)
+	defer cleanup()
+
+	record, err := s.FromOPK(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := record.Entries[0].Icon; got != nil {
+		t.Errorf("got icon %q, want none for an icon outside of the opk", got)
+	}
+}
+
+func TestIconSymlink(t *testing.T) {
+	secret, removeSecret := secretFile(t)
+	defer removeSecret()
+
+	for _, icon := range []string{"doom", "icons/environ"} {
+		path, remove := writeOPK(t, fakeImage(map[string]string{
+			"default.gcw0.desktop": desktopEntry("Doom", "Icon="+icon+"\n"),
+		}))
+		defer remove()
+		s, cleanup := newService(t, nil, nil)
+		defer cleanup()
+		// Symlinks in the image, to the secret file and to its directory, are extracted as they are.
+		fetcher.SetUnsquashfs(s, func(ctx context.Context, dst, file string) error {
+			if err := fakeUnsquashfs(ctx, dst, file); err != nil {
+				return err
+			}
+			if err := os.Symlink(secret, filepath.Join(dst, "doom.png")); err != nil {
+				return err
+			}
+			return os.Symlink(filepath.Dir(secret), filepath.Join(dst, "icons"))
+		})
+
+		record, err := s.FromOPK(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := record.Entries[0].Icon; got != nil {
+			t.Errorf("Icon=%s: got icon %q, want none for a symlinked icon", icon, got)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/avalonbits/opkcat/fetcher"
+	"github.com/avalonbits/opkcat/fetcher/fetchertest"
+)
+
+// signalingGetter is a FakeGetter sending the time of every request on requested.
+type signalingGetter struct {
+	*fetchertest.FakeGetter
+	requested chan time.Time
+}
+
+func (g *signalingGetter) GetIfModified(since time.Time, etag, url string) (*http.Response, error) {
+	g.requested <- time.Now()
+	return g.FakeGetter.GetIfModified(since, etag, url)
+}
+
+func TestStartJitter(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	const opkurl = "http://example.com/doom.opk"
+	getter := &signalingGetter{FakeGetter: fetchertest.NewFakeGetter(), requested: make(chan time.Time, 1)}
+	getter.Set(opkurl, &fetchertest.Response{Body: fakeOPK("Doom")})
+	s, cleanup := newService(t, storage, getter, fetcher.WithStartJitter(time.Hour))
+	defer cleanup()
+	addURLs(t, s, opkurl)
+
+	// The first fetch waits for the delay drawn within the configured window.
+	const delay = 200 * time.Millisecond
+	var window time.Duration
+	fetcher.SetJitter(s, func(max time.Duration) time.Duration {
+		window = max
+		return delay
+	})
+	started := time.Now()
+	go s.Start()
+	<-s.Ready()
+	defer s.Stop()
+
+	select {
+	case requested := <-getter.requested:
+		if waited := requested.Sub(started); waited < delay {
+			t.Errorf("the first fetch started after %v, want it delayed by %v", waited, delay)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first fetch didn't start")
+	}
+	if window != time.Hour {
+		t.Errorf("got a delay drawn within %v, want the configured %v", window, time.Hour)
+	}
+}
+
+func TestNoStartJitter(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	const opkurl = "http://example.com/doom.opk"
+	getter := &signalingGetter{FakeGetter: fetchertest.NewFakeGetter(), requested: make(chan time.Time, 1)}
+	getter.Set(opkurl, &fetchertest.Response{Body: fakeOPK("Doom")})
+	s, cleanup := newService(t, storage, getter)
+	defer cleanup()
+	addURLs(t, s, opkurl)
+
+	go s.Start()
+	<-s.Ready()
+	defer s.Stop()
+
+	select {
+	case <-getter.requested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first fetch didn't start right away")
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/avalonbits/opkcat"
+)
+
+// Log levels of the fetcher events. Events about a single url are debug, unless something went
+// wrong with it.
+const (
+	levelDebug   = "debug"
+	levelInfo    = "info"
+	levelWarning = "warning"
+	levelError   = "error"
+)
+
+// logEvent is something the fetcher logs. Only Msg is required.
+type logEvent struct {
+	Level    string
+	Msg      string
+	URL      string
+	Status   int
+	Duration time.Duration
+	Err      error
+}
+
+// jsonEvent is how a logEvent is written in JSON mode.
+type jsonEvent struct {
+	Time       time.Time `json:"time"`
+	Level      string    `json:"level"`
+	Msg        string    `json:"msg"`
+	URL        string    `json:"url,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	DurationMS float64   `json:"duration_ms,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// jsonLog writes log events as JSON objects, one per line.
+type jsonLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// WithLogger makes the service write its log events as text to logger. By default they are
+// written to the standard logger.
+func WithLogger(logger opkcat.Logger) Option {
+	return func(s *Service) {
+		s.logger = logger
+	}
+}
+
+// WithJSONLog makes the service write its log events to w as JSON objects, one per line, for
+// ingestion by log aggregators. By default events are written as text to the standard logger.
+func WithJSONLog(w io.Writer) Option {
+	return func(s *Service) {
+		s.jsonLog = &jsonLog{enc: json.NewEncoder(w)}
+	}
+}
+
+// logEvent logs ev, as text or JSON depending on how the service was configured.
+func (s *Service) logEvent(ev logEvent) {
+	if ev.Level == "" {
+		ev.Level = levelInfo
+	}
+	if s.jsonLog == nil {
+		args := []interface{}{ev.Msg}
+		if ev.URL != "" {
+			args = append(args, ev.URL)
+		}
+		if ev.Status != 0 {
+			args = append(args, ev.Status)
+		}
+		if ev.Duration != 0 {
+			args = append(args, ev.Duration)
+		}
+		if ev.Err != nil {
+			args = append(args, ev.Err)
+		}
+		switch ev.Level {
+		case levelDebug:
+			s.logger.Debug(args...)
+		case levelWarning:
+			s.logger.Warn(args...)
+		case levelError:
+			s.logger.Error(args...)
+		default:
+			s.logger.Info(args...)
+		}
+		return
+	}
+
+	out := jsonEvent{
+		Time:       time.Now().UTC(),
+		Level:      ev.Level,
+		Msg:        ev.Msg,
+		URL:        ev.URL,
+		Status:     ev.Status,
+		DurationMS: float64(ev.Duration) / float64(time.Millisecond),
+	}
+	if ev.Err != nil {
+		out.Error = ev.Err.Error()
+	}
+	s.jsonLog.mu.Lock()
+	defer s.jsonLog.mu.Unlock()
+	if err := s.jsonLog.enc.Encode(&out); err != nil {
+		s.logger.Error(err)
+	}
+}
+
+// logError logs err as an error event about opkurl, which may be empty. Errors about a single url
+// are warnings, as the other urls are still fetched.
+func (s *Service) logError(opkurl string, err error) {
+	level := levelError
+	if opkurl != "" {
+		level = levelWarning
+	}
+	s.logEvent(logEvent{Level: level, Msg: "error", URL: opkurl, Err: err})
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/avalonbits/opkcat/fetcher"
+	"github.com/avalonbits/opkcat/fetcher/fetchertest"
+)
+
+func TestJSONLog(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	const (
+		found   = "http://example.com/doom.opk"
+		missing = "http://example.com/missing.opk"
+	)
+	getter := fetchertest.NewFakeGetter()
+	getter.Set(found, &fetchertest.Response{Body: fakeOPK("Doom")})
+	var out bytes.Buffer
+	s, cleanup := newService(t, storage, getter, fetcher.WithJSONLog(&out))
+	defer cleanup()
+	addURLs(t, s, found, missing)
+
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	type event struct {
+		Time       time.Time `json:"time"`
+		Level      string    `json:"level"`
+		Msg        string    `json:"msg"`
+		URL        string    `json:"url"`
+		Status     int       `json:"status"`
+		DurationMS float64   `json:"duration_ms"`
+		Error      string    `json:"error"`
+	}
+	fetched := map[string]event{}
+	var failed *event
+	lines := bufio.NewScanner(&out)
+	for lines.Scan() {
+		var ev event
+		if err := json.Unmarshal(lines.Bytes(), &ev); err != nil {
+			t.Fatalf("got invalid JSON line %q: %v", lines.Text(), err)
+		}
+		if ev.Time.IsZero() || ev.Level == "" || ev.Msg == "" {
+			t.Errorf("got event %q without its time, level or message", lines.Text())
+		}
+		switch {
+		case ev.Msg == "Fetched":
+			fetched[ev.URL] = ev
+		case ev.Error != "":
+			failed = &ev
+		}
+	}
+
+	if ev := fetched[found]; ev.Status != http.StatusOK || ev.DurationMS <= 0 || ev.Level != "debug" {
+		t.Errorf("got fetched event %+v, want a debug event with the status and duration", ev)
+	}
+	if ev := fetched[missing]; ev.Status != http.StatusNotFound {
+		t.Errorf("got fetched event %+v for the missing url, want status %d", ev, http.StatusNotFound)
+	}
+	if failed == nil || failed.URL != missing || failed.Level != "warning" {
+		t.Errorf("got error event %+v, want a warning about the missing url", failed)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package fetcher
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/avalonbits/opkcat/db"
+	"golang.org/x/sync/errgroup"
+)
+
+// MirrorStatus is the result of checking a url with CheckMirrors.
+type MirrorStatus struct {
+	URL string `json:"url"`
+
+	// Status is the HTTP status code of the response, zero if there was none.
+	Status int `json:"status"`
+
+	// Reachable is set when the url answered with its content or with Not Modified.
+	Reachable bool          `json:"reachable"`
+	Err       string        `json:"error,omitempty"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// CheckMirrors checks that every known url still serves its opk, without downloading, extracting
+// or storing anything. Urls are requested with the freshness of their records, so unchanged ones
+// answer Not Modified, and the content of the changed ones is not read. The requests follow the
+// same rate and host limits as fetches. Statuses are returned in the order of KnownURLs.
+func (s *Service) CheckMirrors(ctx context.Context) ([]MirrorStatus, error) {
+	urls, err := s.storage.KnownURLs()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MirrorStatus, len(urls))
+	next := make(chan int)
+	var group errgroup.Group
+	group.Go(func() error {
+		defer close(next)
+		for i := range urls {
+			select {
+			case next <- i:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+
+	var mu sync.Mutex
+	for w := 0; w < s.maxFetches; w++ {
+		group.Go(func() error {
+			for i := range next {
+				status := s.checkMirror(ctx, urls[i])
+				mu.Lock()
+				statuses[i] = status
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// checkMirror requests opkurl, closing the response without reading its content.
+func (s *Service) checkMirror(ctx context.Context, opkurl *db.URLFreshness) MirrorStatus {
+	status := MirrorStatus{URL: opkurl.URL}
+	release, err := s.hosts.acquire(ctx, opkurl.URL)
+	if err != nil {
+		status.Err = err.Error()
+		return status
+	}
+	defer release()
+	if err := s.waitRequest(ctx, opkurl.URL); err != nil {
+		status.Err = err.Error()
+		return status
+	}
+
+	since, etag := conditionalHeaders(opkurl)
+	start := time.Now()
+	resp, err := getWithHeaders(ctx, s.getter, since, etag, opkurl.URL, opkurl.Headers)
+	status.Duration = time.Since(start)
+	if err != nil {
+		status.Err = err.Error()
+		return status
+	}
+	resp.Body.Close()
+
+	status.Status = resp.StatusCode
+	status.Reachable = resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNotModified
+	if !status.Reachable {
+		status.Err = http.StatusText(resp.StatusCode)
+	}
+	return status
+}
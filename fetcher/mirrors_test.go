@@ -0,0 +1,105 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/avalonbits/opkcat/fetcher/fetchertest"
+)
+
+// failingGetter is a downloadCounter whose requests for the failing url fail without a response.
+type failingGetter struct {
+	*downloadCounter
+	failing string
+}
+
+func (g *failingGetter) GetIfModifiedContext(ctx context.Context, since time.Time, etag, url string, headers map[string]string) (*http.Response, error) {
+	if url == g.failing {
+		return nil, errors.New("connection refused")
+	}
+	return g.downloadCounter.GetIfModifiedContext(ctx, since, etag, url, headers)
+}
+
+func TestCheckMirrors(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	const (
+		fetched = "http://example.com/doom.opk"
+		added   = "http://example.com/quake.opk"
+		missing = "http://example.com/missing.opk"
+		down    = "http://down.example.com/doom.opk"
+	)
+	getter := &failingGetter{
+		downloadCounter: &downloadCounter{FakeGetter: fetchertest.NewFakeGetter(), downloads: map[string]int{}},
+		failing:         down,
+	}
+	getter.Set(fetched, &fetchertest.Response{Body: fakeOPK("Doom"), Etag: `"doom"`})
+	s, cleanup := newService(t, storage, getter)
+	defer cleanup()
+	addURLs(t, s, fetched)
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	getter.Set(added, &fetchertest.Response{Body: fakeOPK("Quake")})
+	addURLs(t, s, added, missing, down)
+	getter.downloads = map[string]int{}
+
+	statuses, err := s.CheckMirrors(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	type want struct {
+		status    int
+		reachable bool
+		err       bool
+	}
+	wants := map[string]want{
+		fetched: {http.StatusNotModified, true, false},
+		added:   {http.StatusOK, true, false},
+		missing: {http.StatusNotFound, false, true},
+		down:    {0, false, true},
+	}
+	if len(statuses) != len(wants) {
+		t.Fatalf("got %d statuses, want %d", len(statuses), len(wants))
+	}
+	for _, status := range statuses {
+		w, ok := wants[status.URL]
+		if !ok {
+			t.Errorf("got a status for unknown url %s", status.URL)
+			continue
+		}
+		if status.Status != w.status || status.Reachable != w.reachable || (status.Err != "") != w.err {
+			t.Errorf("%s: got status %+v, want %+v", status.URL, status, w)
+		}
+	}
+
+	// Nothing was downloaded or stored.
+	if len(getter.downloads) != 0 {
+		t.Errorf("got downloads %v, want none", getter.downloads)
+	}
+	if records := storedRecords(t, storage); len(records) != 1 {
+		t.Errorf("got %d records, want only the fetched one", len(records))
+	}
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/avalonbits/opkcat/fetcher"
+	"github.com/avalonbits/opkcat/fetcher/fetchertest"
+)
+
+func TestPruneAfter(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	const (
+		healthy = "http://example.com/healthy.opk"
+		dead    = "http://example.com/dead.opk"
+	)
+	getter := fetchertest.NewFakeGetter()
+	getter.Set(healthy, &fetchertest.Response{Body: fakeOPK("Healthy"), Etag: `"healthy"`})
+	getter.Set(dead, &fetchertest.Response{Status: http.StatusInternalServerError})
+	s, cleanup := newService(t, storage, getter, fetcher.WithPruneAfter(2))
+	defer cleanup()
+	addURLs(t, s, healthy, dead)
+
+	for cycle := 1; cycle <= 3; cycle++ {
+		if err := s.Fetch(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		known := knownURLs(t, storage)
+		if !known[healthy] {
+			t.Fatalf("cycle %d: the healthy url was pruned", cycle)
+		}
+		// The url is pruned once it failed more than twice in a row.
+		if pruned := !known[dead]; pruned != (cycle == 3) {
+			t.Fatalf("cycle %d: got pruned %t for the failing url", cycle, pruned)
+		}
+	}
+}
+
+func TestPruneAfterResetsOnSuccess(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	const flaky = "http://example.com/flaky.opk"
+	getter := fetchertest.NewFakeGetter()
+	s, cleanup := newService(t, storage, getter, fetcher.WithPruneAfter(2))
+	defer cleanup()
+	addURLs(t, s, flaky)
+
+	// Two failures, a success and two more failures are never more than two in a row.
+	statuses := []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusOK, http.StatusBadGateway, http.StatusBadGateway}
+	for _, status := range statuses {
+		getter.Set(flaky, &fetchertest.Response{Status: status, Body: fakeOPK("Flaky")})
+		if err := s.Fetch(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !knownURLs(t, storage)[flaky] {
+		t.Error("the url was pruned although its failures were not consecutive")
+	}
+}
+
+func TestRecordTTL(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	const (
+		healthy = "http://example.com/healthy.opk"
+		dead    = "http://example.com/dead.opk"
+		ttl     = 500 * time.Millisecond
+	)
+	getter := fetchertest.NewFakeGetter()
+	getter.Set(healthy, &fetchertest.Response{Body: fakeOPK("Healthy"), Etag: `"healthy"`})
+	getter.Set(dead, &fetchertest.Response{Body: fakeOPK("Dead"), Etag: `"dead"`})
+	s, cleanup := newService(t, storage, getter, fetcher.WithRecordTTL(ttl))
+	defer cleanup()
+	addURLs(t, s, healthy, dead)
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The mirror vanishes. The url is kept while it has been failing for less than the ttl.
+	getter.Set(dead, &fetchertest.Response{Status: http.StatusNotFound})
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if records := storedRecords(t, storage); records[dead] == nil {
+		t.Fatal("the failing url was removed before the ttl")
+	}
+	time.Sleep(ttl)
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	known := knownURLs(t, storage)
+	if known[dead] || storedRecords(t, storage)[dead] != nil {
+		t.Error("got the url failing for longer than the ttl kept")
+	}
+	// The healthy record is older than the ttl, but it is fetched successfully.
+	if !known[healthy] || storedRecords(t, storage)[healthy] == nil {
+		t.Error("got the healthy url removed")
+	}
+}
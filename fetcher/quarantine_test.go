@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/avalonbits/opkcat/fetcher"
+	"github.com/avalonbits/opkcat/fetcher/fetchertest"
+)
+
+func TestQuarantine(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	const opkurl = "http://example.com/corrupt.opk"
+	getter := fetchertest.NewFakeGetter()
+	getter.Set(opkurl, &fetchertest.Response{Body: []byte(squashfsMagic + "corrupt"), Etag: `"v1"`})
+	s, cleanup := newService(t, storage, getter)
+	defer cleanup()
+	extractions := 0
+	fetcher.SetUnsquashfs(s, func(ctx context.Context, dst, file string) error {
+		extractions++
+		return fakeUnsquashfs(ctx, dst, file)
+	})
+	addURLs(t, s, opkurl)
+
+	// The first failure quarantines the url, which isn't downloaded or extracted again while it
+	// serves the same content.
+	for i := 0; i < 3; i++ {
+		if err := s.Fetch(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if extractions != 1 {
+		t.Errorf("got %d extractions of the quarantined content, want 1", extractions)
+	}
+	quarantined, err := storage.QuarantinedURLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantined) != 1 || quarantined[0].URL != opkurl || quarantined[0].Etag != `"v1"` {
+		t.Fatalf("got quarantined urls %+v, want %s with its etag", quarantined, opkurl)
+	}
+	for _, req := range getter.RequestsFor(opkurl)[1:] {
+		if req.Etag != `"v1"` {
+			t.Errorf("got a request with etag %q, want the quarantined one", req.Etag)
+		}
+	}
+
+	// Once the content changes, it gets another chance.
+	getter.Set(opkurl, &fetchertest.Response{Body: fakeOPK("Fixed"), Etag: `"v2"`})
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if extractions != 2 {
+		t.Errorf("got %d extractions, want the changed content extracted", extractions)
+	}
+	if records := storedRecords(t, storage); records[opkurl] == nil {
+		t.Error("got no record for the changed content")
+	}
+	if quarantined, err = storage.QuarantinedURLs(); err != nil || len(quarantined) != 0 {
+		t.Errorf("got quarantined urls %+v and error %v, want none", quarantined, err)
+	}
+}
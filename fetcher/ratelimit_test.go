@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/avalonbits/opkcat/fetcher"
+	"github.com/avalonbits/opkcat/fetcher/fetchertest"
+)
+
+// timingGetter is a FakeGetter recording when each request is sent.
+type timingGetter struct {
+	*fetchertest.FakeGetter
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func (g *timingGetter) GetIfModifiedContext(ctx context.Context, since time.Time, etag, url string, headers map[string]string) (*http.Response, error) {
+	g.mu.Lock()
+	g.times = append(g.times, time.Now())
+	g.mu.Unlock()
+	return g.GetIfModifiedWithHeaders(since, etag, url, headers)
+}
+
+func TestRateLimit(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	const (
+		urls      = 6
+		perMinute = 600
+		interval  = time.Minute / perMinute
+	)
+	getter := &timingGetter{FakeGetter: fetchertest.NewFakeGetter()}
+	s, cleanup := newService(t, storage, getter, fetcher.WithRateLimit(perMinute))
+	defer cleanup()
+	for i := 0; i < urls; i++ {
+		opkurl := fmt.Sprintf("http://example%d.com/app.opk", i)
+		getter.Set(opkurl, &fetchertest.Response{Body: fakeOPK(fmt.Sprintf("App %d", i))})
+		addURLs(t, s, opkurl)
+	}
+
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	times := getter.times
+	if len(times) != urls {
+		t.Fatalf("got %d requests, want %d", len(times), urls)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	// However the workers interleave their requests to different hosts, request i isn't sent before
+	// i intervals passed since the first one. The slack covers the time between the first request
+	// being allowed and being recorded.
+	for i := 1; i < urls; i++ {
+		if elapsed, want := times[i].Sub(times[0]), time.Duration(i)*interval-interval/10; elapsed < want {
+			t.Errorf("got request %d %v after the first one, want at least %v", i, elapsed, want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy is how many times and how long apart a failed opk download is retried. Only
+// timeouts, temporary network errors, 5xx and 429 responses are retried. A zero policy doesn't
+// retry.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of requests per url, including the first one.
+	MaxAttempts int
+
+	// BaseDelay is the delay before the first retry. It doubles on every retry, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// WithRetry makes the service retry failed opk downloads following policy.
+func WithRetry(policy RetryPolicy) Option {
+	return func(s *Service) {
+		s.retry = policy
+	}
+}
+
+// backoff returns the delay before retry number attempt, starting at 1: half of it is fixed and
+// half is random, so urls failing together aren't retried together.
+func (p RetryPolicy) backoff(attempt int, jitter func(time.Duration) time.Duration) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay/2 + jitter(delay/2)
+}
+
+// retryable returns whether a request failing with resp or err may succeed if sent again. Errors
+// other than timeouts and temporary network errors, like a malformed url or a refused TLS
+// certificate, would fail the same way.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		var nerr net.Error
+		return errors.As(err, &nerr) && (nerr.Timeout() || nerr.Temporary())
+	}
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// retryAfter returns the delay requested by the Retry-After header of resp, in seconds or as an
+// HTTP date, and whether there was one.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		delay := time.Until(at)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+// getWithRetry calls get until it succeeds, fails permanently or runs out of attempts, and returns
+// its last result. Every attempt waits for the rate limits of the service and of the host. A 429
+// response is retried after the delay in its Retry-After header, unless that is longer than the
+// policy's MaxDelay, in which case it is returned as is. So is the last result when the retry
+// would come after the deadline of ctx.
+func (s *Service) getWithRetry(ctx context.Context, opkurl string, get func() (*http.Response, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		if err := s.waitRequest(ctx, opkurl); err != nil {
+			return nil, err
+		}
+		resp, err := get()
+		if attempt >= s.retry.MaxAttempts || !retryable(resp, err) {
+			return resp, err
+		}
+
+		delay := s.retry.backoff(attempt, s.jitter)
+		if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+			if after, ok := retryAfter(resp); ok {
+				if s.retry.MaxDelay > 0 && after > s.retry.MaxDelay {
+					return resp, nil
+				}
+				delay = after
+			}
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return resp, err
+		}
+
+		ev := logEvent{
+			Level: levelWarning,
+			Msg:   fmt.Sprintf("Retrying (attempt %d of %d)", attempt+1, s.retry.MaxAttempts),
+			URL:   opkurl,
+			Err:   err,
+		}
+		if resp != nil {
+			ev.Status = resp.StatusCode
+			resp.Body.Close()
+		}
+		ev.Duration = delay
+		s.logEvent(ev)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/avalonbits/opkcat/fetcher"
+	"github.com/avalonbits/opkcat/fetcher/fetchertest"
+)
+
+const retryURL = "http://example.com/doom.opk"
+
+// retryService returns a service retrying following policy, without jitter, fetching retryURL from
+// a getter serving the queued responses and then the opk.
+func retryService(t *testing.T, policy fetcher.RetryPolicy, queued ...*fetchertest.Response) (*fetcher.Service, *timingGetter, func()) {
+	t.Helper()
+	getter := &timingGetter{FakeGetter: fetchertest.NewFakeGetter()}
+	getter.Set(retryURL, &fetchertest.Response{Body: fakeOPK("Doom")})
+	getter.Queue(retryURL, queued...)
+	s, cleanup := newService(t, nil, getter, fetcher.WithRetry(policy))
+	fetcher.SetJitter(s, func(time.Duration) time.Duration { return 0 })
+	return s, getter, cleanup
+}
+
+// status returns a response with status code and the header key set to value, if not empty.
+func status(code int, key, value string) *fetchertest.Response {
+	resp := &fetchertest.Response{Status: code, Header: http.Header{}}
+	if key != "" {
+		resp.Header.Set(key, value)
+	}
+	return resp
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := fetcher.RetryPolicy{MaxAttempts: 4, BaseDelay: 40 * time.Millisecond, MaxDelay: 100 * time.Millisecond}
+	unavailable := status(http.StatusServiceUnavailable, "", "")
+	s, getter, cleanup := retryService(t, policy, unavailable, unavailable, unavailable)
+	defer cleanup()
+
+	record, err := fetcher.RecordFromURL(context.Background(), s, retryURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record == nil || record.Entries[0].Name != "Doom" {
+		t.Fatalf("got record %+v, want doom after the retries", record)
+	}
+	if len(getter.times) != 4 {
+		t.Fatalf("got %d requests, want 4", len(getter.times))
+	}
+	// Without jitter, retries wait half of the doubling delay, capped by MaxDelay.
+	for i, want := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond} {
+		if got := getter.times[i+1].Sub(getter.times[i]); got < want || got > want+time.Second {
+			t.Errorf("retry %d came %v after the previous request, want %v", i+1, got, want)
+		}
+	}
+}
+
+func TestRetryMaxAttempts(t *testing.T) {
+	policy := fetcher.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+	unavailable := status(http.StatusServiceUnavailable, "", "")
+	s, getter, cleanup := retryService(t, policy, unavailable, unavailable, unavailable)
+	defer cleanup()
+
+	if record, err := fetcher.RecordFromURL(context.Background(), s, retryURL); err == nil {
+		t.Errorf("got record %+v, want the last 503 after 3 attempts", record)
+	}
+	if len(getter.times) != 3 {
+		t.Errorf("got %d requests, want 3", len(getter.times))
+	}
+
+	// Permanent failures aren't retried.
+	s, getter, cleanup = retryService(t, policy, status(http.StatusNotFound, "", ""))
+	defer cleanup()
+	if _, err := fetcher.RecordFromURL(context.Background(), s, retryURL); err == nil {
+		t.Error("got no error for a 404")
+	}
+	if len(getter.times) != 1 {
+		t.Errorf("got %d requests for a 404, want 1", len(getter.times))
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	policy := fetcher.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Second}
+	s, getter, cleanup := retryService(t, policy, status(http.StatusTooManyRequests, "Retry-After", "1"))
+	defer cleanup()
+
+	if _, err := fetcher.RecordFromURL(context.Background(), s, retryURL); err != nil {
+		t.Fatal(err)
+	}
+	if len(getter.times) != 2 {
+		t.Fatalf("got %d requests, want 2", len(getter.times))
+	}
+	if got := getter.times[1].Sub(getter.times[0]); got < time.Second {
+		t.Errorf("got the retry %v after the 429, want the second of its Retry-After", got)
+	}
+
+	// A Retry-After longer than MaxDelay isn't waited for.
+	s, getter, cleanup = retryService(t, policy, status(http.StatusTooManyRequests, "Retry-After", "10"))
+	defer cleanup()
+	if _, err := fetcher.RecordFromURL(context.Background(), s, retryURL); err == nil {
+		t.Error("got no error for a 429 retried after more than MaxDelay")
+	}
+	if len(getter.times) != 1 {
+		t.Errorf("got %d requests, want 1", len(getter.times))
+	}
+}
+
+func TestRetryAfterDeadline(t *testing.T) {
+	// Without MaxDelay, only the deadline of the fetch keeps it from waiting for Retry-After.
+	policy := fetcher.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}
+	s, getter, cleanup := retryService(t, policy, status(http.StatusTooManyRequests, "Retry-After", "10"))
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := fetcher.RecordFromURL(ctx, s, retryURL); err == nil || err == context.DeadlineExceeded {
+		t.Errorf("got error %v, want the 429", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %v, want no wait for a retry past the deadline", elapsed)
+	}
+	if len(getter.times) != 1 {
+		t.Errorf("got %d requests, want 1", len(getter.times))
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/avalonbits/opkcat/db"
+	"github.com/avalonbits/opkcat/fetcher"
+	"github.com/avalonbits/opkcat/fetcher/fetchertest"
+)
+
+// heldGetter is a FakeGetter holding its responses until release is closed. The held channel is
+// closed when the first request arrives.
+type heldGetter struct {
+	*fetchertest.FakeGetter
+	held    chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (g *heldGetter) GetIfModified(since time.Time, etag, url string) (*http.Response, error) {
+	g.once.Do(func() { close(g.held) })
+	<-g.release
+	return g.FakeGetter.GetIfModified(since, etag, url)
+}
+
+func TestSharedDownload(t *testing.T) {
+	const opkurl = "http://example.com/shared.opk"
+	getter := &heldGetter{
+		FakeGetter: fetchertest.NewFakeGetter(),
+		held:       make(chan struct{}),
+		release:    make(chan struct{}),
+	}
+	getter.Set(opkurl, &fetchertest.Response{Body: fakeOPK("Shared")})
+	s, cleanup := newService(t, nil, getter)
+	defer cleanup()
+
+	const workers = 4
+	records := make([]*db.Record, workers)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			records[i], errs[i] = fetcher.SharedRecordFromURL(s, opkurl)
+		}(i)
+	}
+	// Give the other workers time to ask for the url while the first download is held.
+	<-getter.held
+	time.Sleep(100 * time.Millisecond)
+	close(getter.release)
+	wg.Wait()
+
+	if got := len(getter.Requests()); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+	for i := range records {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if records[i] != records[0] {
+			t.Errorf("worker %d got a different record", i)
+		}
+	}
+}
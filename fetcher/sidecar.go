@@ -0,0 +1,132 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package fetcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/avalonbits/opkcat/db"
+)
+
+// Enrichment is the metadata a sidecar adds to the record of an opk.
+type Enrichment struct {
+	// Description is the description of the primary entry of the opk.
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+	Rating      string   `json:"rating"`
+}
+
+// Sidecar maps opk urls, or opk file names, to the metadata curators add to their records.
+type Sidecar map[string]*Enrichment
+
+// SidecarPolicy is how sidecar values are merged with the values read from the opk.
+type SidecarPolicy int
+
+const (
+	// SidecarOverride replaces the values read from the opk.
+	SidecarOverride SidecarPolicy = iota
+
+	// SidecarSupplement only fills the values missing from the opk. Sidecar tags are added to
+	// the derived ones.
+	SidecarSupplement
+)
+
+// LoadSidecar reads a JSON object mapping opk urls or file names to their enrichment from path.
+func LoadSidecar(path string) (Sidecar, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var sidecar Sidecar
+	if err := json.NewDecoder(f).Decode(&sidecar); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return sidecar, nil
+}
+
+// WithSidecar merges the metadata in sidecar into the records of the opks it has, following
+// policy. A sidecar rating is set as if by a curator, and replaces the rating set through the web
+// service when the opk changes.
+func WithSidecar(sidecar Sidecar, policy SidecarPolicy) Option {
+	return func(s *Service) {
+		s.sidecar = sidecar
+		s.sidecarPolicy = policy
+	}
+}
+
+// lookup returns the enrichment of opkurl, by url or else by file name.
+func (sc Sidecar) lookup(opkurl string) *Enrichment {
+	if e, ok := sc[opkurl]; ok {
+		return e
+	}
+	name := opkurl
+	if u, err := url.Parse(opkurl); err == nil {
+		name = u.Path
+	}
+	return sc[path.Base(name)]
+}
+
+// enrich merges the sidecar metadata of the record url into record.
+func (s *Service) enrich(record *db.Record) {
+	if s.sidecar == nil {
+		return
+	}
+	e := s.sidecar.lookup(record.URL)
+	if e == nil {
+		return
+	}
+	override := s.sidecarPolicy == SidecarOverride
+
+	if primary := record.Primary(); primary != nil && e.Description != "" {
+		if override || strings.TrimSpace(primary.Description) == "" {
+			primary.Description = e.Description
+		}
+	}
+	if e.Rating != "" && (override || record.Rating == "") {
+		record.Rating = e.Rating
+	}
+	if len(e.Tags) > 0 {
+		if override {
+			record.Tags = append([]string(nil), e.Tags...)
+		} else {
+			record.Tags = mergeTags(record.Tags, e.Tags)
+		}
+	}
+}
+
+// mergeTags appends the tags in extra missing from tags.
+func mergeTags(tags, extra []string) []string {
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		seen[tag] = true
+	}
+	for _, tag := range extra {
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/avalonbits/opkcat/fetcher"
+	"github.com/avalonbits/opkcat/fetcher/fetchertest"
+)
+
+// loadSidecar writes content to a sidecar file and loads it.
+func loadSidecar(t *testing.T, content string) fetcher.Sidecar {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "sidecar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sidecar.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sidecar, err := fetcher.LoadSidecar(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sidecar
+}
+
+func TestSidecar(t *testing.T) {
+	sidecar := loadSidecar(t, `{
+		"http://example.com/doom.opk": {"description": "The classic shooter.", "tags": ["fps"], "rating": "mature"},
+		"quake.opk": {"description": "Quake, by file name."}
+	}`)
+	const (
+		doom    = "http://example.com/doom.opk"
+		quake   = "http://mirror.example.com/games/quake.opk"
+		heretic = "http://example.com/heretic.opk"
+	)
+	tests := []struct {
+		policy fetcher.SidecarPolicy
+		want   map[string]string
+	}{
+		{fetcher.SidecarOverride, map[string]string{
+			doom:    "The classic shooter.",
+			quake:   "Quake, by file name.",
+			heretic: "Heretic from the opk",
+		}},
+		{fetcher.SidecarSupplement, map[string]string{
+			doom:    "Doom from the opk",
+			quake:   "Quake, by file name.",
+			heretic: "Heretic from the opk",
+		}},
+	}
+	for _, test := range tests {
+		storage, closeStorage := newStorage(t)
+		getter := fetchertest.NewFakeGetter()
+		getter.Set(doom, &fetchertest.Response{Body: fakeImage(map[string]string{
+			"default.gcw0.desktop": desktopEntry("Doom", "Comment=Doom from the opk\n"),
+		})})
+		// Without a Comment, there is nothing to supplement.
+		getter.Set(quake, &fetchertest.Response{Body: fakeOPK("Quake")})
+		getter.Set(heretic, &fetchertest.Response{Body: fakeImage(map[string]string{
+			"default.gcw0.desktop": desktopEntry("Heretic", "Comment=Heretic from the opk\n"),
+		})})
+		s, cleanup := newService(t, storage, getter, fetcher.WithSidecar(sidecar, test.policy))
+		addURLs(t, s, doom, quake, heretic)
+		if err := s.Fetch(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		records := storedRecords(t, storage)
+		for opkurl, want := range test.want {
+			if got := records[opkurl].Primary().Description; got != want {
+				t.Errorf("policy %d, %s: got description %q, want %q", test.policy, opkurl, got, want)
+			}
+		}
+		if got := records[doom]; !reflect.DeepEqual(got.Tags, []string{"fps"}) || got.Rating != "mature" {
+			t.Errorf("policy %d: got tags %v and rating %q, want the sidecar ones", test.policy, got.Tags, got.Rating)
+		}
+		cleanup()
+		closeStorage()
+	}
+}
+
+func TestLoadSidecarInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidecar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sidecar.json")
+	if err := ioutil.WriteFile(path, []byte(`["doom.opk"]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetcher.LoadSidecar(path); err == nil {
+		t.Error("got no error loading a sidecar that isn't an object")
+	}
+}
@@ -0,0 +1,48 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInstalledSize(t *testing.T) {
+	// The zip archive deflates the repetitive data well below its installed size.
+	entry := desktopEntry("Doom", "")
+	data := strings.Repeat("doom", 4096)
+	path, remove := writeOPK(t, zipImage(map[string]string{
+		"default.gcw0.desktop": entry,
+		"doom.wad":             data,
+	}))
+	defer remove()
+	s, cleanup := newService(t, nil, nil)
+	defer cleanup()
+
+	record, err := s.FromOPK(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(len(entry) + len(data)); record.InstalledSize != want {
+		t.Errorf("got installed size %d, want %d", record.InstalledSize, want)
+	}
+	if record.InstalledSize <= record.Size {
+		t.Errorf("got installed size %d, want it larger than the compressed size %d", record.InstalledSize, record.Size)
+	}
+}
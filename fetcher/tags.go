@@ -0,0 +1,136 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/avalonbits/opkcat/db"
+)
+
+// TagRule adds Tag to a record when Pattern matches the name or description of one of its
+// entries. If Category is set, the entry must also have that category (case insensitive).
+type TagRule struct {
+	Pattern  string `json:"pattern"`
+	Tag      string `json:"tag"`
+	Category string `json:"category,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// defaultTagRules is used when no rules are configured.
+var defaultTagRules = []*TagRule{
+	{Pattern: `(?i)\b(game ?boy( colou?r)?|gbc?)\b`, Tag: "gameboy"},
+	{Pattern: `(?i)\b(game ?boy advance|gba)\b`, Tag: "gba"},
+	{Pattern: `(?i)\b(nes|famicom|nintendo entertainment system)\b`, Tag: "nes"},
+	{Pattern: `(?i)\b(snes|super nintendo|super famicom)\b`, Tag: "snes"},
+	{Pattern: `(?i)\b(n64|nintendo 64)\b`, Tag: "n64"},
+	{Pattern: `(?i)\b(genesis|mega ?drive)\b`, Tag: "genesis"},
+	{Pattern: `(?i)\b(master system|sms)\b`, Tag: "mastersystem"},
+	{Pattern: `(?i)\b(game ?gear)\b`, Tag: "gamegear"},
+	{Pattern: `(?i)\b(playstation|psx|ps1)\b`, Tag: "psx"},
+	{Pattern: `(?i)\b(pc ?engine|turbografx)\b`, Tag: "pcengine"},
+	{Pattern: `(?i)\b(neo ?geo pocket|ngpc?)\b`, Tag: "ngp"},
+	{Pattern: `(?i)\b(mame|fba|final ?burn|neo ?geo|arcade)\b`, Tag: "arcade"},
+	{Pattern: `(?i)\b(atari ?2600)\b`, Tag: "atari2600"},
+	{Pattern: `(?i)\b(c64|commodore 64)\b`, Tag: "c64"},
+	{Pattern: `(?i)\b(zx ?spectrum)\b`, Tag: "zxspectrum"},
+	{Pattern: `(?i)\b(msx)\b`, Tag: "msx"},
+	{Pattern: `(?i)\b(dos|dosbox)\b`, Tag: "dos"},
+}
+
+func init() {
+	if err := compileTagRules(defaultTagRules); err != nil {
+		panic(err)
+	}
+}
+
+// LoadTagRules reads a JSON array of tag rules from path.
+func LoadTagRules(path string) ([]*TagRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []*TagRule
+	if err := json.NewDecoder(f).Decode(&rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := compileTagRules(rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
+func compileTagRules(rules []*TagRule) error {
+	for _, rule := range rules {
+		if rule.Tag == "" {
+			return fmt.Errorf("tag rule %q has no tag", rule.Pattern)
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return err
+		}
+		rule.re = re
+	}
+	return nil
+}
+
+// deriveTags applies rules to the entries of a record, returning the sorted set of matching tags.
+func deriveTags(rules []*TagRule, entries []*db.Entry) []string {
+	found := map[string]bool{}
+	for _, entry := range entries {
+		for _, rule := range rules {
+			if found[rule.Tag] {
+				continue
+			}
+			if rule.Category != "" && !hasCategory(entry, rule.Category) {
+				continue
+			}
+			if rule.re.MatchString(entry.Name) || rule.re.MatchString(entry.Description) {
+				found[rule.Tag] = true
+			}
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+
+	tags := make([]string, 0, len(found))
+	for tag := range found {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func hasCategory(entry *db.Entry, category string) bool {
+	for _, c := range entry.Categories {
+		if strings.EqualFold(c, category) {
+			return true
+		}
+	}
+	return false
+}
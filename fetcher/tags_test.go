@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/avalonbits/opkcat/db"
+)
+
+func TestDeriveTags(t *testing.T) {
+	tests := []struct {
+		entry *db.Entry
+		want  []string
+	}{
+		{&db.Entry{Name: "Gambatte", Description: "Game Boy and Game Boy Color emulator"}, []string{"gameboy"}},
+		{&db.Entry{Name: "PicoDrive", Description: "Sega Mega Drive / Genesis emulator"}, []string{"genesis"}},
+		{&db.Entry{Name: "Snes9x", Description: "Super Nintendo emulator"}, []string{"snes"}},
+		{&db.Entry{Name: "Doom", Description: "First person shooter"}, nil},
+	}
+	for _, test := range tests {
+		got := deriveTags(defaultTagRules, []*db.Entry{test.entry})
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got tags %v, want %v", test.entry.Name, got, test.want)
+		}
+	}
+}
+
+func TestDeriveTagsCategory(t *testing.T) {
+	rules := []*TagRule{{Pattern: `(?i)\brpg\b`, Tag: "rpg", Category: "Game"}}
+	if err := compileTagRules(rules); err != nil {
+		t.Fatal(err)
+	}
+	game := &db.Entry{Name: "Quest", Description: "An RPG", Categories: []string{"game"}}
+	if got := deriveTags(rules, []*db.Entry{game}); !reflect.DeepEqual(got, []string{"rpg"}) {
+		t.Errorf("got tags %v for a game, want [rpg]", got)
+	}
+	editor := &db.Entry{Name: "Maker", Description: "An RPG editor", Categories: []string{"Development"}}
+	if got := deriveTags(rules, []*db.Entry{editor}); got != nil {
+		t.Errorf("got tags %v outside the rule category, want none", got)
+	}
+}
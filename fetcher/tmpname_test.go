@@ -0,0 +1,57 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/avalonbits/opkcat/fetcher"
+	"github.com/avalonbits/opkcat/fetcher/fetchertest"
+)
+
+func TestLongURL(t *testing.T) {
+	// The escaped file name alone is well over the 255 byte limit of most filesystems.
+	opkurl := "http://example.com/" + strings.Repeat("very%20long%20directory/", 20) +
+		strings.Repeat("doom_", 100) + ".opk"
+	getter := fetchertest.NewFakeGetter()
+	getter.Set(opkurl, &fetchertest.Response{Body: fakeOPK("Doom")})
+	s, cleanup := newService(t, nil, getter)
+	defer cleanup()
+	var names []string
+	fetcher.SetUnsquashfs(s, func(ctx context.Context, dst, file string) error {
+		names = append(names, filepath.Base(dst), filepath.Base(file))
+		return fakeUnsquashfs(ctx, dst, file)
+	})
+
+	record, err := s.FromOPKURL(opkurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.URL != opkurl || len(record.Entries) != 1 {
+		t.Errorf("got record %+v, want the doom record of the long url", record)
+	}
+	for _, name := range names {
+		if len(name) > 255 {
+			t.Errorf("got temporary name %q of %d bytes", name, len(name))
+		}
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/avalonbits/opkcat/fetcher"
+)
+
+// flakyUnsquashfs fails the first failures extractions with err before extracting as
+// fakeUnsquashfs does, recording the parent directory of every extraction.
+type flakyUnsquashfs struct {
+	failures int
+	err      error
+	dirs     []string
+}
+
+func (f *flakyUnsquashfs) unsquashfs(ctx context.Context, dst, file string) error {
+	f.dirs = append(f.dirs, filepath.Dir(dst))
+	if len(f.dirs) <= f.failures {
+		return f.err
+	}
+	return fakeUnsquashfs(ctx, dst, file)
+}
+
+func TestUnsquashfsRetry(t *testing.T) {
+	path, remove := writeOPK(t, fakeOPK("doom"))
+	defer remove()
+	s, cleanup := newService(t, nil, nil)
+	defer cleanup()
+	flaky := &flakyUnsquashfs{failures: 1, err: errors.New("unsquashfs: cannot create directory")}
+	fetcher.SetUnsquashfs(s, flaky.unsquashfs)
+
+	record, err := s.FromOPK(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record.Entries) != 1 || record.Entries[0].Name != "doom" {
+		t.Errorf("got entries %+v, want the doom entry", record.Entries)
+	}
+	if len(flaky.dirs) != 2 {
+		t.Fatalf("got %d extractions, want 2", len(flaky.dirs))
+	}
+	if flaky.dirs[0] == flaky.dirs[1] {
+		t.Errorf("both attempts extracted into %s, want a fresh directory for the retry", flaky.dirs[0])
+	}
+}
+
+func TestUnsquashfsRetryGivesUp(t *testing.T) {
+	path, remove := writeOPK(t, fakeOPK("doom"))
+	defer remove()
+	s, cleanup := newService(t, nil, nil)
+	defer cleanup()
+	flaky := &flakyUnsquashfs{failures: 10, err: errors.New("unsquashfs: Too many open files")}
+	fetcher.SetUnsquashfs(s, flaky.unsquashfs)
+
+	if _, err := s.FromOPK(path); err != flaky.err {
+		t.Errorf("got error %v, want %v", err, flaky.err)
+	}
+	if len(flaky.dirs) != 3 {
+		t.Errorf("got %d extractions, want the 3 attempts", len(flaky.dirs))
+	}
+}
+
+func TestUnsquashfsNoRetryOnCorruptImage(t *testing.T) {
+	path, remove := writeOPK(t, fakeOPK("doom"))
+	defer remove()
+	s, cleanup := newService(t, nil, nil)
+	defer cleanup()
+	flaky := &flakyUnsquashfs{failures: 1, err: errors.New("unsquashfs: read_block: failed to read block")}
+	fetcher.SetUnsquashfs(s, flaky.unsquashfs)
+
+	if _, err := s.FromOPK(path); err != flaky.err {
+		t.Errorf("got error %v, want %v", err, flaky.err)
+	}
+	if len(flaky.dirs) != 1 {
+		t.Errorf("got %d extractions, want a single attempt", len(flaky.dirs))
+	}
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package fetcher
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// Warning is a problem found by ValidateDesktopEntry.
+type Warning struct {
+	// File is the desktop entry file with the problem, when validating an opk.
+	File string `json:"file,omitempty"`
+	// Key is the desktop entry key with the problem, if it is about a single key.
+	Key string `json:"key,omitempty"`
+	Msg string `json:"message"`
+}
+
+func (w Warning) String() string {
+	var b strings.Builder
+	if w.File != "" {
+		b.WriteString(w.File + ": ")
+	}
+	if w.Key != "" {
+		b.WriteString(w.Key + ": ")
+	}
+	b.WriteString(w.Msg)
+	return b.String()
+}
+
+// desktopTypes are the valid values of the Type key.
+var desktopTypes = map[string]bool{"Application": true, "Link": true, "Directory": true}
+
+// mainCategories are the main categories of the freedesktop menu specification. Entries should
+// have at least one.
+var mainCategories = map[string]bool{
+	"AudioVideo": true, "Audio": true, "Video": true, "Development": true, "Education": true,
+	"Game": true, "Graphics": true, "Network": true, "Office": true, "Science": true,
+	"Settings": true, "System": true, "Utility": true,
+}
+
+// additionalCategories are the additional and reserved categories of the freedesktop menu
+// specification.
+var additionalCategories = map[string]bool{}
+
+func init() {
+	for _, c := range strings.Fields(`
+		Building Debugger IDE GUIDesigner Profiling RevisionControl Translation Calendar
+		ContactManagement Database Dictionary Chart Email Finance FlowChart PDA ProjectManagement
+		Presentation Spreadsheet WordProcessor 2DGraphics VectorGraphics RasterGraphics 3DGraphics
+		Scanning OCR Photography Publishing Viewer TextTools DesktopSettings HardwareSettings
+		Printing PackageManager Dialup InstantMessaging Chat IRCClient Feed FileTransfer HamRadio
+		News P2P RemoteAccess Telephony TelephonyTools VideoConference WebBrowser WebDevelopment
+		Midi Mixer Sequencer Tuner TV AudioVideoEditing Player Recorder DiscBurning ActionGame
+		AdventureGame ArcadeGame BoardGame BlocksGame CardGame KidsGame LogicGame RolePlaying
+		Shooter Simulation SportsGame StrategyGame Art Construction Music Languages
+		ArtificialIntelligence Astronomy Biology Chemistry ComputerScience DataVisualization
+		Economy Electricity Geography Geology Geoscience History Humanities ImageProcessing
+		Literature Maps Math NumericalAnalysis MedicalSoftware Physics Robotics Spirituality
+		Sports ParallelComputing Amusement Archiving Compression Electronics Emulator Engineering
+		FileTools FileManager TerminalEmulator Filesystem Monitor Security Accessibility
+		Calculator Clock TextEditor Documentation Adult Core KDE GNOME XFCE DDE GTK Qt Motif Java
+		ConsoleOnly Screensaver TrayIcon Applet Shell`) {
+		additionalCategories[c] = true
+	}
+}
+
+// ValidateDesktopEntry checks the desktop entry in content against the freedesktop desktop entry
+// and menu specifications: the required keys, the Type, the Categories and the Exec command line.
+// It returns nil if the entry is compliant.
+func ValidateDesktopEntry(content []byte) []Warning {
+	// Desktop entries only have whole line comments, and values like Categories are lists
+	// separated by semicolons, which ini would take for the start of a comment.
+	cfg, err := ini.LoadSources(ini.LoadOptions{IgnoreInlineComment: true}, content)
+	if err != nil {
+		return []Warning{{Msg: err.Error()}}
+	}
+	sec, err := cfg.GetSection("Desktop Entry")
+	if err != nil {
+		return []Warning{{Msg: `missing the "Desktop Entry" group`}}
+	}
+
+	var warnings []Warning
+	warn := func(key, format string, args ...interface{}) {
+		warnings = append(warnings, Warning{Key: key, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	typ := strings.TrimSpace(sec.Key("Type").String())
+	switch {
+	case typ == "":
+		warn("Type", "required key is missing")
+	case !desktopTypes[typ]:
+		warn("Type", "invalid value %q, must be Application, Link or Directory", typ)
+	}
+	if strings.TrimSpace(sec.Key("Name").String()) == "" {
+		warn("Name", "required key is missing")
+	}
+	if typ == "Link" && strings.TrimSpace(sec.Key("URL").String()) == "" {
+		warn("URL", "required key for Link entries is missing")
+	}
+
+	if typ == "Application" {
+		exec := sec.Key("Exec").String()
+		if strings.TrimSpace(exec) == "" {
+			warn("Exec", "required key for Application entries is missing")
+		} else if msg := validateExec(exec); msg != "" {
+			warn("Exec", "%s", msg)
+		}
+	}
+
+	if sec.HasKey("Categories") {
+		hasMain := false
+		for _, c := range strings.Split(sec.Key("Categories").String(), ";") {
+			c = strings.TrimSpace(c)
+			switch {
+			case c == "":
+			case mainCategories[c]:
+				hasMain = true
+			case additionalCategories[c], strings.HasPrefix(c, "X-"):
+			default:
+				warn("Categories", "%q is not a registered category", c)
+			}
+		}
+		if !hasMain {
+			warn("Categories", "no main category")
+		}
+	}
+	return warnings
+}
+
+// validateExec checks the quoting and the field codes of an Exec command line. It returns a
+// description of the first problem found, or an empty string.
+func validateExec(exec string) string {
+	quoted := false
+	for i := 0; i < len(exec); i++ {
+		switch c := exec[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == '%':
+			if i+1 == len(exec) {
+				return "field code is missing after %"
+			}
+			i++
+			switch code := exec[i]; code {
+			case 'f', 'F', 'u', 'U', 'i', 'c', 'k', '%':
+			case 'd', 'D', 'n', 'N', 'v', 'm':
+				return fmt.Sprintf("deprecated field code %%%c", code)
+			default:
+				return fmt.Sprintf("invalid field code %%%c", code)
+			}
+		}
+	}
+	if quoted {
+		return "unterminated quote"
+	}
+	return ""
+}
+
+// ValidateOPK checks every desktop entry in the opk file at opkfile with ValidateDesktopEntry.
+func (s *Service) ValidateOPK(opkfile string) ([]Warning, error) {
+	dir, finalDir, err := s.extract(context.Background(), opkfile, opkfile)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	entries, err := desktopEntries(finalDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return []Warning{{Msg: "no desktop entries"}}, nil
+	}
+
+	var warnings []Warning
+	for _, entry := range entries {
+		content, err := ioutil.ReadFile(entry)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range ValidateDesktopEntry(content) {
+			w.File = filepath.Base(entry)
+			warnings = append(warnings, w)
+		}
+	}
+	return warnings, nil
+}
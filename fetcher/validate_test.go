@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/avalonbits/opkcat/fetcher"
+)
+
+func TestValidateDesktopEntry(t *testing.T) {
+	const valid = "[Desktop Entry]\nType=Application\nName=Doom\nExec=doom %f\nCategories=Game;ActionGame;\n"
+	tests := []struct {
+		name  string
+		entry string
+		want  []fetcher.Warning
+	}{
+		{"compliant", valid, nil},
+		{"no group", "Name=Doom\n", []fetcher.Warning{{Msg: `missing the "Desktop Entry" group`}}},
+
+		// Required keys.
+		{"missing type", "[Desktop Entry]\nName=Doom\n", []fetcher.Warning{{Key: "Type", Msg: "required key is missing"}}},
+		{"missing name", "[Desktop Entry]\nType=Directory\n", []fetcher.Warning{{Key: "Name", Msg: "required key is missing"}}},
+
+		// Types.
+		{"directory", "[Desktop Entry]\nType=Directory\nName=Games\n", nil},
+		{"invalid type", "[Desktop Entry]\nType=Game\nName=Doom\n",
+			[]fetcher.Warning{{Key: "Type", Msg: `invalid value "Game", must be Application, Link or Directory`}}},
+		{"link", "[Desktop Entry]\nType=Link\nName=Manual\nURL=manual.html\n", nil},
+		{"link without url", "[Desktop Entry]\nType=Link\nName=Manual\n",
+			[]fetcher.Warning{{Key: "URL", Msg: "required key for Link entries is missing"}}},
+
+		// Categories.
+		{"additional categories", "[Desktop Entry]\nType=Directory\nName=Games\nCategories=Utility;Emulator;X-OpenDingux;\n", nil},
+		{"unregistered category", "[Desktop Entry]\nType=Directory\nName=Games\nCategories=Game;Retro;\n",
+			[]fetcher.Warning{{Key: "Categories", Msg: `"Retro" is not a registered category`}}},
+		{"no main category", "[Desktop Entry]\nType=Directory\nName=Games\nCategories=ActionGame;\n",
+			[]fetcher.Warning{{Key: "Categories", Msg: "no main category"}}},
+
+		// Exec.
+		{"missing exec", "[Desktop Entry]\nType=Application\nName=Doom\n",
+			[]fetcher.Warning{{Key: "Exec", Msg: "required key for Application entries is missing"}}},
+		{"quoted exec", "[Desktop Entry]\nType=Application\nName=Doom\nExec=\"doom engine\" -iwad \"\\\\\"doom\\\\\".wad\" %U %%\n", nil},
+		{"unterminated quote", "[Desktop Entry]\nType=Application\nName=Doom\nExec=\"doom %f\n",
+			[]fetcher.Warning{{Key: "Exec", Msg: "unterminated quote"}}},
+		{"invalid field code", "[Desktop Entry]\nType=Application\nName=Doom\nExec=doom %x\n",
+			[]fetcher.Warning{{Key: "Exec", Msg: "invalid field code %x"}}},
+		{"deprecated field code", "[Desktop Entry]\nType=Application\nName=Doom\nExec=doom %d\n",
+			[]fetcher.Warning{{Key: "Exec", Msg: "deprecated field code %d"}}},
+		{"missing field code", "[Desktop Entry]\nType=Application\nName=Doom\nExec=doom %\n",
+			[]fetcher.Warning{{Key: "Exec", Msg: "field code is missing after %"}}},
+	}
+	for _, test := range tests {
+		if got := fetcher.ValidateDesktopEntry([]byte(test.entry)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got warnings %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestValidateOPK(t *testing.T) {
+	tests := []struct {
+		files map[string]string
+		want  []fetcher.Warning
+	}{
+		{
+			map[string]string{
+				"doom.gcw0.desktop":  desktopEntry("Doom", "Categories=Game;\n"),
+				"quake.gcw0.desktop": desktopEntry("Quake", "Categories=Shooter;\n"),
+			},
+			[]fetcher.Warning{{File: "quake.gcw0.desktop", Key: "Categories", Msg: "no main category"}},
+		},
+		{
+			map[string]string{"README": "no entries"},
+			[]fetcher.Warning{{Msg: "no desktop entries"}},
+		},
+	}
+	for _, test := range tests {
+		path, remove := writeOPK(t, fakeImage(test.files))
+		s, cleanup := newService(t, nil, nil)
+		got, err := s.ValidateOPK(path)
+		cleanup()
+		remove()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("got warnings %v, want %v", got, test.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/avalonbits/opkcat/db"
+)
+
+// maxSummaryErrors is the maximum number of url errors listed in a FetchSummary.
+const maxSummaryErrors = 50
+
+// FetchSummary describes a fetch cycle.
+type FetchSummary struct {
+	Start       time.Time `json:"start"`
+	Duration    float64   `json:"duration_seconds"`
+	URLs        int       `json:"urls"`
+	Updated     int       `json:"updated"`
+	UpToDate    int       `json:"up_to_date"`
+	Failed      int       `json:"failed"`
+	Quarantined int       `json:"quarantined"`
+	Skipped     int       `json:"skipped"`
+
+	// NewPackages are the urls fetched for the first time, and Pruned the urls removed for
+	// failing too long.
+	NewPackages []string `json:"new_packages,omitempty"`
+	Pruned      []string `json:"pruned,omitempty"`
+
+	// Errors are the first url errors, and Error the error that ended the cycle, if any.
+	Errors []string `json:"errors,omitempty"`
+	Error  string   `json:"error,omitempty"`
+
+	// Text and Content repeat the summary as a sentence, which is what Slack and Discord
+	// webhooks display.
+	Text    string `json:"text"`
+	Content string `json:"content"`
+
+	mu sync.Mutex
+}
+
+// inc increments counter, which must be a field of sum.
+func (sum *FetchSummary) inc(counter *int) {
+	sum.mu.Lock()
+	defer sum.mu.Unlock()
+	*counter++
+}
+
+// addError counts a failed url, keeping its error if there is room.
+func (sum *FetchSummary) addError(opkurl string, err error) {
+	sum.mu.Lock()
+	defer sum.mu.Unlock()
+	sum.Failed++
+	if len(sum.Errors) < maxSummaryErrors {
+		sum.Errors = append(sum.Errors, fmt.Sprintf("%s: %v", opkurl, err))
+	}
+}
+
+// addPruned adds a pruned url.
+func (sum *FetchSummary) addPruned(opkurl string) {
+	sum.mu.Lock()
+	defer sum.mu.Unlock()
+	sum.Pruned = append(sum.Pruned, opkurl)
+}
+
+// stats returns the summary as kept in the fetch history.
+func (sum *FetchSummary) stats() *db.FetchStats {
+	sum.mu.Lock()
+	defer sum.mu.Unlock()
+	return &db.FetchStats{
+		Start:       sum.Start,
+		Duration:    sum.Duration,
+		URLs:        sum.URLs,
+		Updated:     sum.Updated,
+		UpToDate:    sum.UpToDate,
+		Failed:      sum.Failed,
+		Quarantined: sum.Quarantined,
+		Skipped:     sum.Skipped,
+		NewURLs:     sum.NewPackages,
+		PrunedURLs:  sum.Pruned,
+		Error:       sum.Error,
+	}
+}
+
+// finish completes the summary of the cycle ending with err.
+func (sum *FetchSummary) finish(err error) {
+	sum.mu.Lock()
+	defer sum.mu.Unlock()
+	sum.Duration = time.Since(sum.Start).Seconds()
+	if err != nil {
+		sum.Error = err.Error()
+	}
+	sum.Text = fmt.Sprintf("opkcat fetched %d urls in %.0fs: %d updated, %d new, %d up-to-date, %d failed, %d quarantined, %d skipped.",
+		sum.URLs, sum.Duration, sum.Updated, len(sum.NewPackages), sum.UpToDate, sum.Failed, sum.Quarantined, sum.Skipped)
+	if sum.Error != "" {
+		sum.Text += " The cycle failed: " + sum.Error
+	}
+	sum.Content = sum.Text
+}
+
+// webhookTimeout is how long delivering a summary may take.
+const webhookTimeout = 10 * time.Second
+
+// WithWebhook makes the service POST a JSON FetchSummary to url after each fetch cycle, whether it
+// succeeded or not. The payload also works with Slack and Discord webhooks.
+func WithWebhook(url string) Option {
+	return func(s *Service) {
+		s.webhook = url
+	}
+}
+
+// postSummary delivers sum to the webhook. Failing to deliver it is only logged, it doesn't fail
+// the fetch.
+func (s *Service) postSummary(sum *FetchSummary) {
+	body, err := json.Marshal(sum)
+	if err != nil {
+		s.logError(s.webhook, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", s.webhook, bytes.NewReader(body))
+	if err != nil {
+		s.logError(s.webhook, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		s.logError(s.webhook, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		s.logError(s.webhook, fmt.Errorf("webhook error: %v", resp.StatusCode))
+	}
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fetcher_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/avalonbits/opkcat/fetcher"
+	"github.com/avalonbits/opkcat/fetcher/fetchertest"
+)
+
+func TestWebhook(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	payloads := make(chan []byte, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got a %s request of %q, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		payloads <- body
+	}))
+	defer hook.Close()
+
+	const (
+		found   = "http://example.com/doom.opk"
+		missing = "http://example.com/missing.opk"
+	)
+	getter := fetchertest.NewFakeGetter()
+	getter.Set(found, &fetchertest.Response{Body: fakeOPK("Doom"), Etag: `"doom"`})
+	s, cleanup := newService(t, storage, getter, fetcher.WithWebhook(hook.URL))
+	defer cleanup()
+	addURLs(t, s, found, missing)
+
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var body []byte
+	select {
+	case body = <-payloads:
+	default:
+		t.Fatal("got no summary posted")
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("got an invalid payload %q: %v", body, err)
+	}
+	for _, key := range []string{"start", "duration_seconds", "urls", "updated", "up_to_date", "failed", "quarantined", "skipped", "new_packages", "errors", "text", "content"} {
+		if _, ok := payload[key]; !ok {
+			t.Errorf("got payload %s without %q", body, key)
+		}
+	}
+	var sum fetcher.FetchSummary
+	if err := json.Unmarshal(body, &sum); err != nil {
+		t.Fatal(err)
+	}
+	if sum.URLs != 2 || sum.Updated != 1 || sum.Failed != 1 || len(sum.Errors) != 1 || sum.Error != "" {
+		t.Errorf("got summary %s, want 2 urls, 1 updated and 1 failed", body)
+	}
+	if len(sum.NewPackages) != 1 || sum.NewPackages[0] != found {
+		t.Errorf("got new packages %v, want %s", sum.NewPackages, found)
+	}
+	if sum.Text == "" || sum.Content != sum.Text {
+		t.Errorf("got text %q and content %q, want the same sentence", sum.Text, sum.Content)
+	}
+
+	// The next cycle finds nothing new.
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	body = <-payloads
+	var next fetcher.FetchSummary
+	if err := json.Unmarshal(body, &next); err != nil {
+		t.Fatal(err)
+	}
+	if next.UpToDate != 1 || next.Updated != 0 || len(next.NewPackages) != 0 {
+		t.Errorf("got summary %s of the second cycle, want 1 up-to-date url", body)
+	}
+}
+
+func TestWebhookFailure(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer hook.Close()
+
+	const opkurl = "http://example.com/doom.opk"
+	getter := fetchertest.NewFakeGetter()
+	getter.Set(opkurl, &fetchertest.Response{Body: fakeOPK("Doom")})
+	for _, url := range []string{hook.URL, "http://127.0.0.1:0/hook"} {
+		s, cleanup := newService(t, storage, getter, fetcher.WithWebhook(url))
+		addURLs(t, s, opkurl)
+		if err := s.Fetch(context.Background()); err != nil {
+			t.Errorf("got error %v delivering to %s, want the fetch to succeed", err, url)
+		}
+		cleanup()
+	}
+	if record := storedRecords(t, storage)[opkurl]; record == nil {
+		t.Error("got no record stored")
+	}
+}
+
+func TestFetchHistory(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+	storage.SetFetchHistory(2)
+
+	const opkurl = "http://example.com/doom.opk"
+	getter := fetchertest.NewFakeGetter()
+	getter.Set(opkurl, &fetchertest.Response{Body: fakeOPK("Doom"), Etag: `"doom"`})
+	s, cleanup := newService(t, storage, getter)
+	defer cleanup()
+	addURLs(t, s, opkurl)
+
+	for i := 0; i < 3; i++ {
+		if err := s.Fetch(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history, err := storage.FetchHistory(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("got %d cycles, want the last 2", len(history))
+	}
+	for _, stats := range history {
+		if stats.URLs != 1 || stats.UpToDate != 1 || len(stats.NewURLs) != 0 {
+			t.Errorf("got cycle %+v, want the url up-to-date", stats)
+		}
+	}
+	if !history[0].Start.After(history[1].Start) {
+		t.Errorf("got cycles started at %v and %v, want the most recent first", history[0].Start, history[1].Start)
+	}
+}
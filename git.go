@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package opkcat
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+type gitOptions struct {
+	token string
+}
+
+// GitOption configures how SourceListFromGit accesses the repository.
+type GitOption func(*gitOptions)
+
+// WithGitToken authenticates https requests to the repository with token, as supported by GitHub
+// and most other hosts for private repositories.
+func WithGitToken(token string) GitOption {
+	return func(o *gitOptions) {
+		o.token = token
+	}
+}
+
+// SourceListFromGit returns a list of known opk files read from the markdown file at path
+// in the git repository at repoURL. The ref can be a branch, a tag or a commit, which pins the
+// source list to a known version. Only ref is fetched, without history.
+func SourceListFromGit(ctx context.Context, repoURL, ref, path string, opts ...GitOption) ([]SourceEntry, error) {
+	var o gitOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	dir, err := ioutil.TempDir("", "opkcat-git-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	git := func(args ...string) ([]byte, error) {
+		cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		if o.token != "" {
+			// Passing the header through the environment keeps the token out of the process list.
+			auth := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + o.token))
+			cmd.Env = append(cmd.Env,
+				"GIT_CONFIG_COUNT=1",
+				"GIT_CONFIG_KEY_0=http.extraHeader",
+				"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth)
+		}
+		out, err := cmd.Output()
+		if err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				return nil, fmt.Errorf("git %s: %s: %w", args[0], bytes.TrimSpace(exitErr.Stderr), err)
+			}
+			return nil, err
+		}
+		return out, nil
+	}
+
+	if _, err := git("init", "-q"); err != nil {
+		return nil, err
+	}
+	if _, err := git("fetch", "-q", "--depth", "1", repoURL, ref); err != nil {
+		return nil, err
+	}
+	// Check the size first so a huge file is never read.
+	size, err := git("cat-file", "-s", "FETCH_HEAD:"+path)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseInt(string(bytes.TrimSpace(size)), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if n > MaxSourceBytes {
+		return nil, fmt.Errorf("%s: source list is larger than the maximum of %d bytes", path, MaxSourceBytes)
+	}
+	content, err := git("show", "FETCH_HEAD:"+path)
+	if err != nil {
+		return nil, err
+	}
+	return opkLinks(content)
+}
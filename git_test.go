@@ -0,0 +1,87 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package opkcat
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// gitRepo returns a git repository in a temporary directory and a function running git in it.
+func gitRepo(t *testing.T) (string, func(args ...string), func()) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "opkcat-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	git := func(args ...string) {
+		t.Helper()
+		args = append([]string{"-C", dir, "-c", "user.name=opkcat", "-c", "user.email=opkcat@example.com", "-c", "commit.gpgsign=false"}, args...)
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s: %v", args, out, err)
+		}
+	}
+	git("init", "-q")
+	return dir, git, func() { os.RemoveAll(dir) }
+}
+
+func TestSourceListFromGit(t *testing.T) {
+	dir, git, cleanup := gitRepo(t)
+	defer cleanup()
+
+	commit := func(md, tag string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(dir, "Sources.md"), []byte(md), 0644); err != nil {
+			t.Fatal(err)
+		}
+		git("add", "Sources.md")
+		git("commit", "-q", "-m", tag)
+		git("tag", tag)
+	}
+	commit("* [Doom](http://example.com/doom.opk)\n", "v1")
+	commit("* [Doom](http://example.com/doom.opk)\n* [Quake](http://example.com/quake.opk)\n", "v2")
+
+	// The list is read as of the ref, not the latest commit.
+	links, err := SourceListFromGit(context.Background(), "file://"+dir, "v1", "Sources.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []SourceEntry{{URL: "http://example.com/doom.opk", Title: "Doom"}}; !reflect.DeepEqual(links, want) {
+		t.Errorf("got links %v at v1, want %v", links, want)
+	}
+	links, err = SourceListFromGit(context.Background(), "file://"+dir, "v2", "Sources.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 2 {
+		t.Errorf("got links %v at v2, want 2", links)
+	}
+
+	if _, err := SourceListFromGit(context.Background(), "file://"+dir, "v2", "Missing.md"); err == nil {
+		t.Error("got no error for a missing file")
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package opkcat
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger receives the log messages of the services by severity. Routine progress is Debug,
+// summaries and state changes Info, problems the services recover from Warn, and failures Error.
+type Logger interface {
+	Debug(v ...interface{})
+	Info(v ...interface{})
+	Warn(v ...interface{})
+	Error(v ...interface{})
+}
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level named name: debug, info, warn or error.
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+type stdLogger struct {
+	min Level
+}
+
+// StdLogger returns a Logger writing the messages at least as severe as min to the standard
+// logger. Messages other than Debug and Info are prefixed by their level.
+func StdLogger(min Level) Logger {
+	return &stdLogger{min: min}
+}
+
+func (l *stdLogger) Debug(v ...interface{}) { l.print(LevelDebug, v) }
+func (l *stdLogger) Info(v ...interface{})  { l.print(LevelInfo, v) }
+func (l *stdLogger) Warn(v ...interface{})  { l.print(LevelWarn, v) }
+func (l *stdLogger) Error(v ...interface{}) { l.print(LevelError, v) }
+
+func (l *stdLogger) print(level Level, v []interface{}) {
+	if level < l.min {
+		return
+	}
+	if level >= LevelWarn {
+		v = append([]interface{}{strings.ToUpper(level.String()) + ":"}, v...)
+	}
+	log.Println(v...)
+}
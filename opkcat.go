@@ -20,11 +20,20 @@ package opkcat
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 
 	"github.com/gomarkdown/markdown/ast"
 	"github.com/gomarkdown/markdown/parser"
@@ -35,91 +44,477 @@ type StartStopper interface {
 	Stop() error
 }
 
+// Readier is a StartStopper that reports when it is running, that is when Stop can stop it.
+// ServiceManager considers the services that don't implement it running as soon as Start is
+// called.
+type Readier interface {
+	Ready() <-chan struct{}
+}
+
+// closedC is a closed channel, the readiness of services that don't report it.
+var closedC = make(chan struct{})
+
+func init() {
+	close(closedC)
+}
+
+// ready returns the channel closed once ss is running.
+func ready(ss StartStopper) <-chan struct{} {
+	if r, ok := ss.(Readier); ok {
+		return r.Ready()
+	}
+	return closedC
+}
+
 type ServiceManager struct {
 	services []StartStopper
 	wg       sync.WaitGroup
+	reload   func() error
+	logger   Logger
 }
 
 func NewServiceManager(services []StartStopper) *ServiceManager {
 	return &ServiceManager{
 		services: services,
+		logger:   StdLogger(LevelDebug),
 	}
 }
 
+// SetLogger makes the manager write its messages to logger instead of the standard logger.
+func (sm *ServiceManager) SetLogger(logger Logger) {
+	sm.logger = logger
+}
+
+// SetReload makes Run call reload every time the process receives SIGHUP, while the services keep
+// running. Reloads don't overlap, and a failed reload is only logged.
+func (sm *ServiceManager) SetReload(reload func() error) {
+	sm.reload = reload
+}
+
 func (sm *ServiceManager) Run() error {
 	sigC := make(chan os.Signal, 1)
-	signal.Notify(sigC, os.Interrupt, os.Kill)
+	signal.Notify(sigC, os.Interrupt, syscall.SIGTERM)
+
+	if sm.reload != nil {
+		hupC := make(chan os.Signal, 1)
+		signal.Notify(hupC, syscall.SIGHUP)
+		defer func() {
+			signal.Stop(hupC)
+			close(hupC)
+		}()
+		go func() {
+			for range hupC {
+				sm.logger.Info("Reloading.")
+				if err := sm.reload(); err != nil {
+					sm.logger.Error("Reload failed:", err)
+				}
+			}
+		}()
+	}
 
+	// A service failing to start stops the others, as a signal would. Only the services that
+	// are running are stopped: a quit arriving while a service starts waits for it to be running
+	// or to fail, and a service whose Start returned has nothing to stop.
 	quit := make(chan bool)
+	failed := make(chan struct{})
+	var failOnce sync.Once
 	errs := make([]error, len(sm.services))
 	for idx, s := range sm.services {
 		sm.wg.Add(1)
 		go func(idx int, ss StartStopper) {
 			defer sm.wg.Done()
+			started := make(chan error, 1)
 			go func() {
-				if err := ss.Start(); err != nil {
-					panic(err)
-				}
+				started <- ss.Start()
 			}()
-			<-quit
+			fail := func(err error) {
+				errs[idx] = fmt.Errorf("start: %w", err)
+				failOnce.Do(func() { close(failed) })
+			}
+
+			select {
+			case err := <-started:
+				if err != nil {
+					fail(err)
+				}
+				return
+			case <-ready(ss):
+			}
+			select {
+			case err := <-started:
+				if err != nil {
+					fail(err)
+				}
+				return
+			case <-quit:
+			}
 			if err := ss.Stop(); err != nil {
 				errs[idx] = err
 			}
+			if err := <-started; err != nil && errs[idx] == nil {
+				errs[idx] = fmt.Errorf("start: %w", err)
+			}
 		}(idx, s)
 	}
-	<-sigC
-	log.Println("Signalling quit.")
+	select {
+	case <-sigC:
+	case <-failed:
+		sm.logger.Error("A service failed to start.")
+	}
+	sm.logger.Info("Signalling quit.")
 	close(quit)
 
-	log.Println("Waiting for everyone to finish")
+	sm.logger.Debug("Waiting for everyone to finish")
 	sm.wg.Wait()
 
-	log.Println("Checking for errors.")
+	sm.logger.Debug("Checking for errors.")
+	var msgs []string
 	for _, err := range errs {
 		if err != nil {
-			return err
+			msgs = append(msgs, err.Error())
 		}
 	}
+	if len(msgs) > 0 {
+		return fmt.Errorf("%d services failed: %s", len(msgs), strings.Join(msgs, "; "))
+	}
 
-	log.Println("Service manager is done.")
+	sm.logger.Info("Service manager is done.")
 	return nil
 }
 
 var opkEnd = []byte(".opk")
 
-// SourceList returns a list of URLs of known opk files
-func SourceList(markdown string) []string {
+// Limits on the source lists, which may come from untrusted places. They keep hostile documents
+// from exhausting memory.
+var (
+	// MaxSourceBytes is the maximum size of a source list document.
+	MaxSourceBytes int64 = 16 << 20
+
+	// MaxSourceLinks is the maximum number of opk links in a source list, including the
+	// documents it links to.
+	MaxSourceLinks = 100000
+)
+
+// errTooManyLinks is returned when a source list has more than MaxSourceLinks opk links.
+var errTooManyLinks = errors.New("source list has more than the maximum number of opk links")
+
+// SourceEntry is an opk link of a source list. Title is the text of the link, which often names
+// the opk better than its own metadata.
+type SourceEntry struct {
+	URL   string
+	Title string
+}
+
+// SourceURLs returns the URLs of entries.
+func SourceURLs(entries []SourceEntry) []string {
+	urls := make([]string, len(entries))
+	for i, entry := range entries {
+		urls[i] = entry.URL
+	}
+	return urls
+}
+
+// SourceList returns a list of known opk files read from the markdown file.
+func SourceList(markdown string) ([]SourceEntry, error) {
 	f, err := os.Open(markdown)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	defer f.Close()
+
+	buf, err := readSource(f, markdown)
+	if err != nil {
+		return nil, err
+	}
+	links, err := opkLinks(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", markdown, err)
+	}
+	return links, nil
+}
+
+// SourceListFrom returns a list of known opk files read from the file at path, in the format
+// matching its extension: one url per line for .txt, a JSON array of urls, or of objects with url
+// and title fields, for .json, and markdown otherwise.
+func SourceListFrom(path string) ([]SourceEntry, error) {
+	var parse func([]byte) ([]SourceEntry, error)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".txt":
+		parse = textLinks
+	case ".json":
+		parse = jsonLinks
+	default:
+		return SourceList(path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
 	}
 	defer f.Close()
 
-	buf, err := ioutil.ReadAll(f)
+	buf, err := readSource(f, path)
+	if err != nil {
+		return nil, err
+	}
+	links, err := parse(buf)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	links = dedupeSources(links)
+	if len(links) > MaxSourceLinks {
+		return nil, fmt.Errorf("%s: %w", path, errTooManyLinks)
+	}
+	return links, nil
+}
+
+// textLinks returns the urls in buf, one per line. Blank lines and lines starting with # are
+// skipped.
+func textLinks(buf []byte) ([]SourceEntry, error) {
+	var links []SourceEntry
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		links = append(links, SourceEntry{URL: line})
+	}
+	return links, nil
+}
+
+// jsonLink is an object of a JSON source list.
+type jsonLink struct {
+	URL   string `json:"url"`
+	Title string `json:"title"`
+}
+
+// jsonLinks returns the urls in the JSON array in buf, whose elements are either urls or objects
+// with a url field.
+func jsonLinks(buf []byte) ([]SourceEntry, error) {
+	var elems []json.RawMessage
+	if err := json.Unmarshal(buf, &elems); err != nil {
+		return nil, err
+	}
+	links := make([]SourceEntry, 0, len(elems))
+	for i, elem := range elems {
+		var link jsonLink
+		if err := json.Unmarshal(elem, &link.URL); err != nil {
+			if err := json.Unmarshal(elem, &link); err != nil {
+				return nil, fmt.Errorf("element %d: %w", i, err)
+			}
+		}
+		if link.URL == "" {
+			return nil, fmt.Errorf("element %d: missing url", i)
+		}
+		links = append(links, SourceEntry{URL: link.URL, Title: link.Title})
 	}
+	return links, nil
+}
 
+// readSource reads the source list document in r, failing if it is larger than MaxSourceBytes.
+func readSource(r io.Reader, name string) ([]byte, error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(r, MaxSourceBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) > MaxSourceBytes {
+		return nil, fmt.Errorf("%s: source list is larger than the maximum of %d bytes", name, MaxSourceBytes)
+	}
+	return buf, nil
+}
+
+// LoadURLHeaders reads a JSON file mapping opk urls to the headers sent only with their requests,
+// e.g. mirror specific tokens or referers. It lives next to the source list so that a mirror's
+// credentials are never sent to other mirrors.
+func LoadURLHeaders(path string) (map[string]map[string]string, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]map[string]string{}
+	if err := json.Unmarshal(buf, &headers); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return headers, nil
+}
+
+// opkLinks returns the links to opk files in the markdown document. It fails if there are more
+// than MaxSourceLinks.
+func opkLinks(buf []byte) ([]SourceEntry, error) {
+	links := dedupeSources(markdownLinks(buf, opkEnd))
+	if len(links) > MaxSourceLinks {
+		return nil, errTooManyLinks
+	}
+	return links, nil
+}
+
+// normalizeURL returns link without its fragment and with a lowercase scheme and host, so links to
+// the same opk compare equal. Links that can't be parsed are returned as they are. It is only used
+// to compare urls: the catalog keys its records by the url as written, so storing the normalized
+// form would orphan the records of urls already known.
+func normalizeURL(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	u.Fragment = ""
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	return u.String()
+}
+
+// dedupeSources returns sources keeping only the first entry of each url, as compared by
+// normalizeURL. The entries kept are unchanged.
+func dedupeSources(sources []SourceEntry) []SourceEntry {
+	seen := make(map[string]bool, len(sources))
+	unique := sources[:0]
+	for _, src := range sources {
+		key := normalizeURL(src.URL)
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, src)
+		}
+	}
+	return unique
+}
+
+// markdownLinks returns the links in the markdown document with a destination that ends with one
+// of suffixes.
+func markdownLinks(buf []byte, suffixes ...[]byte) []SourceEntry {
 	mdParser := parser.New()
 	node := mdParser.Parse(buf)
 
-	opks := make([]string, 0, 32)
+	links := make([]SourceEntry, 0, 32)
 	ast.WalkFunc(node, ast.NodeVisitorFunc(func(node ast.Node, entering bool) ast.WalkStatus {
 		if !entering {
 			return ast.GoToNext
 		}
 
-		// We look for links in the page that end with .opk
+		// We look for links in the page that end with one of the suffixes.
 		link, ok := node.(*ast.Link)
 		if !ok {
 			return ast.GoToNext
 		}
-		if !bytes.HasSuffix(link.Destination, opkEnd) {
-			return ast.GoToNext
+		// The fragment is not part of the file name.
+		dest := link.Destination
+		if i := bytes.IndexByte(dest, '#'); i >= 0 {
+			dest = dest[:i]
+		}
+		for _, suffix := range suffixes {
+			if bytes.HasSuffix(dest, suffix) {
+				links = append(links, SourceEntry{
+					URL:   string(link.Destination),
+					Title: linkText(link),
+				})
+				break
+			}
 		}
+		return ast.GoToNext
+	}))
+	return links
+}
 
-		opks = append(opks, string(link.Destination))
+// linkText returns the text of link, without formatting.
+func linkText(link *ast.Link) string {
+	var text bytes.Buffer
+	ast.WalkFunc(link, ast.NodeVisitorFunc(func(node ast.Node, entering bool) ast.WalkStatus {
+		if leaf := node.AsLeaf(); entering && leaf != nil {
+			text.Write(leaf.Literal)
+		}
 		return ast.GoToNext
 	}))
-	return opks
+	return strings.Join(strings.Fields(text.String()), " ")
+}
+
+var markdownEnds = [][]byte{[]byte(".md"), []byte(".markdown")}
+
+// SourceListFromURL returns a list of known opk files read from the markdown document at srcURL.
+// Relative links are resolved against the document URL. When maxDepth is positive, links to other
+// markdown documents are followed up to maxDepth levels deep and the opk links of all of them are
+// returned. Each document is read only once, so cycles are harmless. Failing to read a linked
+// document is logged to logger as a warning and does not fail the whole list.
+func SourceListFromURL(ctx context.Context, client *http.Client, srcURL string, maxDepth int, logger Logger) ([]SourceEntry, error) {
+	root, err := url.Parse(srcURL)
+	if err != nil {
+		return nil, err
+	}
+
+	visited := map[string]bool{}
+	seen := map[string]bool{}
+	opks := []SourceEntry{}
+
+	var visit func(page *url.URL, depth int) error
+	visit = func(page *url.URL, depth int) error {
+		visited[page.String()] = true
+		buf, err := fetchDocument(ctx, client, page.String())
+		if err != nil {
+			return err
+		}
+
+		links, err := opkLinks(buf)
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			opk, err := page.Parse(link.URL)
+			if err != nil {
+				logger.Warn("Skipping link:", err)
+				continue
+			}
+			key := normalizeURL(opk.String())
+			if !seen[key] {
+				seen[key] = true
+				opks = append(opks, SourceEntry{URL: opk.String(), Title: link.Title})
+			}
+		}
+		if len(opks) > MaxSourceLinks {
+			return errTooManyLinks
+		}
+
+		if depth >= maxDepth {
+			return nil
+		}
+		for _, link := range markdownLinks(buf, markdownEnds...) {
+			child, err := page.Parse(link.URL)
+			if err != nil {
+				logger.Warn("Skipping link:", err)
+				continue
+			}
+			child.Fragment = ""
+			if visited[child.String()] {
+				continue
+			}
+			if err := visit(child, depth+1); err != nil {
+				if err == errTooManyLinks {
+					return err
+				}
+				logger.Warn("Skipping linked document:", err)
+			}
+		}
+		return nil
+	}
+
+	root.Fragment = ""
+	if err := visit(root, 0); err != nil {
+		return nil, err
+	}
+	return opks, nil
+}
+
+// fetchDocument returns the body of the document at docURL.
+func fetchDocument(ctx context.Context, client *http.Client, docURL string) ([]byte, error) {
+	req, err := http.NewRequest("GET", docURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: http fetch error: %v", docURL, resp.StatusCode)
+	}
+	return readSource(resp.Body, docURL)
 }
@@ -0,0 +1,238 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package opkcat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSourceListDedupes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opkcat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	md := `# Games
+
+* [Game](http://Example.com/game.opk)
+* [Tool](http://example.com/tool.opk)
+
+# Favorites
+
+* [Game again](http://example.com/game.opk#favorite)
+* [Tool again](http://example.com/tool.opk)
+* [Other](http://example.com/other.opk)
+`
+	path := filepath.Join(dir, "Sources.md")
+	if err := ioutil.WriteFile(path, []byte(md), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	links, err := SourceList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first entry of each url is kept as written, since it is the key of its record.
+	want := []SourceEntry{
+		{URL: "http://Example.com/game.opk", Title: "Game"},
+		{URL: "http://example.com/tool.opk", Title: "Tool"},
+		{URL: "http://example.com/other.opk", Title: "Other"},
+	}
+	if len(links) != len(want) {
+		t.Fatalf("got %d links, want %d: %v", len(links), len(want), links)
+	}
+	for i := range want {
+		if links[i] != want[i] {
+			t.Errorf("link %d: got %+v, want %+v", i, links[i], want[i])
+		}
+	}
+}
+
+func TestSourceListLinkText(t *testing.T) {
+	md := []byte(`* [**Super** _Mario_
+  War](http://example.com/smw.opk)
+* [Doom ` + "`" + `1.9` + "`" + `](http://example.com/doom.opk "The title attribute")
+* [Not an opk](http://example.com/readme.html)
+`)
+	links, err := opkLinks(md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The link text is kept without its formatting, in a single line.
+	want := []SourceEntry{
+		{URL: "http://example.com/smw.opk", Title: "Super Mario War"},
+		{URL: "http://example.com/doom.opk", Title: "Doom 1.9"},
+	}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("got links %+v, want %+v", links, want)
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		link, want string
+	}{
+		{"http://example.com/game.opk", "http://example.com/game.opk"},
+		{"HTTP://Example.COM/game.opk", "http://example.com/game.opk"},
+		{"http://example.com/game.opk#top", "http://example.com/game.opk"},
+		// The path is case sensitive.
+		{"http://example.com/Game.opk", "http://example.com/Game.opk"},
+	}
+	for _, test := range tests {
+		if got := normalizeURL(test.link); got != test.want {
+			t.Errorf("normalizeURL(%q) = %q, want %q", test.link, got, test.want)
+		}
+	}
+}
+
+func TestSourceListFromURLFollowsLinks(t *testing.T) {
+	docs := map[string]string{
+		"/index.md":       "* [Root](root.opk)\n* [More games](lists/child.md)\n* [Home](index.md)\n* [Broken](missing.md)\n",
+		"/lists/child.md": "* [Child](/opks/child.opk)\n* [Root again](../root.opk)\n* [Even more](grand.md)\n",
+		"/lists/grand.md": "* [Grandchild](grand.opk)\n",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doc, ok := docs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, doc)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		depth int
+		want  []string
+	}{
+		{0, []string{"Root"}},
+		{1, []string{"Root", "Child"}},
+		{2, []string{"Root", "Child", "Grandchild"}},
+	}
+	for _, test := range tests {
+		links, err := SourceListFromURL(context.Background(), srv.Client(), srv.URL+"/index.md", test.depth, discardLogger{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var titles []string
+		for _, link := range links {
+			titles = append(titles, link.Title)
+		}
+		if !reflect.DeepEqual(titles, test.want) {
+			t.Errorf("depth %d: got links %v, want %v", test.depth, titles, test.want)
+		}
+		// Links are resolved against the document they are in.
+		if test.depth == 2 && links[2].URL != srv.URL+"/lists/grand.opk" {
+			t.Errorf("got url %s for the grandchild, want it relative to its list", links[2].URL)
+		}
+	}
+}
+
+// warnLogger keeps the warnings, dropping every other message.
+type warnLogger struct {
+	discardLogger
+	warnings []string
+}
+
+func (l *warnLogger) Warn(v ...interface{}) { l.warnings = append(l.warnings, fmt.Sprintln(v...)) }
+
+func TestSourceListFromURLMissingDocument(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/index.md" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "* [Root](root.opk)\n* [Gone](gone.md)\n")
+	}))
+	defer srv.Close()
+
+	logger := &warnLogger{}
+	links, err := SourceListFromURL(context.Background(), srv.Client(), srv.URL+"/index.md", 1, logger)
+	if err != nil || len(links) != 1 {
+		t.Fatalf("got links %v and error %v, want the root link", links, err)
+	}
+	if len(logger.warnings) != 1 || !strings.Contains(logger.warnings[0], "/gone.md") {
+		t.Errorf("got warnings %q, want one for gone.md", logger.warnings)
+	}
+}
+
+func TestSourceListLimits(t *testing.T) {
+	defer func(bytes int64, links int) {
+		MaxSourceBytes, MaxSourceLinks = bytes, links
+	}(MaxSourceBytes, MaxSourceLinks)
+	MaxSourceBytes, MaxSourceLinks = 100, 2
+
+	dir, err := ioutil.TempDir("", "opkcat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, md string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(md), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	if _, err := SourceList(write("huge.md", strings.Repeat("# Games\n", 20))); err == nil {
+		t.Error("got no error for a source list over the size limit")
+	}
+	links := "* [A](a.opk)\n* [B](b.opk)\n"
+	if got, err := SourceList(write("two.md", links)); err != nil || len(got) != 2 {
+		t.Errorf("got %d links and error %v at the link limit, want 2 links", len(got), err)
+	}
+	if _, err := SourceList(write("three.md", links+"* [C](c.opk)\n")); !errors.Is(err, errTooManyLinks) {
+		t.Errorf("got error %v for a source list over the link limit, want %v", err, errTooManyLinks)
+	}
+}
+
+func TestSourceListFromURLLimits(t *testing.T) {
+	defer func(links int) { MaxSourceLinks = links }(MaxSourceLinks)
+	MaxSourceLinks = 2
+
+	// Each document is under the limit, but not all of them together.
+	docs := map[string]string{
+		"/index.md": "* [A](a.opk)\n* [More](more.md)\n",
+		"/more.md":  "* [B](b.opk)\n* [C](c.opk)\n",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, docs[r.URL.Path])
+	}))
+	defer srv.Close()
+
+	if _, err := SourceListFromURL(context.Background(), srv.Client(), srv.URL+"/index.md", 0, discardLogger{}); err != nil {
+		t.Errorf("got error %v without following links, want none", err)
+	}
+	if _, err := SourceListFromURL(context.Background(), srv.Client(), srv.URL+"/index.md", 1, discardLogger{}); !errors.Is(err, errTooManyLinks) {
+		t.Errorf("got error %v over the link limit, want %v", err, errTooManyLinks)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package opkcat
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeService is a StartStopper whose Start fails with startErr after startDelay, or else runs
+// until Stop once it is ready.
+type fakeService struct {
+	startDelay time.Duration
+	startErr   error
+
+	ready   chan struct{}
+	stopC   chan struct{}
+	stops   int32
+	running int32
+}
+
+func newFakeService(startDelay time.Duration, startErr error) *fakeService {
+	return &fakeService{
+		startDelay: startDelay,
+		startErr:   startErr,
+		ready:      make(chan struct{}),
+		stopC:      make(chan struct{}),
+	}
+}
+
+func (s *fakeService) Ready() <-chan struct{} {
+	return s.ready
+}
+
+func (s *fakeService) Start() error {
+	time.Sleep(s.startDelay)
+	if s.startErr != nil {
+		return s.startErr
+	}
+	atomic.StoreInt32(&s.running, 1)
+	close(s.ready)
+	<-s.stopC
+	return nil
+}
+
+func (s *fakeService) Stop() error {
+	if atomic.LoadInt32(&s.running) == 0 {
+		return errors.New("stopped before running")
+	}
+	atomic.AddInt32(&s.stops, 1)
+	close(s.stopC)
+	return nil
+}
+
+// discardLogger drops every message.
+type discardLogger struct{}
+
+func (discardLogger) Debug(v ...interface{}) {}
+func (discardLogger) Info(v ...interface{})  {}
+func (discardLogger) Warn(v ...interface{})  {}
+func (discardLogger) Error(v ...interface{}) {}
+
+// quietManager returns a manager of services that doesn't log.
+func quietManager(services ...StartStopper) *ServiceManager {
+	sm := NewServiceManager(services)
+	sm.SetLogger(discardLogger{})
+	return sm
+}
+
+func TestServiceManagerStartFailure(t *testing.T) {
+	running := newFakeService(0, nil)
+	// The failure arrives before this one is running, which still has to be stopped once it is.
+	slow := newFakeService(50*time.Millisecond, nil)
+	failing := newFakeService(10*time.Millisecond, errors.New("address already in use"))
+
+	err := quietManager(running, slow, failing).Run()
+	if err == nil || !strings.Contains(err.Error(), "address already in use") {
+		t.Fatalf("got error %v, want the start failure", err)
+	}
+	if strings.Contains(err.Error(), "stopped before running") {
+		t.Errorf("a service was stopped before it was running: %v", err)
+	}
+	for name, s := range map[string]*fakeService{"running": running, "slow": slow} {
+		if stops := atomic.LoadInt32(&s.stops); stops != 1 {
+			t.Errorf("%s service stopped %d times, want 1", name, stops)
+		}
+	}
+	if stops := atomic.LoadInt32(&failing.stops); stops != 0 {
+		t.Errorf("failed service stopped %d times, want 0", stops)
+	}
+}
+
+func TestServiceManagerSignal(t *testing.T) {
+	a, b := newFakeService(0, nil), newFakeService(0, nil)
+	go func() {
+		<-a.ready
+		<-b.ready
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+	if err := quietManager(a, b).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&a.stops) != 1 || atomic.LoadInt32(&b.stops) != 1 {
+		t.Errorf("got %d and %d stops, want 1 each", atomic.LoadInt32(&a.stops), atomic.LoadInt32(&b.stops))
+	}
+}
+
+func TestServiceManagerReload(t *testing.T) {
+	s := newFakeService(0, nil)
+	sm := quietManager(s)
+	reloaded := make(chan struct{}, 2)
+	sm.SetReload(func() error {
+		reloaded <- struct{}{}
+		return errors.New("a failed reload is only logged")
+	})
+	go func() {
+		<-s.ready
+		for i := 0; i < 2; i++ {
+			syscall.Kill(os.Getpid(), syscall.SIGHUP)
+			<-reloaded
+		}
+		// The services keep running through the reloads.
+		if stops := atomic.LoadInt32(&s.stops); stops != 0 {
+			t.Errorf("got %d stops on reload, want none", stops)
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+	if err := sm.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if stops := atomic.LoadInt32(&s.stops); stops != 1 {
+		t.Errorf("got %d stops, want 1", stops)
+	}
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package web
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestAdminBackup(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+	rec := testRecord("http://example.com/game.opk", "Game")
+	if err := storage.UpdateRecord(rec); err != nil {
+		t.Fatal(err)
+	}
+	_, srv := newTestServer(storage)
+	defer srv.Close()
+
+	resp := get(t, srv, "/admin/backup", false, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d without the admin token, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	resp = get(t, srv, "/admin/backup", true, nil)
+	backup, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// The backup of the running service restores into another catalog.
+	restored, closeRestored := newStorage(t)
+	defer closeRestored()
+	if err := restored.Restore(bytes.NewReader(backup)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restored.GetRecord(rec.Hash); err != nil {
+		t.Errorf("restored record: %v", err)
+	}
+}
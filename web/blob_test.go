@@ -0,0 +1,80 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package web
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/avalonbits/opkcat/blob"
+)
+
+func TestBlob(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := blob.New(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opk := []byte("hsqs raw opk bytes")
+	src := filepath.Join(dir, "doom.opk")
+	if err := ioutil.WriteFile(src, opk, 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash := []byte{0xde, 0xad, 0xbe, 0xef}
+	if err := store.Put(hash, src); err != nil {
+		t.Fatal(err)
+	}
+
+	_, srv := newTestServer(storage, WithBlobStore(store))
+	defer srv.Close()
+
+	resp := get(t, srv, "/blob/"+hex.EncodeToString(hash), false, nil)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if !bytes.Equal(body, opk) {
+		t.Errorf("got body %q, want the stored opk %q", body, opk)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "application/octet-stream" {
+		t.Errorf("got content type %q, want application/octet-stream", got)
+	}
+
+	resp = get(t, srv, "/blob/"+hex.EncodeToString([]byte{0x01}), false, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown blob, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package web
+
+import (
+	"container/list"
+	"sync"
+)
+
+// searchCache is an LRU cache of encoded search responses, bounded by number of entries and total
+// size. The whole cache is dropped when the catalog version changes, whether the fetcher wrote to
+// the catalog or a record was curated.
+type searchCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	version    int64
+	order      *list.List
+	entries    map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	body []byte
+}
+
+func newSearchCache(maxEntries int, maxBytes int64) *searchCache {
+	return &searchCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		order:      list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+// get returns the response cached for key, if it was cached at the catalog version.
+func (c *searchCache) get(key string, version int64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidate(version)
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).body, true
+}
+
+// put caches body for key, evicting the least recently used responses to make room. Responses
+// larger than the whole cache, or read at a version older than the cached ones, are not cached.
+func (c *searchCache) put(key string, body []byte, version int64) {
+	if int64(len(body)) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidate(version)
+	if version < c.version {
+		return
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, body: body})
+	c.bytes += int64(len(body))
+	for c.order.Len() > c.maxEntries || c.bytes > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// invalidate drops every response if the catalog changed since they were cached. Callers must
+// hold mu.
+func (c *searchCache) invalidate(version int64) {
+	if version <= c.version {
+		return
+	}
+	c.version = version
+	c.order.Init()
+	c.entries = map[string]*list.Element{}
+	c.bytes = 0
+}
+
+func (c *searchCache) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= int64(len(entry.body))
+}
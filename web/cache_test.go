@@ -0,0 +1,102 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package web
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+// search returns the decoded response of srv to the search for path.
+func search(t *testing.T, srv *httptest.Server, path string) *searchResponse {
+	t.Helper()
+	resp := get(t, srv, path, false, nil)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results searchResponse
+	if err := json.Unmarshal(body, &results); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+	return &results
+}
+
+func TestSearchCache(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+	addRecords(t, storage, testRecord("http://example.com/doom.opk", "Doom"))
+	s, srv := newTestServer(storage, WithSearchCache(10, 1<<20))
+	defer srv.Close()
+
+	if results := search(t, srv, "/api/search?q=doom"); results.Total != 1 {
+		t.Fatalf("got %d results, want 1", results.Total)
+	}
+	if _, ok := s.cache.get("q=doom", storage.Version()); !ok {
+		t.Fatal("the response was not cached")
+	}
+	// The repeated query is served from the cache, so a change in the cached response shows up.
+	s.cache.put("q=doom", []byte(`{"total": 42}`), storage.Version())
+	if results := search(t, srv, "/api/search?q=doom"); results.Total != 42 {
+		t.Errorf("got %d results, want the 42 of the cached response", results.Total)
+	}
+
+	// A fetch writing to the catalog drops the cached responses.
+	addRecords(t, storage, testRecord("http://example.com/doom2.opk", "Doom II"))
+	if results := search(t, srv, "/api/search?q=doom"); results.Total != 2 {
+		t.Errorf("got %d results after a fetch, want 2", results.Total)
+	}
+}
+
+func TestSearchCacheEviction(t *testing.T) {
+	c := newSearchCache(2, 10)
+	c.put("a", []byte("aaaa"), 1)
+	c.put("b", []byte("bbbb"), 1)
+	// Reading a makes b the least recently used.
+	if _, ok := c.get("a", 1); !ok {
+		t.Fatal("a was not cached")
+	}
+	c.put("c", []byte("cc"), 1)
+	if _, ok := c.get("b", 1); ok {
+		t.Error("b was not evicted by the entries limit")
+	}
+
+	// The bytes limit evicts too, and responses larger than the cache are not kept.
+	c.put("d", []byte("dddddd"), 1)
+	if _, ok := c.get("a", 1); ok {
+		t.Error("a was not evicted by the bytes limit")
+	}
+	c.put("e", []byte("eeeeeeeeeeee"), 1)
+	if _, ok := c.get("e", 1); ok {
+		t.Error("got a response larger than the cache cached")
+	}
+
+	// Responses read at an older version than the cached ones are not cached.
+	c.put("f", []byte("f"), 2)
+	c.put("g", []byte("g"), 1)
+	if _, ok := c.get("g", 2); ok {
+		t.Error("got a response of an older version cached")
+	}
+	if _, ok := c.get("d", 2); ok {
+		t.Error("got a response of the previous version after the version changed")
+	}
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package web
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/avalonbits/opkcat/db"
+)
+
+// post sends body to path in srv with the admin token, returning the response status.
+func post(t *testing.T, srv *httptest.Server, path, body string) int {
+	t.Helper()
+	req, err := http.NewRequest("POST", srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// getRecord returns the record with hash in storage.
+func getRecord(t *testing.T, storage *db.Handle, hash []byte) *db.Record {
+	t.Helper()
+	rec, err := storage.GetRecord(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestSetRatingSurvivesRefetch(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+	rec := testRecord("http://example.com/game.opk", "Game")
+	addRecords(t, storage, rec)
+	_, srv := newTestServer(storage)
+	defer srv.Close()
+
+	path := "/admin/rating/" + hex.EncodeToString(rec.Hash)
+	if status := post(t, srv, path, `{"rating": "PEGI 7", "languages": ["en", "pt"]}`); status != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d", status, http.StatusNoContent)
+	}
+	wantLanguages := []string{"en", "pt"}
+	if got := getRecord(t, storage, rec.Hash); got.Rating != "PEGI 7" || !reflect.DeepEqual(got.Languages, wantLanguages) {
+		t.Fatalf("got rating %q and languages %v, want the curated ones", got.Rating, got.Languages)
+	}
+
+	// Fetching the same content again keeps the curated fields.
+	addRecords(t, storage, testRecord(rec.URL, "Game"))
+	if got := getRecord(t, storage, rec.Hash); got.Rating != "PEGI 7" || !reflect.DeepEqual(got.Languages, wantLanguages) {
+		t.Errorf("got rating %q and languages %v after a re-fetch, want the curated ones", got.Rating, got.Languages)
+	}
+
+	// So does fetching new content from the same url.
+	update := testRecord(rec.URL, "Game 2")
+	addRecords(t, storage, update)
+	if got := getRecord(t, storage, update.Hash); got.Rating != "PEGI 7" || !reflect.DeepEqual(got.Languages, wantLanguages) {
+		t.Errorf("got rating %q and languages %v for the new content, want the curated ones", got.Rating, got.Languages)
+	}
+}
+
+func TestSetRatingUnknownRecord(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+	_, srv := newTestServer(storage)
+	defer srv.Close()
+
+	path := "/admin/rating/" + strings.Repeat("ab", 32)
+	if status := post(t, srv, path, `{"rating": "PEGI 7"}`); status != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown record, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestDeprecate(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+	old := testRecord("http://example.com/doom.opk", "Doom")
+	replacement := testRecord("http://example.com/doom-retro.opk", "Doom Retro")
+	addRecords(t, storage, old, replacement)
+	_, srv := newTestServer(storage)
+	defer srv.Close()
+
+	path := "/admin/deprecate/" + hex.EncodeToString(old.Hash)
+	body := `{"deprecated": true, "superseded_by": "` + replacement.URL + `"}`
+	if status := post(t, srv, path, body); status != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d", status, http.StatusNoContent)
+	}
+
+	// The record detail links to the replacement.
+	resp := get(t, srv, "/api/record/"+hex.EncodeToString(old.Hash), false, nil)
+	var detail db.Record
+	err := json.NewDecoder(resp.Body).Decode(&detail)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Deprecated || detail.SupersededBy != replacement.URL {
+		t.Errorf("got deprecated %t superseded by %q, want it superseded by %s", detail.Deprecated, detail.SupersededBy, replacement.URL)
+	}
+
+	// Deprecated records are still found, unless excluded.
+	if results := search(t, srv, "/api/search?q=doom"); results.Total != 2 {
+		t.Errorf("got %d results, want both records", results.Total)
+	}
+	results := search(t, srv, "/api/search?q=doom&exclude_deprecated=1")
+	if results.Total != 1 || results.Records[0].URL != replacement.URL {
+		t.Errorf("got %d results excluding the deprecated records, want only %s", results.Total, replacement.URL)
+	}
+
+	// The marks survive fetching the same content again.
+	addRecords(t, storage, testRecord(old.URL, "Doom"))
+	if got := getRecord(t, storage, old.Hash); !got.Deprecated || got.SupersededBy != replacement.URL {
+		t.Errorf("got deprecated %t superseded by %q after a re-fetch, want the curated marks", got.Deprecated, got.SupersededBy)
+	}
+	if results := search(t, srv, "/api/search?q=doom&exclude_deprecated=1"); results.Total != 1 {
+		t.Errorf("got %d results excluding the deprecated records after a re-fetch, want 1", results.Total)
+	}
+
+	// A new release from the same url isn't deprecated.
+	release := testRecord(old.URL, "Doom 2")
+	addRecords(t, storage, release)
+	if got := getRecord(t, storage, release.Hash); got.Deprecated || got.SupersededBy != "" {
+		t.Errorf("got the new release deprecated %t superseded by %q, want it not deprecated", got.Deprecated, got.SupersededBy)
+	}
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package web
+
+import (
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+func TestETag(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+	doom := testRecord("http://example.com/doom.opk", "Doom")
+	addRecords(t, storage, doom)
+	_, srv := newTestServer(storage)
+	defer srv.Close()
+
+	for _, path := range []string{"/api/search?q=doom", "/api/record/" + hex.EncodeToString(doom.Hash)} {
+		resp := get(t, srv, path, false, nil)
+		resp.Body.Close()
+		etag := resp.Header.Get("ETag")
+		if resp.StatusCode != http.StatusOK || etag == "" {
+			t.Fatalf("%s: got status %d and ETag %q, want 200 with an ETag", path, resp.StatusCode, etag)
+		}
+
+		resp = get(t, srv, path, false, http.Header{"If-None-Match": {etag}})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotModified {
+			t.Errorf("%s: got status %d for a matching ETag, want 304", path, resp.StatusCode)
+		}
+	}
+
+	// Changing the catalog changes the ETags.
+	resp := get(t, srv, "/api/search?q=doom", false, nil)
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	addRecords(t, storage, testRecord("http://example.com/doom2.opk", "Doom II"))
+	resp = get(t, srv, "/api/search?q=doom", false, http.Header{"If-None-Match": {etag}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d after the catalog changed, want 200", resp.StatusCode)
+	}
+	if resp.Header.Get("ETag") == etag {
+		t.Error("the ETag didn't change with the catalog")
+	}
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package web
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+
+	"github.com/avalonbits/opkcat/db"
+)
+
+// browseTemplate is the HTML catalog page. It has no external dependencies so the catalog can be
+// browsed without a separate frontend.
+var browseTemplate = template.Must(template.New("browse").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>opkcat{{if .Query}} - {{.Query}}{{end}}</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 1em auto; }
+li { list-style: none; display: flex; gap: 1em; margin-bottom: 1em; }
+img { width: 32px; height: 32px; }
+.categories { color: #666; font-size: small; }
+</style>
+</head>
+<body>
+<h1>opkcat</h1>
+<form action="/" method="get">
+<input type="search" name="q" value="{{.Query}}" placeholder="Search packages" autofocus>
+{{if .Since}}<input type="hidden" name="since" value="{{.Since}}">{{end}}
+<button type="submit">Search</button>
+</form>
+{{if or .Query .Since}}
+<p>{{.Total}} {{if .Since}}new {{end}}packages found{{if gt .Total (len .Packages)}}, showing {{len .Packages}}{{end}}.</p>
+<ul>
+{{range .Packages}}
+<li>
+{{if .Icon}}<img src="{{.Icon}}" alt="">{{end}}
+<div>
+<strong>{{.Name}}</strong>{{if .Version}} {{.Version}}{{end}} {{.Description}}
+{{if .Categories}}<div class="categories">{{range $i, $c := .Categories}}{{if $i}}, {{end}}{{$c}}{{end}}</div>{{end}}
+<div><a href="{{.URL}}">Download</a>{{range .Mirrors}} | <a href="{{.}}">Mirror</a>{{end}}{{if .Blob}} | <a href="{{.Blob}}">Archived copy</a>{{end}}</div>
+</div>
+</li>
+{{end}}
+</ul>
+{{end}}
+</body>
+</html>
+`))
+
+type browsePage struct {
+	Query    string
+	Since    string
+	Total    int
+	Packages []browsePackage
+}
+
+// browsePackage is an entry of a record as shown in the catalog page.
+type browsePackage struct {
+	Name        string
+	Version     string
+	Description string
+	Categories  []string
+	Icon        template.URL
+	URL         string
+	Blob        string
+
+	// Mirrors are the other urls serving the same opk.
+	Mirrors []string
+}
+
+// handleBrowse renders the HTML catalog page, with the records matching the q parameter. With a
+// since parameter, only the records that changed since then are shown, and q is optional.
+func (s *Service) handleBrowse(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	page := browsePage{Query: r.URL.Query().Get("q"), Since: r.URL.Query().Get("since")}
+	since, err := parseSince(page.Since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if page.Query != "" || !since.IsZero() {
+		var opts []db.QueryOption
+		if !since.IsZero() {
+			opts = append(opts, db.ChangedSince(since))
+		}
+		records, total, err := s.storage.Query(page.Query, opts...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		page.Total = total
+		for _, record := range records {
+			page.Packages = append(page.Packages, s.browsePackages(record)...)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := browseTemplate.Execute(w, &page); err != nil {
+		s.logger.Error("Rendering the catalog page:", err)
+	}
+}
+
+// browsePackages returns the entries of record as shown in the catalog page.
+func (s *Service) browsePackages(record *db.Record) []browsePackage {
+	var blobURL string
+	if s.blobs != nil {
+		blobURL = "/blob/" + hex.EncodeToString(record.Hash)
+	}
+
+	// The primary entry is shown first.
+	entries := make([]*db.Entry, 0, len(record.Entries))
+	primary := record.Primary()
+	if primary != nil {
+		entries = append(entries, primary)
+	}
+	for _, entry := range record.Entries {
+		if entry != primary {
+			entries = append(entries, entry)
+		}
+	}
+
+	var mirrors []string
+	for _, u := range record.Mirrors() {
+		if u != record.URL {
+			mirrors = append(mirrors, u)
+		}
+	}
+
+	pkgs := make([]browsePackage, 0, len(entries))
+	for _, entry := range entries {
+		pkg := browsePackage{
+			Name:        entry.Name,
+			Version:     entry.Version,
+			Description: entry.Description,
+			Categories:  entry.Categories,
+			URL:         record.URL,
+			Blob:        blobURL,
+			Mirrors:     mirrors,
+		}
+		if len(entry.Icon) > 0 {
+			pkg.Icon = template.URL("data:" + iconType(entry.IconFormat) + ";base64," +
+				base64.StdEncoding.EncodeToString(entry.Icon))
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs
+}
+
+// iconType returns the media type of icons in format. Icons without a format are png.
+func iconType(format string) string {
+	switch format {
+	case "":
+		return "image/png"
+	case "svg":
+		return "image/svg+xml"
+	}
+	return "image/" + format
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// browse returns the catalog page served by srv for path.
+func browse(t *testing.T, srv *httptest.Server, path string) string {
+	t.Helper()
+	resp := get(t, srv, path, false, nil)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("got content type %q, want text/html", got)
+	}
+	return string(body)
+}
+
+func TestBrowse(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+	doom := testRecord("http://example.com/doom.opk", "Doom")
+	doom.Entries[0].Icon = []byte("\x89PNG")
+	doom.Entries[0].Description = "Rip <and> tear"
+	addRecords(t, storage, doom, testRecord("http://example.com/quake.opk", "Quake"))
+	_, srv := newTestServer(storage)
+	defer srv.Close()
+
+	page := browse(t, srv, "/?q=doom")
+	for _, want := range []string{
+		"<strong>Doom</strong>",
+		`<a href="http://example.com/doom.opk">Download</a>`,
+		`<img src="data:image/png;base64,iVBORw==" alt="">`,
+		`<div class="categories">games</div>`,
+		"Rip &lt;and&gt; tear",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("the page doesn't contain %q:\n%s", want, page)
+		}
+	}
+	if strings.Contains(page, "Quake") {
+		t.Error("the page lists a record that doesn't match the query")
+	}
+
+	// Without a query, only the search form is shown.
+	if page := browse(t, srv, "/"); strings.Contains(page, "Doom") || !strings.Contains(page, `<form action="/"`) {
+		t.Errorf("got page without a query:\n%s", page)
+	}
+	resp := get(t, srv, "/missing", false, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown page, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package web
+
+import (
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+func TestIconSVG(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(document.cookie)</script></svg>`)
+	record := testRecord("http://example.com/doom.opk", "Doom")
+	record.Entries[0].Icon = svg
+	record.Entries[0].IconFormat = "svg"
+	addRecords(t, storage, record)
+	_, srv := newTestServer(storage)
+	defer srv.Close()
+
+	resp := get(t, srv, "/api/icon/"+hex.EncodeToString(record.Hash)+"/0", false, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	for key, want := range map[string]string{
+		"Content-Type":            "image/svg+xml",
+		"Content-Security-Policy": "default-src 'none'; style-src 'unsafe-inline'; sandbox",
+		"X-Content-Type-Options":  "nosniff",
+	} {
+		if got := resp.Header.Get(key); got != want {
+			t.Errorf("got %s %q, want %q", key, got, want)
+		}
+	}
+}
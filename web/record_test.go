@@ -0,0 +1,45 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package web
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestRecordMetaKey(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+	record := testRecord("http://example.com/doom.opk", "Doom")
+	addRecords(t, storage, record)
+	_, srv := newTestServer(storage)
+	defer srv.Close()
+
+	// The url of the record has its freshness stored under a _url: key, which isn't a record.
+	key := hex.EncodeToString([]byte("_url:" + url.PathEscape(record.URL)))
+	for _, path := range []string{"/api/record/" + key, "/api/icon/" + key + "/0", "/api/related/" + key} {
+		resp := get(t, srv, path, false, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want %d", path, resp.StatusCode, http.StatusNotFound)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package web
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/avalonbits/opkcat/db"
+)
+
+func TestStreamSearch(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+	doom := testRecord("http://example.com/doom.opk", "Doom")
+	doom.Entries[0].Icon = []byte("\x89PNG")
+	addRecords(t, storage,
+		testRecord("http://example.com/doom2.opk", "Doom II"),
+		doom,
+		testRecord("http://example.com/quake.opk", "Quake"),
+	)
+	_, srv := newTestServer(storage)
+	defer srv.Close()
+
+	resp := get(t, srv, "/api/search?q=doom&stream=1", false, nil)
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "application/x-ndjson" {
+		t.Errorf("got content type %q, want application/x-ndjson", got)
+	}
+
+	var names []string
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var record db.Record
+		if err := dec.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if record.Entries[0].Icon != nil {
+			t.Errorf("%s: got an icon in the streamed record", record.URL)
+		}
+		names = append(names, record.Entries[0].Name)
+	}
+	if want := []string{"Doom", "Doom II"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got records %v, want %v", names, want)
+	}
+}
+
+func TestSearchQuotedPhrase(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+	addRecords(t, storage,
+		testRecord("http://example.com/smw.opk", "Super Mario War"),
+		testRecord("http://example.com/mksc.opk", "Mario Kart Super Circuit"),
+	)
+	_, srv := newTestServer(storage)
+	defer srv.Close()
+
+	resp := get(t, srv, "/api/search?q=%22super+mario%22&stream=1", false, nil)
+	defer resp.Body.Close()
+	var names []string
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var record db.Record
+		if err := dec.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, record.Entries[0].Name)
+	}
+	if want := []string{"Super Mario War"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got records %v for the quoted phrase, want %v", names, want)
+	}
+}
+
+func TestSearchSince(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+	now := time.Now().UTC()
+	old := testRecord("http://example.com/doom.opk", "Doom")
+	old.Date = now.AddDate(0, 0, -7)
+	addRecords(t, storage,
+		old,
+		testRecord("http://example.com/doom2.opk", "Doom II"),
+		testRecord("http://example.com/quake.opk", "Quake"),
+	)
+	_, srv := newTestServer(storage)
+	defer srv.Close()
+
+	since := now.AddDate(0, 0, -1)
+	tests := []struct {
+		path  string
+		total int
+		want  []string
+	}{
+		// Without a query, every new record.
+		{"/api/search?since=" + url.QueryEscape(since.Format(time.RFC3339)), 2, []string{"Doom II", "Quake"}},
+		{fmt.Sprintf("/api/search?since=%d", since.Unix()), 2, []string{"Doom II", "Quake"}},
+		{fmt.Sprintf("/api/search?q=doom&since=%d", since.Unix()), 1, []string{"Doom II"}},
+		{"/api/search?q=doom", 2, []string{"Doom", "Doom II"}},
+	}
+	for _, test := range tests {
+		results := search(t, srv, test.path)
+		var names []string
+		for _, record := range results.Records {
+			names = append(names, record.Entries[0].Name)
+		}
+		if results.Total != test.total || !reflect.DeepEqual(names, test.want) {
+			t.Errorf("%s: got records %v of %d, want %v of %d", test.path, names, results.Total, test.want, test.total)
+		}
+	}
+
+	for _, path := range []string{"/api/search?since=yesterday", "/api/search"} {
+		resp := get(t, srv, path, false, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", path, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestSearchCSV(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+	addRecords(t, storage,
+		testRecord("http://example.com/doom.opk", "Doom"),
+		testRecord("http://example.com/doom2.opk", "Doom II"),
+		testRecord("http://example.com/quake.opk", "Quake"),
+	)
+	_, srv := newTestServer(storage)
+	defer srv.Close()
+
+	resp := get(t, srv, "/api/search?q=doom&format=csv", false, nil)
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/csv; charset=utf-8" {
+		t.Errorf("got content type %q, want CSV", got)
+	}
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) == 0 || rows[0][0] != "url" {
+		t.Fatalf("got rows %q, want a header first", rows)
+	}
+	var names []string
+	for _, row := range rows[1:] {
+		names = append(names, row[2])
+	}
+	if want := []string{"Doom", "Doom II"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got rows for %v, want %v", names, want)
+	}
+}
+
+func TestExplainSearch(t *testing.T) {
+	storage, closeStorage := newStorage(t)
+	defer closeStorage()
+	addRecords(t, storage,
+		testRecord("http://example.com/doom.opk", "Doom"),
+		testRecord("http://example.com/quake.opk", "Quake"),
+	)
+	_, srv := newTestServer(storage)
+	defer srv.Close()
+
+	const path = "/admin/search/explain?q=doom"
+	resp := get(t, srv, path, false, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d without the admin token, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	resp = get(t, srv, path, true, nil)
+	defer resp.Body.Close()
+	var hits []*db.ExplainedHit
+	if err := json.NewDecoder(resp.Body).Decode(&hits); err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].Name != "Doom" {
+		t.Fatalf("got hits %+v, want doom", hits)
+	}
+	if expl := hits[0].Explanation; expl == nil || expl.Value != hits[0].Score || len(expl.Children) == 0 {
+		t.Errorf("got explanation %+v, want how the score was computed", expl)
+	}
+}
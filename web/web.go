@@ -16,32 +16,695 @@
  * along with this program.  If not, see <http://www.gnu.org/licenses/>.
  */
 
+// Package web implements the HTTP service for opkcat.
 package web
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avalonbits/opkcat"
+	"github.com/avalonbits/opkcat/blob"
 	"github.com/avalonbits/opkcat/db"
 )
 
 type Service struct {
-	storage *db.Handle
-	quit    chan bool
+	storage    *db.Handle
+	blobs      *blob.Store
+	adminToken string
+	cache      *searchCache
+	server     *http.Server
+	logger     opkcat.Logger
+
+	// ready is closed once the service listens on its address.
+	ready chan struct{}
+}
+
+// Option configures optional behavior of the Service.
+type Option func(*Service)
+
+// WithBlobStore makes the service serve archived opk files from store.
+func WithBlobStore(store *blob.Store) Option {
+	return func(s *Service) {
+		s.blobs = store
+	}
 }
 
-func New(storage *db.Handle) *Service {
-	return &Service{
+// WithAdminToken enables the admin endpoints, which require an "Authorization: Bearer <token>"
+// header.
+func WithAdminToken(token string) Option {
+	return func(s *Service) {
+		s.adminToken = token
+	}
+}
+
+// WithSearchCache caches up to maxEntries search responses in memory, using up to maxBytes. The
+// cache is dropped whenever the catalog is fetched again.
+func WithSearchCache(maxEntries int, maxBytes int64) Option {
+	return func(s *Service) {
+		s.cache = newSearchCache(maxEntries, maxBytes)
+	}
+}
+
+// WithLogger makes the service write its messages to logger instead of the standard logger.
+func WithLogger(logger opkcat.Logger) Option {
+	return func(s *Service) {
+		s.logger = logger
+	}
+}
+
+// New returns a service that will listen on addr.
+func New(addr string, storage *db.Handle, opts ...Option) *Service {
+	s := &Service{
 		storage: storage,
-		quit:    make(chan bool),
+		ready:   make(chan struct{}),
+		logger:  opkcat.StdLogger(opkcat.LevelDebug),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleBrowse)
+	mux.HandleFunc("/api/search", s.handleSearch)
+	mux.HandleFunc("/api/stats", s.handleStats)
+	mux.HandleFunc("/api/related/", s.handleRelated)
+	mux.HandleFunc("/api/record/", s.handleRecord)
+	mux.HandleFunc("/api/icon/", s.handleIcon)
+	if s.blobs != nil {
+		mux.HandleFunc("/blob/", s.handleBlob)
+	}
+	if s.adminToken != "" {
+		mux.HandleFunc("/admin/rating/", s.admin(s.handleSetRating))
+		mux.HandleFunc("/admin/deprecate/", s.admin(s.handleSetDeprecated))
+		mux.HandleFunc("/admin/duplicates", s.admin(s.handleDuplicates))
+		mux.HandleFunc("/admin/quarantine", s.admin(s.handleQuarantine))
+		mux.HandleFunc("/admin/failing", s.admin(s.handleFailing))
+		mux.HandleFunc("/admin/index", s.admin(s.handleIndexStats))
+		mux.HandleFunc("/admin/history", s.admin(s.handleHistory))
+		mux.HandleFunc("/admin/backup", s.admin(s.handleBackup))
+		mux.HandleFunc("/admin/search/explain", s.admin(s.handleExplain))
+	}
+	s.server = &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	return s
+}
+
+// Handler returns the handler serving the endpoints of the service, to serve them without
+// starting the service.
+func (s *Service) Handler() http.Handler {
+	return s.server.Handler
+}
+
+// Ready returns a channel closed once the service listens on its address. Start returns the error
+// instead if it can't.
+func (s *Service) Ready() <-chan struct{} {
+	return s.ready
 }
 
 func (s *Service) Start() error {
-	<-s.quit
-	s.quit <- true
+	addr := s.server.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	close(s.ready)
+	if err := s.server.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
 	return nil
 }
 
 func (s *Service) Stop() error {
-	s.quit <- true
-	<-s.quit
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// handleBlob serves the raw opk file stored for the hex encoded hash in the path.
+func (s *Service) handleBlob(w http.ResponseWriter, r *http.Request) {
+	hash, ok := pathHash(w, r, "/blob/")
+	if !ok {
+		return
+	}
+
+	f, err := s.blobs.Open(hash)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, hex.EncodeToString(hash)+".opk", info.ModTime(), f)
+}
+
+type searchResponse struct {
+	Total   int          `json:"total"`
+	Records []*db.Record `json:"records"`
+}
+
+// handleSearch returns the records matching the q parameter. With a non-empty stream parameter,
+// records are written as JSON lines as soon as they are read from the database. With a non-empty
+// offline parameter, records that download additional assets when they run are left out. With a
+// non-empty phrase parameter, or when q is wrapped in double quotes, only records with the exact
+// phrase match. With a non-empty exclude_deprecated parameter, deprecated records are left out.
+// With a since parameter, only the records that changed since then are returned, and the total
+// counts the new records. The query is optional when since is set. With format=csv, the records
+// are returned as CSV instead of JSON. Icons are left out; /api/icon serves them. Unless
+// streaming, the size and from parameters page through the results: size records are returned
+// starting at the match from.
+func (s *Service) handleSearch(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	qry := params.Get("q")
+	since, err := parseSince(params.Get("since"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if qry == "" && since.IsZero() {
+		http.Error(w, "missing query", http.StatusBadRequest)
+		return
+	}
+	if s.notModified(w, r) {
+		return
+	}
+
+	size, err := intParam(params, "size")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := intParam(params, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	order, ok := sortOrders[params.Get("sort")]
+	if !ok {
+		http.Error(w, "invalid sort: "+params.Get("sort"), http.StatusBadRequest)
+		return
+	}
+
+	qry, opts := searchOptions(qry, params, since)
+	if order != "" {
+		opts = append(opts, db.SortBy(order))
+	}
+	if params.Get("stream") != "" {
+		s.streamSearch(w, qry, opts)
+		return
+	}
+	if params.Get("format") == "csv" {
+		records, _, err := s.storage.QueryPaged(qry, size, from, opts...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="opkcat.csv"`)
+		if err := s.storage.ExportCSV(w, records); err != nil {
+			s.logger.Warn("Writing the CSV export:", err)
+		}
+		return
+	}
+
+	if s.cache == nil {
+		records, total, err := s.storage.QueryPaged(qry, size, from, opts...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.writeJSON(w, &searchResponse{Total: total, Records: stripIcons(records)})
+		return
+	}
+
+	// The version is read before the query, so a change made while it runs invalidates the
+	// response instead of being cached with it.
+	version := s.storage.Version()
+	key := r.URL.RawQuery
+	body, ok := s.cache.get(key, version)
+	if !ok {
+		records, total, err := s.storage.QueryPaged(qry, size, from, opts...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if body, err = json.Marshal(&searchResponse{Total: total, Records: stripIcons(records)}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.cache.put(key, body, version)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// intParam returns the non-negative integer parameter key, or 0 if it is missing.
+func intParam(params url.Values, key string) (int, error) {
+	v := params.Get(key)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s", key)
+	}
+	return n, nil
+}
+
+// sortOrders maps the values of the sort parameter to the order of the results. Without it, the
+// results are sorted by name, or by relevance when there is a recency boost.
+var sortOrders = map[string]string{
+	"":          "",
+	"name":      db.SortName,
+	"newest":    db.SortNewest,
+	"date-desc": db.SortNewest,
+	"oldest":    db.SortOldest,
+	"date-asc":  db.SortOldest,
+}
+
+// searchOptions returns the query options set by the search parameters, and qry without the
+// double quotes requesting a phrase match.
+func searchOptions(qry string, params url.Values, since time.Time) (string, []db.QueryOption) {
+	var opts []db.QueryOption
+	if len(qry) > 2 && strings.HasPrefix(qry, `"`) && strings.HasSuffix(qry, `"`) {
+		qry = qry[1 : len(qry)-1]
+		opts = append(opts, db.MatchPhrase())
+	} else if params.Get("phrase") != "" {
+		opts = append(opts, db.MatchPhrase())
+	}
+	if params.Get("offline") != "" {
+		opts = append(opts, db.ExcludeNeedsDownload())
+	}
+	if params.Get("exclude_deprecated") != "" {
+		opts = append(opts, db.ExcludeDeprecated())
+	}
+	if !since.IsZero() {
+		opts = append(opts, db.ChangedSince(since))
+	}
+	return qry, opts
+}
+
+func (s *Service) streamSearch(w http.ResponseWriter, qry string, opts []db.QueryOption) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	wrote := false
+	_, err := s.storage.QueryFunc(qry, func(record *db.Record) error {
+		wrote = true
+		stripIcons([]*db.Record{record})
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}, opts...)
+	if err != nil {
+		// Once we started streaming, the status can't be changed anymore.
+		if !wrote {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.logger.Error("Streaming search results:", err)
+	}
+}
+
+// handleStats returns an overview of the catalog.
+func (s *Service) handleStats(w http.ResponseWriter, r *http.Request) {
+	if s.notModified(w, r) {
+		return
+	}
+	stats, err := s.storage.Stats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.writeJSON(w, &stats)
+}
+
+// notModified sets a weak ETag for the response to r and reports whether the client already has
+// it, in which case a 304 has been written. The ETag is derived from the catalog version and the
+// request URI, so it changes with every fetch or curation.
+func (s *Service) notModified(w http.ResponseWriter, r *http.Request) bool {
+	sum := sha256.New()
+	fmt.Fprintf(sum, "%d\x00%s", s.storage.Version(), r.URL.RequestURI())
+	etag := fmt.Sprintf(`W/"%x"`, sum.Sum(nil)[:16])
+	w.Header().Set("ETag", etag)
+
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		match = strings.TrimSpace(match)
+		if match == "*" || strings.TrimPrefix(match, "W/") == strings.TrimPrefix(etag, "W/") {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// defaultRelated is the number of related records returned without a limit parameter.
+const defaultRelated = 10
+
+// handleRelated returns the records related to the one whose hex encoded hash follows
+// /api/related/ in the path, most related first. The limit parameter caps their number.
+func (s *Service) handleRelated(w http.ResponseWriter, r *http.Request) {
+	hash, ok := pathHash(w, r, "/api/related/")
+	if !ok {
+		return
+	}
+	limit := defaultRelated
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	records, err := s.storage.Related(hash, limit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if records == nil {
+		records = []*db.Record{}
+	}
+	s.writeJSON(w, stripIcons(records))
+}
+
+// handleRecord returns the record with the hex encoded hash in the path, icons included.
+func (s *Service) handleRecord(w http.ResponseWriter, r *http.Request) {
+	hash, ok := pathHash(w, r, "/api/record/")
+	if !ok {
+		return
+	}
+	if s.notModified(w, r) {
+		return
+	}
+	record, err := s.storage.GetRecord(hash)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.writeJSON(w, record)
+}
+
+// iconMaxAge is how long clients may cache icons. Records never change under the same hash, so
+// neither do their icons.
+const iconMaxAge = 365 * 24 * time.Hour
+
+// iconCSP is the content security policy of icons. It lets SVG icons be styled, but nothing else.
+const iconCSP = "default-src 'none'; style-src 'unsafe-inline'; sandbox"
+
+// handleIcon serves the icon of an entry of a record, from a path like /api/icon/<hash>/<entry>,
+// where hash is hex encoded and entry is the index of the entry in the record.
+func (s *Service) handleIcon(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/icon/")
+	slash := strings.LastIndex(path, "/")
+	if slash < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	hash, err := hex.DecodeString(path[:slash])
+	if err != nil || len(hash) == 0 {
+		http.Error(w, "invalid hash", http.StatusBadRequest)
+		return
+	}
+	idx, err := strconv.Atoi(path[slash+1:])
+	if err != nil {
+		http.Error(w, "invalid entry", http.StatusBadRequest)
+		return
+	}
+
+	record, err := s.storage.GetRecord(hash)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if idx < 0 || idx >= len(record.Entries) || len(record.Entries[idx].Icon) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	entry := record.Entries[idx]
+	w.Header().Set("Content-Type", iconType(entry.IconFormat))
+	// Icons come from untrusted opks. SVG icons opened directly would run their scripts on the
+	// catalog's origin, so they are sandboxed, and no icon is sniffed into something else.
+	w.Header().Set("Content-Security-Policy", iconCSP)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", int(iconMaxAge.Seconds())))
+	w.Write(entry.Icon)
+}
+
+// stripIcons removes the icons of records, which are most of their size, and returns them. Lists
+// of records are returned without icons; /api/icon serves them.
+func stripIcons(records []*db.Record) []*db.Record {
+	for _, record := range records {
+		for _, entry := range record.Entries {
+			entry.Icon = nil
+		}
+	}
+	return records
+}
+
+// handleBackup streams a backup of the database, in the format read by the restore command, while
+// the service keeps running. A failure midway aborts the response, so the client sees the download
+// fail rather than a truncated backup.
+func (s *Service) handleBackup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="opkcat.backup"`)
+	if err := s.storage.Backup(w); err != nil {
+		s.logger.Error("Backup failed:", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// admin wraps handler so it only serves requests carrying the admin token.
+func (s *Service) admin(handler http.HandlerFunc) http.HandlerFunc {
+	want := []byte("Bearer " + s.adminToken)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+type ratingRequest struct {
+	Rating    string   `json:"rating"`
+	Languages []string `json:"languages"`
+}
+
+// handleSetRating sets the curated rating and languages of the record in the path.
+func (s *Service) handleSetRating(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hash, ok := pathHash(w, r, "/admin/rating/")
+	if !ok {
+		return
+	}
+
+	var req ratingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.storage.SetRating(hash, req.Rating, req.Languages); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type deprecateRequest struct {
+	Deprecated   bool   `json:"deprecated"`
+	SupersededBy string `json:"superseded_by"`
+}
+
+// handleSetDeprecated marks the record in the path as deprecated or not.
+func (s *Service) handleSetDeprecated(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hash, ok := pathHash(w, r, "/admin/deprecate/")
+	if !ok {
+		return
+	}
+
+	var req deprecateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.storage.SetDeprecated(hash, req.Deprecated, req.SupersededBy); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDuplicates returns the records sharing a name with other records, grouped by name.
+func (s *Service) handleDuplicates(w http.ResponseWriter, r *http.Request) {
+	dups, err := s.storage.DuplicateNames()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.writeJSON(w, dups)
+}
+
+// handleQuarantine returns the urls whose content failed extraction and is not fetched again
+// until it changes.
+func (s *Service) handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	urls, err := s.storage.QuarantinedURLs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.writeJSON(w, urls)
+}
+
+// handleFailing returns the urls whose last fetch failed, the ones failing the longest first.
+func (s *Service) handleFailing(w http.ResponseWriter, r *http.Request) {
+	urls, err := s.storage.FailingURLs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.writeJSON(w, urls)
+}
+
+// handleIndexStats returns the internals of the full-text index, to debug unexpected search
+// results.
+func (s *Service) handleIndexStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.storage.IndexStats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.writeJSON(w, stats)
+}
+
+// handleExplain runs a search like handleSearch, with the same parameters, but returns how the
+// score of each hit was computed, to tune field boosts and recency weighting.
+func (s *Service) handleExplain(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	qry := params.Get("q")
+	since, err := parseSince(params.Get("since"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if qry == "" && since.IsZero() {
+		http.Error(w, "missing query", http.StatusBadRequest)
+		return
+	}
+
+	qry, opts := searchOptions(qry, params, since)
+	hits, err := s.storage.Explain(qry, opts...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.writeJSON(w, hits)
+}
+
+// parseSince parses the since parameter, either RFC 3339 or seconds since the Unix epoch. It
+// returns the zero time when since is empty.
+func parseSince(since string) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+	if secs, err := strconv.ParseInt(since, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid since: %q", since)
+	}
+	return t, nil
+}
+
+// defaultHistory is the number of fetch cycles returned without a limit parameter.
+const defaultHistory = 20
+
+// handleHistory returns the most recent fetch cycles, most recent first. The limit parameter
+// caps their number.
+func (s *Service) handleHistory(w http.ResponseWriter, r *http.Request) {
+	limit := defaultHistory
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	history, err := s.storage.FetchHistory(limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if history == nil {
+		history = []*db.FetchStats{}
+	}
+	s.writeJSON(w, history)
+}
+
+// pathHash decodes the hex encoded record hash that follows prefix in the request path. If it is
+// invalid, it writes an error and returns false.
+func pathHash(w http.ResponseWriter, r *http.Request, prefix string) ([]byte, bool) {
+	hash, err := hex.DecodeString(strings.TrimPrefix(r.URL.Path, prefix))
+	if err != nil || len(hash) == 0 {
+		http.Error(w, "invalid hash", http.StatusBadRequest)
+		return nil, false
+	}
+	return hash, true
+}
+
+// writeError writes err with a status matching it.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == db.ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func (s *Service) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.logger.Warn("Writing the response:", err)
+	}
 }
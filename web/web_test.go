@@ -0,0 +1,103 @@
+/*
+ * Copyright (C) 2020  Igor Cananea <icc@avalonbits.com>
+ * Author: Igor Cananea <icc@avalonbits.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package web
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/avalonbits/opkcat/db"
+)
+
+// testToken is the admin token of the services built by newTestServer.
+const testToken = "secret"
+
+// newStorage returns a database with an index in a temporary directory, and a function closing
+// and removing it.
+func newStorage(t *testing.T) (*db.Handle, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := db.Prod(filepath.Join(dir, "db"), filepath.Join(dir, "index"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return storage, func() {
+		storage.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// newTestServer serves the service for storage, with the admin token testToken.
+func newTestServer(storage *db.Handle, opts ...Option) (*Service, *httptest.Server) {
+	s := New("", storage, append([]Option{WithAdminToken(testToken)}, opts...)...)
+	return s, httptest.NewServer(s.server.Handler)
+}
+
+// testRecord returns a record of an opk named name served at opkurl.
+func testRecord(opkurl, name string) *db.Record {
+	sum := sha256.Sum256([]byte(opkurl + "\x00" + name))
+	return &db.Record{
+		URL:     opkurl,
+		Hash:    sum[:],
+		Date:    time.Now().UTC(),
+		Size:    1024,
+		Entries: []*db.Entry{{Name: name, Type: "Application", Categories: []string{"games"}}},
+	}
+}
+
+// get sends a GET request for path to srv, with the admin token if admin is set, and the
+// additional headers in header.
+func get(t *testing.T, srv *httptest.Server, path string, admin bool, header http.Header) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest("GET", srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if admin {
+		req.Header.Set("Authorization", "Bearer "+testToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// addRecords stores records in storage.
+func addRecords(t *testing.T, storage *db.Handle, records ...*db.Record) {
+	t.Helper()
+	for _, record := range records {
+		if err := storage.UpdateRecord(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+}